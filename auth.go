@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Sessionless request authentication: API tokens
+// and verified client certificates
+type Auth struct {
+	tokens *TokenStore
+	// Principals by certificate subject
+	certs map[string]*Principal
+}
+
+func NewAuth(tokens *TokenStore, cfg *TLSConfig) (auth *Auth) {
+	auth = &Auth{
+		tokens: tokens,
+		certs:  make(map[string]*Principal),
+	}
+
+	if cfg == nil {
+		return
+	}
+
+	for _, client := range cfg.Clients {
+		name := client.Name
+		if name == "" {
+			name = client.Subject
+		}
+
+		auth.certs[client.Subject] = &Principal{
+			Kind:   PrincipalCert,
+			Name:   name,
+			Role:   client.Role,
+			Scopes: client.Scopes,
+			Tenant: client.Tenant,
+		}
+	}
+
+	return
+}
+
+// Principal by API token or client certificate, nil if request
+// has neither. Invalid token is an error
+func (this *Auth) Authenticate(r *http.Request) (*Principal, error) {
+	if this == nil {
+		return nil, nil
+	}
+
+	if secret := requestToken(r); secret != "" && this.tokens != nil {
+		return this.tokens.Authenticate(secret)
+	}
+
+	return this.certPrincipal(r), nil
+}
+
+// Principal of the verified client certificate by the full
+// subject or common name
+func (this *Auth) certPrincipal(r *http.Request) *Principal {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	if p, ok := this.certs[subject.String()]; ok {
+		return p
+	}
+
+	if p, ok := this.certs[subject.CommonName]; ok && subject.CommonName != "" {
+		return p
+	}
+
+	return nil
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bulk record types
+const (
+	BulkDomain  = "domain"
+	BulkMailbox = "mailbox"
+	BulkAlias   = "alias"
+)
+
+// Upload size limit
+const bulkMaxSize = 64 << 20
+
+// Content types by format
+var bulkTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"json": "application/json",
+	"yaml": "application/x-yaml",
+}
+
+// CSV columns, `type` may be omitted if the file has one record type
+var bulkColumns = []string{"type", "name", "address", "description", "password", "password_hash", "quota", "active", "goto", "tenant_id"}
+
+// CSV export of the other panel, one record type per file. Columns
+// are the panel ones by the record type, others are ignored
+type bulkSource struct {
+	columns map[string]map[string]string
+	// Bytes of the quota unit
+	quotaUnit int64
+}
+
+// Table exports of PostfixAdmin and iRedMail keep the crypt hashes.
+// Plesk stores the passwords encrypted, so its mailboxes come from
+// the plain passwords of `mail_auth_view`
+var bulkSources = map[string]bulkSource{
+	"postfixadmin": {
+		columns: map[string]map[string]string{
+			BulkDomain:  {"domain": "name", "description": "description", "active": "active"},
+			BulkMailbox: {"username": "address", "name": "name", "password": "password_hash", "quota": "quota", "active": "active"},
+			BulkAlias:   {"address": "address", "goto": "goto", "active": "active"},
+		},
+		quotaUnit: 1,
+	},
+	"iredmail": {
+		columns: map[string]map[string]string{
+			BulkDomain:  {"domain": "name", "description": "description", "active": "active"},
+			BulkMailbox: {"username": "address", "name": "name", "password": "password_hash", "quota": "quota", "active": "active"},
+			BulkAlias:   {"address": "address", "forwarding": "goto", "active": "active"},
+		},
+		quotaUnit: 1 << 20,
+	},
+	"plesk": {
+		columns: map[string]map[string]string{
+			BulkDomain:  {"name": "name"},
+			BulkMailbox: {"address": "address", "password": "password"},
+		},
+		quotaUnit: 1,
+	},
+}
+
+// Imported or exported row, one of the items is set
+type BulkRecord struct {
+	Row     int
+	Type    string
+	Domain  *Domain
+	Mailbox *Mailbox
+	Alias   *Alias
+}
+
+// Domain name or address
+func (this *BulkRecord) Key() string {
+	switch {
+	case this.Domain != nil:
+		return this.Domain.Name
+	case this.Mailbox != nil:
+		return this.Mailbox.Address
+	case this.Alias != nil:
+		return this.Alias.Address
+	}
+
+	return ""
+}
+
+// JSON and YAML document
+type bulkDocument struct {
+	Domains   []*Domain  `json:"domains" yaml:"domains"`
+	Mailboxes []*Mailbox `json:"mailboxes" yaml:"mailboxes"`
+	Aliases   []*Alias   `json:"aliases" yaml:"aliases"`
+}
+
+type BulkError struct {
+	Row   int    `json:"row"`
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// Import result. Nothing is committed if there are errors
+type BulkReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Committed bool        `json:"committed"`
+	Domains   int         `json:"domains"`
+	Mailboxes int         `json:"mailboxes"`
+	Aliases   int         `json:"aliases"`
+	Errors    []BulkError `json:"errors"`
+}
+
+// Import records in one transaction. Each row is validated and
+// inserted, failed rows are reported and the transaction is rolled
+// back. Dry run is always rolled back. Kind is the record type of
+// CSV without the type column, source is the panel of the CSV export.
+// Domains go to the tenant unless set, only the domains of the tenant
+// scope can be filled
+func Import(db *sql.DB, tenant int64, format, kind, source string, r io.Reader, dryRun bool) (report *BulkReport, err error) {
+	var (
+		tx      *sql.Tx
+		visible = make(map[string]bool)
+	)
+
+	report = &BulkReport{DryRun: dryRun, Errors: make([]BulkError, 0)}
+
+	if source != "" && format != "csv" {
+		return nil, errors.New("Source export must be csv")
+	}
+
+	if tx, err = db.Begin(); err != nil {
+		return
+	}
+
+	err = readBulk(format, kind, source, r, func(rec *BulkRecord) error {
+		if err := importRecord(tx, rec, tenant, visible); err != nil {
+			report.Errors = append(report.Errors, BulkError{Row: rec.Row, Type: rec.Type, Key: rec.Key(), Error: err.Error()})
+			return nil
+		}
+
+		switch rec.Type {
+		case BulkDomain:
+			report.Domains++
+		case BulkMailbox:
+			report.Mailboxes++
+		case BulkAlias:
+			report.Aliases++
+		}
+
+		return nil
+	})
+
+	if err != nil || dryRun || len(report.Errors) > 0 {
+		rollbackTx(tx)
+		return
+	}
+
+	if err = commitTx(tx); err == nil {
+		report.Committed = true
+	}
+
+	return
+}
+
+// Validate and insert, domains of the mailboxes and aliases
+// must exist or be imported before
+func importRecord(tx *sql.Tx, rec *BulkRecord, tenant int64, visible map[string]bool) (err error) {
+	var (
+		item interface {
+			Validate() error
+			Insert(q querier) error
+		}
+		domain string
+	)
+
+	switch {
+	case rec.Type == BulkDomain && rec.Domain != nil:
+		item = rec.Domain
+	case rec.Type == BulkMailbox && rec.Mailbox != nil:
+		item = rec.Mailbox
+	case rec.Type == BulkAlias && rec.Alias != nil:
+		item = rec.Alias
+	default:
+		return errors.New("Unknown or empty record of type " + rec.Type)
+	}
+
+	if err = item.Validate(); err != nil {
+		return
+	}
+
+	// Crypt hashes of the other systems are replaced on the first login
+	if rec.Type == BulkMailbox && rec.Mailbox.Password == "" && !bcryptHash(rec.Mailbox.PasswordHash) && !legacyHash(rec.Mailbox.PasswordHash) {
+		return constraintError("Password hash of %s must be bcrypt, MD5-CRYPT, SHA256-CRYPT, SHA512-CRYPT, SSHA256 or SSHA512", rec.Mailbox.Address)
+	}
+
+	switch rec.Type {
+	case BulkMailbox:
+		domain = rec.Mailbox.Domain
+	case BulkAlias:
+		domain = rec.Alias.Domain
+	}
+
+	// Unknown domain is reported by insert
+	if tenant != 0 && domain != "" && !visible[domain] {
+		var owner int64
+
+		if owner, err = domainTenant(tx, domain); err != nil {
+			return
+		}
+
+		if visible[domain], err = tenantVisible(tx, tenant, owner); err != nil {
+			return
+		} else if !visible[domain] {
+			return constraintError("Unknown domain %s", domain)
+		}
+	}
+
+	if rec.Type == BulkDomain {
+		if rec.Domain.TenantId == 0 {
+			rec.Domain.TenantId = tenant
+		} else if ok, err := tenantVisible(tx, tenant, rec.Domain.TenantId); err != nil {
+			return err
+		} else if !ok {
+			return constraintError("Unknown tenant %d", rec.Domain.TenantId)
+		}
+	}
+
+	if err = item.Insert(tx); err != nil {
+		return
+	}
+
+	if rec.Type == BulkDomain {
+		visible[rec.Domain.Name] = true
+	}
+
+	return
+}
+
+// Read records one by one, CSV and JSON are streamed
+func readBulk(format, kind, source string, r io.Reader, fn func(rec *BulkRecord) error) error {
+	switch format {
+	case "csv":
+		return readBulkCSV(r, kind, source, fn)
+	case "json":
+		return readBulkJSON(r, fn)
+	case "yaml":
+		return readBulkYAML(r, fn)
+	}
+
+	return fmt.Errorf("Unknown format %s", format)
+}
+
+func readBulkCSV(r io.Reader, kind, source string, fn func(rec *BulkRecord) error) (err error) {
+	var (
+		reader  = csv.NewReader(r)
+		header  []string
+		columns = make(map[string]int)
+		names   map[string]string
+		unit    int64 = 1
+	)
+
+	if source != "" {
+		src, ok := bulkSources[source]
+		if !ok {
+			return fmt.Errorf("Unknown source %s, expected postfixadmin, iredmail or plesk", source)
+		}
+
+		if names = src.columns[kind]; names == nil {
+			return fmt.Errorf("Record type of the %s export required", source)
+		}
+
+		unit = src.quotaUnit
+	}
+
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	if header, err = reader.Read(); err != nil {
+		return
+	}
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if names == nil {
+			columns[name] = i
+		} else if column, ok := names[name]; ok {
+			columns[column] = i
+		}
+	}
+
+	// Header is the first line
+	for row := 2; ; row++ {
+		var (
+			fields []string
+			rec    = &BulkRecord{Row: row, Type: kind}
+		)
+
+		if fields, err = reader.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+
+			return ""
+		}
+
+		if t := get("type"); t != "" {
+			rec.Type = strings.ToLower(t)
+		}
+
+		active := get("active") == "" || bulkBool(get("active"))
+
+		switch rec.Type {
+		case BulkDomain:
+			rec.Domain = &Domain{Name: get("name"), Description: get("description"), Active: active}
+
+			// Invalid tenant is unknown
+			if t := get("tenant_id"); t != "" {
+				if tenant, err := strconv.ParseInt(t, 10, 64); err == nil {
+					rec.Domain.TenantId = tenant
+				} else {
+					rec.Domain.TenantId = -1
+				}
+			}
+
+		case BulkMailbox:
+			rec.Mailbox = &Mailbox{
+				Address:      get("address"),
+				Name:         get("name"),
+				Password:     get("password"),
+				PasswordHash: get("password_hash"),
+				Active:       active,
+			}
+
+			// Invalid quota fails validation
+			if q := get("quota"); q != "" {
+				if quota, err := strconv.ParseInt(q, 10, 64); err == nil {
+					rec.Mailbox.Quota = quota * unit
+				} else {
+					rec.Mailbox.Quota = -1
+				}
+			}
+
+		case BulkAlias:
+			rec.Alias = &Alias{Address: get("address"), Active: active}
+
+			for _, dest := range strings.FieldsFunc(get("goto"), bulkSeparator) {
+				rec.Alias.Goto = append(rec.Alias.Goto, dest)
+			}
+		}
+
+		if err = fn(rec); err != nil {
+			return
+		}
+	}
+}
+
+// Stream `{"domains": [...], "mailboxes": [...], "aliases": [...]}`
+// element by element
+func readBulkJSON(r io.Reader, fn func(rec *BulkRecord) error) (err error) {
+	var (
+		dec = json.NewDecoder(r)
+		row int
+	)
+
+	if err = bulkDelim(dec, '{'); err != nil {
+		return
+	}
+
+	for dec.More() {
+		var (
+			token   json.Token
+			section string
+		)
+
+		if token, err = dec.Token(); err != nil {
+			return
+		}
+
+		switch token {
+		case "domains":
+			section = BulkDomain
+		case "mailboxes":
+			section = BulkMailbox
+		case "aliases":
+			section = BulkAlias
+		default:
+			return fmt.Errorf("Unknown section %v", token)
+		}
+
+		if err = bulkDelim(dec, '['); err != nil {
+			return
+		}
+
+		for dec.More() {
+			row++
+
+			rec := &BulkRecord{Row: row, Type: section}
+
+			switch section {
+			case BulkDomain:
+				err = dec.Decode(&rec.Domain)
+			case BulkMailbox:
+				err = dec.Decode(&rec.Mailbox)
+			case BulkAlias:
+				err = dec.Decode(&rec.Alias)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if err = fn(rec); err != nil {
+				return
+			}
+		}
+
+		if err = bulkDelim(dec, ']'); err != nil {
+			return
+		}
+	}
+
+	return bulkDelim(dec, '}')
+}
+
+// YAML document is read at once
+func readBulkYAML(r io.Reader, fn func(rec *BulkRecord) error) (err error) {
+	var (
+		data []byte
+		doc  bulkDocument
+		row  int
+	)
+
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return
+	}
+
+	each := func(rec *BulkRecord) error {
+		row++
+		rec.Row = row
+
+		return fn(rec)
+	}
+
+	for _, item := range doc.Domains {
+		if err = each(&BulkRecord{Type: BulkDomain, Domain: item}); err != nil {
+			return
+		}
+	}
+
+	for _, item := range doc.Mailboxes {
+		if err = each(&BulkRecord{Type: BulkMailbox, Mailbox: item}); err != nil {
+			return
+		}
+	}
+
+	for _, item := range doc.Aliases {
+		if err = each(&BulkRecord{Type: BulkAlias, Alias: item}); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func bulkDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("Expected %s, but got %v", delim, token)
+	}
+
+	return nil
+}
+
+func bulkBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "y", "on":
+		return true
+	}
+
+	return false
+}
+
+// Alias destinations are separated by comma, space or semicolon
+func bulkSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == ' '
+}
+
+// Export writer
+type BulkWriter interface {
+	Write(rec *BulkRecord) error
+	Close() error
+}
+
+func NewBulkWriter(format string, w io.Writer) (BulkWriter, error) {
+	switch format {
+	case "csv":
+		writer := &csvBulkWriter{w: csv.NewWriter(w)}
+		return writer, writer.w.Write(bulkColumns)
+	case "json":
+		return &jsonBulkWriter{w: w}, nil
+	case "yaml":
+		return &yamlBulkWriter{w: w}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown format %s", format)
+}
+
+type csvBulkWriter struct {
+	w *csv.Writer
+}
+
+func (this *csvBulkWriter) Write(rec *BulkRecord) error {
+	var fields = make([]string, len(bulkColumns))
+
+	fields[0] = rec.Type
+
+	switch {
+	case rec.Domain != nil:
+		fields[1], fields[3], fields[7] = rec.Domain.Name, rec.Domain.Description, strconv.FormatBool(rec.Domain.Active)
+
+		if rec.Domain.TenantId != 0 {
+			fields[9] = strconv.FormatInt(rec.Domain.TenantId, 10)
+		}
+	case rec.Mailbox != nil:
+		fields[1], fields[2], fields[5] = rec.Mailbox.Name, rec.Mailbox.Address, rec.Mailbox.PasswordHash
+		fields[6], fields[7] = strconv.FormatInt(rec.Mailbox.Quota, 10), strconv.FormatBool(rec.Mailbox.Active)
+	case rec.Alias != nil:
+		fields[2], fields[7], fields[8] = rec.Alias.Address, strconv.FormatBool(rec.Alias.Active), strings.Join(rec.Alias.Goto, ",")
+	}
+
+	return this.w.Write(fields)
+}
+
+func (this *csvBulkWriter) Close() error {
+	this.w.Flush()
+	return this.w.Error()
+}
+
+// Streamed document, records come ordered by type
+type jsonBulkWriter struct {
+	w       io.Writer
+	section int
+	count   int
+}
+
+var bulkSections = []string{"", BulkDomain, BulkMailbox, BulkAlias}
+
+func (this *jsonBulkWriter) Write(rec *BulkRecord) (err error) {
+	var (
+		data    []byte
+		section int
+	)
+
+	for i, name := range bulkSections {
+		if name == rec.Type {
+			section = i
+		}
+	}
+
+	if section < this.section || section == 0 {
+		return errors.New("Records must be ordered by type")
+	}
+
+	if err = this.open(section); err != nil {
+		return
+	}
+
+	switch {
+	case rec.Domain != nil:
+		data, err = json.Marshal(rec.Domain)
+	case rec.Mailbox != nil:
+		data, err = json.Marshal(rec.Mailbox)
+	case rec.Alias != nil:
+		data, err = json.Marshal(rec.Alias)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if this.count++; this.count > 1 {
+		this.w.Write([]byte(",\n"))
+	}
+
+	_, err = this.w.Write(data)
+
+	return
+}
+
+// Write section headers up to the given one
+func (this *jsonBulkWriter) open(section int) (err error) {
+	var names = map[int]string{1: "domains", 2: "mailboxes", 3: "aliases"}
+
+	for ; this.section < section; this.section++ {
+		prefix := "{"
+		if this.section > 0 {
+			prefix = "\n],"
+		}
+
+		if _, err = fmt.Fprintf(this.w, "%s\n\"%s\": [\n", prefix, names[this.section+1]); err != nil {
+			return
+		}
+
+		this.count = 0
+	}
+
+	return
+}
+
+func (this *jsonBulkWriter) Close() (err error) {
+	if err = this.open(len(bulkSections) - 1); err != nil {
+		return
+	}
+
+	_, err = this.w.Write([]byte("\n]}\n"))
+
+	return
+}
+
+// Document is written on close
+type yamlBulkWriter struct {
+	w   io.Writer
+	doc bulkDocument
+}
+
+func (this *yamlBulkWriter) Write(rec *BulkRecord) error {
+	switch {
+	case rec.Domain != nil:
+		this.doc.Domains = append(this.doc.Domains, rec.Domain)
+	case rec.Mailbox != nil:
+		this.doc.Mailboxes = append(this.doc.Mailboxes, rec.Mailbox)
+	case rec.Alias != nil:
+		this.doc.Aliases = append(this.doc.Aliases, rec.Alias)
+	}
+
+	return nil
+}
+
+func (this *yamlBulkWriter) Close() error {
+	data, err := yaml.Marshal(&this.doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.w.Write(data)
+
+	return err
+}
+
+// Write domains, mailboxes and aliases of the tenant scope, password
+// hashes are omitted unless requested
+func Export(q querier, scope int64, w BulkWriter, hashes bool) (err error) {
+	var (
+		rows       *sql.Rows
+		cond, args = tenantScope(scope, "`tenant_id`")
+		domains    = "`domain` IN (SELECT `name` FROM `msm_domain` WHERE " + cond + ")"
+	)
+
+	if rows, err = q.Query("SELECT `name`, `description`, `active`, `tenant_id` FROM `msm_domain` WHERE "+cond+" ORDER BY `name`", args...); err != nil {
+		return
+	}
+
+	for rows.Next() {
+		item := &Domain{}
+
+		if err = rows.Scan(&item.Name, &item.Description, &item.Active, &item.TenantId); err == nil {
+			err = w.Write(&BulkRecord{Type: BulkDomain, Domain: item})
+		}
+
+		if err != nil {
+			rows.Close()
+			return
+		}
+	}
+
+	if err = rows.Close(); err != nil {
+		return
+	}
+
+	if rows, err = q.Query("SELECT `address`, `domain`, `name`, `password`, `quota`, `active` FROM `msm_mailbox` WHERE "+domains+" ORDER BY `address`", args...); err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var (
+			item   = &Mailbox{}
+			domain sql.NullString
+			name   sql.NullString
+		)
+
+		if err = rows.Scan(&item.Address, &domain, &name, &item.PasswordHash, &item.Quota, &item.Active); err == nil {
+			item.Domain, item.Name = domain.String, name.String
+
+			if !hashes {
+				item.PasswordHash = ""
+			}
+
+			err = w.Write(&BulkRecord{Type: BulkMailbox, Mailbox: item})
+		}
+
+		if err != nil {
+			rows.Close()
+			return
+		}
+	}
+
+	if err = rows.Close(); err != nil {
+		return
+	}
+
+	if rows, err = q.Query("SELECT `address`, `domain`, `goto`, `active` FROM `msm_alias` WHERE "+domains+" ORDER BY `address`", args...); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			item = &Alias{}
+			dest string
+		)
+
+		if err = rows.Scan(&item.Address, &item.Domain, &dest, &item.Active); err != nil {
+			return
+		}
+
+		item.Goto = strings.Split(dest, ",")
+
+		if err = w.Write(&BulkRecord{Type: BulkAlias, Alias: item}); err != nil {
+			return
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	return w.Close()
+}
+
+// Format from the query parameter or the content type
+func bulkFormat(r *http.Request, header string) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	switch ct := r.Header.Get(header); {
+	case strings.Contains(ct, "csv"):
+		return "csv"
+	case strings.Contains(ct, "yaml"):
+		return "yaml"
+	}
+
+	return "json"
+}
+
+// Import: POST /import?format=csv&type=mailbox&dry_run=1 with the
+// file in the body
+func handleImport(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var format = bulkFormat(ctx.r, "Content-Type")
+
+		for _, scope := range []string{"domains:write", "mailboxes:write", "aliases:write"} {
+			if !ctx.Require(w, scope) {
+				return
+			}
+		}
+
+		if ctx.r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		var query = ctx.r.URL.Query()
+
+		report, err := Import(db, ctx.Tenant(), format, query.Get("type"), query.Get("source"), http.MaxBytesReader(w, ctx.r.Body, bulkMaxSize), bulkBool(query.Get("dry_run")))
+		if err != nil {
+			ctx.log.Notice("Import failed", "format", format, "error", err)
+			writeError(w, http.StatusBadRequest, "Can't read "+format+": "+err.Error())
+			return
+		}
+
+		ctx.log.Notice("Import", "format", format, "dry_run", report.DryRun, "committed", report.Committed,
+			"domains", report.Domains, "mailboxes", report.Mailboxes, "aliases", report.Aliases, "errors", len(report.Errors))
+
+		if len(report.Errors) > 0 {
+			writeJSON(w, http.StatusUnprocessableEntity, report)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// Export: GET /export?format=yaml, password hashes are exported
+// with the mailboxes:export scope
+func handleExport(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var format = bulkFormat(ctx.r, "Accept")
+
+		for _, scope := range []string{"domains:read", "mailboxes:read", "aliases:read"} {
+			if !ctx.Require(w, scope) {
+				return
+			}
+		}
+
+		if ctx.r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		contentType, ok := bulkTypes[format]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Unknown format "+format)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+NAME+"."+format+"\"")
+
+		writer, err := NewBulkWriter(format, w)
+		if err != nil {
+			ctx.log.Error("Export failed", "error", err)
+			return
+		}
+
+		// Status is sent already, the error is only logged
+		if err = Export(db, ctx.Tenant(), writer, ctx.principal.Can("mailboxes:export")); err != nil {
+			ctx.log.Error("Export failed", "error", err)
+		}
+	}
+}
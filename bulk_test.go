@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"strings"
+	"testing"
+)
+
+func Test_ImportCSV(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		input    = "type,name,address,password,quota,goto\n" +
+			"domain,Example.COM,,,,\n" +
+			"mailbox,John,john@example.com,secret,1024,\n" +
+			"alias,,info@example.com,,,\"john@example.com, jane@example.org\"\n"
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO `msm_domain`").
+		WithArgs("example.com", "", true, sqlmock.AnyArg(), 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWebhooks(mock, 0)
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `msm_mailbox`").
+		WithArgs("john@example.com", "example.com", "John", sqlmock.AnyArg(), 1024, true, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWebhooks(mock, 0)
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `msm_alias`").
+		WithArgs("info@example.com", "example.com", "john@example.com,jane@example.org", true, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	report, err := Import(db, 0, "csv", "", "", strings.NewReader(input), false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if !report.Committed || report.Domains != 1 || report.Mailboxes != 1 || report.Aliases != 1 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Table export of the panel, crypt hash is kept for the first login
+func Test_ImportSource(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		hash     = "{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+		input    = "username,password,name,maildir,quota,domain,active\n" +
+			"john@example.com," + hash + ",John,example.com/john/,2,example.com,1\n"
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `msm_mailbox`").
+		WithArgs("john@example.com", "example.com", "John", hash, 2<<20, true, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWebhooks(mock, 0)
+	mock.ExpectCommit()
+
+	report, err := Import(db, 0, "csv", BulkMailbox, "iredmail", strings.NewReader(input), false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if !report.Committed || report.Mailboxes != 1 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	if _, err = Import(db, 0, "csv", "", "postfixadmin", strings.NewReader(input), false); err == nil {
+		t.Errorf("Expected record type error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Failed rows are reported and nothing is committed
+func Test_ImportErrors(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		input    = `{
+			"domains": [{"name": "example.com"}],
+			"mailboxes": [
+				{"address": "john@example.com", "password_hash": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", "active": false},
+				{"address": "jane@unknown.org", "password_hash": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+				{"address": "invalid", "password": "secret"},
+				{"address": "old@example.com", "password_hash": "$AES-128-CBC$iv$encrypted"}
+			],
+			"aliases": [{"address": "@example.com", "goto": []}]
+		}`
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO `msm_domain`").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWebhooks(mock, 0)
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `msm_mailbox`").
+		WithArgs("john@example.com", "example.com", "", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", 0, false, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWebhooks(mock, 0)
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").
+		WithArgs("unknown.org").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}))
+	mock.ExpectRollback()
+
+	report, err := Import(db, 0, "json", "", "", strings.NewReader(input), false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if report.Committed || report.Domains != 1 || report.Mailboxes != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	expected := []BulkError{
+		{Row: 3, Type: BulkMailbox, Key: "jane@unknown.org", Error: "Unknown domain unknown.org"},
+		{Row: 4, Type: BulkMailbox, Key: "invalid", Error: "Invalid mailbox address"},
+		{Row: 5, Type: BulkMailbox, Key: "old@example.com", Error: "Password hash of old@example.com must be bcrypt, MD5-CRYPT, SHA256-CRYPT, SHA512-CRYPT, SSHA256 or SSHA512"},
+		{Row: 6, Type: BulkAlias, Key: "@example.com", Error: "Alias destination required"},
+	}
+
+	if len(report.Errors) != len(expected) {
+		t.Fatalf("Expected %d errors, got %+v", len(expected), report.Errors)
+	}
+
+	for i := range expected {
+		if report.Errors[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], report.Errors[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_ImportDryRun(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		input    = "aliases:\n  - address: postmaster@example.com\n    goto: [root@example.com]\n"
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").
+		WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `msm_alias`").
+		WithArgs("postmaster@example.com", "example.com", "root@example.com", true, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	report, err := Import(db, 0, "yaml", "", "", strings.NewReader(input), true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if report.Committed || !report.DryRun || report.Aliases != 1 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_Export(t *testing.T) {
+	var tests = []struct {
+		format   string
+		expected string
+	}{
+		{"csv", "type,name,address,description,password,password_hash,quota,active,goto,tenant_id\n" +
+			"domain,example.com,,Main,,,,true,,3\n" +
+			"mailbox,John,john@example.com,,,$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy,1024,true,,\n" +
+			"alias,,info@example.com,,,,,false,\"john@example.com,jane@example.org\",\n"},
+		{"json", "{\n\"domains\": [\n{\"name\":\"example.com\",\"description\":\"Main\",\"active\":true,\"tenant_id\":3}\n],\n" +
+			"\"mailboxes\": [\n{\"address\":\"john@example.com\",\"domain\":\"example.com\",\"name\":\"John\",\"password_hash\":\"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy\",\"quota\":1024,\"active\":true}\n],\n" +
+			"\"aliases\": [\n{\"address\":\"info@example.com\",\"domain\":\"example.com\",\"goto\":[\"john@example.com\",\"jane@example.org\"],\"active\":false}\n]}\n"},
+	}
+
+	for _, test := range tests {
+		var (
+			db, mock = InitDBMock(t)
+			buf      bytes.Buffer
+		)
+
+		mock.ExpectQuery("SELECT (.+) FROM `msm_domain`").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "description", "active", "tenant_id"}).AddRow("example.com", "Main", true, 3))
+		mock.ExpectQuery("SELECT (.+) FROM `msm_mailbox`").
+			WillReturnRows(sqlmock.NewRows([]string{"address", "domain", "name", "password", "quota", "active"}).
+				AddRow("john@example.com", "example.com", "John", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", 1024, true))
+		mock.ExpectQuery("SELECT (.+) FROM `msm_alias`").
+			WillReturnRows(sqlmock.NewRows([]string{"address", "domain", "goto", "active"}).
+				AddRow("info@example.com", "example.com", "john@example.com,jane@example.org", false))
+
+		writer, err := NewBulkWriter(test.format, &buf)
+		if err == nil {
+			err = Export(db, 0, writer, true)
+		}
+
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		if buf.String() != test.expected {
+			t.Errorf("Expected %s output:\n%s\ngot:\n%s", test.format, test.expected, buf.String())
+		}
+
+		// Output is read back
+		records := 0
+		readBulk(test.format, "", "", &buf, func(rec *BulkRecord) error {
+			records++
+			return nil
+		})
+
+		if records != 3 {
+			t.Errorf("Expected 3 records read back from %s, got %d", test.format, records)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unfulfilled expections: %s", err)
+		}
+	}
+}
+
+// Hashes are exported with the explicit scope only
+func Test_ExportWithoutHashes(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		buf      bytes.Buffer
+	)
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_domain`").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "description", "active", "tenant_id"}))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_mailbox`").
+		WillReturnRows(sqlmock.NewRows([]string{"address", "domain", "name", "password", "quota", "active"}).
+			AddRow("john@example.com", "example.com", "John", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", 1024, true))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_alias`").
+		WillReturnRows(sqlmock.NewRows([]string{"address", "domain", "goto", "active"}))
+
+	writer, _ := NewBulkWriter("csv", &buf)
+
+	if err := Export(db, 0, writer, false); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if strings.Contains(buf.String(), "$2a$") {
+		t.Errorf("Unexpected password hash in %s", buf.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
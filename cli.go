@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Run subcommand given after the flags, returns exit code
+//
+//	msm-server -C msm-server.toml import [-format csv] [-type mailbox] [-source postfixadmin] [-tenant id] [-dry-run] file
+//	msm-server -C msm-server.toml export [-format json] [-tenant id] [-o file]
+//	msm-server -C msm-server.toml sessions list|kill|purge [-principal name] [-kind staff] [id]
+func runCommand(args []string) int {
+	var (
+		cfg *Config
+		db  *sql.DB
+		err error
+	)
+
+	if args[0] != "import" && args[0] != "export" && args[0] != "sessions" {
+		fmt.Fprintf(os.Stderr, "Unknown command %s, expected import, export or sessions\n", args[0])
+		return 2
+	}
+
+	if cfg, err = NewConfig(CONFIGFILE); err == nil {
+		err = cfg.Parse()
+	}
+
+	if err == nil {
+		db, err = openDB(cfg.Database.DSN())
+	}
+
+	if err == nil {
+		err = migrate(db)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	defer db.Close()
+
+	switch args[0] {
+	case "import":
+		return commandImport(db, args[1:])
+	case "sessions":
+		return commandSessions(db, args[1:])
+	}
+
+	return commandExport(db, args[1:])
+}
+
+func commandImport(db *sql.DB, args []string) int {
+	var (
+		flags  = flag.NewFlagSet("import", flag.ContinueOnError)
+		format = flags.String("format", "csv", "File format: csv, json or yaml")
+		kind   = flags.String("type", "", "Record type of CSV without the type column: domain, mailbox or alias")
+		source = flags.String("source", "", "Panel of the CSV export: postfixadmin, iredmail or plesk, requires -type")
+		dryRun = flags.Bool("dry-run", false, "Validate only, nothing is stored")
+		tenant = flags.Int64("tenant", 0, "Tenant of the imported domains, zero is global")
+		input  io.Reader
+	)
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: import [-format csv] [-type mailbox] [-source postfixadmin] [-tenant id] [-dry-run] file")
+		fmt.Fprintln(os.Stderr, "MD5-CRYPT, SHA256-CRYPT, SHA512-CRYPT, SSHA256 and SSHA512 hashes are replaced by bcrypt on the first login.")
+		fmt.Fprintln(os.Stderr, "Plesk passwords are encrypted, export them in plain with mail_auth_view.")
+		return 2
+	}
+
+	if name := flags.Arg(0); name == "-" {
+		input = os.Stdin
+	} else if f, err := os.Open(name); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	} else {
+		defer f.Close()
+		input = f
+	}
+
+	report, err := Import(db, *tenant, *format, *kind, *source, input, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+
+	if len(report.Errors) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func commandExport(db *sql.DB, args []string) int {
+	var (
+		flags  = flag.NewFlagSet("export", flag.ContinueOnError)
+		format = flags.String("format", "json", "File format: csv, json or yaml")
+		output = flags.String("o", "-", "Output file")
+		tenant = flags.Int64("tenant", 0, "Export the tenant with its customers, zero is all")
+		w      io.Writer
+	)
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: export [-format json] [-tenant id] [-o file]")
+		return 2
+	}
+
+	if *output == "-" {
+		w = os.Stdout
+	} else if f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	} else {
+		defer f.Close()
+		w = f
+	}
+
+	writer, err := NewBulkWriter(*format, w)
+	if err == nil {
+		err = Export(db, *tenant, writer, true)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// Sessions of the database. Running servers drop the killed sessions
+// from the memory storage within the cache interval
+func commandSessions(db *sql.DB, args []string) int {
+	var (
+		flags   = flag.NewFlagSet("sessions", flag.ContinueOnError)
+		name    = flags.String("principal", "", "Sessions of the staff login or mailbox address")
+		kind    = flags.String("kind", "", "Principal kind: staff, mailbox or token")
+		usage   = "Usage: sessions list [-principal name] [-kind staff] | kill [-principal name] [-kind staff] [id] | purge"
+		command string
+		list    []*SessionInfo
+		n       int64
+	)
+
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	if err := flags.Parse(args); err != nil || command == "" || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	sessions, err := NewManager(db, 0)
+	if err == nil && command != "purge" {
+		list, err = sessions.Sessions()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if *name != "" {
+		list = filterSessions(list, *kind, *name)
+	}
+
+	switch {
+	case command == "list":
+		for _, info := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.Id, info.PrincipalKind, info.Principal, info.IP,
+				time.Unix(info.Started, 0).Format(time.RFC3339), time.Unix(info.Updated, 0).Format(time.RFC3339), info.UserAgent)
+		}
+
+		return 0
+
+	case command == "kill" && flags.NArg() == 1:
+		var found []*SessionInfo
+
+		for _, info := range list {
+			if info.Id == flags.Arg(0) {
+				found = append(found, info)
+			}
+		}
+
+		if len(found) == 0 {
+			fmt.Fprintln(os.Stderr, "Session not found")
+			return 1
+		}
+
+		n, err = sessions.Kill(found)
+
+	case command == "kill" && *name != "":
+		n, err = sessions.Kill(list)
+
+	case command == "purge":
+		n, err = sessions.Purge()
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("%d sessions killed\n", n)
+
+	return 0
+}
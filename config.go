@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -25,14 +26,222 @@ var (
 type Config struct {
 	ConfFile string `tomp:"-"`
 	Score    *Score
-	Server   string
+	Server   Server
+	Metrics  *Metrics
+	Lockout  *Lockout
+	Rate     *RateConfig `toml:"rate_limit"`
+	TOTP     *TOTPConfig `toml:"totp"`
+	Password *Password
+	Notify   *Notify
+	DKIM     *DKIM `toml:"dkim"`
+	DNS      *DNS  `toml:"dns"`
+	Webhook  *Webhooks
+	Stream   *Stream
+	Session  *SessionConfig `toml:"session"`
 	Log      map[string]LogAdapter
 	Database *dsncfg.Database `toml:"database"`
 }
 
+// Log adapter options. Zero values are omitted from the adapter
+// configuration, so the adapter defaults are used
 type LogAdapter struct {
-	File  string `json:"filename"`
+	File  string `json:"filename,omitempty"`
 	Level int    `json:"level"`
+
+	// File rotation: file, json
+	MaxLines int    `json:"maxlines,omitempty"`
+	MaxSize  int    `json:"maxsize,omitempty"`
+	Daily    *bool  `json:"daily,omitempty"`
+	MaxDays  int64  `json:"maxdays,omitempty"`
+	Rotate   *bool  `json:"rotate,omitempty"`
+	Perm     string `json:"perm,omitempty"`
+
+	// Syslog connection, empty values for the local socket
+	Net  string `json:"net,omitempty"`
+	Addr string `json:"addr,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// API listener. Plain address string is accepted
+// as well as the table with TLS options
+type Server struct {
+	Listen string
+	TLS    *TLSConfig `toml:"tls"`
+}
+
+// Listener TLS options
+type TLSConfig struct {
+	Cert string
+	Key  string
+	// Minimal protocol version: 1.0, 1.1, 1.2, 1.3
+	MinVersion string `toml:"min_version"`
+	// Cipher suite names for TLS 1.2 and lower, Go defaults if empty
+	Ciphers []string
+	// CA bundle to verify client certificates
+	ClientCA string `toml:"client_ca"`
+	// Client certificates are required if true, optional otherwise
+	ClientRequire bool `toml:"client_require"`
+	// Client certificate subjects mapped to principals
+	Clients []TLSClient `toml:"client"`
+}
+
+// Principal for the client certificate subject: full distinguished
+// name or common name
+type TLSClient struct {
+	Subject string
+	Name    string
+	Role    string
+	Scopes  []string
+	// Tenant id, zero is global
+	Tenant int64
+}
+
+func (this *Server) UnmarshalTOML(data interface{}) (err error) {
+	type server Server
+
+	var (
+		buf = bytes.NewBuffer(nil)
+		tmp server
+	)
+
+	switch data.(type) {
+	case string:
+		this.Listen = data.(string)
+		return nil
+
+	case map[string]interface{}:
+		if err = toml.NewEncoder(buf).Encode(data); err != nil {
+			return
+		}
+
+		if _, err = toml.Decode(buf.String(), &tmp); err != nil {
+			return
+		}
+
+		*this = Server(tmp)
+		return nil
+	}
+
+	return fmt.Errorf("Invalid server configuration: %v", data)
+}
+
+// Prometheus metrics listener
+type Metrics struct {
+	Listen string
+}
+
+// Failed logins throttling. Interval is the sliding window in
+// seconds, limits are failures in the window before lock
+type Lockout struct {
+	Interval int
+	Limit    int
+	IPLimit  int `toml:"ip_limit"`
+	// Seconds
+	LockTime int `toml:"lock_time"`
+	// Keep locks in the database
+	Persist bool
+}
+
+// Request rate of the client address on the throttled routes,
+// requests per second with the burst
+type RateConfig struct {
+	Rate  float64
+	Burst int
+}
+
+// Staff second factor. Skew is the number of accepted code
+// periods before and after the current one
+type TOTPConfig struct {
+	Issuer string
+	Skew   *int
+}
+
+// Mailbox password rules. Breached is the file with the known
+// passwords or their SHA1 hashes, one per line
+type Password struct {
+	MinLength int `toml:"min_length"`
+	Classes   int
+	Breached  string `toml:"breached_file"`
+	// Reset token lifetime in seconds
+	ResetTTL int64 `toml:"reset_ttl"`
+}
+
+// Outbound mail. Sender is `smtp`, `maildir` or `log`
+type Notify struct {
+	Sender string
+	From   string
+	// Lockout alerts recipients
+	Admins []string
+	// Directory with `<name>.tmpl` templates overriding built-in ones
+	Templates string
+	// Delivery attempts and the first retry delay in seconds,
+	// the delay doubles with each attempt
+	Retries int
+	Backoff int
+	// Maildir sink directory
+	Dir  string
+	SMTP *SMTP `toml:"smtp"`
+}
+
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	// Implicit TLS, STARTTLS is used if the server offers it otherwise
+	TLS bool `toml:"tls"`
+}
+
+// DKIM keys. KeyFile is the 32 bytes master key, raw or hex,
+// used to encrypt private keys in the database. Private keys
+// are written to KeyDir for the signing milter
+type DKIM struct {
+	KeyFile string `toml:"key_file"`
+	KeyDir  string `toml:"key_dir"`
+	Bits    int
+}
+
+// Expected DNS of the managed domains. MX are the mail exchanger
+// hosts, SPF are the mechanisms the record must contain, like
+// `include:_spf.example.net`. Server is the resolver `host:port`,
+// the system one is used if empty
+type DNS struct {
+	MX     []string `toml:"mx"`
+	SPF    []string `toml:"spf"`
+	Server string
+	// Seconds
+	Timeout int
+}
+
+// Webhook delivery. Attempts and the first retry delay in seconds,
+// the delay doubles with each attempt. Outbox is polled each interval
+type Webhooks struct {
+	Retries  int
+	Backoff  int
+	Timeout  int
+	Interval int
+}
+
+// Activity stream. Buffer is the number of the events kept for the
+// reconnected clients, keepalive is the comment interval in seconds
+type Stream struct {
+	Buffer    int
+	Keepalive int
+}
+
+// Session binding to the client. Bind is `ip`, `subnet` or empty,
+// subnet is the client address with the prefix length. Agent binds
+// the user agent. CookieOnly ignores the session id of the form
+// and query parameters. Idle and lifetime are the session timeouts
+// in seconds, role overrides them for the staff role or `mailbox`
+type SessionConfig struct {
+	Bind       string
+	IPv4Prefix int `toml:"ipv4_prefix"`
+	IPv6Prefix int `toml:"ipv6_prefix"`
+	Agent      bool
+	CookieOnly bool `toml:"cookie_only"`
+	Idle       int64
+	Lifetime   int64
+	Role       map[string]SessionTimeout
 }
 
 type Score struct {
@@ -81,8 +290,10 @@ func (this *Config) Parse() (err error) {
 		this.Log = make(map[string]LogAdapter)
 	}
 
-	if _, ok := this.Log["console"]; !ok || CONSOLELOG > 0 {
-		this.Log["console"] = LogAdapter{Level: CONSOLELOG}
+	// Command line verbose level overrides console level
+	if a, ok := this.Log["console"]; !ok || CONSOLELOG > 0 {
+		a.Level = CONSOLELOG
+		this.Log["console"] = a
 	}
 
 	return nil
@@ -101,6 +312,257 @@ func (this *Config) GetLogAdapterJSON(name string) (cfg string, err error) {
 	return
 }
 
+// Metrics listen address, empty if disabled
+func (this *Config) GetMetricsListen() string {
+	if this.Metrics == nil {
+		return ""
+	}
+
+	return this.Metrics.Listen
+}
+
+func (this *Config) GetLockoutInterval() int {
+	if this.Lockout == nil || this.Lockout.Interval == 0 {
+		return 900
+	}
+
+	return this.Lockout.Interval
+}
+
+func (this *Config) GetLockoutLimit() int {
+	if this.Lockout == nil || this.Lockout.Limit == 0 {
+		return 5
+	}
+
+	return this.Lockout.Limit
+}
+
+func (this *Config) GetLockoutIPLimit() int {
+	if this.Lockout == nil || this.Lockout.IPLimit == 0 {
+		return 20
+	}
+
+	return this.Lockout.IPLimit
+}
+
+func (this *Config) GetLockoutTime() int {
+	if this.Lockout == nil || this.Lockout.LockTime == 0 {
+		return 900
+	}
+
+	return this.Lockout.LockTime
+}
+
+func (this *Config) GetRateLimit() float64 {
+	if this.Rate == nil || this.Rate.Rate == 0 {
+		return 1
+	}
+
+	return this.Rate.Rate
+}
+
+func (this *Config) GetRateBurst() int {
+	if this.Rate == nil || this.Rate.Burst == 0 {
+		return 10
+	}
+
+	return this.Rate.Burst
+}
+
+func (this *Config) GetTOTPIssuer() string {
+	if this.TOTP == nil || this.TOTP.Issuer == "" {
+		return "msm"
+	}
+
+	return this.TOTP.Issuer
+}
+
+func (this *Config) GetTOTPSkew() int {
+	if this.TOTP == nil || this.TOTP.Skew == nil || *this.TOTP.Skew < 0 {
+		return 1
+	}
+
+	return *this.TOTP.Skew
+}
+
+func (this *Config) GetPasswordMinLength() int {
+	if this.Password == nil || this.Password.MinLength == 0 {
+		return 10
+	}
+
+	return this.Password.MinLength
+}
+
+// Required character classes: lower, upper, digits, others
+func (this *Config) GetPasswordClasses() int {
+	if this.Password == nil || this.Password.Classes == 0 {
+		return 3
+	}
+
+	return this.Password.Classes
+}
+
+func (this *Config) GetPasswordBreached() string {
+	if this.Password == nil {
+		return ""
+	}
+
+	return this.Password.Breached
+}
+
+func (this *Config) GetPasswordResetTTL() int64 {
+	if this.Password == nil || this.Password.ResetTTL == 0 {
+		return 86400
+	}
+
+	return this.Password.ResetTTL
+}
+
+func (this *Config) GetNotifySender() string {
+	if this.Notify == nil || this.Notify.Sender == "" {
+		return "log"
+	}
+
+	return this.Notify.Sender
+}
+
+func (this *Config) GetNotifyFrom() string {
+	if this.Notify == nil || this.Notify.From == "" {
+		return NAME + "@localhost"
+	}
+
+	return this.Notify.From
+}
+
+func (this *Config) GetNotifyRetries() int {
+	if this.Notify == nil || this.Notify.Retries == 0 {
+		return 5
+	}
+
+	return this.Notify.Retries
+}
+
+func (this *Config) GetNotifyBackoff() int {
+	if this.Notify == nil || this.Notify.Backoff == 0 {
+		return 30
+	}
+
+	return this.Notify.Backoff
+}
+
+func (this *Config) GetDKIMKeyDir() string {
+	if this.DKIM == nil || this.DKIM.KeyDir == "" {
+		return "/var/lib/" + NAME + "/dkim"
+	}
+
+	return this.DKIM.KeyDir
+}
+
+// RSA key size
+func (this *Config) GetDKIMBits() int {
+	if this.DKIM == nil || this.DKIM.Bits == 0 {
+		return 2048
+	}
+
+	return this.DKIM.Bits
+}
+
+func (this *Config) GetDNSTimeout() int {
+	if this.DNS == nil || this.DNS.Timeout == 0 {
+		return 5
+	}
+
+	return this.DNS.Timeout
+}
+
+func (this *Config) GetWebhookRetries() int {
+	if this.Webhook == nil || this.Webhook.Retries == 0 {
+		return 8
+	}
+
+	return this.Webhook.Retries
+}
+
+func (this *Config) GetWebhookBackoff() int {
+	if this.Webhook == nil || this.Webhook.Backoff == 0 {
+		return 30
+	}
+
+	return this.Webhook.Backoff
+}
+
+func (this *Config) GetWebhookTimeout() int {
+	if this.Webhook == nil || this.Webhook.Timeout == 0 {
+		return 10
+	}
+
+	return this.Webhook.Timeout
+}
+
+func (this *Config) GetWebhookInterval() int {
+	if this.Webhook == nil || this.Webhook.Interval == 0 {
+		return 5
+	}
+
+	return this.Webhook.Interval
+}
+
+func (this *Config) GetStreamBuffer() int {
+	if this.Stream == nil || this.Stream.Buffer == 0 {
+		return activityBuffer
+	}
+
+	return this.Stream.Buffer
+}
+
+func (this *Config) GetStreamKeepalive() int {
+	if this.Stream == nil || this.Stream.Keepalive == 0 {
+		return 15
+	}
+
+	return this.Stream.Keepalive
+}
+
+func (this *Config) GetSessionBind() string {
+	if this.Session == nil {
+		return ""
+	}
+
+	return this.Session.Bind
+}
+
+func (this *Config) GetSessionIPv4Prefix() int {
+	if this.Session == nil || this.Session.IPv4Prefix == 0 {
+		return 24
+	}
+
+	return this.Session.IPv4Prefix
+}
+
+func (this *Config) GetSessionIPv6Prefix() int {
+	if this.Session == nil || this.Session.IPv6Prefix == 0 {
+		return 64
+	}
+
+	return this.Session.IPv6Prefix
+}
+
+func (this *Config) GetSessionIdle() int64 {
+	if this.Session == nil {
+		return 0
+	}
+
+	return this.Session.Idle
+}
+
+func (this *Config) GetSessionLifetime() int64 {
+	if this.Session == nil {
+		return 0
+	}
+
+	return this.Session.Lifetime
+}
+
 func (this *Config) GetScoreInterval() int {
 	if this.Score == nil || this.Score.Interval == 0 {
 		return 60
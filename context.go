@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"net/http"
+	"regexp"
+)
+
+const (
+	RequestIdHeader    = "X-Request-ID"
+	ProblemContentType = "application/problem+json"
+)
+
+// MySQL error number of the unique key violation
+const mysqlDuplicateEntry = 1062
+
+// Accept request id from the proxy if it looks sane
+var requestIdRe = regexp.MustCompile(`^[A-Za-z0-9._-]{8,64}$`)
+
+// Request context passed to the handlers
+type Context struct {
+	db *sql.DB
+	// Request id
+	id string
+	// Logger with request fields
+	log *Entry
+	// Authenticated caller, nil if anonymous
+	principal *Principal
+	r         *http.Request
+	s         *Session
+	// Matched route and its path parameters, nil without router
+	route  *Route
+	params map[string]string
+}
+
+// Wrap handler with the request context: request id, logger, session
+// and principal. Request authenticated with API token or client
+// certificate gets detached session. Unsafe methods with the stored
+// session require CSRF token
+func HandleInContext(fn func(http.ResponseWriter, *Context), sessions *Provider, auth *Auth) http.HandlerFunc {
+	return inContext(Chain(fn, Authenticate(sessions, auth), CheckCSRF, ValidateBody), sessions, nil)
+}
+
+// Create request context with id and logger for the handler
+func inContext(fn ContextHandler, sessions *Provider, route *Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ctx = &Context{
+			db:    sessions.conn,
+			id:    requestId(r),
+			r:     r,
+			route: route,
+		}
+
+		ctx.params, _ = r.Context().Value(routeParamsKey{}).(map[string]string)
+		ctx.log = log.With("request_id", ctx.id).Hook(ctx.audit)
+		w.Header().Set(RequestIdHeader, ctx.id)
+
+		if route != nil {
+			ctx.log = ctx.log.With("route", route.Name)
+		}
+
+		ctx.log.Debug("Request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+
+		fn(w, ctx)
+	}
+}
+
+// Authenticate with API token or client certificate, otherwise
+// start the session and take its principal
+func Authenticate(sessions *Provider, auth *Auth) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(w http.ResponseWriter, ctx *Context) {
+			var err error
+
+			if ctx.principal, err = auth.Authenticate(ctx.r); err == ErrTokenInvalid {
+				ctx.log.Notice("API token rejected", "remote", ctx.r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+NAME+`"`)
+				writeError(w, http.StatusUnauthorized, err.Error())
+
+				return
+			} else if err != nil {
+				ctx.log.Error("Can't check API token", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+
+				return
+			}
+
+			if ctx.principal != nil {
+				ctx.s = NewSession("")
+			} else {
+				if ctx.s, err = sessions.Start(w, ctx.r); err != nil {
+					ctx.log.Error("Can't start session", "error", err)
+					writeError(w, http.StatusInternalServerError, "")
+
+					return
+				}
+
+				if p, ok := ctx.s.Get(PrincipalKey).(Principal); ok {
+					ctx.principal = &p
+				}
+			}
+
+			if ctx.principal != nil {
+				ctx.log = ctx.log.With("principal", ctx.principal.Name, "principal_kind", ctx.principal.Kind)
+			}
+
+			next(w, ctx)
+		}
+	}
+}
+
+// Check principal access to the scope, write error response on failure
+func (this *Context) Require(w http.ResponseWriter, scope string) bool {
+	if this.principal == nil {
+		writeError(w, http.StatusUnauthorized, "Authentication required")
+		return false
+	}
+
+	if !this.principal.Can(scope) {
+		this.log.Notice("Access denied", "scope", scope)
+		writeError(w, http.StatusForbidden, "Access denied")
+		return false
+	}
+
+	return true
+}
+
+// Tenant of the principal, zero for the global or anonymous caller
+func (this *Context) Tenant() int64 {
+	if this.principal == nil {
+		return 0
+	}
+
+	return this.principal.Tenant
+}
+
+// Path parameter of the route, empty if not defined
+func (this *Context) Param(name string) string {
+	return this.params[name]
+}
+
+// Request id
+func (this *Context) Id() string {
+	return this.id
+}
+
+// Write value as JSON response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+// RFC 7807 problem details
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Rejected fields of the request body
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Write problem+json response, the title is the status text
+func writeProblem(w http.ResponseWriter, problem *Problem) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+
+	if problem.Title == "" {
+		problem.Title = http.StatusText(problem.Status)
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+
+	json.NewEncoder(w).Encode(problem)
+}
+
+// Write error response, message is the problem detail
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeProblem(w, &Problem{Status: code, Detail: msg})
+}
+
+// Write response for the failed create or update: rejected by the
+// data rules, duplicate or missing item. Other errors are logged.
+// Returns false if there is no error
+func writeStoreError(w http.ResponseWriter, ctx *Context, msg string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if e, ok := err.(*ConstraintError); ok {
+		if err := emitLimitEvent(ctx.db, e); err != nil {
+			ctx.log.Error("Can't emit limit event", "error", err)
+		}
+
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	} else if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlDuplicateEntry {
+		writeError(w, http.StatusConflict, "Already exists")
+	} else if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "")
+	} else {
+		ctx.log.Error(msg, "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+	}
+
+	return true
+}
+
+// Get request id from the header or generate new one
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(RequestIdHeader); requestIdRe.MatchString(id) {
+		return id
+	}
+
+	return RandStringId(32)
+}
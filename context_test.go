@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_HandleInContextRequestId(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		ids      = []string{"", "proxy-request-0001", "bad id"}
+	)
+
+	defer db.Close()
+
+	for _, id := range ids {
+		var ctxId string
+
+		handler := HandleInContext(func(w http.ResponseWriter, ctx *Context) {
+			ctxId = ctx.Id()
+
+			if v := ctx.log.Get("request_id"); v != ctxId {
+				t.Errorf("Expected logger request id %s, but got %v", ctxId, v)
+			}
+		}, prov, nil)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set(RequestIdHeader, id)
+		}
+
+		handler(w, r)
+
+		if ctxId == "" || w.Header().Get(RequestIdHeader) != ctxId {
+			t.Errorf("Expected response header %s, but got %s", ctxId, w.Header().Get(RequestIdHeader))
+		}
+
+		if id == "proxy-request-0001" && ctxId != id {
+			t.Errorf("Expected request id %s from the header, but got %s", id, ctxId)
+		}
+
+		if id == "bad id" && ctxId == id {
+			t.Errorf("Unexpected request id from the header: %s", id)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
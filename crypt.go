@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Crypt alphabet of the MD5 and SHA crypt hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// SHA crypt rounds
+const (
+	shaCryptRounds    = 5000
+	shaCryptMinRounds = 1000
+	shaCryptMaxRounds = 999999999
+)
+
+// Byte order of the encoded SHA crypt digests, three bytes per group
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	md5CryptOrder = [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+)
+
+// Hash of the other mail systems: MD5-CRYPT, SHA256-CRYPT,
+// SHA512-CRYPT, SSHA256, SSHA512 and BLF-CRYPT of Dovecot, with or
+// without the `{SCHEME}` prefix. It is replaced by bcrypt on the
+// first login
+func legacyHash(hash string) bool {
+	scheme, _ := splitScheme(hash)
+	return scheme != ""
+}
+
+// Password matches the legacy hash
+func checkLegacyHash(hash, password string) bool {
+	var computed []byte
+
+	scheme, value := splitScheme(hash)
+
+	switch scheme {
+	case "BLF-CRYPT":
+		return bcrypt.CompareHashAndPassword([]byte(value), []byte(password)) == nil
+	case "MD5-CRYPT":
+		computed = md5Crypt([]byte(password), value)
+	case "SHA256-CRYPT":
+		computed = shaCrypt(sha256.New, sha256CryptOrder, "$5$", []byte(password), value)
+	case "SHA512-CRYPT":
+		computed = shaCrypt(sha512.New, sha512CryptOrder, "$6$", []byte(password), value)
+	case "SSHA256":
+		return saltedSHA(sha256.New, value, password)
+	case "SSHA512":
+		return saltedSHA(sha512.New, value, password)
+	default:
+		return false
+	}
+
+	return computed != nil && subtle.ConstantTimeCompare(computed, []byte(value)) == 1
+}
+
+// Scheme and the hash without the prefix, empty scheme if unknown
+func splitScheme(hash string) (scheme, value string) {
+	value = hash
+
+	if strings.HasPrefix(hash, "{") {
+		if end := strings.Index(hash, "}"); end > 0 {
+			scheme, value = strings.ToUpper(hash[1:end]), hash[end+1:]
+		}
+	} else {
+		switch {
+		case strings.HasPrefix(hash, "$1$"):
+			scheme = "MD5-CRYPT"
+		case strings.HasPrefix(hash, "$5$"):
+			scheme = "SHA256-CRYPT"
+		case strings.HasPrefix(hash, "$6$"):
+			scheme = "SHA512-CRYPT"
+		}
+	}
+
+	switch scheme {
+	case "BLF-CRYPT":
+		if !bcryptHash(value) {
+			return "", hash
+		}
+	case "MD5-CRYPT", "SHA256-CRYPT", "SHA512-CRYPT", "SSHA256", "SSHA512":
+	default:
+		return "", hash
+	}
+
+	return
+}
+
+// Base64 of the digest followed by the salt
+func saltedSHA(newHash func() hash.Hash, value, password string) bool {
+	var h = newHash()
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(data) <= h.Size() {
+		return false
+	}
+
+	h.Write([]byte(password))
+	h.Write(data[h.Size():])
+
+	return subtle.ConstantTimeCompare(h.Sum(nil), data[:h.Size()]) == 1
+}
+
+// Salt of `$id$salt$digest`, at most max characters
+func cryptSalt(value, magic string, max int) (salt string, ok bool) {
+	if !strings.HasPrefix(value, magic) {
+		return
+	}
+
+	salt = value[len(magic):]
+	if end := strings.Index(salt, "$"); end >= 0 {
+		salt = salt[:end]
+	}
+
+	if len(salt) > max {
+		salt = salt[:max]
+	}
+
+	return salt, true
+}
+
+// Little endian 24 bit groups in the crypt alphabet
+func cryptEncode(buf *bytes.Buffer, b2, b1, b0 byte, n int) {
+	var w = uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+
+	for ; n > 0; n-- {
+		buf.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// MD5 crypt of the salt of the value, nil if malformed
+func md5Crypt(password []byte, value string) []byte {
+	var buf bytes.Buffer
+
+	salt, ok := cryptSalt(value, "$1$", 8)
+	if !ok {
+		return nil
+	}
+
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write([]byte(salt))
+	alt.Write(password)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(password)
+	h.Write([]byte("$1$" + salt))
+
+	for n := len(password); n > 0; n -= 16 {
+		if n > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:n])
+		}
+	}
+
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h = md5.New()
+
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(sum)
+		}
+
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			h.Write(password)
+		}
+
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(password)
+		}
+
+		sum = h.Sum(nil)
+	}
+
+	buf.WriteString("$1$" + salt + "$")
+
+	for _, g := range md5CryptOrder {
+		cryptEncode(&buf, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+
+	cryptEncode(&buf, 0, 0, sum[11], 2)
+
+	return buf.Bytes()
+}
+
+// SHA256 or SHA512 crypt of the salt and rounds of the value, nil if
+// malformed
+func shaCrypt(newHash func() hash.Hash, order [][3]int, magic string, password []byte, value string) []byte {
+	var (
+		buf    bytes.Buffer
+		rounds = shaCryptRounds
+		custom bool
+	)
+
+	if !strings.HasPrefix(value, magic) {
+		return nil
+	}
+
+	rest := value[len(magic):]
+
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.Index(rest, "$")
+		if end < 0 {
+			return nil
+		}
+
+		n, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return nil
+		}
+
+		switch {
+		case n < shaCryptMinRounds:
+			n = shaCryptMinRounds
+		case n > shaCryptMaxRounds:
+			n = shaCryptMaxRounds
+		}
+
+		rounds, custom, rest = n, true, rest[end+1:]
+	}
+
+	salt, _ := cryptSalt("$"+rest, "$", 16)
+
+	b := newHash()
+	b.Write(password)
+	b.Write([]byte(salt))
+	b.Write(password)
+	bSum := b.Sum(nil)
+
+	a := newHash()
+	a.Write(password)
+	a.Write([]byte(salt))
+
+	for n := len(password); n > 0; n -= len(bSum) {
+		if n > len(bSum) {
+			a.Write(bSum)
+		} else {
+			a.Write(bSum[:n])
+		}
+	}
+
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(bSum)
+		} else {
+			a.Write(password)
+		}
+	}
+
+	sum := a.Sum(nil)
+
+	dp := newHash()
+	for i := 0; i < len(password); i++ {
+		dp.Write(password)
+	}
+
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := newHash()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write([]byte(salt))
+	}
+
+	s := repeatBytes(ds.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		c := newHash()
+
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+
+		if i%3 != 0 {
+			c.Write(s)
+		}
+
+		if i%7 != 0 {
+			c.Write(p)
+		}
+
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+
+		sum = c.Sum(nil)
+	}
+
+	buf.WriteString(magic)
+
+	if custom {
+		buf.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+
+	buf.WriteString(salt + "$")
+
+	for _, g := range order {
+		cryptEncode(&buf, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+
+	if len(sum) == sha256.Size {
+		cryptEncode(&buf, 0, sum[31], sum[30], 3)
+	} else {
+		cryptEncode(&buf, 0, 0, sum[63], 2)
+	}
+
+	return buf.Bytes()
+}
+
+// Digest repeated to the length
+func repeatBytes(digest []byte, n int) []byte {
+	var out = make([]byte, 0, n)
+
+	for len(out) < n {
+		if n-len(out) >= len(digest) {
+			out = append(out, digest...)
+		} else {
+			out = append(out, digest[:n-len(out)]...)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func Test_CheckLegacyHash(t *testing.T) {
+	cases := []struct {
+		hash     string
+		password string
+	}{
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+		{"{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$1$abcdefgh$ZE59VolIMROFw2UgfozW8/", "secret password"},
+		{"{MD5-CRYPT}$1$xy$ieohG.FgC9YEJCCLEDfvh1", "aaaaaaaaaaaaaaaaaaaa"},
+		{"{SSHA512}+1+wcvojrpMq/LIQ43fxync7rR+PF6jlyuDnDxy2HBuda4WLc03YuwjlnIC46IVuDdfXWN+H9PhKCOgu8PMyXnNhbHQxMjM0", "secret password"},
+		{"{SSHA256}0V5rs8B5j2Fdd7IoxvpbRJWLUO0brtZkjC2n6RTOP/5zYWx0MTIzNA==", "secret password"},
+	}
+
+	if hash, err := bcrypt.GenerateFromPassword([]byte("Dovecot bcrypt"), bcrypt.MinCost); err == nil {
+		cases = append(cases, struct {
+			hash     string
+			password string
+		}{"{BLF-CRYPT}" + string(hash), "Dovecot bcrypt"})
+	}
+
+	for _, c := range cases {
+		if !legacyHash(c.hash) {
+			t.Errorf("Expected legacy hash %s", c.hash)
+		}
+
+		if !checkLegacyHash(c.hash, c.password) {
+			t.Errorf("Expected password %q of %s", c.password, c.hash)
+		}
+
+		if checkLegacyHash(c.hash, c.password+"x") {
+			t.Errorf("Unexpected password %q of %s", c.password+"x", c.hash)
+		}
+	}
+
+	for _, hash := range []string{"", "secret", "{PLAIN}secret", "{SSHA512}!", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"} {
+		if legacyHash(hash) && checkLegacyHash(hash, "secret") {
+			t.Errorf("Unexpected legacy hash %s", hash)
+		}
+	}
+}
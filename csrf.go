@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	// Session key for the CSRF token
+	CSRFKey = "csrf"
+	// Request and response header with the token
+	CSRFHeader = "X-CSRF-Token"
+	// Form field with the token
+	CSRFField = "csrf_token"
+
+	csrfTokenLen = 43
+)
+
+// Get session CSRF token, create if not exists
+func csrfToken(s *Session) (token string, err error) {
+	if token, _ = s.Get(CSRFKey).(string); token != "" {
+		return
+	}
+
+	return rotateCSRF(s)
+}
+
+// Replace session CSRF token
+func rotateCSRF(s *Session) (token string, err error) {
+	token = RandSecureId(csrfTokenLen)
+	err = s.Set(CSRFKey, token)
+
+	return
+}
+
+// Check request token from the header or form field
+// against the session one
+func validCSRF(r *http.Request, s *Session) bool {
+	var (
+		expected, _ = s.Get(CSRFKey).(string)
+		token       = r.Header.Get(CSRFHeader)
+	)
+
+	if token == "" {
+		token = r.PostFormValue(CSRFField)
+	}
+
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Methods without side effects
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+// Unsafe methods of the stored session require CSRF token, the
+// token is returned in the response header. Detached session of
+// the API token has no CSRF token
+func CheckCSRF(next ContextHandler) ContextHandler {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if ctx.s != nil && ctx.s.Id() != "" && !ctx.s.IsNew() {
+			if !safeMethod(ctx.r.Method) && !validCSRF(ctx.r, ctx.s) {
+				ctx.log.Notice("CSRF token mismatch", "method", ctx.r.Method, "path", ctx.r.URL.Path)
+				writeError(w, http.StatusForbidden, "Invalid CSRF token")
+
+				return
+			}
+
+			if token, err := csrfToken(ctx.s); err == nil {
+				w.Header().Set(CSRFHeader, token)
+			}
+		}
+
+		next(w, ctx)
+	}
+}
+
+// Return session CSRF token for the UI
+func handleCSRF(w http.ResponseWriter, ctx *Context) {
+	token, err := csrfToken(ctx.s)
+	if err != nil {
+		ctx.log.Error("Can't create CSRF token", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set(CSRFHeader, token)
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
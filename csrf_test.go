@@ -0,0 +1,107 @@
+package main
+
+import (
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_HandleInContextCSRF(t *testing.T) {
+	var (
+		db, _   = InitDBMock(t)
+		prov, _ = NewManager(db, 0)
+		sess    = NewSession(RandStringId(64))
+		token   string
+		called  bool
+	)
+
+	defer db.Close()
+
+	token, _ = csrfToken(sess)
+	prov.append(sess)
+
+	handler := HandleInContext(func(w http.ResponseWriter, ctx *Context) {
+		called = true
+	}, prov, nil)
+
+	tests := []struct {
+		method string
+		header string
+		form   string
+		code   int
+	}{
+		{"GET", "", "", http.StatusOK},
+		{"POST", "", "", http.StatusForbidden},
+		{"POST", "wrong", "", http.StatusForbidden},
+		{"POST", token, "", http.StatusOK},
+		{"DELETE", token, "", http.StatusOK},
+		{"POST", "", CSRFField + "=" + token, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(test.method, "/", strings.NewReader(test.form))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: sess.Id()})
+
+		if test.form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		if test.header != "" {
+			r.Header.Set(CSRFHeader, test.header)
+		}
+
+		called = false
+		handler(w, r)
+
+		if w.Code != test.code || called != (test.code == http.StatusOK) {
+			t.Errorf("Test %d: expected status %d, but got %d", i, test.code, w.Code)
+		}
+
+		if h := w.Header().Get(CSRFHeader); called && h != token {
+			t.Errorf("Test %d: expected token header %s, but got %s", i, token, h)
+		}
+	}
+}
+
+func Test_RegenerateRotatesCSRF(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		sess     = NewSession(RandStringId(64))
+		sid      = sess.Id()
+	)
+
+	defer db.Close()
+
+	token, _ := csrfToken(sess)
+	prov.append(sess)
+
+	mock.ExpectExec("UPDATE `msm_session` SET `id`").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/", nil)
+
+	if err := prov.Regenerate(w, r, sess); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if sess.Id() == sid || sess.Get(CSRFKey) == token {
+		t.Errorf("Expected new session id and CSRF token")
+	}
+
+	if !strings.Contains(w.Header().Get("Set-Cookie"), sess.Id()) {
+		t.Errorf("Expected cookie with the new session id")
+	}
+
+	if _, s := prov.get(sess.Id()); s != sess {
+		t.Errorf("Expected session by the new id")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
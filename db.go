@@ -3,6 +3,13 @@ package main
 import (
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
+	"sync"
+)
+
+// Functions of the open transactions run after the commit
+var (
+	txHooks     = make(map[*sql.Tx][]func())
+	txHooksLock sync.Mutex
 )
 
 // Create database connection
@@ -14,3 +21,64 @@ func openDB(url string) (db *sql.DB, err error) {
 	err = db.Ping()
 	return
 }
+
+// Run fn in the transaction, commit if it succeeds
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	var tx *sql.Tx
+
+	if tx, err = db.Begin(); err != nil {
+		return
+	}
+
+	if err = fn(tx); err != nil {
+		rollbackTx(tx)
+		return
+	}
+
+	return commitTx(tx)
+}
+
+// Run fn after the transaction commit, at once if q isn't one
+func afterCommit(q querier, fn func()) {
+	tx, ok := q.(*sql.Tx)
+	if !ok {
+		fn()
+		return
+	}
+
+	txHooksLock.Lock()
+	txHooks[tx] = append(txHooks[tx], fn)
+	txHooksLock.Unlock()
+}
+
+// Commit and run the hooks of the transaction
+func commitTx(tx *sql.Tx) (err error) {
+	var hooks = takeTxHooks(tx)
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	for _, fn := range hooks {
+		fn()
+	}
+
+	return
+}
+
+// Rollback and drop the hooks of the transaction
+func rollbackTx(tx *sql.Tx) error {
+	takeTxHooks(tx)
+
+	return tx.Rollback()
+}
+
+func takeTxHooks(tx *sql.Tx) []func() {
+	txHooksLock.Lock()
+	defer txHooksLock.Unlock()
+
+	hooks := txHooks[tx]
+	delete(txHooks, tx)
+
+	return hooks
+}
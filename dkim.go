@@ -0,0 +1,650 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM key algorithms
+const (
+	DKIMRSA     = "rsa"
+	DKIMEd25519 = "ed25519"
+)
+
+// Key states. Retiring keys are published in DNS but not used
+// for signing, so signatures made before rotation still verify
+const (
+	DKIMActive   = "active"
+	DKIMRetiring = "retiring"
+	DKIMRetired  = "retired"
+)
+
+var (
+	ErrDKIMDisabled = errors.New("DKIM master key is not configured")
+
+	dkimSelector = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// Domain DKIM key, the private part is never returned
+type DKIMKey struct {
+	Id        int64  `json:"id"`
+	Domain    string `json:"domain"`
+	Selector  string `json:"selector"`
+	Algorithm string `json:"algorithm"`
+	State     string `json:"state"`
+	Created   int64  `json:"created"`
+	// Public key base64
+	Public string `json:"-"`
+}
+
+// DNS record name
+func (this *DKIMKey) Name() string {
+	return this.Selector + "._domainkey." + this.Domain
+}
+
+// DNS TXT record value
+func (this *DKIMKey) Record() string {
+	return "v=DKIM1; k=" + this.Algorithm + "; p=" + this.Public
+}
+
+func (this *DKIMKey) MarshalJSON() ([]byte, error) {
+	type key DKIMKey
+
+	return json.Marshal(struct {
+		*key
+		Name   string `json:"name"`
+		Record string `json:"record"`
+	}{(*key)(this), this.Name(), this.Record()})
+}
+
+// Private key file for the milter
+func (this *DKIMKey) path(dir string) string {
+	return filepath.Join(dir, this.Domain, this.Selector+".private")
+}
+
+// DKIM keys with the private keys encrypted by the master key
+type DKIMStore struct {
+	conn   *sql.DB
+	aead   cipher.AEAD
+	keyDir string
+	bits   int
+	now    func() time.Time
+}
+
+func NewDKIMStore(cfg *Config, db *sql.DB) (store *DKIMStore, err error) {
+	var (
+		key   []byte
+		block cipher.Block
+	)
+
+	store = &DKIMStore{
+		conn:   db,
+		keyDir: cfg.GetDKIMKeyDir(),
+		bits:   cfg.GetDKIMBits(),
+		now:    time.Now,
+	}
+
+	if cfg.DKIM == nil || cfg.DKIM.KeyFile == "" {
+		return
+	}
+
+	if key, err = ioutil.ReadFile(cfg.DKIM.KeyFile); err != nil {
+		return nil, err
+	}
+
+	if text := strings.TrimSpace(string(key)); len(text) == 64 {
+		if key, err = hex.DecodeString(text); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("DKIM master key must be 32 bytes")
+	}
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	store.aead, err = cipher.NewGCM(block)
+
+	return
+}
+
+// Create key pair, bits are used for RSA, zero for default size
+func (this *DKIMStore) Generate(domain, selector, algorithm string, bits int) (key *DKIMKey, err error) {
+	var private []byte
+
+	if key, private, err = this.newKey(domain, selector, algorithm, bits); err != nil {
+		return
+	}
+
+	defer metricDBQuery.Since(time.Now(), "dkim_generate")
+
+	err = this.insert(this.conn, key, private)
+
+	return
+}
+
+// Create new active key of the old key domain with the selector,
+// the active keys of the domain with the same algorithm become
+// retiring in the same transaction
+func (this *DKIMStore) Rotate(old *DKIMKey, selector string) (key *DKIMKey, err error) {
+	var private []byte
+
+	if key, private, err = this.newKey(old.Domain, selector, old.Algorithm, 0); err != nil {
+		return
+	}
+
+	defer metricDBQuery.Since(time.Now(), "dkim_rotate")
+
+	err = inTx(this.conn, func(tx *sql.Tx) (err error) {
+		if err = this.insert(tx, key, private); err != nil {
+			return
+		}
+
+		_, err = tx.Exec("UPDATE `msm_dkim` SET `state` = ? WHERE `domain` = ? AND `algorithm` = ? AND `state` = ? AND `id` <> ?",
+			DKIMRetiring, key.Domain, key.Algorithm, DKIMActive, key.Id)
+
+		return
+	})
+
+	return
+}
+
+// Stop publishing the key
+func (this *DKIMStore) Retire(id int64) (err error) {
+	var (
+		result sql.Result
+		rows   int64
+	)
+
+	defer metricDBQuery.Since(time.Now(), "dkim_retire")
+
+	if result, err = this.conn.Exec("UPDATE `msm_dkim` SET `state` = ? WHERE `id` = ?", DKIMRetired, id); err != nil {
+		return
+	}
+
+	if rows, err = result.RowsAffected(); err == nil && rows == 0 {
+		err = sql.ErrNoRows
+	}
+
+	return
+}
+
+// Keys of the domain or all if empty, retired keys are skipped
+func (this *DKIMStore) List(domain string) (keys []*DKIMKey, err error) {
+	var rows *sql.Rows
+
+	defer metricDBQuery.Since(time.Now(), "dkim_list")
+
+	keys = make([]*DKIMKey, 0)
+
+	rows, err = this.conn.Query("SELECT `id`, `domain`, `selector`, `algorithm`, `public`, `state`, `created` FROM `msm_dkim` "+
+		"WHERE (? = '' OR `domain` = ?) AND `state` <> ? ORDER BY `domain`, `created`", domain, domain, DKIMRetired)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		key := &DKIMKey{}
+
+		if err = rows.Scan(&key.Id, &key.Domain, &key.Selector, &key.Algorithm, &key.Public, &key.State, &key.Created); err != nil {
+			return
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Write private keys of the active keys to the key directory
+func (this *DKIMStore) WriteKeys() (err error) {
+	var rows *sql.Rows
+
+	if this.aead == nil {
+		return ErrDKIMDisabled
+	}
+
+	rows, err = this.conn.Query("SELECT `id`, `domain`, `selector`, `private` FROM `msm_dkim` WHERE `state` = ?", DKIMActive)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key    = &DKIMKey{}
+			sealed []byte
+			plain  []byte
+		)
+
+		if err = rows.Scan(&key.Id, &key.Domain, &key.Selector, &sealed); err != nil {
+			return
+		}
+
+		if plain, err = this.open(key, sealed); err != nil {
+			return fmt.Errorf("Can't decrypt DKIM key %d: %s", key.Id, err.Error())
+		}
+
+		if err = os.MkdirAll(filepath.Dir(key.path(this.keyDir)), 0700); err != nil {
+			return
+		}
+
+		if err = ioutil.WriteFile(key.path(this.keyDir), plain, 0600); err != nil {
+			return
+		}
+	}
+
+	return rows.Err()
+}
+
+// Write configuration: `opendkim-keytable`, `opendkim-signingtable`,
+// `rspamd` dkim_signing domains or `zone` TXT records
+func (this *DKIMStore) Export(format string, w io.Writer) (err error) {
+	var keys []*DKIMKey
+
+	switch format {
+	case "opendkim-keytable", "opendkim-signingtable", "rspamd", "zone":
+	default:
+		return fmt.Errorf("Unknown export format %s", format)
+	}
+
+	if keys, err = this.List(""); err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		if key.State != DKIMActive && format != "zone" {
+			continue
+		}
+
+		switch format {
+		case "opendkim-keytable":
+			fmt.Fprintf(w, "%s %s:%s:%s\n", key.Name(), key.Domain, key.Selector, key.path(this.keyDir))
+
+		case "opendkim-signingtable":
+			fmt.Fprintf(w, "*@%s %s\n", key.Domain, key.Name())
+
+		case "rspamd":
+			fmt.Fprintf(w, "%s {\n  selector = %q;\n  path = %q;\n}\n", key.Domain, key.Selector, key.path(this.keyDir))
+
+		case "zone":
+			fmt.Fprintf(w, "%s. IN TXT ( %s )\n", key.Name(), txtStrings(key.Record()))
+		}
+	}
+
+	return
+}
+
+// Unsaved key and its private key, nil key if the request is invalid
+func (this *DKIMStore) newKey(domain, selector, algorithm string, bits int) (key *DKIMKey, private []byte, err error) {
+	if this.aead == nil {
+		return nil, nil, ErrDKIMDisabled
+	}
+
+	domain, selector = strings.ToLower(domain), strings.ToLower(selector)
+
+	if !domainPattern.MatchString(domain) || !dkimSelector.MatchString(selector) {
+		return nil, nil, errors.New("Invalid domain or selector")
+	}
+
+	key = &DKIMKey{
+		Domain:    domain,
+		Selector:  selector,
+		Algorithm: algorithm,
+		State:     DKIMActive,
+		Created:   this.now().Unix(),
+	}
+
+	if private, key.Public, err = dkimKeyPair(algorithm, bits, this.bits); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// Store the key and set its id
+func (this *DKIMStore) insert(q querier, key *DKIMKey, private []byte) (err error) {
+	var result sql.Result
+
+	result, err = q.Exec("INSERT INTO `msm_dkim`(`domain`, `selector`, `algorithm`, `private`, `public`, `state`, `created`) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		key.Domain, key.Selector, key.Algorithm, this.seal(key, private), key.Public, key.State, key.Created)
+	if err != nil {
+		return
+	}
+
+	key.Id, err = result.LastInsertId()
+
+	return
+}
+
+func (this *DKIMStore) get(id int64) (key *DKIMKey, sealed []byte, err error) {
+	key = &DKIMKey{}
+
+	err = this.conn.QueryRow("SELECT `id`, `domain`, `selector`, `algorithm`, `private`, `public`, `state`, `created` FROM `msm_dkim` WHERE `id` = ?", id).
+		Scan(&key.Id, &key.Domain, &key.Selector, &key.Algorithm, &sealed, &key.Public, &key.State, &key.Created)
+
+	return
+}
+
+// Encrypt private key, the domain and selector are authenticated
+func (this *DKIMStore) seal(key *DKIMKey, plain []byte) []byte {
+	var nonce = make([]byte, this.aead.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return this.aead.Seal(nonce, nonce, plain, []byte(key.Name()))
+}
+
+func (this *DKIMStore) open(key *DKIMKey, sealed []byte) ([]byte, error) {
+	var size = this.aead.NonceSize()
+
+	if len(sealed) < size {
+		return nil, errors.New("Sealed key is too short")
+	}
+
+	return this.aead.Open(nil, sealed[:size], sealed[size:], []byte(key.Name()))
+}
+
+// PKCS8 PEM private key and the base64 public key for the record
+func dkimKeyPair(algorithm string, bits, defBits int) (private []byte, public string, err error) {
+	var (
+		signer interface{}
+		pub    []byte
+		der    []byte
+	)
+
+	switch algorithm {
+	case DKIMRSA:
+		if bits == 0 {
+			bits = defBits
+		}
+
+		if bits < 1024 || bits > 4096 {
+			return nil, "", errors.New("RSA key size must be 1024 to 4096 bits")
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if pub, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+			return nil, "", err
+		}
+
+		signer = key
+
+	case DKIMEd25519:
+		raw, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+
+		// RFC 8463: raw key in the record
+		pub, signer = raw, key
+
+	default:
+		return nil, "", errors.New("Unknown DKIM algorithm " + algorithm)
+	}
+
+	if der, err = x509.MarshalPKCS8PrivateKey(signer); err != nil {
+		return
+	}
+
+	private = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	public = base64.StdEncoding.EncodeToString(pub)
+
+	return
+}
+
+// Quoted TXT strings of 255 characters at most
+func txtStrings(value string) string {
+	var parts []string
+
+	for len(value) > 255 {
+		parts = append(parts, strconv.Quote(value[:255]))
+		value = value[255:]
+	}
+
+	return strings.Join(append(parts, strconv.Quote(value)), " ")
+}
+
+// List keys: GET /dkim?domain=, generate: POST /dkim
+func handleDKIM(store *DKIMStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		switch ctx.r.Method {
+		case "GET":
+			if !ctx.Require(w, "domains:read") {
+				return
+			}
+
+			domain := strings.ToLower(ctx.r.URL.Query().Get("domain"))
+			if !dkimAllowed(w, ctx, domain) {
+				return
+			}
+
+			keys, err := store.List(domain)
+			if err != nil {
+				ctx.log.Error("Can't list DKIM keys", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+
+			writeJSON(w, http.StatusOK, keys)
+
+		case "POST":
+			var req struct {
+				Domain    string `json:"domain"`
+				Selector  string `json:"selector"`
+				Algorithm string `json:"algorithm"`
+				Bits      int    `json:"bits"`
+			}
+
+			if !ctx.Require(w, "domains:dkim") {
+				return
+			}
+
+			if err := json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+
+			if req.Algorithm == "" {
+				req.Algorithm = DKIMRSA
+			}
+
+			if !dkimAllowed(w, ctx, strings.ToLower(req.Domain)) {
+				return
+			}
+
+			key, err := store.Generate(req.Domain, req.Selector, req.Algorithm, req.Bits)
+			writeDKIMKey(w, ctx, key, err)
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	}
+}
+
+// Key table of the signer: GET /dkim/export?format=
+func handleDKIMExport(store *DKIMStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "domains:read") || !dkimAllowed(w, ctx, "") {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if err := store.Export(ctx.r.URL.Query().Get("format"), w); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+	}
+}
+
+// Write the key files of the signer: POST /dkim/sync
+func handleDKIMSync(store *DKIMStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "domains:dkim") || !dkimAllowed(w, ctx, "") {
+			return
+		}
+
+		if err := store.WriteKeys(); err != nil {
+			ctx.log.Error("Can't write DKIM keys", "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// New key of the selector replaces the key: POST /dkim/{id}/rotate
+func handleDKIMRotate(store *DKIMStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var req struct {
+			Selector string `json:"selector"`
+		}
+
+		if !ctx.Require(w, "domains:dkim") {
+			return
+		}
+
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil || !dkimKeyAllowed(w, ctx, store, id) {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		old, _, err := store.get(id)
+		if writeStoreError(w, ctx, "Can't get DKIM key", err) {
+			return
+		}
+
+		key, err := store.Rotate(old, req.Selector)
+		writeDKIMKey(w, ctx, key, err)
+	}
+}
+
+// Retire the key: DELETE /dkim/{id}
+func handleDKIMRetire(store *DKIMStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "domains:dkim") {
+			return
+		}
+
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil || !dkimKeyAllowed(w, ctx, store, id) {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		if err = store.Retire(id); err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't retire DKIM key", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		ctx.log.Notice("DKIM key retired", "dkim_id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Tenant principal manages the keys of its domains only, server
+// wide operations without the domain are global
+func dkimAllowed(w http.ResponseWriter, ctx *Context, domain string) bool {
+	if ctx.Tenant() == 0 {
+		return true
+	}
+
+	if domain == "" {
+		writeError(w, http.StatusForbidden, "Access denied")
+		return false
+	}
+
+	if _, err := getDomain(ctx.db, ctx.Tenant(), domain); err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "")
+		return false
+	} else if err != nil {
+		ctx.log.Error("Can't get domain", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return false
+	}
+
+	return true
+}
+
+// Key exists and its domain is in the tenant scope, lookup failure
+// is reported as not found
+func dkimKeyAllowed(w http.ResponseWriter, ctx *Context, store *DKIMStore, id int64) bool {
+	if ctx.Tenant() == 0 {
+		return true
+	}
+
+	key, _, err := store.get(id)
+	if err != nil {
+		return false
+	}
+
+	_, err = getDomain(ctx.db, ctx.Tenant(), key.Domain)
+
+	return err == nil
+}
+
+// Created key response
+func writeDKIMKey(w http.ResponseWriter, ctx *Context, key *DKIMKey, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		writeError(w, http.StatusNotFound, "")
+
+	case err == ErrDKIMDisabled:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+
+	// Invalid request, nothing is stored
+	case err != nil && key == nil:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+
+	// Duplicate selector is a conflict
+	case err != nil:
+		writeStoreError(w, ctx, "Can't store DKIM key", err)
+
+	default:
+		ctx.log.Notice("DKIM key created", "domain", key.Domain, "selector", key.Selector)
+		writeJSON(w, http.StatusCreated, key)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Store the matched argument
+type captureArg struct {
+	value driver.Value
+}
+
+func (this *captureArg) Match(v driver.Value) bool {
+	this.value = v
+	return true
+}
+
+func testDKIMStore(t *testing.T, dir string) (*DKIMStore, sqlmock.Sqlmock) {
+	var (
+		db, mock = InitDBMock(t)
+		keyFile  = filepath.Join(dir, "master.key")
+	)
+
+	ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+
+	store, err := NewDKIMStore(&Config{DKIM: &DKIM{KeyFile: keyFile, KeyDir: filepath.Join(dir, "keys")}}, db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	store.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	return store, mock
+}
+
+func Test_DKIMGenerateAndWriteKeys(t *testing.T) {
+	var (
+		dir, _      = ioutil.TempDir("", "msm")
+		store, mock = testDKIMStore(t, dir)
+		tests       = []struct {
+			algorithm string
+			bits      int
+		}{
+			{DKIMEd25519, 0},
+			{DKIMRSA, 1024},
+		}
+	)
+
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		var sealed = &captureArg{}
+
+		mock.ExpectExec("INSERT INTO `msm_dkim`").
+			WithArgs("example.com", "s1", test.algorithm, sealed, sqlmock.AnyArg(), DKIMActive, int64(1500000000)).
+			WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
+
+		key, err := store.Generate("Example.com", "s1", test.algorithm, test.bits)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.algorithm, err.Error())
+		}
+
+		if !strings.HasPrefix(key.Record(), "v=DKIM1; k="+test.algorithm+"; p=") || key.Name() != "s1._domainkey.example.com" {
+			t.Errorf("%s: unexpected record %s %s", test.algorithm, key.Name(), key.Record())
+		}
+
+		if bytes.Contains(sealed.value.([]byte), []byte("PRIVATE KEY")) {
+			t.Errorf("%s: private key is stored in plain text", test.algorithm)
+		}
+
+		mock.ExpectQuery("SELECT `id`, `domain`, `selector`, `private` FROM `msm_dkim`").WithArgs(DKIMActive).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "domain", "selector", "private"}).
+				AddRow(key.Id, key.Domain, key.Selector, sealed.value))
+
+		if err = store.WriteKeys(); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.algorithm, err.Error())
+		}
+
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "keys", "example.com", "s1.private"))
+		block, _ := pem.Decode(data)
+		if block == nil {
+			t.Fatalf("%s: private key file is not PEM", test.algorithm)
+		}
+
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.algorithm, err.Error())
+		}
+
+		public, _ := base64.StdEncoding.DecodeString(key.Public)
+
+		switch private := private.(type) {
+		case ed25519.PrivateKey:
+			if !bytes.Equal(private.Public().(ed25519.PublicKey), public) {
+				t.Errorf("Ed25519 record does not match private key")
+			}
+		case *rsa.PrivateKey:
+			der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+			if !bytes.Equal(der, public) || private.N.BitLen() != 1024 {
+				t.Errorf("RSA record does not match private key")
+			}
+		}
+
+		// Sealed key is bound to the domain and selector
+		if _, err = store.open(&DKIMKey{Domain: "example.com", Selector: "s2"}, sealed.value.([]byte)); err == nil {
+			t.Errorf("%s: expected error on the other selector", test.algorithm)
+		}
+	}
+
+	if _, err := store.Generate("example.com", "bad_selector", DKIMRSA, 0); err == nil {
+		t.Errorf("Expected error on invalid selector")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_DKIMExport(t *testing.T) {
+	var (
+		dir, _      = ioutil.TempDir("", "msm")
+		store, mock = testDKIMStore(t, dir)
+		columns     = []string{"id", "domain", "selector", "algorithm", "public", "state", "created"}
+		public      = strings.Repeat("A", 300)
+		keysDir     = filepath.Join(dir, "keys")
+		tests       = []struct {
+			format   string
+			expected string
+		}{
+			{"opendkim-keytable", "s2._domainkey.example.com example.com:s2:" + keysDir + "/example.com/s2.private\n"},
+			{"opendkim-signingtable", "*@example.com s2._domainkey.example.com\n"},
+			{"rspamd", "example.com {\n  selector = \"s2\";\n  path = \"" + keysDir + "/example.com/s2.private\";\n}\n"},
+			{"zone", "s1._domainkey.example.com. IN TXT ( \"v=DKIM1; k=rsa; p=" + public[:255-len("v=DKIM1; k=rsa; p=")] + "\" \"" + public[255-len("v=DKIM1; k=rsa; p="):] + "\" )\n" +
+				"s2._domainkey.example.com. IN TXT ( \"v=DKIM1; k=ed25519; p=key\" )\n"},
+		}
+	)
+
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+
+		mock.ExpectQuery("SELECT (.+) FROM `msm_dkim`").WithArgs("", "", DKIMRetired).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(1, "example.com", "s1", DKIMRSA, public, DKIMRetiring, 1400000000).
+				AddRow(2, "example.com", "s2", DKIMEd25519, "key", DKIMActive, 1500000000))
+
+		if err := store.Export(test.format, &buf); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.format, err.Error())
+		}
+
+		if buf.String() != test.expected {
+			t.Errorf("%s: expected\n%s\nbut got\n%s", test.format, test.expected, buf.String())
+		}
+	}
+
+	if err := store.Export("bind", &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error on unknown format")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Rotated key replaces the active keys of its algorithm only
+func Test_DKIMRotate(t *testing.T) {
+	var (
+		dir, _      = ioutil.TempDir("", "msm")
+		store, mock = testDKIMStore(t, dir)
+	)
+
+	defer os.RemoveAll(dir)
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_dkim` WHERE `id` = \\?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "domain", "selector", "algorithm", "private", "public", "state", "created"}).
+			AddRow(1, "example.com", "s1", DKIMEd25519, []byte{}, "", DKIMActive, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO `msm_dkim`").
+		WithArgs("example.com", "s2", DKIMEd25519, sqlmock.AnyArg(), sqlmock.AnyArg(), DKIMActive, int64(1500000000)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("UPDATE `msm_dkim` SET `state` = \\? WHERE `domain` = \\? AND `algorithm` = \\?").
+		WithArgs(DKIMRetiring, "example.com", DKIMEd25519, DKIMActive, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	old, _, err := store.get(1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if key, err := store.Rotate(old, "s2"); err != nil || key.Id != 2 {
+		t.Errorf("Unexpected rotated key %v, %v", key, err)
+	}
+
+	// New key is not kept if the old keys stay active
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO `msm_dkim`").WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("UPDATE `msm_dkim` SET `state` = \\?").WillReturnError(errors.New("Lost connection"))
+	mock.ExpectRollback()
+
+	if _, err := store.Rotate(old, "s3"); err == nil {
+		t.Errorf("Expected rotation error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_WriteDKIMKeyDuplicate(t *testing.T) {
+	var (
+		w   = httptest.NewRecorder()
+		ctx = &Context{log: log.With()}
+		err = &mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"}
+	)
+
+	writeDKIMKey(w, ctx, &DKIMKey{}, err)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, but got %d", http.StatusConflict, w.Code)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Check statuses, ordered by severity
+const (
+	DNSPass = "pass"
+	DNSWarn = "warn"
+	DNSFail = "fail"
+)
+
+var dnsSeverity = map[string]int{DNSPass: 0, DNSWarn: 1, DNSFail: 2}
+
+// DNS lookups used by the checker, implemented by net.Resolver
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Single check result
+type DNSCheck struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Records []string `json:"records,omitempty"`
+}
+
+// Domain report, the status is the worst check status
+type DNSReport struct {
+	Domain string     `json:"domain"`
+	Status string     `json:"status"`
+	Checks []DNSCheck `json:"checks"`
+}
+
+func (this *DNSReport) add(check DNSCheck) {
+	if dnsSeverity[check.Status] > dnsSeverity[this.Status] {
+		this.Status = check.Status
+	}
+
+	this.Checks = append(this.Checks, check)
+}
+
+// Check domain records against the server configuration
+type DNSChecker struct {
+	resolver Resolver
+	dkim     *DKIMStore
+	mx       []string
+	spf      []string
+	timeout  time.Duration
+}
+
+func NewDNSChecker(cfg *Config, dkim *DKIMStore) *DNSChecker {
+	var checker = &DNSChecker{
+		resolver: net.DefaultResolver,
+		dkim:     dkim,
+		timeout:  time.Duration(cfg.GetDNSTimeout()) * time.Second,
+	}
+
+	if cfg.DNS != nil {
+		checker.mx = cfg.DNS.MX
+		checker.spf = cfg.DNS.SPF
+
+		if server := cfg.DNS.Server; server != "" {
+			checker.resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, server)
+				},
+			}
+		}
+	}
+
+	return checker
+}
+
+// Run all checks
+func (this *DNSChecker) Check(domain string) (report *DNSReport) {
+	var ctx, cancel = context.WithTimeout(context.Background(), this.timeout)
+
+	defer cancel()
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	report = &DNSReport{Domain: domain, Status: DNSPass, Checks: make([]DNSCheck, 0)}
+
+	report.add(this.checkMX(ctx, domain))
+	report.add(this.checkSPF(ctx, domain))
+
+	for _, check := range this.checkDKIM(ctx, domain) {
+		report.add(check)
+	}
+
+	report.add(this.checkDMARC(ctx, domain))
+	report.add(this.checkMTASTS(ctx, domain))
+
+	return
+}
+
+func (this *DNSChecker) checkMX(ctx context.Context, domain string) (check DNSCheck) {
+	var (
+		records []*net.MX
+		matched int
+		err     error
+	)
+
+	check.Name = "mx"
+
+	if records, err = this.resolver.LookupMX(ctx, domain); err != nil && !dnsNotFound(err) {
+		return dnsError(check, err)
+	}
+
+	for _, mx := range records {
+		host := strings.TrimSuffix(strings.ToLower(mx.Host), ".")
+
+		check.Records = append(check.Records, host)
+
+		for _, expected := range this.mx {
+			if strings.EqualFold(strings.TrimSuffix(expected, "."), host) {
+				matched++
+			}
+		}
+	}
+
+	switch {
+	case len(records) == 0:
+		check.Status, check.Message = DNSFail, "No MX records"
+	case len(this.mx) == 0:
+		check.Status, check.Message = DNSPass, "MX records found"
+	case matched == len(records):
+		check.Status, check.Message = DNSPass, "MX records point to the server"
+	case matched > 0:
+		check.Status, check.Message = DNSWarn, "Some MX records point to other hosts"
+	default:
+		check.Status, check.Message = DNSFail, "MX records do not point to the server, expected "+strings.Join(this.mx, ", ")
+	}
+
+	return
+}
+
+func (this *DNSChecker) checkSPF(ctx context.Context, domain string) (check DNSCheck) {
+	var err error
+
+	check.Name = "spf"
+
+	if check.Records, err = this.lookupTXT(ctx, domain, "v=spf1"); err != nil {
+		return dnsError(check, err)
+	}
+
+	if len(check.Records) != 1 {
+		return dnsStatus(check, DNSFail, dnsCount(len(check.Records), "SPF"))
+	}
+
+	terms := strings.Fields(strings.ToLower(check.Records[0]))
+
+	for _, expected := range this.spf {
+		if !dnsHasTerm(terms, strings.ToLower(expected)) {
+			return dnsStatus(check, DNSFail, "SPF record does not contain "+expected)
+		}
+	}
+
+	switch {
+	case dnsHasTerm(terms, "+all") || dnsHasTerm(terms, "all"):
+		return dnsStatus(check, DNSFail, "SPF record allows any sender")
+	case dnsHasTerm(terms, "-all") || dnsHasTerm(terms, "~all"):
+		return dnsStatus(check, DNSPass, "SPF record is valid")
+	}
+
+	return dnsStatus(check, DNSWarn, "SPF record does not end with -all or ~all")
+}
+
+// Check each published key of the domain
+func (this *DNSChecker) checkDKIM(ctx context.Context, domain string) (checks []DNSCheck) {
+	var (
+		keys []*DKIMKey
+		err  error
+	)
+
+	if this.dkim != nil {
+		if keys, err = this.dkim.List(domain); err != nil {
+			return []DNSCheck{dnsError(DNSCheck{Name: "dkim"}, err)}
+		}
+	}
+
+	if len(keys) == 0 {
+		return []DNSCheck{{Name: "dkim", Status: DNSWarn, Message: "No DKIM keys for the domain"}}
+	}
+
+	for _, key := range keys {
+		check := DNSCheck{Name: "dkim:" + key.Selector}
+
+		if check.Records, err = this.lookupTXT(ctx, key.Name(), ""); err != nil {
+			checks = append(checks, dnsError(check, err))
+			continue
+		}
+
+		switch {
+		case dnsHasKey(check.Records, key.Public):
+			check.Status, check.Message = DNSPass, "DKIM key is published"
+		case key.State == DKIMRetiring:
+			check.Status, check.Message = DNSWarn, "Retiring DKIM key is not published"
+		default:
+			check.Status, check.Message = DNSFail, "DKIM key is not published at "+key.Name()
+		}
+
+		checks = append(checks, check)
+	}
+
+	return
+}
+
+func (this *DNSChecker) checkDMARC(ctx context.Context, domain string) (check DNSCheck) {
+	var err error
+
+	check.Name = "dmarc"
+
+	if check.Records, err = this.lookupTXT(ctx, "_dmarc."+domain, "v=DMARC1"); err != nil {
+		return dnsError(check, err)
+	}
+
+	if len(check.Records) != 1 {
+		return dnsStatus(check, DNSFail, dnsCount(len(check.Records), "DMARC"))
+	}
+
+	switch dnsTag(check.Records[0], "p") {
+	case "reject", "quarantine":
+		return dnsStatus(check, DNSPass, "DMARC policy is enforced")
+	case "none":
+		return dnsStatus(check, DNSWarn, "DMARC policy is none, only monitoring")
+	}
+
+	return dnsStatus(check, DNSFail, "DMARC record has no valid policy")
+}
+
+func (this *DNSChecker) checkMTASTS(ctx context.Context, domain string) (check DNSCheck) {
+	var err error
+
+	check.Name = "mta-sts"
+
+	if check.Records, err = this.lookupTXT(ctx, "_mta-sts."+domain, "v=STSv1"); err != nil {
+		return dnsError(check, err)
+	}
+
+	switch {
+	case len(check.Records) == 0:
+		return dnsStatus(check, DNSWarn, "No MTA-STS record")
+	case len(check.Records) > 1:
+		return dnsStatus(check, DNSFail, dnsCount(len(check.Records), "MTA-STS"))
+	case dnsTag(check.Records[0], "id") == "":
+		return dnsStatus(check, DNSFail, "MTA-STS record has no id")
+	}
+
+	return dnsStatus(check, DNSPass, "MTA-STS record found")
+}
+
+// TXT records with the prefix, not found name gives no records
+func (this *DNSChecker) lookupTXT(ctx context.Context, name, prefix string) (records []string, err error) {
+	var all []string
+
+	if all, err = this.resolver.LookupTXT(ctx, name); err != nil {
+		if dnsNotFound(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	for _, txt := range all {
+		if prefix == "" || strings.HasPrefix(strings.ToLower(txt), strings.ToLower(prefix)) {
+			records = append(records, txt)
+		}
+	}
+
+	return
+}
+
+func dnsNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+
+	return false
+}
+
+func dnsError(check DNSCheck, err error) DNSCheck {
+	return dnsStatus(check, DNSFail, "Lookup failed: "+err.Error())
+}
+
+func dnsStatus(check DNSCheck, status, msg string) DNSCheck {
+	check.Status, check.Message = status, msg
+
+	return check
+}
+
+func dnsCount(n int, kind string) string {
+	if n == 0 {
+		return "No " + kind + " record"
+	}
+
+	return "Multiple " + kind + " records"
+}
+
+func dnsHasTerm(terms []string, term string) bool {
+	for _, t := range terms {
+		if t == term {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value of the `tag=value` list
+func dnsTag(record, tag string) string {
+	for _, part := range strings.Split(record, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], tag) {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+
+	return ""
+}
+
+// Any record has the public key, whitespace is ignored
+func dnsHasKey(records []string, public string) bool {
+	for _, txt := range records {
+		if strings.Join(strings.Fields(dnsTag(txt, "p")), "") == public {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Domain records report: GET /dns/{domain}
+func handleDNS(checker *DNSChecker) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "domains:read") {
+			return
+		}
+
+		domain := strings.ToLower(ctx.Param("domain"))
+		if !domainPattern.MatchString(domain) {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		// Tenant checks own domains only
+		if ctx.Tenant() != 0 {
+			if _, err := getDomain(ctx.db, ctx.Tenant(), domain); err == sql.ErrNoRows {
+				writeError(w, http.StatusNotFound, "")
+				return
+			} else if err != nil {
+				ctx.log.Error("Can't get domain", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+		}
+
+		report := checker.Check(domain)
+
+		ctx.log.Debug("DNS checked", "domain", report.Domain, "status", report.Status)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net"
+	"testing"
+)
+
+// Resolver with the static records
+type ResolverMock struct {
+	mx  map[string][]*net.MX
+	txt map[string][]string
+}
+
+func (this *ResolverMock) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := this.mx[name]; ok {
+		return records, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (this *ResolverMock) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := this.txt[name]; ok {
+		return records, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func Test_DNSChecker(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		cfg      = &Config{DNS: &DNS{MX: []string{"mx.example.net"}, SPF: []string{"include:_spf.example.net"}}}
+		checker  = NewDNSChecker(cfg, &DKIMStore{conn: db})
+		resolver = &ResolverMock{
+			mx: map[string][]*net.MX{
+				"good.com": {{Host: "MX.example.net.", Pref: 10}},
+				"bad.com":  {{Host: "mx.other.net.", Pref: 10}, {Host: "mx.example.net.", Pref: 20}},
+			},
+			txt: map[string][]string{
+				"good.com":                    {"google-site-verification=x", "v=spf1 mx include:_spf.example.net -all"},
+				"s1._domainkey.good.com":      {"v=DKIM1; k=ed25519; p=key1"},
+				"_dmarc.good.com":             {"v=DMARC1; p=reject; rua=mailto:dmarc@good.com"},
+				"_mta-sts.good.com":           {"v=STSv1; id=20170701"},
+				"bad.com":                     {"v=spf1 include:_spf.other.net -all"},
+				"_dmarc.bad.com":              {"v=DMARC1; p=none"},
+				"s1._domainkey.bad.com":       {"v=DKIM1; k=rsa; p=other"},
+				"_mta-sts.bad.com":            {"v=STSv1;"},
+				"retiring._domainkey.bad.com": {},
+			},
+		}
+		columns = []string{"id", "domain", "selector", "algorithm", "public", "state", "created"}
+	)
+
+	defer db.Close()
+
+	checker.resolver = resolver
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_dkim`").WithArgs("good.com", "good.com", DKIMRetired).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "good.com", "s1", DKIMEd25519, "key1", DKIMActive, 0))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_dkim`").WithArgs("bad.com", "bad.com", DKIMRetired).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, "bad.com", "s1", DKIMRSA, "key2", DKIMActive, 0).
+			AddRow(3, "bad.com", "retiring", DKIMRSA, "key3", DKIMRetiring, 0))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_dkim`").WithArgs("missing.com", "missing.com", DKIMRetired).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	tests := []struct {
+		domain   string
+		status   string
+		statuses map[string]string
+	}{
+		{"Good.com.", DNSPass, map[string]string{
+			"mx": DNSPass, "spf": DNSPass, "dkim:s1": DNSPass, "dmarc": DNSPass, "mta-sts": DNSPass,
+		}},
+		{"bad.com", DNSFail, map[string]string{
+			"mx": DNSWarn, "spf": DNSFail, "dkim:s1": DNSFail, "dkim:retiring": DNSWarn, "dmarc": DNSWarn, "mta-sts": DNSFail,
+		}},
+		{"missing.com", DNSFail, map[string]string{
+			"mx": DNSFail, "spf": DNSFail, "dkim": DNSWarn, "dmarc": DNSFail, "mta-sts": DNSWarn,
+		}},
+	}
+
+	for _, test := range tests {
+		report := checker.Check(test.domain)
+
+		if report.Status != test.status {
+			t.Errorf("%s: expected status %s, but got %s", test.domain, test.status, report.Status)
+		}
+
+		if len(report.Checks) != len(test.statuses) {
+			t.Errorf("%s: expected %d checks, but got %v", test.domain, len(test.statuses), report.Checks)
+		}
+
+		for _, check := range report.Checks {
+			if check.Status != test.statuses[check.Name] {
+				t.Errorf("%s: expected %s %s, but got %s: %s", test.domain, check.Name, test.statuses[check.Name], check.Status, check.Message)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
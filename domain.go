@@ -0,0 +1,1009 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	domainPattern  = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+	addressPattern = regexp.MustCompile(`^[a-z0-9!#$%&'*+/=?^_{|}~.-]+@[^@]+$`)
+)
+
+const (
+	domainColumns  = "`id`, `name`, `description`, `active`, `created`, `tenant_id`"
+	mailboxColumns = "`id`, `address`, `domain`, `name`, `password`, `quota`, `active`, `created`"
+	aliasColumns   = "`id`, `address`, `domain`, `goto`, `active`, `created`"
+)
+
+// Mail domain owned by the tenant, zero tenant is global
+type Domain struct {
+	Id          int64  `json:"id,omitempty" yaml:"-"`
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Active      bool   `json:"active" yaml:"active"`
+	Created     int64  `json:"created,omitempty" yaml:"-"`
+	TenantId    int64  `json:"tenant_id,omitempty" yaml:"tenant_id,omitempty"`
+}
+
+// Mailbox account. Password is the plain text given on create,
+// only the hash is stored and returned
+type Mailbox struct {
+	Id           int64  `json:"id,omitempty" yaml:"-"`
+	Address      string `json:"address" yaml:"address"`
+	Domain       string `json:"domain" yaml:"domain"`
+	Name         string `json:"name,omitempty" yaml:"name,omitempty"`
+	Password     string `json:"password,omitempty" yaml:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty" yaml:"password_hash,omitempty"`
+	// Bytes, zero is unlimited
+	Quota   int64 `json:"quota" yaml:"quota"`
+	Active  bool  `json:"active" yaml:"active"`
+	Created int64 `json:"created,omitempty" yaml:"-"`
+}
+
+// Forwarding of the address to the destinations
+type Alias struct {
+	Id      int64    `json:"id,omitempty" yaml:"-"`
+	Address string   `json:"address" yaml:"address"`
+	Domain  string   `json:"domain" yaml:"domain"`
+	Goto    []string `json:"goto" yaml:"goto"`
+	Active  bool     `json:"active" yaml:"active"`
+	Created int64    `json:"created,omitempty" yaml:"-"`
+}
+
+// Common part of sql.DB and sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Address domain part
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+
+	return ""
+}
+
+func validAddress(address string) bool {
+	return addressPattern.MatchString(address) && domainPattern.MatchString(addressDomain(address))
+}
+
+// Tenant of the existing domain
+func domainTenant(q querier, name string) (tenant int64, err error) {
+	if err = q.QueryRow("SELECT `tenant_id` FROM `msm_domain` WHERE `name` = ?", name).Scan(&tenant); err == sql.ErrNoRows {
+		return 0, constraintError("Unknown domain %s", name)
+	}
+
+	return
+}
+
+func (this *Domain) Validate() error {
+	this.Name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(this.Name)), ".")
+
+	if !domainPattern.MatchString(this.Name) {
+		return errors.New("Invalid domain name")
+	}
+
+	return nil
+}
+
+func (this *Domain) Insert(q querier) (err error) {
+	var result sql.Result
+
+	if err = checkTenantLimits(q, this.TenantId, 0, TenantUsage{Domains: 1}); err != nil {
+		return
+	}
+
+	this.Created = time.Now().Unix()
+
+	result, err = q.Exec("INSERT INTO `msm_domain`(`name`, `description`, `active`, `created`, `tenant_id`) VALUES(?, ?, ?, ?, ?)",
+		this.Name, this.Description, this.Active, this.Created, this.TenantId)
+	if err != nil {
+		return
+	}
+
+	if this.Id, err = result.LastInsertId(); err != nil {
+		return
+	}
+
+	return emitEvent(q, EventDomainCreated, this.TenantId, this)
+}
+
+// Update description, active flag and tenant. Moved domain takes
+// its mailboxes and aliases to the limits of the new tenant
+func (this *Domain) Update(q querier) (err error) {
+	var (
+		from   int64
+		active bool
+		usage  = TenantUsage{Domains: 1}
+	)
+
+	err = q.QueryRow("SELECT `tenant_id`, `active` FROM `msm_domain` WHERE `name` = ?", this.Name).Scan(&from, &active)
+	if err == sql.ErrNoRows {
+		return constraintError("Unknown domain %s", this.Name)
+	} else if err != nil {
+		return
+	}
+
+	if from != this.TenantId {
+		err = q.QueryRow("SELECT COUNT(*), COALESCE(SUM(`quota`), 0) FROM `msm_mailbox` WHERE `domain` = ?", this.Name).
+			Scan(&usage.Mailboxes, &usage.Quota)
+		if err == nil {
+			err = q.QueryRow("SELECT COUNT(*) FROM `msm_alias` WHERE `domain` = ?", this.Name).Scan(&usage.Aliases)
+		}
+
+		if err == nil {
+			err = checkTenantLimits(q, this.TenantId, from, usage)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = q.Exec("UPDATE `msm_domain` SET `description` = ?, `active` = ?, `tenant_id` = ? WHERE `name` = ?",
+		this.Description, this.Active, this.TenantId, this.Name)
+	if err != nil || active == this.Active {
+		return
+	}
+
+	return emitEvent(q, activeEvent(this.Active, EventDomainActivated, EventDomainSuspended), this.TenantId, this)
+}
+
+// Delete the empty domain, its DKIM keys are retired
+func (this *Domain) Delete(q querier) (err error) {
+	var n int64
+
+	if this.TenantId, err = domainTenant(q, this.Name); err != nil {
+		return
+	}
+
+	err = q.QueryRow("SELECT (SELECT COUNT(*) FROM `msm_mailbox` WHERE `domain` = ?) + (SELECT COUNT(*) FROM `msm_alias` WHERE `domain` = ?)",
+		this.Name, this.Name).Scan(&n)
+	if err != nil {
+		return
+	}
+
+	if n > 0 {
+		return constraintError("Domain %s has mailboxes or aliases", this.Name)
+	}
+
+	if _, err = q.Exec("UPDATE `msm_dkim` SET `state` = ? WHERE `domain` = ? AND `state` <> ?", DKIMRetired, this.Name, DKIMRetired); err != nil {
+		return
+	}
+
+	if _, err = q.Exec("DELETE FROM `msm_domain` WHERE `name` = ?", this.Name); err != nil {
+		return
+	}
+
+	return emitEvent(q, EventDomainDeleted, this.TenantId, this)
+}
+
+func (this *Mailbox) Validate() error {
+	this.Address = strings.ToLower(strings.TrimSpace(this.Address))
+	this.Domain = addressDomain(this.Address)
+
+	switch {
+	case !validAddress(this.Address):
+		return errors.New("Invalid mailbox address")
+	case this.Quota < 0:
+		return errors.New("Quota must not be negative")
+	case this.Password == "" && this.PasswordHash == "":
+		return errors.New("Password or password hash required")
+	}
+
+	return nil
+}
+
+// Hash the plain password
+func (this *Mailbox) hashPassword() (err error) {
+	var hash []byte
+
+	if this.Password == "" {
+		return
+	}
+
+	if hash, err = bcrypt.GenerateFromPassword([]byte(this.Password), bcrypt.DefaultCost); err != nil {
+		return
+	}
+
+	this.Password, this.PasswordHash = "", string(hash)
+
+	return
+}
+
+// Hash is accepted by the mailbox login
+func bcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// Insert mailbox, the plain password is hashed
+func (this *Mailbox) Insert(q querier) (err error) {
+	var (
+		result sql.Result
+		tenant int64
+	)
+
+	if tenant, err = domainTenant(q, this.Domain); err != nil {
+		return
+	}
+
+	if err = checkTenantLimits(q, tenant, 0, TenantUsage{Mailboxes: 1, Quota: this.Quota}); err != nil {
+		return
+	}
+
+	if this.Quota == 0 {
+		if err = checkTenantQuota(q, tenant); err != nil {
+			return
+		}
+	}
+
+	if err = this.hashPassword(); err != nil {
+		return
+	}
+
+	this.Created = time.Now().Unix()
+
+	result, err = q.Exec("INSERT INTO `msm_mailbox`(`address`, `domain`, `name`, `password`, `quota`, `active`, `created`, `updated`) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		this.Address, this.Domain, this.Name, this.PasswordHash, this.Quota, this.Active, this.Created, this.Created)
+	if err != nil {
+		return
+	}
+
+	if this.Id, err = result.LastInsertId(); err != nil {
+		return
+	}
+
+	return emitEvent(q, EventMailboxCreated, tenant, this.event())
+}
+
+// Update name, quota, active flag and the password if given.
+// Raised quota is checked against the tenant limits
+func (this *Mailbox) Update(q querier) (err error) {
+	var (
+		tenant, quota int64
+		active        bool
+	)
+
+	err = q.QueryRow("SELECT `quota`, `active` FROM `msm_mailbox` WHERE `address` = ?", this.Address).Scan(&quota, &active)
+	if err != nil {
+		return
+	}
+
+	if tenant, err = domainTenant(q, this.Domain); err != nil {
+		return
+	}
+
+	switch {
+	case this.Quota == 0 && quota != 0:
+		err = checkTenantQuota(q, tenant)
+	case this.Quota > quota:
+		err = checkTenantLimits(q, tenant, 0, TenantUsage{Quota: this.Quota - quota})
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = this.hashPassword(); err != nil {
+		return
+	}
+
+	_, err = q.Exec("UPDATE `msm_mailbox` SET `name` = ?, `password` = ?, `quota` = ?, `active` = ?, `updated` = ? WHERE `address` = ?",
+		this.Name, this.PasswordHash, this.Quota, this.Active, time.Now().Unix(), this.Address)
+	if err != nil || active == this.Active {
+		return
+	}
+
+	return emitEvent(q, activeEvent(this.Active, EventMailboxActivated, EventMailboxSuspended), tenant, this.event())
+}
+
+// Delete mailbox with its pending password resets
+func (this *Mailbox) Delete(q querier) (err error) {
+	var tenant int64
+
+	if tenant, err = domainTenant(q, this.Domain); err != nil {
+		return
+	}
+
+	if _, err = q.Exec("DELETE FROM `msm_reset` WHERE `mailbox_id` = ?", this.Id); err != nil {
+		return
+	}
+
+	if _, err = q.Exec("DELETE FROM `msm_mailbox` WHERE `address` = ?", this.Address); err != nil {
+		return
+	}
+
+	return emitEvent(q, EventMailboxDeleted, tenant, this.event())
+}
+
+// Event data without the password
+func (this *Mailbox) event() *Mailbox {
+	var item = *this
+
+	item.Password, item.PasswordHash = "", ""
+
+	return &item
+}
+
+// Activated or suspended event of the active flag
+func activeEvent(active bool, activated, suspended string) string {
+	if active {
+		return activated
+	}
+
+	return suspended
+}
+
+func (this *Alias) Validate() error {
+	this.Address = strings.ToLower(strings.TrimSpace(this.Address))
+	this.Domain = addressDomain(this.Address)
+
+	// Catch-all alias is @domain
+	if !validAddress(this.Address) && !(strings.HasPrefix(this.Address, "@") && domainPattern.MatchString(this.Domain)) {
+		return errors.New("Invalid alias address")
+	}
+
+	if len(this.Goto) == 0 {
+		return errors.New("Alias destination required")
+	}
+
+	for i, dest := range this.Goto {
+		if this.Goto[i] = strings.ToLower(strings.TrimSpace(dest)); !validAddress(this.Goto[i]) {
+			return errors.New("Invalid alias destination " + dest)
+		}
+	}
+
+	return nil
+}
+
+func (this *Alias) Insert(q querier) (err error) {
+	var (
+		result sql.Result
+		tenant int64
+	)
+
+	if tenant, err = domainTenant(q, this.Domain); err != nil {
+		return
+	}
+
+	if err = checkTenantLimits(q, tenant, 0, TenantUsage{Aliases: 1}); err != nil {
+		return
+	}
+
+	this.Created = time.Now().Unix()
+
+	result, err = q.Exec("INSERT INTO `msm_alias`(`address`, `domain`, `goto`, `active`, `created`) VALUES(?, ?, ?, ?, ?)",
+		this.Address, this.Domain, strings.Join(this.Goto, ","), this.Active, this.Created)
+	if err != nil {
+		return
+	}
+
+	this.Id, err = result.LastInsertId()
+
+	return
+}
+
+// Update destinations and active flag
+func (this *Alias) Update(q querier) (err error) {
+	_, err = q.Exec("UPDATE `msm_alias` SET `goto` = ?, `active` = ? WHERE `address` = ?",
+		strings.Join(this.Goto, ","), this.Active, this.Address)
+
+	return
+}
+
+// Domains are active unless set otherwise
+func (this *Domain) UnmarshalJSON(data []byte) error {
+	type plain Domain
+
+	*this = Domain{Active: true}
+
+	return json.Unmarshal(data, (*plain)(this))
+}
+
+func (this *Domain) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Domain
+
+	*this = Domain{Active: true}
+
+	return unmarshal((*plain)(this))
+}
+
+func (this *Mailbox) UnmarshalJSON(data []byte) error {
+	type plain Mailbox
+
+	*this = Mailbox{Active: true}
+
+	return json.Unmarshal(data, (*plain)(this))
+}
+
+func (this *Mailbox) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Mailbox
+
+	*this = Mailbox{Active: true}
+
+	return unmarshal((*plain)(this))
+}
+
+func (this *Alias) UnmarshalJSON(data []byte) error {
+	type plain Alias
+
+	*this = Alias{Active: true}
+
+	return json.Unmarshal(data, (*plain)(this))
+}
+
+func (this *Alias) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Alias
+
+	*this = Alias{Active: true}
+
+	return unmarshal((*plain)(this))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDomain(row rowScanner) (item *Domain, err error) {
+	item = &Domain{}
+
+	if err = row.Scan(&item.Id, &item.Name, &item.Description, &item.Active, &item.Created, &item.TenantId); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func scanMailbox(row rowScanner) (item *Mailbox, err error) {
+	var name sql.NullString
+
+	item = &Mailbox{}
+
+	if err = row.Scan(&item.Id, &item.Address, &item.Domain, &name, &item.PasswordHash, &item.Quota, &item.Active, &item.Created); err != nil {
+		return nil, err
+	}
+
+	item.Name = name.String
+
+	return
+}
+
+func scanAlias(row rowScanner) (item *Alias, err error) {
+	var dest string
+
+	item = &Alias{}
+
+	if err = row.Scan(&item.Id, &item.Address, &item.Domain, &dest, &item.Active, &item.Created); err != nil {
+		return nil, err
+	}
+
+	item.Goto = strings.Split(dest, ",")
+
+	return
+}
+
+// Domain in the tenant scope
+func getDomain(q querier, scope int64, name string) (*Domain, error) {
+	var cond, args = tenantScope(scope, "`tenant_id`")
+
+	return scanDomain(q.QueryRow("SELECT "+domainColumns+" FROM `msm_domain` WHERE `name` = ? AND "+cond,
+		append([]interface{}{name}, args...)...))
+}
+
+func getMailbox(q querier, address string) (*Mailbox, error) {
+	return scanMailbox(q.QueryRow("SELECT "+mailboxColumns+" FROM `msm_mailbox` WHERE `address` = ?", address))
+}
+
+func getAlias(q querier, address string) (*Alias, error) {
+	return scanAlias(q.QueryRow("SELECT "+aliasColumns+" FROM `msm_alias` WHERE `address` = ?", address))
+}
+
+// List fields, named as in JSON
+var (
+	domainList = &ListSpec{
+		Columns: domainColumns,
+		Table:   "`msm_domain`",
+		Fields: map[string]ListField{
+			"id":          {"id", FieldInt, true},
+			"name":        {"name", FieldString, true},
+			"description": {"description", FieldString, false},
+			"active":      {"active", FieldBool, true},
+			"created":     {"created", FieldInt, true},
+			"tenant_id":   {"tenant_id", FieldInt, true},
+		},
+		Key:     "id",
+		Default: "name",
+	}
+	mailboxList = &ListSpec{
+		Columns: mailboxColumns,
+		Table:   "`msm_mailbox`",
+		Fields: map[string]ListField{
+			"id":      {"id", FieldInt, true},
+			"address": {"address", FieldString, true},
+			"domain":  {"domain", FieldString, true},
+			"name":    {"name", FieldString, false},
+			"quota":   {"quota", FieldInt, true},
+			"active":  {"active", FieldBool, true},
+			"created": {"created", FieldInt, true},
+		},
+		Key:     "id",
+		Default: "address",
+	}
+	aliasList = &ListSpec{
+		Columns: aliasColumns,
+		Table:   "`msm_alias`",
+		Fields: map[string]ListField{
+			"id":      {"id", FieldInt, true},
+			"address": {"address", FieldString, true},
+			"domain":  {"domain", FieldString, true},
+			"goto":    {"goto", FieldString, false},
+			"active":  {"active", FieldBool, true},
+			"created": {"created", FieldInt, true},
+		},
+		Key:     "id",
+		Default: "address",
+	}
+)
+
+func scanDomainItem(row rowScanner) (interface{}, error) {
+	return scanDomain(row)
+}
+
+// Password hash is not listed
+func scanMailboxItem(row rowScanner) (interface{}, error) {
+	item, err := scanMailbox(row)
+	if err != nil {
+		return nil, err
+	}
+
+	item.PasswordHash = ""
+
+	return item, nil
+}
+
+func scanAliasItem(row rowScanner) (interface{}, error) {
+	return scanAlias(row)
+}
+
+// Condition on the domain column to match the domains of the tenant scope
+func domainScope(scope int64) (string, []interface{}) {
+	if scope == 0 {
+		return "1 = 1", nil
+	}
+
+	cond, args := tenantScope(scope, "`tenant_id`")
+
+	return "`domain` IN (SELECT `name` FROM `msm_domain` WHERE " + cond + ")", args
+}
+
+// Domains with their mailboxes and aliases. Domains out of the
+// principal tenant scope are not found. List and create: GET, POST /domains
+func handleDomains(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if requireResource(w, ctx, "domains") {
+			serveDomains(w, ctx, db)
+		}
+	}
+}
+
+// GET, PUT, DELETE /domains/{domain}
+func handleDomain(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !requireResource(w, ctx, "domains") {
+			return
+		}
+
+		if domain, ok := pathDomain(w, ctx, db); ok {
+			serveDomain(w, ctx, db, domain)
+		}
+	}
+}
+
+// GET, POST /domains/{domain}/mailboxes
+func handleMailboxes(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !requireResource(w, ctx, "mailboxes") {
+			return
+		}
+
+		if domain, ok := pathDomain(w, ctx, db); ok {
+			serveMailboxes(w, ctx, db, domain)
+		}
+	}
+}
+
+// GET, PUT, DELETE /domains/{domain}/mailboxes/{local}
+func handleMailbox(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !requireResource(w, ctx, "mailboxes") {
+			return
+		}
+
+		if domain, ok := pathDomain(w, ctx, db); ok {
+			serveMailbox(w, ctx, db, strings.ToLower(ctx.Param("local"))+"@"+domain.Name)
+		}
+	}
+}
+
+// GET, POST /domains/{domain}/aliases
+func handleAliases(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !requireResource(w, ctx, "aliases") {
+			return
+		}
+
+		if domain, ok := pathDomain(w, ctx, db); ok {
+			serveAliases(w, ctx, db, domain)
+		}
+	}
+}
+
+// GET, PUT /domains/{domain}/aliases/{local}
+func handleAlias(db *sql.DB) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !requireResource(w, ctx, "aliases") {
+			return
+		}
+
+		if domain, ok := pathDomain(w, ctx, db); ok {
+			serveAlias(w, ctx, db, strings.ToLower(ctx.Param("local"))+"@"+domain.Name)
+		}
+	}
+}
+
+// Read scope of the resource for the safe method, write otherwise
+func requireResource(w http.ResponseWriter, ctx *Context, resource string) bool {
+	var action = "read"
+
+	if !safeMethod(ctx.r.Method) {
+		action = "write"
+	}
+
+	return ctx.Require(w, resource+":"+action)
+}
+
+// Domain of the path in the principal tenant scope
+func pathDomain(w http.ResponseWriter, ctx *Context, db *sql.DB) (*Domain, bool) {
+	domain, err := getDomain(db, ctx.Tenant(), strings.ToLower(ctx.Param("domain")))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "")
+		return nil, false
+	} else if err != nil {
+		ctx.log.Error("Can't get domain", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	return domain, true
+}
+
+func serveDomains(w http.ResponseWriter, ctx *Context, db *sql.DB) {
+	switch ctx.r.Method {
+	case "GET":
+		cond, args := tenantScope(ctx.Tenant(), "`tenant_id`")
+		serveList(w, ctx, db, domainList, scanDomainItem, cond, args...)
+
+	case "POST":
+		var item = &Domain{}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(item); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		if item.TenantId == 0 {
+			item.TenantId = ctx.Tenant()
+		}
+
+		if !validTenant(w, ctx, db, item.TenantId) {
+			return
+		}
+
+		if err := item.Validate(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Insert(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't create domain", err) {
+			ctx.log.Notice("Domain created", "domain", item.Name, "tenant_id", item.TenantId)
+			writeJSON(w, http.StatusCreated, item)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func serveDomain(w http.ResponseWriter, ctx *Context, db *sql.DB, item *Domain) {
+	switch ctx.r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, item)
+
+	// Given fields are changed, no defaults
+	case "PUT":
+		type plain Domain
+
+		var current = *item
+
+		if err := json.NewDecoder(ctx.r.Body).Decode((*plain)(item)); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		item.Id, item.Name, item.Created = current.Id, current.Name, current.Created
+
+		if !validTenant(w, ctx, db, item.TenantId) {
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Update(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't update domain", err) {
+			ctx.log.Notice("Domain updated", "domain", item.Name, "tenant_id", item.TenantId)
+			writeJSON(w, http.StatusOK, item)
+		}
+
+	case "DELETE":
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Delete(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't delete domain", err) {
+			ctx.log.Notice("Domain deleted", "domain", item.Name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func serveMailboxes(w http.ResponseWriter, ctx *Context, db *sql.DB, domain *Domain) {
+	switch ctx.r.Method {
+	case "GET":
+		serveList(w, ctx, db, mailboxList, scanMailboxItem, "`domain` = ?", domain.Name)
+
+	case "POST":
+		var item = &Mailbox{}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(item); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		// Local part is enough
+		if !strings.Contains(item.Address, "@") {
+			item.Address += "@" + domain.Name
+		}
+
+		if err := item.Validate(); err != nil || item.Domain != domain.Name {
+			writeError(w, http.StatusUnprocessableEntity, validationMessage(err, "Address must be in domain "+domain.Name))
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Insert(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't create mailbox", err) {
+			ctx.log.Notice("Mailbox created", "address", item.Address)
+
+			item.PasswordHash = ""
+			writeJSON(w, http.StatusCreated, item)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func serveMailbox(w http.ResponseWriter, ctx *Context, db *sql.DB, address string) {
+	item, err := getMailbox(db, address)
+	if writeStoreError(w, ctx, "Can't get mailbox", err) {
+		return
+	}
+
+	switch ctx.r.Method {
+	case "GET":
+		item.PasswordHash = ""
+		writeJSON(w, http.StatusOK, item)
+
+	// Given fields are changed, no defaults
+	case "PUT":
+		type plain Mailbox
+
+		var current = *item
+
+		if err := json.NewDecoder(ctx.r.Body).Decode((*plain)(item)); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		item.Id, item.Address, item.PasswordHash, item.Created = current.Id, address, current.PasswordHash, current.Created
+
+		if err := item.Validate(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Update(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't update mailbox", err) {
+			ctx.log.Notice("Mailbox updated", "address", item.Address)
+
+			item.PasswordHash = ""
+			writeJSON(w, http.StatusOK, item)
+		}
+
+	case "DELETE":
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Delete(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't delete mailbox", err) {
+			ctx.log.Notice("Mailbox deleted", "address", item.Address)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func serveAliases(w http.ResponseWriter, ctx *Context, db *sql.DB, domain *Domain) {
+	switch ctx.r.Method {
+	case "GET":
+		serveList(w, ctx, db, aliasList, scanAliasItem, "`domain` = ?", domain.Name)
+
+	case "POST":
+		var item = &Alias{}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(item); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		// Local part is enough, empty is catch-all
+		if !strings.Contains(item.Address, "@") {
+			item.Address += "@" + domain.Name
+		}
+
+		if err := item.Validate(); err != nil || item.Domain != domain.Name {
+			writeError(w, http.StatusUnprocessableEntity, validationMessage(err, "Address must be in domain "+domain.Name))
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Insert(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't create alias", err) {
+			ctx.log.Notice("Alias created", "address", item.Address)
+			writeJSON(w, http.StatusCreated, item)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func serveAlias(w http.ResponseWriter, ctx *Context, db *sql.DB, address string) {
+	item, err := getAlias(db, address)
+	if writeStoreError(w, ctx, "Can't get alias", err) {
+		return
+	}
+
+	switch ctx.r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, item)
+
+	// Given fields are changed, no defaults
+	case "PUT":
+		type plain Alias
+
+		var current = *item
+
+		if err := json.NewDecoder(ctx.r.Body).Decode((*plain)(item)); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		item.Id, item.Address, item.Created = current.Id, address, current.Created
+
+		if err := item.Validate(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			return item.Update(tx)
+		})
+
+		if !writeStoreError(w, ctx, "Can't update alias", err) {
+			ctx.log.Notice("Alias updated", "address", item.Address)
+			writeJSON(w, http.StatusOK, item)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// Mailboxes or aliases of all domains in the tenant scope:
+// GET /mailboxes, GET /aliases
+func handleAddresses(db *sql.DB, resource string) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var cond, args = domainScope(ctx.Tenant())
+
+		if !ctx.Require(w, resource+":read") {
+			return
+		}
+
+		if resource == "mailboxes" {
+			serveList(w, ctx, db, mailboxList, scanMailboxItem, cond, args...)
+		} else {
+			serveList(w, ctx, db, aliasList, scanAliasItem, cond, args...)
+		}
+	}
+}
+
+// Write the page of the list query
+func serveList(w http.ResponseWriter, ctx *Context, q querier, spec *ListSpec, scan func(row rowScanner) (interface{}, error), base string, args ...interface{}) {
+	query, ok := ctx.ListQuery(w, spec)
+	if !ok {
+		return
+	}
+
+	page, err := query.Run(q, scan, base, args...)
+	if err != nil {
+		ctx.log.Error("Can't list items", "path", ctx.r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Assigned tenant must be in the principal scope
+func validTenant(w http.ResponseWriter, ctx *Context, q querier, tenant int64) bool {
+	ok, err := tenantVisible(q, ctx.Tenant(), tenant)
+	if err != nil {
+		ctx.log.Error("Can't check tenant", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return false
+	}
+
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "Unknown tenant")
+	}
+
+	return ok
+}
+
+// Validation error message or the fallback
+func validationMessage(err error, fallback string) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return fallback
+}
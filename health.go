@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthOk   = "ok"
+	HealthFail = "fail"
+)
+
+// Probe response
+type HealthReport struct {
+	Status    string                  `json:"status"`
+	Name      string                  `json:"name"`
+	Version   string                  `json:"version"`
+	BuildDate string                  `json:"build_date"`
+	Checks    map[string]*HealthCheck `json:"checks,omitempty"`
+}
+
+// Single readiness check result
+type HealthCheck struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func NewHealthReport() *HealthReport {
+	return &HealthReport{
+		Status:    HealthOk,
+		Name:      NAME,
+		Version:   VERSION,
+		BuildDate: BUILDDATE,
+	}
+}
+
+// Add check result, report fails if any check fails
+func (this *HealthReport) Check(name string, details interface{}, err error) {
+	var check = &HealthCheck{
+		Status:  HealthOk,
+		Details: details,
+	}
+
+	if err != nil {
+		check.Status = HealthFail
+		check.Error = err.Error()
+		this.Status = HealthFail
+	}
+
+	if this.Checks == nil {
+		this.Checks = make(map[string]*HealthCheck)
+	}
+
+	this.Checks[name] = check
+}
+
+func (this *HealthReport) Write(w http.ResponseWriter) {
+	var code = http.StatusOK
+
+	if this.Status != HealthOk {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(this)
+}
+
+// Liveness probe: process serves requests
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	NewHealthReport().Write(w)
+}
+
+// Readiness probe: database answers, schema is current
+// and session garbage collector ran recently
+func handleReady(db *sql.DB, sessions *Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			report = NewHealthReport()
+			start  = time.Now()
+		)
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		err := db.PingContext(ctx)
+		report.Check("database", map[string]string{
+			"latency": time.Since(start).String(),
+		}, err)
+
+		report.Check(checkSchema(db))
+		report.Check(checkSessionGC(sessions))
+
+		report.Write(w)
+	}
+}
+
+func checkSchema(db *sql.DB) (name string, details interface{}, err error) {
+	var version int
+
+	name = "schema"
+
+	if version, err = schemaVersion(db); err == nil && version != len(migrations) {
+		err = fmt.Errorf("Schema version %d, expected %d", version, len(migrations))
+	}
+
+	details = map[string]int{
+		"version":  version,
+		"expected": len(migrations),
+	}
+
+	return
+}
+
+func checkSessionGC(sessions *Provider) (name string, details interface{}, err error) {
+	var last = sessions.LastGC()
+
+	name = "session_gc"
+
+	if last.IsZero() {
+		return name, nil, fmt.Errorf("Session garbage collector did not run")
+	}
+
+	details = map[string]string{
+		"last_run": last.Format(time.RFC3339),
+	}
+
+	// Allow one missed run
+	if time.Since(last) > 2*sessions.gcInterval {
+		err = fmt.Errorf("Session garbage collector did not run since %s", last.Format(time.RFC3339))
+	}
+
+	return
+}
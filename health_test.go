@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_HealthReportNoSession(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+
+	handleHealth(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("Unexpected cookie %s", c)
+	}
+}
+
+func Test_ReadyReport(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		tests    = []struct {
+			version int
+			gcTime  time.Time
+			code    int
+		}{
+			{len(migrations), time.Now(), http.StatusOK},
+			{len(migrations) - 1, time.Now(), http.StatusServiceUnavailable},
+			{len(migrations), time.Time{}, http.StatusServiceUnavailable},
+			{len(migrations), time.Now().Add(-3 * prov.gcInterval), http.StatusServiceUnavailable},
+		}
+	)
+
+	defer db.Close()
+
+	for i, test := range tests {
+		var report HealthReport
+
+		mock.ExpectQuery("SELECT COALESCE").
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(test.version))
+
+		prov.gcTime = test.gcTime
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/readyz", nil)
+		handleReady(db, prov)(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("Test %d: expected status %d, but got %d: %s", i, test.code, w.Code, w.Body.String())
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		if len(report.Checks) != 3 || report.Checks["database"].Status != HealthOk {
+			t.Errorf("Test %d: unexpected checks %v", i, report.Checks)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
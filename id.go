@@ -1,6 +1,7 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"math/rand"
 	"time"
 )
@@ -31,3 +32,24 @@ func RandStringId(n int) string {
 
 	return string(b)
 }
+
+// Random string from the crypto source for secrets
+func RandSecureId(n int) string {
+	var b = make([]byte, n)
+
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+
+	// Take 6 bits of each byte, read again values out of the alphabet
+	for i := 0; i < n; {
+		if idx := int(b[i] & letterIdxMask); idx < len(letterBytes) {
+			b[i] = letterBytes[idx]
+			i++
+		} else if _, err := crand.Read(b[i : i+1]); err != nil {
+			panic(err)
+		}
+	}
+
+	return string(b)
+}
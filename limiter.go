@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked    = errors.New("Too many failed attempts, temporary locked")
+	ErrThrottled = errors.New("Too many failed attempts, try later")
+)
+
+// Failed attempts of the key in the sliding window
+type attempts struct {
+	fails []time.Time
+	// Next attempt is allowed after
+	next time.Time
+	// Locked until
+	until time.Time
+}
+
+// Locked key info
+type LockInfo struct {
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// Failed authentication throttling by keys like `staff:<login>`,
+// `mailbox:<address>` and `ip:<address>`. Each failure delays the
+// next attempt twice longer, the key is locked after the limit of
+// failures in the window. Locks are stored to the DB if connection
+// is given
+type Limiter struct {
+	// Sliding window
+	window time.Duration
+	// Failures in the window before lock for account and ip keys
+	limit   int
+	ipLimit int
+	// Lock duration
+	lockTime time.Duration
+	// Progressive delay base and limit
+	delay    time.Duration
+	maxDelay time.Duration
+
+	conn *sql.DB
+	now  func() time.Time
+	// Called for each new lock
+	OnLock func(info LockInfo)
+
+	lock  sync.Mutex
+	state map[string]*attempts
+}
+
+func NewLimiter(cfg *Config, db *sql.DB) (limiter *Limiter) {
+	limiter = &Limiter{
+		window:   time.Duration(cfg.GetLockoutInterval()) * time.Second,
+		limit:    cfg.GetLockoutLimit(),
+		ipLimit:  cfg.GetLockoutIPLimit(),
+		lockTime: time.Duration(cfg.GetLockoutTime()) * time.Second,
+		delay:    time.Second,
+		maxDelay: 30 * time.Second,
+		now:      time.Now,
+		state:    make(map[string]*attempts),
+	}
+
+	if cfg.Lockout != nil && cfg.Lockout.Persist {
+		limiter.conn = db
+	}
+
+	return
+}
+
+// Check keys are not locked or throttled, returns time to wait
+func (this *Limiter) Check(keys ...string) (wait time.Duration, err error) {
+	var now = this.now()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, key := range keys {
+		a, ok := this.state[key]
+		if !ok {
+			continue
+		}
+
+		if a.until.After(now) {
+			return a.until.Sub(now), ErrLocked
+		}
+
+		if a.next.After(now) && a.next.Sub(now) > wait {
+			wait, err = a.next.Sub(now), ErrThrottled
+		}
+	}
+
+	return
+}
+
+// Register failure for the keys, returns delay before the next attempt
+func (this *Limiter) Fail(keys ...string) (delay time.Duration) {
+	var (
+		now    = this.now()
+		locked []LockInfo
+	)
+
+	this.lock.Lock()
+
+	for _, key := range keys {
+		a, ok := this.state[key]
+		if !ok {
+			a = &attempts{}
+			this.state[key] = a
+		}
+
+		a.fails = append(this.prune(a.fails, now), now)
+
+		d := this.delay << uint(len(a.fails)-1)
+		if d > this.maxDelay || d <= 0 {
+			d = this.maxDelay
+		}
+
+		a.next = now.Add(d)
+
+		if d > delay {
+			delay = d
+		}
+
+		if len(a.fails) >= this.limitFor(key) {
+			a.until = now.Add(this.lockTime)
+			this.store(key, a.until)
+
+			log.Warning("Key %s locked until %s after %d failures", key, a.until.Format(time.RFC3339), len(a.fails))
+			locked = append(locked, LockInfo{Key: key, Failures: len(a.fails), Until: a.until})
+		}
+	}
+
+	this.lock.Unlock()
+
+	if this.OnLock != nil {
+		for _, info := range locked {
+			this.OnLock(info)
+		}
+	}
+
+	return
+}
+
+// Forget failures of the keys after successful attempt
+func (this *Limiter) Success(keys ...string) {
+	this.lock.Lock()
+	for _, key := range keys {
+		if a, ok := this.state[key]; ok && !a.until.After(this.now()) {
+			delete(this.state, key)
+		}
+	}
+	this.lock.Unlock()
+}
+
+// Locked keys
+func (this *Limiter) Locks() (locks []LockInfo) {
+	var now = this.now()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	locks = make([]LockInfo, 0)
+
+	for key, a := range this.state {
+		if a.until.After(now) {
+			locks = append(locks, LockInfo{Key: key, Failures: len(a.fails), Until: a.until})
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+
+	return
+}
+
+// Remove key lock and failures, all keys if empty
+func (this *Limiter) Clear(key string) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if key == "" {
+		this.state = make(map[string]*attempts)
+	} else {
+		delete(this.state, key)
+	}
+
+	if this.conn == nil {
+		return
+	}
+
+	if key == "" {
+		_, err = this.conn.Exec("DELETE FROM `msm_lockout`")
+	} else {
+		_, err = this.conn.Exec("DELETE FROM `msm_lockout` WHERE `name` = ?", key)
+	}
+
+	return
+}
+
+// Restore active locks from the DB
+func (this *Limiter) Load() (err error) {
+	var rows *sql.Rows
+
+	if this.conn == nil {
+		return
+	}
+
+	rows, err = this.conn.Query("SELECT `name`, `until` FROM `msm_lockout` WHERE `until` > ?", this.now().Unix())
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for rows.Next() {
+		var (
+			key   string
+			until int64
+		)
+
+		if err = rows.Scan(&key, &until); err != nil {
+			return
+		}
+
+		this.state[key] = &attempts{until: time.Unix(until, 0)}
+	}
+
+	return rows.Err()
+}
+
+// Remove stale entries periodically
+func (this *Limiter) Watch() {
+	var now = this.now()
+
+	this.lock.Lock()
+	for key, a := range this.state {
+		if a.fails = this.prune(a.fails, now); len(a.fails) == 0 && !a.until.After(now) && !a.next.After(now) {
+			delete(this.state, key)
+		}
+	}
+	this.lock.Unlock()
+
+	if this.conn != nil {
+		if _, err := this.conn.Exec("DELETE FROM `msm_lockout` WHERE `until` <= ?", now.Unix()); err != nil {
+			log.Error("Can't clean lockouts: %s", err.Error())
+		}
+	}
+
+	time.AfterFunc(this.window, this.Watch)
+}
+
+func (this *Limiter) limitFor(key string) int {
+	if len(key) > 3 && key[:3] == "ip:" {
+		return this.ipLimit
+	}
+
+	return this.limit
+}
+
+// Drop failures out of the window
+func (this *Limiter) prune(fails []time.Time, now time.Time) []time.Time {
+	var point = now.Add(-1 * this.window)
+
+	for len(fails) > 0 && !fails[0].After(point) {
+		fails = fails[1:]
+	}
+
+	return fails
+}
+
+func (this *Limiter) store(key string, until time.Time) {
+	if this.conn == nil {
+		return
+	}
+
+	_, err := this.conn.Exec("REPLACE INTO `msm_lockout`(`name`, `until`) VALUES(?, ?)", key, until.Unix())
+	if err != nil {
+		log.Error("Can't store lockout %s: %s", key, err.Error())
+	}
+}
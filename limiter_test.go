@@ -0,0 +1,211 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Limiter with the manual clock
+func testLimiter() (limiter *Limiter, clock *time.Time) {
+	var now = time.Unix(1500000000, 0)
+
+	clock = &now
+	limiter = NewLimiter(&Config{Lockout: &Lockout{Interval: 60, Limit: 3, IPLimit: 5, LockTime: 300}}, nil)
+	limiter.now = func() time.Time { return *clock }
+
+	return
+}
+
+func Test_LimiterProgressiveDelay(t *testing.T) {
+	var limiter, clock = testLimiter()
+
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second} {
+		if delay := limiter.Fail("staff:admin"); delay != expected {
+			t.Errorf("Failure %d: expected delay %s, but got %s", i, expected, delay)
+		}
+
+		if wait, err := limiter.Check("staff:admin"); err != ErrThrottled || wait != expected {
+			t.Errorf("Failure %d: expected throttling %s, but got %s, %v", i, expected, wait, err)
+		}
+
+		*clock = clock.Add(expected)
+
+		if _, err := limiter.Check("staff:admin"); err != nil {
+			t.Errorf("Failure %d: unexpected error %v after delay", i, err)
+		}
+	}
+
+	// Failures out of the window are forgotten
+	*clock = clock.Add(time.Minute)
+
+	if delay := limiter.Fail("staff:admin"); delay != time.Second {
+		t.Errorf("Expected first failure delay, but got %s", delay)
+	}
+}
+
+func Test_LimiterLockout(t *testing.T) {
+	var limiter, clock = testLimiter()
+
+	for i := 0; i < 3; i++ {
+		limiter.Fail("staff:admin", "ip:10.0.0.1")
+	}
+
+	if wait, err := limiter.Check("staff:admin"); err != ErrLocked || wait != 300*time.Second {
+		t.Errorf("Expected lock for %s, but got %s, %v", 300*time.Second, wait, err)
+	}
+
+	// Ip limit is higher
+	if _, err := limiter.Check("ip:10.0.0.1"); err == ErrLocked {
+		t.Errorf("Unexpected ip lock")
+	}
+
+	// Success does not unlock
+	limiter.Success("staff:admin")
+
+	if locks := limiter.Locks(); len(locks) != 1 || locks[0].Key != "staff:admin" || locks[0].Failures != 3 {
+		t.Errorf("Unexpected locks %v", locks)
+	}
+
+	*clock = clock.Add(301 * time.Second)
+
+	if _, err := limiter.Check("staff:admin"); err != nil {
+		t.Errorf("Unexpected error %v after lock time", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		limiter.Fail("staff:admin")
+	}
+
+	limiter.Clear("staff:admin")
+
+	if _, err := limiter.Check("staff:admin"); err != nil || len(limiter.Locks()) != 0 {
+		t.Errorf("Unexpected error %v after clear", err)
+	}
+}
+
+func Test_LimiterPersistence(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		cfg      = &Config{Lockout: &Lockout{Limit: 1, Persist: true}}
+		limiter  = NewLimiter(cfg, db)
+		until    = time.Now().Add(time.Hour).Unix()
+	)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT `name`, `until` FROM `msm_lockout`").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "until"}).AddRow("staff:admin", until))
+	mock.ExpectExec("REPLACE INTO `msm_lockout`").WithArgs("mailbox:user@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM `msm_lockout` WHERE `name`").WithArgs("staff:admin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := limiter.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if _, err := limiter.Check("staff:admin"); err != ErrLocked {
+		t.Errorf("Expected restored lock, but got %v", err)
+	}
+
+	limiter.Fail("mailbox:user@example.com")
+	limiter.Clear("staff:admin")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_HandleLoginThrottling(t *testing.T) {
+	var (
+		db, mock       = InitDBMock(t)
+		prov, _        = NewManager(db, 0)
+		limiter, clock = testLimiter()
+		handler        = HandleInContext(handleLogin(prov, NewStaffStore(db), limiter, nil), prov, nil)
+		hash, _        = bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	)
+
+	defer db.Close()
+
+	login := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"login":"admin","password":"`+password+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = "10.0.0.1:40000"
+
+		handler(w, r)
+
+		return w
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_staff`").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password", "role", "tenant_id"}).AddRow(1, hash, RoleAdmin, 0))
+
+	if w := login("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if w := login("secret"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected throttled request, but got %d", w.Code)
+	}
+
+	*clock = clock.Add(time.Second)
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_staff`").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password", "role", "tenant_id"}).AddRow(1, hash, RoleAdmin, 0))
+	mock.ExpectExec("INSERT INTO `msm_session`").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := login("secret")
+	if w.Code != http.StatusOK || w.Header().Get(CSRFHeader) == "" || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("Expected login with session cookie and CSRF token, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, err := limiter.Check("staff:admin"); err != nil {
+		t.Errorf("Expected failures reset after login, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Reseller admin can't read or clear the server wide locks
+func Test_LockoutsTenantRefused(t *testing.T) {
+	var (
+		db, _      = InitDBMock(t)
+		prov, _    = NewManager(db, 0)
+		limiter, _ = testLimiter()
+		handler    = HandleInContext(handleLockouts(limiter), prov, nil)
+		session    = NewSession(RandSecureId(64))
+	)
+
+	defer db.Close()
+
+	limiter.Fail("staff:admin")
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 5, Name: "reseller", Role: RoleAdmin, Tenant: 3})
+	prov.append(session)
+
+	for _, method := range []string{"GET", "DELETE"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "/lockouts", nil)
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+		r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+
+		handler(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d of %s, but got %d", http.StatusForbidden, method, w.Code)
+		}
+	}
+
+	if wait, _ := limiter.Check("staff:admin"); wait == 0 {
+		t.Errorf("Expected failures kept")
+	}
+}
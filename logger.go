@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/astaxie/beego/logs"
 	"os"
+	"sync"
+	"time"
 )
 
 var log *Log
@@ -28,6 +30,16 @@ const (
 	LevelDebug
 )
 
+var (
+	levelNames = [LevelDebug + 1]string{
+		"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug",
+	}
+
+	levelPrefix = [LevelDebug + 1]string{
+		"[M]", "[A]", "[C]", "[E]", "[W]", "[N]", "[I]", "[D]",
+	}
+)
+
 type LogIface interface {
 	Critical(format string, v ...interface{})
 
@@ -48,54 +60,180 @@ type LogIface interface {
 	Info(format string, v ...interface{})
 }
 
-// Wrap external library for the short way to log events.
-// This will help to implement other logic
-type Log struct {
-	// In future its's better to discard chinese code
-	*logs.BeeLogger
+// Log message passed to the sinks
+type Record struct {
+	When   time.Time
+	Level  int
+	Msg    string
+	Fields Fields
+}
 
+// Leveled logger. Writes records to the named sinks,
+// asynchronously if buffer size was given
+type Log struct {
 	// Log level
 	Level int
+
+	lock    sync.RWMutex
+	outputs *MultiSink
+
+	// Asynchronous writing
+	qlock   sync.RWMutex
+	queue   chan *Record
+	flush   chan chan bool
+	stopped chan bool
+	closed  bool
 }
 
-// Create log object
+// Create log object. Positive buffer size makes logger asynchronous
 func NewLogger(recbuf int64) (logger *Log) {
 	logger = &Log{
-		BeeLogger: logs.NewLogger(recbuf),
-		Level:     LevelDebug,
+		Level:   LevelDebug,
+		outputs: NewMultiSink(),
 	}
 
-	// Set default log level
-	logger.SetLevel(LevelDebug)
+	if recbuf > 0 {
+		logger.queue = make(chan *Record, recbuf)
+		logger.flush = make(chan chan bool)
+		logger.stopped = make(chan bool)
+
+		go logger.run()
+	}
 
 	return
 }
 
-// Override to set level value: main class and embeded BeeLog
+// Override to set level value
 func (this *Log) SetLevel(lv int) {
 	if lv < LevelEmergency || lv > LevelDebug {
 		lv = LevelError
 	}
 
 	this.Level = lv
-	this.BeeLogger.SetLevel(this.Level)
+}
+
+// Add sink by the adapter name with JSON configuration
+func (this *Log) SetLogger(adapter string, config string) error {
+	var (
+		sink Sink
+		err  error
+	)
+
+	if sink, err = NewSink(adapter, config); err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	this.outputs.Add(adapter, sink, sinkLevel(config))
+	this.lock.Unlock()
+
+	return nil
+}
+
+// Remove sink by the adapter name
+func (this *Log) DelLogger(adapter string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.outputs.Del(adapter) {
+		return fmt.Errorf("Unknown log adapter `%s`", adapter)
+	}
+
+	return nil
+}
+
+func (this *Log) SetLogAdapter(cfg *Config, adapter string) error {
+	if adapter == "" {
+		return nil
+	}
+
+	if a, ok := cfg.Log[adapter]; ok && a.Level > 0 {
+		if new_cfg, err := cfg.GetLogAdapterJSON(adapter); err != nil {
+			return err
+		} else {
+			this.DelLogger(adapter)
+			return this.SetLogger(adapter, new_cfg)
+		}
+	} else {
+		this.DelLogger(adapter)
+	}
+
+	return nil
+}
+
+// Write buffered records and flush sinks
+func (this *Log) Flush() {
+	this.qlock.RLock()
+	defer this.qlock.RUnlock()
+
+	if this.queue != nil && !this.closed {
+		done := make(chan bool)
+		this.flush <- done
+		<-done
+
+		return
+	}
+
+	this.lock.RLock()
+	this.outputs.Flush()
+	this.lock.RUnlock()
+}
+
+// Write buffered records and destroy sinks
+func (this *Log) Close() {
+	this.qlock.Lock()
+	if this.queue != nil && !this.closed {
+		this.closed = true
+		close(this.queue)
+		<-this.stopped
+	}
+	this.qlock.Unlock()
+
+	this.lock.Lock()
+	this.outputs.Flush()
+	this.outputs.Destroy()
+	this.lock.Unlock()
+}
+
+func (this *Log) Emergency(format string, v ...interface{}) {
+	this.write(LevelEmergency, nil, format, v...)
+}
+
+func (this *Log) Alert(format string, v ...interface{}) {
+	this.write(LevelAlert, nil, format, v...)
 }
 
 func (this *Log) Error(format interface{}, v ...interface{}) {
 	switch format.(type) {
 	case string:
-		this.BeeLogger.Error(format.(string), v...)
+		this.write(LevelError, nil, format.(string), v...)
 
 	case error:
-		this.BeeLogger.Error(format.(error).Error())
+		this.write(LevelError, nil, format.(error).Error())
 
 	default:
-		this.BeeLogger.Error("Unknown Error")
+		this.write(LevelError, nil, "Unknown Error")
 	}
 }
 
+func (this *Log) Warning(format string, v ...interface{}) {
+	this.write(LevelWarning, nil, format, v...)
+}
+
+func (this *Log) Notice(format string, v ...interface{}) {
+	this.write(LevelNotice, nil, format, v...)
+}
+
+func (this *Log) Info(format string, v ...interface{}) {
+	this.write(LevelInformational, nil, format, v...)
+}
+
+func (this *Log) Debug(format string, v ...interface{}) {
+	this.write(LevelDebug, nil, format, v...)
+}
+
 func (this *Log) Critical(format string, v ...interface{}) {
-	this.BeeLogger.Critical(format, v...)
+	this.write(LevelCritical, nil, format, v...)
 
 	this.Die(true)
 }
@@ -117,56 +255,117 @@ func (this *Log) Die(iserror bool) {
 }
 
 func (this *Log) Fatal(v ...interface{}) {
-	this.Critical(fmt.Sprint(v))
+	this.Critical("%s", fmt.Sprint(v...))
 }
 
 func (this *Log) Fatalf(format string, v ...interface{}) {
-	this.Critical(format, v)
+	this.Critical(format, v...)
 }
 
 func (this *Log) Fatalln(v ...interface{}) {
-	this.Fatal(v)
+	this.Fatal(v...)
 }
 
 func (this *Log) Panic(v ...interface{}) {
-	this.Fatal(v)
+	this.Fatal(v...)
 }
 
 func (this *Log) Panicf(format string, v ...interface{}) {
-	this.Fatal(format, v)
+	this.Fatalf(format, v...)
 }
 
 func (this *Log) Panicln(v ...interface{}) {
-	this.Fatal(v)
+	this.Fatal(v...)
 }
 
 func (this *Log) Print(v ...interface{}) {
-	this.Info(fmt.Sprint(v))
+	this.Info("%s", fmt.Sprint(v...))
 }
 
 func (this *Log) Printf(format string, v ...interface{}) {
-	this.Info(format, v)
+	this.Info(format, v...)
 }
 
 func (this *Log) Println(v ...interface{}) {
-	this.Print(v)
+	this.Print(v...)
 }
 
-func (this *Log) SetLogAdapter(cfg *Config, adapter string) error {
-	if adapter == "" {
-		return nil
-	}
+// Create log entry with the key-value fields
+func (this *Log) With(kv ...interface{}) *Entry {
+	return (&Entry{log: this}).With(kv...)
+}
 
-	if a, ok := cfg.Log[adapter]; ok && a.Level > 0 {
-		if new_cfg, err := cfg.GetLogAdapterJSON(adapter); err != nil {
-			return err
-		} else {
-			this.DelLogger(adapter)
-			this.SetLogger(adapter, new_cfg)
+// Drain records queue, serve flush requests
+func (this *Log) run() {
+	for {
+		select {
+		case rec, ok := <-this.queue:
+			if !ok {
+				close(this.stopped)
+				return
+			}
+
+			this.output(rec)
+
+		case done := <-this.flush:
+			for n := len(this.queue); n > 0; n-- {
+				this.output(<-this.queue)
+			}
+
+			this.lock.RLock()
+			this.outputs.Flush()
+			this.lock.RUnlock()
+
+			close(done)
 		}
-	} else {
-		this.DelLogger(adapter)
 	}
+}
 
-	return nil
+func (this *Log) output(rec *Record) {
+	this.lock.RLock()
+	this.outputs.WriteMsg(rec)
+	this.lock.RUnlock()
+}
+
+func (this *Log) write(level int, fields Fields, format string, v ...interface{}) {
+	var rec *Record
+
+	if level > this.Level {
+		return
+	}
+
+	if len(v) > 0 {
+		format = fmt.Sprintf(format, v...)
+	}
+
+	rec = &Record{
+		When:   time.Now(),
+		Level:  level,
+		Msg:    format,
+		Fields: fields,
+	}
+
+	this.qlock.RLock()
+	if this.queue != nil && !this.closed {
+		this.queue <- rec
+		this.qlock.RUnlock()
+
+		return
+	}
+	this.qlock.RUnlock()
+
+	this.output(rec)
+}
+
+// Sink level from the JSON configuration, debug if not set
+func sinkLevel(config string) int {
+	var opts struct {
+		Level *int `json:"level"`
+	}
+
+	if json.Unmarshal([]byte(config), &opts) != nil || opts.Level == nil {
+		return LevelDebug
+	}
+
+	return *opts.Level
 }
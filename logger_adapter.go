@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log sink interface
+type Sink interface {
+	Init(config string) error
+	WriteMsg(rec *Record) error
+	Flush()
+	Destroy()
+}
+
+// Sink constructors by the adapter name
+var sinks = map[string]func() Sink{
+	"console": func() Sink { return &ConsoleSink{writer: os.Stdout} },
+	"file":    func() Sink { return NewFileSink(formatText) },
+	"json":    func() Sink { return NewFileSink(formatJSON) },
+	"syslog":  func() Sink { return &SyslogSink{} },
+}
+
+// Create and initialize sink
+func NewSink(adapter, config string) (sink Sink, err error) {
+	if fn, ok := sinks[adapter]; !ok {
+		return nil, fmt.Errorf("Unknown log adapter `%s`", adapter)
+	} else {
+		sink = fn()
+	}
+
+	if err = sink.Init(config); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Write records to the set of named sinks, each one
+// with its own level
+type MultiSink struct {
+	levels map[string]int
+	sinks  map[string]Sink
+}
+
+func NewMultiSink() *MultiSink {
+	return &MultiSink{
+		levels: make(map[string]int),
+		sinks:  make(map[string]Sink),
+	}
+}
+
+// Add or replace sink by name
+func (this *MultiSink) Add(name string, sink Sink, level int) {
+	this.Del(name)
+
+	this.levels[name] = level
+	this.sinks[name] = sink
+}
+
+// Destroy and remove sink by name
+func (this *MultiSink) Del(name string) bool {
+	if sink, ok := this.sinks[name]; ok {
+		sink.Destroy()
+
+		delete(this.levels, name)
+		delete(this.sinks, name)
+
+		return true
+	}
+
+	return false
+}
+
+func (this *MultiSink) Init(config string) error {
+	return nil
+}
+
+func (this *MultiSink) WriteMsg(rec *Record) (err error) {
+	for name, sink := range this.sinks {
+		if rec.Level > this.levels[name] {
+			continue
+		}
+
+		if e := sink.WriteMsg(rec); e != nil {
+			err = e
+			fmt.Fprintf(os.Stderr, "Log adapter `%s` write error: %s\n", name, e.Error())
+		}
+	}
+
+	return
+}
+
+func (this *MultiSink) Flush() {
+	for _, sink := range this.sinks {
+		sink.Flush()
+	}
+}
+
+func (this *MultiSink) Destroy() {
+	for name := range this.sinks {
+		this.Del(name)
+	}
+}
+
+// Text lines to the console
+type ConsoleSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func (this *ConsoleSink) Init(config string) error {
+	return nil
+}
+
+func (this *ConsoleSink) WriteMsg(rec *Record) (err error) {
+	this.lock.Lock()
+	_, err = this.writer.Write(formatText(rec))
+	this.lock.Unlock()
+
+	return
+}
+
+func (this *ConsoleSink) Flush() {
+}
+
+func (this *ConsoleSink) Destroy() {
+}
+
+// Write records to the file with rotation by lines, size or day.
+// Stdout is used if file name is empty
+type FileSink struct {
+	File     string `json:"filename"`
+	MaxLines int    `json:"maxlines"`
+	MaxSize  int    `json:"maxsize"`
+	Daily    bool   `json:"daily"`
+	MaxDays  int64  `json:"maxdays"`
+	Rotate   bool   `json:"rotate"`
+	Perm     string `json:"perm"`
+
+	format func(*Record) []byte
+
+	lock   sync.Mutex
+	writer *os.File
+	lines  int
+	size   int
+	opened time.Time
+}
+
+func NewFileSink(format func(*Record) []byte) *FileSink {
+	return &FileSink{
+		MaxSize: 1 << 28,
+		Daily:   true,
+		MaxDays: 7,
+		Rotate:  true,
+		Perm:    "0660",
+		format:  format,
+	}
+}
+
+func (this *FileSink) Init(config string) (err error) {
+	if err = json.Unmarshal([]byte(config), this); err != nil {
+		return
+	}
+
+	if this.File == "" {
+		this.writer = os.Stdout
+		return
+	}
+
+	return this.open()
+}
+
+func (this *FileSink) WriteMsg(rec *Record) (err error) {
+	var line = this.format(rec)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.File != "" && this.Rotate && this.expired(rec.When) {
+		if err = this.rotate(); err != nil {
+			return
+		}
+	}
+
+	_, err = this.writer.Write(line)
+
+	this.lines++
+	this.size += len(line)
+
+	return
+}
+
+func (this *FileSink) Flush() {
+	this.lock.Lock()
+	this.writer.Sync()
+	this.lock.Unlock()
+}
+
+func (this *FileSink) Destroy() {
+	this.lock.Lock()
+	if this.writer != os.Stdout {
+		this.writer.Close()
+	}
+	this.lock.Unlock()
+}
+
+// Check rotation limits
+func (this *FileSink) expired(when time.Time) bool {
+	if this.MaxLines > 0 && this.lines >= this.MaxLines {
+		return true
+	}
+
+	if this.MaxSize > 0 && this.size >= this.MaxSize {
+		return true
+	}
+
+	if this.Daily && when.Format("20060102") != this.opened.Format("20060102") {
+		return true
+	}
+
+	return false
+}
+
+func (this *FileSink) open() (err error) {
+	var (
+		perm int64
+		info os.FileInfo
+	)
+
+	if perm, err = strconv.ParseInt(this.Perm, 8, 64); err != nil {
+		return fmt.Errorf("Invalid file permission `%s`", this.Perm)
+	}
+
+	this.writer, err = os.OpenFile(this.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(perm))
+	if err != nil {
+		return
+	}
+
+	if info, err = this.writer.Stat(); err != nil {
+		return
+	}
+
+	this.lines = 0
+	this.size = int(info.Size())
+	this.opened = info.ModTime()
+
+	if this.size == 0 {
+		this.opened = time.Now()
+	}
+
+	return
+}
+
+// Rename current file to the name with date and sequence number,
+// open new one and remove files older than max days
+func (this *FileSink) rotate() (err error) {
+	var (
+		ext  = filepath.Ext(this.File)
+		base = strings.TrimSuffix(this.File, ext)
+		name string
+	)
+
+	for i := 1; ; i++ {
+		name = fmt.Sprintf("%s.%s.%03d%s", base, this.opened.Format("2006-01-02"), i, ext)
+
+		if _, err = os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	this.writer.Close()
+
+	if err = os.Rename(this.File, name); err != nil {
+		return
+	}
+
+	if err = this.open(); err != nil {
+		return
+	}
+
+	if this.MaxDays > 0 {
+		go removeExpired(base+".*"+ext, time.Duration(this.MaxDays)*24*time.Hour)
+	}
+
+	return
+}
+
+// Remove rotated files by pattern older than given age
+func removeExpired(pattern string, age time.Duration) {
+	var (
+		files, _ = filepath.Glob(pattern)
+		point    = time.Now().Add(-1 * age)
+	)
+
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().Before(point) {
+			os.Remove(file)
+		}
+	}
+}
+
+// Write records to the syslog daemon. Local socket is used
+// if network and address are empty
+type SyslogSink struct {
+	Net  string `json:"net"`
+	Addr string `json:"addr"`
+	Tag  string `json:"tag"`
+
+	writer *syslog.Writer
+}
+
+func (this *SyslogSink) Init(config string) (err error) {
+	if err = json.Unmarshal([]byte(config), this); err != nil {
+		return
+	}
+
+	if this.Tag == "" {
+		this.Tag = NAME
+	}
+
+	this.writer, err = syslog.Dial(this.Net, this.Addr, syslog.LOG_INFO|syslog.LOG_DAEMON, this.Tag)
+
+	return
+}
+
+func (this *SyslogSink) WriteMsg(rec *Record) error {
+	var msg = string(bytes.TrimSpace(formatFields(rec)))
+
+	switch rec.Level {
+	case LevelEmergency:
+		return this.writer.Emerg(msg)
+	case LevelAlert:
+		return this.writer.Alert(msg)
+	case LevelCritical:
+		return this.writer.Crit(msg)
+	case LevelError:
+		return this.writer.Err(msg)
+	case LevelWarning:
+		return this.writer.Warning(msg)
+	case LevelNotice:
+		return this.writer.Notice(msg)
+	case LevelInformational:
+		return this.writer.Info(msg)
+	}
+
+	return this.writer.Debug(msg)
+}
+
+func (this *SyslogSink) Flush() {
+}
+
+func (this *SyslogSink) Destroy() {
+	if this.writer != nil {
+		this.writer.Close()
+	}
+}
+
+// Text line: time, level mark, message and sorted key=value pairs
+func formatText(rec *Record) []byte {
+	var buf = bytes.NewBufferString(rec.When.Format("2006/01/02 15:04:05.000"))
+
+	buf.WriteByte(' ')
+	buf.WriteString(levelPrefix[rec.Level])
+	buf.WriteByte(' ')
+	buf.Write(formatFields(rec))
+
+	return buf.Bytes()
+}
+
+// Message and sorted key=value pairs ended with new line
+func formatFields(rec *Record) []byte {
+	var (
+		buf  = bytes.NewBufferString(rec.Msg)
+		keys = make([]string, 0, len(rec.Fields))
+	)
+
+	for k := range rec.Fields {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := fmt.Sprint(rec.Fields[k])
+
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = strconv.Quote(v)
+		}
+
+		fmt.Fprintf(buf, " %s=%s", k, v)
+	}
+
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// JSON object line with time, level, message and fields
+func formatJSON(rec *Record) []byte {
+	var (
+		obj  = make(map[string]interface{}, len(rec.Fields)+3)
+		line []byte
+		err  error
+	)
+
+	for k, v := range rec.Fields {
+		obj[k] = v
+	}
+
+	obj["time"] = rec.When.Format(time.RFC3339Nano)
+	obj["level"] = levelNames[rec.Level]
+	obj["msg"] = rec.Msg
+
+	if line, err = json.Marshal(obj); err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  obj["time"],
+			"level": obj["level"],
+			"msg":   rec.Msg,
+			"error": err.Error(),
+		})
+	}
+
+	return append(line, '\n')
+}
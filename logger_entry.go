@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Key-value pairs attached to the log message
+type Fields map[string]interface{}
+
+// Structured log message builder. Entry keeps context fields
+// (request id, user etc.) and writes them with every message
+type Entry struct {
+	log    *Log
+	fields Fields
+	// Gets each message regardless of the log level
+	hook func(level int, msg string, fields Fields)
+}
+
+// Create new entry with the parent fields and the key-value pairs
+func (this *Entry) With(kv ...interface{}) *Entry {
+	var entry = &Entry{
+		log:    this.log,
+		fields: make(Fields, len(this.fields)+len(kv)/2),
+		hook:   this.hook,
+	}
+
+	for k, v := range this.fields {
+		entry.fields[k] = v
+	}
+
+	entry.fields.add(kv...)
+
+	return entry
+}
+
+func (this *Entry) Error(msg string, kv ...interface{}) {
+	this.write(LevelError, msg, kv...)
+}
+
+func (this *Entry) Warning(msg string, kv ...interface{}) {
+	this.write(LevelWarning, msg, kv...)
+}
+
+func (this *Entry) Notice(msg string, kv ...interface{}) {
+	this.write(LevelNotice, msg, kv...)
+}
+
+func (this *Entry) Info(msg string, kv ...interface{}) {
+	this.write(LevelInformational, msg, kv...)
+}
+
+func (this *Entry) Debug(msg string, kv ...interface{}) {
+	this.write(LevelDebug, msg, kv...)
+}
+
+// Create new entry passing the messages to the hook too
+func (this *Entry) Hook(fn func(level int, msg string, fields Fields)) *Entry {
+	var entry = this.With()
+
+	entry.hook = fn
+
+	return entry
+}
+
+// Field value by key
+func (this *Entry) Get(key string) interface{} {
+	return this.fields[key]
+}
+
+func (this *Entry) write(level int, msg string, kv ...interface{}) {
+	var fields = make(Fields, len(this.fields)+len(kv)/2)
+
+	if level > this.log.Level && this.hook == nil {
+		return
+	}
+
+	for k, v := range this.fields {
+		fields[k] = v
+	}
+
+	fields.add(kv...)
+
+	if this.hook != nil {
+		this.hook(level, msg, fields)
+	}
+
+	this.log.write(level, fields, msg)
+}
+
+// Append key-value pairs. Not string keys are formatted,
+// errors are written as text
+func (this Fields) add(kv ...interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		var (
+			key   = fmt.Sprint(kv[i])
+			value interface{}
+		)
+
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		this[key] = value
+	}
+}
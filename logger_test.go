@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type SinkMock struct {
+	records []*Record
+}
+
+func (this *SinkMock) Init(config string) error { return nil }
+func (this *SinkMock) WriteMsg(rec *Record) error {
+	this.records = append(this.records, rec)
+	return nil
+}
+func (this *SinkMock) Flush()   {}
+func (this *SinkMock) Destroy() {}
+
+func Test_LoggerSinkLevelFilter(t *testing.T) {
+	var (
+		logger = NewLogger(0)
+		debug  = &SinkMock{}
+		errs   = &SinkMock{}
+	)
+
+	logger.outputs.Add("debug", debug, LevelDebug)
+	logger.outputs.Add("errs", errs, LevelError)
+
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Error("error message")
+
+	if l := len(debug.records); l != 3 {
+		t.Errorf("Expected %d records in the debug sink, but got %d", 3, l)
+	}
+
+	if l := len(errs.records); l != 1 {
+		t.Errorf("Expected %d records in the errs sink, but got %d", 1, l)
+	}
+
+	logger.SetLevel(LevelWarning)
+	logger.Info("info message")
+
+	if l := len(debug.records); l != 3 {
+		t.Errorf("Expected logger level filter, but got %d records", l)
+	}
+}
+
+func Test_LoggerAsyncFlush(t *testing.T) {
+	var (
+		logger = NewLogger(100)
+		sink   = &SinkMock{}
+		queue  = 1000
+	)
+
+	logger.outputs.Add("mock", sink, LevelDebug)
+
+	for i := 0; i < queue; i++ {
+		logger.Info("message %d", i)
+	}
+
+	logger.Flush()
+
+	if l := len(sink.records); l != queue {
+		t.Fatalf("Expected %d records after flush, but got %d", queue, l)
+	}
+
+	for i, rec := range sink.records {
+		if rec.Msg != fmt.Sprintf("message %d", i) {
+			t.Fatalf("Unexpected record order at %d: %s", i, rec.Msg)
+		}
+	}
+
+	logger.Close()
+	logger.Info("after close")
+}
+
+func Test_LoggerEntryFields(t *testing.T) {
+	var (
+		logger = NewLogger(0)
+		sink   = &SinkMock{}
+		entry  = logger.With("request_id", "abc").With("user", "admin")
+	)
+
+	logger.outputs.Add("mock", sink, LevelDebug)
+
+	entry.Info("Request", "error", fmt.Errorf("failed"), "odd")
+
+	if len(sink.records) != 1 {
+		t.Fatalf("Expected one record, but got %d", len(sink.records))
+	}
+
+	rec := sink.records[0]
+	for k, v := range map[string]interface{}{"request_id": "abc", "user": "admin", "error": "failed", "odd": nil} {
+		if val, ok := rec.Fields[k]; !ok || val != v {
+			t.Errorf("Expected field %s=%v, but got %v", k, v, val)
+		}
+	}
+
+	if line := string(formatText(rec)); !strings.HasSuffix(line, "[I] Request error=failed odd=<nil> request_id=abc user=admin\n") {
+		t.Errorf("Unexpected text line: %s", line)
+	}
+
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(formatJSON(rec), &obj); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if obj["msg"] != "Request" || obj["level"] != "info" || obj["request_id"] != "abc" {
+		t.Errorf("Unexpected JSON line: %v", obj)
+	}
+}
+
+func Test_FileSinkRotateByLines(t *testing.T) {
+	var (
+		dir, _ = ioutil.TempDir("", "msm-log")
+		file   = filepath.Join(dir, "server.log")
+		logger = NewLogger(0)
+	)
+
+	defer os.RemoveAll(dir)
+
+	if err := logger.SetLogger("file", fmt.Sprintf(`{"filename":%q,"maxlines":2,"level":7}`, file)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		logger.Info("message %d", i)
+	}
+
+	logger.Close()
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "server.*.log")); len(files) != 2 {
+		t.Errorf("Expected %d rotated files, but got %v", 2, files)
+	}
+
+	if data, _ := ioutil.ReadFile(file); bytes.Count(data, []byte("\n")) != 1 {
+		t.Errorf("Expected one line in the current file, but got %q", data)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"time"
+)
+
+const resetTokenLen = 43
+
+var ErrResetInvalid = errors.New("Invalid or expired reset token")
+
+// Mailbox accounts of the end users
+type MailboxStore struct {
+	conn *sql.DB
+	now  func() time.Time
+}
+
+func NewMailboxStore(db *sql.DB) *MailboxStore {
+	return &MailboxStore{
+		conn: db,
+		now:  time.Now,
+	}
+}
+
+// Check address and password of the active mailbox
+func (this *MailboxStore) Authenticate(address, password string) (principal *Principal, err error) {
+	var (
+		hash  string
+		start = time.Now()
+	)
+
+	principal = &Principal{
+		Kind: PrincipalMailbox,
+		Name: address,
+	}
+
+	err = this.conn.QueryRow("SELECT `id`, `password` FROM `msm_mailbox` WHERE `address` = ? AND `active` = 1", address).
+		Scan(&principal.Id, &hash)
+	metricDBQuery.Since(start, "mailbox_auth")
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrBadCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if legacyHash(hash) {
+		if !checkLegacyHash(hash, password) {
+			return nil, ErrBadCredentials
+		}
+
+		// Imported hash is replaced, the login succeeds anyway
+		if err := this.upgradeHash(principal.Id, hash, password); err != nil {
+			log.With("mailbox", address, "error", err).Warning("Can't upgrade password hash")
+		}
+
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+
+	return
+}
+
+// Replace the legacy hash by bcrypt unless the password changed
+func (this *MailboxStore) upgradeHash(id int64, legacy, password string) (err error) {
+	var hash []byte
+
+	if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+		return
+	}
+
+	defer metricDBQuery.Since(time.Now(), "mailbox_rehash")
+
+	_, err = this.conn.Exec("UPDATE `msm_mailbox` SET `password` = ?, `updated` = ? WHERE `id` = ? AND `password` = ?",
+		string(hash), this.now().Unix(), id, legacy)
+
+	return
+}
+
+// Store new password hash, unused reset tokens are dropped
+func (this *MailboxStore) SetPassword(id int64, password string) (err error) {
+	var hash []byte
+
+	if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+		return
+	}
+
+	defer metricDBQuery.Since(time.Now(), "mailbox_password")
+
+	_, err = this.conn.Exec("UPDATE `msm_mailbox` SET `password` = ?, `updated` = ? WHERE `id` = ?", string(hash), this.now().Unix(), id)
+	if err != nil {
+		return
+	}
+
+	_, err = this.conn.Exec("DELETE FROM `msm_reset` WHERE `mailbox_id` = ?", id)
+
+	return
+}
+
+// Issue single use reset token for the active mailbox, ttl in seconds.
+// Only the hash is stored
+func (this *MailboxStore) CreateReset(address string, ttl int64) (token string, expires int64, err error) {
+	var (
+		id  int64
+		now = this.now().Unix()
+	)
+
+	defer metricDBQuery.Since(time.Now(), "mailbox_reset_create")
+
+	err = this.conn.QueryRow("SELECT `id` FROM `msm_mailbox` WHERE `address` = ? AND `active` = 1", address).Scan(&id)
+	if err != nil {
+		return
+	}
+
+	token = RandSecureId(resetTokenLen)
+	expires = now + ttl
+
+	_, err = this.conn.Exec("INSERT INTO `msm_reset`(`hash`, `mailbox_id`, `created`, `expires`, `used`) VALUES(?, ?, ?, ?, 0)",
+		tokenHash(token), id, now, expires)
+
+	return
+}
+
+// Mark reset token used, returns the mailbox id
+func (this *MailboxStore) UseReset(token string) (id int64, err error) {
+	var (
+		tx   *sql.Tx
+		hash = tokenHash(token)
+		rows int64
+		res  sql.Result
+	)
+
+	defer metricDBQuery.Since(time.Now(), "mailbox_reset_use")
+
+	if tx, err = this.conn.Begin(); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err = tx.Exec("UPDATE `msm_reset` SET `used` = 1 WHERE `hash` = ? AND `used` = 0 AND `expires` > ?", hash, this.now().Unix())
+	if err != nil {
+		return
+	}
+
+	if rows, err = res.RowsAffected(); err != nil {
+		return
+	} else if rows != 1 {
+		return 0, ErrResetInvalid
+	}
+
+	if err = tx.QueryRow("SELECT `mailbox_id` FROM `msm_reset` WHERE `hash` = ?", hash).Scan(&id); err != nil {
+		return
+	}
+
+	return id, tx.Commit()
+}
+
+// Mailbox owner login: POST /mailbox/login with JSON address and password
+func handleMailboxLogin(sessions *Provider, mailboxes *MailboxStore, limiter *Limiter) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			req struct {
+				Address  string `json:"address"`
+				Password string `json:"password"`
+			}
+			principal *Principal
+			err       error
+		)
+
+		if ctx.r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		keys := []string{"mailbox:" + req.Address, "ip:" + remoteIP(ctx.r)}
+
+		if wait, err := limiter.Check(keys...); err != nil {
+			ctx.log.Notice("Mailbox login throttled", "address", req.Address, "error", err)
+			writeRetry(w, wait, err)
+			return
+		}
+
+		if principal, err = mailboxes.Authenticate(req.Address, req.Password); err == ErrBadCredentials {
+			limiter.Fail(keys...)
+
+			ctx.log.Notice("Mailbox login failed", "address", req.Address)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't check mailbox login", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		limiter.Success(keys[0])
+		completeLogin(w, ctx, sessions, principal)
+	}
+}
+
+// Owner password change: POST /mailbox/password with the current
+// and the new password
+func handleMailboxPassword(sessions *Provider, mailboxes *MailboxStore, policy *PasswordPolicy, limiter *Limiter) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			req struct {
+				Current  string `json:"current"`
+				Password string `json:"password"`
+			}
+			err error
+		)
+
+		if ctx.r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		if !ctx.Require(w, "self:password") {
+			return
+		}
+
+		// Staff and tokens have the scope too, but no mailbox
+		if ctx.principal.Kind != PrincipalMailbox {
+			writeError(w, http.StatusForbidden, "Mailbox principal required")
+			return
+		}
+
+		if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		keys := []string{"mailbox:" + ctx.principal.Name, "ip:" + remoteIP(ctx.r)}
+
+		if wait, err := limiter.Check(keys...); err != nil {
+			writeRetry(w, wait, err)
+			return
+		}
+
+		owner, err := mailboxes.Authenticate(ctx.principal.Name, req.Current)
+		if err == ErrBadCredentials {
+			limiter.Fail(keys...)
+			writeError(w, http.StatusForbidden, "Invalid current password")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't check mailbox password", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		if err = policy.Check(req.Password); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		if err = mailboxes.SetPassword(owner.Id, req.Password); err != nil {
+			ctx.log.Error("Can't change mailbox password", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		if err = sessions.Regenerate(w, ctx.r, ctx.s); err != nil {
+			ctx.log.Error("Can't regenerate session", "error", err)
+		}
+
+		// Other clients log in with the new password
+		if _, err = sessions.KillPrincipal(PrincipalMailbox, owner.Id, ctx.s.Id()); err != nil {
+			ctx.log.Error("Can't kill mailbox sessions", "error", err)
+		}
+
+		ctx.log.Notice("Mailbox password changed")
+
+		w.Header().Set(CSRFHeader, ctx.s.Get(CSRFKey).(string))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Admin triggered reset: POST /mailbox/reset with the address
+// returns the token, it is also mailed to the notify address if given.
+// The token is used with POST /mailbox/reset/confirm and the new
+// password without login
+func handleMailboxReset(mailboxes *MailboxStore, notifier *Notifier, ttl int64) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var req struct {
+			Address string `json:"address"`
+			Notify  string `json:"notify"`
+		}
+
+		if !ctx.Require(w, "mailboxes:password") {
+			return
+		}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		if req.Notify != "" && !validAddress(req.Notify) {
+			writeError(w, http.StatusBadRequest, "Invalid notify address")
+			return
+		}
+
+		// Tenant resets the mailboxes of own domains
+		if ctx.Tenant() != 0 {
+			if _, err := getDomain(ctx.db, ctx.Tenant(), addressDomain(req.Address)); err != nil {
+				writeError(w, http.StatusNotFound, "Mailbox not found")
+				return
+			}
+		}
+
+		token, expires, err := mailboxes.CreateReset(req.Address, ttl)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Mailbox not found")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't create reset token", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		ctx.log.Notice("Mailbox reset token issued", "address", req.Address)
+
+		if notifier != nil && req.Notify != "" {
+			err = notifier.Notify("password_reset", []string{req.Notify}, map[string]interface{}{
+				"Address": req.Address,
+				"Token":   token,
+				"Expires": time.Unix(expires, 0).Format(time.RFC1123Z),
+			})
+			if err != nil {
+				ctx.log.Error("Can't send reset token", "error", err)
+			}
+		}
+
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"token":   token,
+			"expires": expires,
+		})
+	}
+}
+
+// Set the password with the reset token: POST /mailbox/reset/confirm.
+// Sessions of the mailbox are ended
+func handleResetConfirm(sessions *Provider, mailboxes *MailboxStore, policy *PasswordPolicy, limiter *Limiter) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			req struct {
+				Token    string `json:"token"`
+				Password string `json:"password"`
+			}
+			keys = []string{"ip:" + remoteIP(ctx.r)}
+		)
+
+		if wait, err := limiter.Check(keys...); err != nil {
+			writeRetry(w, wait, err)
+			return
+		}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		// Token is kept if the password is rejected
+		if err := policy.Check(req.Password); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		id, err := mailboxes.UseReset(req.Token)
+		if err == ErrResetInvalid {
+			limiter.Fail(keys...)
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't check reset token", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		if err = mailboxes.SetPassword(id, req.Password); err != nil {
+			ctx.log.Error("Can't change mailbox password", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		if _, err = sessions.KillPrincipal(PrincipalMailbox, id, ""); err != nil {
+			ctx.log.Error("Can't kill mailbox sessions", "error", err)
+		}
+
+		ctx.log.Notice("Mailbox password reset", "mailbox", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Quota warning of the mail server: POST /mailbox/quota-warning with
+// the address and the used bytes, e.g. by the Dovecot quota_warning
+// script. The warning is mailed to the mailbox
+func handleQuotaWarning(notifier *Notifier) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			req struct {
+				Address string `json:"address"`
+				Used    int64  `json:"used"`
+			}
+			mailbox *Mailbox
+			tenant  int64
+			err     error
+		)
+
+		if !ctx.Require(w, "mailboxes:write") {
+			return
+		}
+
+		if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		if !validAddress(req.Address) || req.Used < 0 {
+			writeError(w, http.StatusBadRequest, "Valid address and used bytes required")
+			return
+		}
+
+		// Tenant warns the mailboxes of own domains
+		if ctx.Tenant() != 0 {
+			if _, err = getDomain(ctx.db, ctx.Tenant(), addressDomain(req.Address)); err != nil {
+				writeError(w, http.StatusNotFound, "Mailbox not found")
+				return
+			}
+		}
+
+		if mailbox, err = getMailbox(ctx.db, req.Address); err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Mailbox not found")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't read mailbox", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		if mailbox.Quota == 0 {
+			writeError(w, http.StatusUnprocessableEntity, "Mailbox quota is unlimited")
+			return
+		}
+
+		event := EventQuotaWarning
+		if req.Used >= mailbox.Quota {
+			event = EventQuotaExceeded
+		}
+
+		// Subscribers learn of the warning even if the mail fails
+		if tenant, err = domainTenant(ctx.db, mailbox.Domain); err == nil {
+			err = emitEvent(ctx.db, event, tenant, map[string]interface{}{
+				"address": mailbox.Address,
+				"used":    req.Used,
+				"quota":   mailbox.Quota,
+				"percent": req.Used * 100 / mailbox.Quota,
+			})
+		}
+
+		if err != nil {
+			ctx.log.Error("Can't emit quota event", "error", err)
+		}
+
+		err = notifier.Notify("quota_warning", []string{mailbox.Address}, map[string]interface{}{
+			"Address": mailbox.Address,
+			"Used":    req.Used,
+			"Quota":   mailbox.Quota,
+			"Percent": req.Used * 100 / mailbox.Quota,
+		})
+		if err != nil {
+			ctx.log.Error("Can't send quota warning", "error", err)
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		ctx.log.Info("Quota warning sent", "address", mailbox.Address, "used", req.Used)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_MailboxResetSingleUse(t *testing.T) {
+	var (
+		db, mock  = InitDBMock(t)
+		mailboxes = NewMailboxStore(db)
+		now       = time.Unix(1500000000, 0)
+	)
+
+	defer db.Close()
+
+	mailboxes.now = func() time.Time { return now }
+
+	mock.ExpectQuery("SELECT `id` FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("INSERT INTO `msm_reset`").WithArgs(sqlmock.AnyArg(), 7, now.Unix(), now.Unix()+3600).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	token, expires, err := mailboxes.CreateReset("user@example.com", 3600)
+	if err != nil || len(token) != resetTokenLen || expires != now.Unix()+3600 {
+		t.Fatalf("Unexpected reset token %s, %d, %v", token, expires, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE `msm_reset` SET `used` = 1").WithArgs(tokenHash(token), now.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT `mailbox_id` FROM `msm_reset`").WithArgs(tokenHash(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"mailbox_id"}).AddRow(7))
+	mock.ExpectCommit()
+
+	// Used or expired
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE `msm_reset` SET `used` = 1").WithArgs(tokenHash(token), now.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if id, err := mailboxes.UseReset(token); err != nil || id != 7 {
+		t.Errorf("Expected mailbox 7, but got %d, %v", id, err)
+	}
+
+	if _, err := mailboxes.UseReset(token); err != ErrResetInvalid {
+		t.Errorf("Expected error %v, but got %v", ErrResetInvalid, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_HandleMailboxPassword(t *testing.T) {
+	var (
+		db, mock   = InitDBMock(t)
+		prov, _    = NewManager(db, 0)
+		limiter, _ = testLimiter()
+		policy, _  = NewPasswordPolicy(&Config{})
+		mailboxes  = NewMailboxStore(db)
+		handler    = HandleInContext(handleMailboxPassword(prov, mailboxes, policy, limiter), prov, nil)
+		hash, _    = bcrypt.GenerateFromPassword([]byte("Old password 1"), bcrypt.MinCost)
+		session    = NewSession(RandStringId(64))
+	)
+
+	defer db.Close()
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalMailbox, Id: 7, Name: "user@example.com"})
+	prov.append(session)
+
+	request := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/mailbox/password", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+		r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+		r.RemoteAddr = "10.0.0.1:40000"
+
+		handler(w, r)
+
+		return w
+	}
+
+	mock.ExpectQuery("SELECT `id`, `password` FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(7, hash))
+
+	if w := request(`{"current":"Old password 1","password":"weak"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+
+	mock.ExpectQuery("SELECT `id`, `password` FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(7, hash))
+	mock.ExpectExec("UPDATE `msm_mailbox` SET `password`").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM `msm_reset`").WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_session` SET `id`").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_session`").
+		WillReturnRows(sqlmock.NewRows(sessionInfoColumns).
+			AddRow("other", PrincipalMailbox, 7, "user@example.com", 0, "10.0.0.2", "", 100, 200).
+			AddRow("stranger", PrincipalMailbox, 8, "stranger@example.com", 0, "10.0.0.3", "", 100, 200))
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("other").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if w := request(`{"current":"Old password 1","password":"New password 2"}`); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	// Admin has every scope, but no mailbox of its own
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 7, Name: "admin", Role: RoleAdmin})
+
+	if w := request(`{"current":"Old password 1","password":"New password 2"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Mailbox owner ends the session
+func Test_MailboxLogout(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		handler  = HandleInContext(handleLogout(prov), prov, nil)
+		session  = NewSession(RandSecureId(64))
+	)
+
+	defer db.Close()
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalMailbox, Id: 7, Name: "user@example.com"})
+	prov.append(session)
+
+	mock.ExpectExec("UPDATE `msm_session` SET `id`").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+	r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+
+	handler(w, r)
+
+	if w.Code != http.StatusNoContent || session.Get(PrincipalKey) != nil {
+		t.Errorf("Expected logout, but got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_QuotaWarning(t *testing.T) {
+	var (
+		db, mock    = InitDBMock(t)
+		prov, _     = NewManager(db, 0)
+		sender      = &SenderMock{sent: make(chan *Message, 1)}
+		notifier, _ = NewNotifier(&Config{Notify: &Notify{From: "msm@example.com"}}, sender)
+		handler     = HandleInContext(handleQuotaWarning(notifier), prov, nil)
+		session     = NewSession(RandSecureId(64))
+	)
+
+	defer db.Close()
+	defer notifier.Close()
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "admin", Role: RoleOperator})
+	prov.append(session)
+
+	request := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/mailbox/quota-warning", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+		r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+
+		handler(w, r)
+
+		return w
+	}
+
+	if w := request(`{"address":"user@example.com\r\nBcc: other@example.net","used":900}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "address", "domain", "name", "password", "quota", "active", "created"}).
+			AddRow(7, "user@example.com", "example.com", "", "", 1000, true, 0))
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(2))
+	expectWebhooks(mock, 2)
+
+	_, events, cancel := activity.Subscribe(0)
+	defer cancel()
+
+	if w := request(`{"address":"user@example.com","used":900}`); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	select {
+	case msg := <-sender.sent:
+		if msg.Subject != "Mailbox user@example.com is 90% full" || msg.To[0] != "user@example.com" {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message is not delivered")
+	}
+
+	// Audit records of the request are streamed too
+	for found := false; !found; {
+		select {
+		case ev := <-events:
+			if found = ev.Type == EventQuotaWarning; found && (ev.Tenant != 2 || ev.Scope != "mailboxes:read") {
+				t.Errorf("Unexpected event %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Quota event is not published")
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Imported crypt hash authenticates once and is replaced by bcrypt
+func Test_MailboxLegacyHash(t *testing.T) {
+	var (
+		db, mock  = InitDBMock(t)
+		mailboxes = NewMailboxStore(db)
+		legacy    = "$1$abcdefgh$ZE59VolIMROFw2UgfozW8/"
+	)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT `id`, `password` FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(7, legacy))
+
+	if _, err := mailboxes.Authenticate("user@example.com", "wrong password"); err != ErrBadCredentials {
+		t.Errorf("Expected bad credentials, but got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT `id`, `password` FROM `msm_mailbox`").WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(7, legacy))
+	mock.ExpectExec("UPDATE `msm_mailbox` SET `password` = \\?, `updated` = \\? WHERE `id` = \\? AND `password` = \\?").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7, legacy).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if principal, err := mailboxes.Authenticate("user@example.com", "secret password"); err != nil || principal.Id != 7 {
+		t.Errorf("Unexpected login %v, %v", principal, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -17,11 +18,28 @@ func init() {
 
 func main() {
 	var (
-		cfg      *Config
-		db       *sql.DB
-		sessions *Provider
-		sig      chan os.Signal
-		err      error
+		cfg       *Config
+		db        *sql.DB
+		sessions  *Provider
+		binding   *SessionBinding
+		timeouts  map[string]SessionTimeout
+		tokens    *TokenStore
+		auth      *Auth
+		staff     *StaffStore
+		limiter   *Limiter
+		mfa       *TOTPAuth
+		mailboxes *MailboxStore
+		policy    *PasswordPolicy
+		sender    Sender
+		notifier  *Notifier
+		webhooks  *WebhookDispatcher
+		dkim      *DKIMStore
+		reloader  *TLSReloader
+		router    *Router
+		api       []Middleware
+		throttled []Middleware
+		sig       chan os.Signal
+		err       error
 	)
 
 	// Read flags
@@ -32,6 +50,11 @@ func main() {
 		showVersion()
 	}
 
+	// Import or export and exit
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	// Read configuration
 	if cfg, err = NewConfig(CONFIGFILE); err != nil {
 		log.Critical(err.Error())
@@ -41,52 +64,219 @@ func main() {
 		}
 	}
 
+	// Apply log adapters from configuration
+	for name := range cfg.Log {
+		if err = log.SetLogAdapter(cfg, name); err != nil {
+			log.Critical(err.Error())
+		}
+	}
+
 	// Prepare statement
 	if db, err = openDB(cfg.Database.DSN()); err != nil {
 		log.Critical(err.Error())
 	}
 
+	// Database schema
+	if err = migrate(db); err != nil {
+		log.Critical(err.Error())
+	}
+
 	// Create sessions storage
 	if sessions, err = NewManager(db, 0); err != nil {
 		log.Critical(err.Error())
 	}
+	if binding, err = NewSessionBinding(cfg); err != nil {
+		log.Critical(err.Error())
+	}
+	sessions.SetBinding(binding)
+	sessions.SetCookieOnly(cfg.Session != nil && cfg.Session.CookieOnly)
+	if timeouts, err = NewSessionTimeouts(cfg); err != nil {
+		log.Critical(err.Error())
+	}
+	sessions.SetTimeouts(timeouts)
+
+	// Outbound mail
+	if sender, err = NewSender(cfg); err != nil {
+		log.Critical(err.Error())
+	}
+	if notifier, err = NewNotifier(cfg, sender); err != nil {
+		log.Critical(err.Error())
+	}
+
+	// Deliver webhook outbox
+	webhooks = NewWebhookDispatcher(cfg, db)
+	webhooks.Start()
 
 	// Catch system signal to save sessions
 	// Close DB connection and flush log
 	sig = make(chan os.Signal, 2)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	go destruct(sig, sessions, db, log)
+	go destruct(sig, notifier, webhooks, sessions, db, log)
 	// Run garbage collector
 	sessions.GC(0)
 
-	http.HandleFunc("/", HandleInContext(handleRoot, sessions))
+	// Metrics on the separate listener
+	if listen := cfg.GetMetricsListen(); listen != "" {
+		metrics.GaugeFunc("msm_sessions_active", "Sessions in the memmory cache.", func() float64 {
+			return float64(sessions.Len())
+		})
 
-	http.ListenAndServe(cfg.Server, nil)
-}
+		go serveMetrics(listen)
+	}
+
+	tokens = NewTokenStore(db)
+	auth = NewAuth(tokens, cfg.Server.TLS)
+	staff = NewStaffStore(db)
+	router = NewRouter(sessions)
+
+	// Session or token authentication, CSRF check of the session and
+	// body validation. Login routes are throttled by the client address
+	api = []Middleware{Authenticate(sessions, auth), CheckCSRF, ValidateBody}
+	throttled = append([]Middleware{RateLimit(NewRateLimiter(cfg))}, api...)
+
+	// Probes are served without session
+	router.Handle("GET", "/healthz", "healthz", PlainHandler(handleHealth))
+	router.Handle("GET", "/readyz", "readyz", PlainHandler(handleReady(db, sessions)))
+
+	// Failed logins throttling
+	limiter = NewLimiter(cfg, db)
+	if err = limiter.Load(); err != nil {
+		log.Critical(err.Error())
+	}
+	limiter.Watch()
+
+	// Lockout alerts
+	if cfg.Notify != nil && len(cfg.Notify.Admins) > 0 {
+		limiter.OnLock = func(info LockInfo) {
+			if err := notifier.Notify("lockout", cfg.Notify.Admins, info); err != nil {
+				log.Error("Can't send lockout alert: %s", err.Error())
+			}
+		}
+	}
+
+	mfa = NewTOTPAuth(cfg, sessions, staff, limiter)
 
-type Context struct {
-	db *sql.DB
-	r  *http.Request
-	s  *Session
+	router.Handle("POST", "/login", "login", handleLogin(sessions, staff, limiter, mfa), throttled...)
+	router.Handle("POST", "/login/totp", "login_totp", mfa.handleLogin, throttled...)
+	router.Handle("POST", "/logout", "logout", handleLogout(sessions), api...)
+	router.Handle("POST", "/totp/enroll", "enroll_totp", mfa.handleEnroll, api...)
+	router.Handle("POST", "/totp/confirm", "confirm_totp", mfa.handleConfirm, api...)
+	router.Handle("DELETE", "/totp", "disable_totp", mfa.handleDisable, api...)
+	router.Handle("GET", "/lockouts", "list_lockouts", handleLockouts(limiter), api...)
+	router.Handle("DELETE", "/lockouts", "clear_lockouts", handleLockouts(limiter), api...)
+	router.Handle("DELETE", "/lockouts/{key}", "clear_lockout", handleLockouts(limiter), api...)
+
+	mailboxes = NewMailboxStore(db)
+	if policy, err = NewPasswordPolicy(cfg); err != nil {
+		log.Critical(err.Error())
+	}
+
+	router.Handle("POST", "/mailbox/login", "mailbox_login", handleMailboxLogin(sessions, mailboxes, limiter), throttled...)
+	router.Handle("POST", "/mailbox/password", "mailbox_password", handleMailboxPassword(sessions, mailboxes, policy, limiter), throttled...)
+	router.Handle("POST", "/mailbox/reset", "mailbox_reset", handleMailboxReset(mailboxes, notifier, cfg.GetPasswordResetTTL()), api...)
+	router.Handle("POST", "/mailbox/reset/confirm", "mailbox_reset_confirm", handleResetConfirm(sessions, mailboxes, policy, limiter), throttled...)
+	router.Handle("POST", "/mailbox/quota-warning", "mailbox_quota_warning", handleQuotaWarning(notifier), api...)
+
+	if dkim, err = NewDKIMStore(cfg, db); err != nil {
+		log.Critical(err.Error())
+	}
+
+	router.Handle("GET", "/dkim", "list_dkim_keys", handleDKIM(dkim), api...)
+	router.Handle("POST", "/dkim", "create_dkim_key", handleDKIM(dkim), api...)
+	router.Handle("GET", "/dkim/export", "export_dkim_keys", handleDKIMExport(dkim), api...)
+	router.Handle("POST", "/dkim/sync", "sync_dkim_keys", handleDKIMSync(dkim), api...)
+	router.Handle("POST", "/dkim/{id}/rotate", "rotate_dkim_key", handleDKIMRotate(dkim), api...)
+	router.Handle("DELETE", "/dkim/{id}", "retire_dkim_key", handleDKIMRetire(dkim), api...)
+	router.Handle("GET", "/dns/{domain}", "check_dns", handleDNS(NewDNSChecker(cfg, dkim)), api...)
+
+	router.Handle("GET", "/tenants", "list_tenants", handleTenants(NewTenantStore(db)), api...)
+	router.Handle("POST", "/tenants", "create_tenant", handleTenants(NewTenantStore(db)), api...)
+	router.Handle("GET", "/tenants/{id}", "get_tenant", handleTenants(NewTenantStore(db)), api...)
+	router.Handle("PUT", "/tenants/{id}", "update_tenant", handleTenants(NewTenantStore(db)), api...)
+
+	router.Handle("GET", "/domains", "list_domains", handleDomains(db), api...)
+	router.Handle("POST", "/domains", "create_domain", handleDomains(db), api...)
+	router.Handle("GET", "/domains/{domain}", "get_domain", handleDomain(db), api...)
+	router.Handle("PUT", "/domains/{domain}", "update_domain", handleDomain(db), api...)
+	router.Handle("DELETE", "/domains/{domain}", "delete_domain", handleDomain(db), api...)
+	router.Handle("GET", "/domains/{domain}/mailboxes", "list_domain_mailboxes", handleMailboxes(db), api...)
+	router.Handle("POST", "/domains/{domain}/mailboxes", "create_mailbox", handleMailboxes(db), api...)
+	router.Handle("GET", "/domains/{domain}/mailboxes/{local}", "get_mailbox", handleMailbox(db), api...)
+	router.Handle("PUT", "/domains/{domain}/mailboxes/{local}", "update_mailbox", handleMailbox(db), api...)
+	router.Handle("DELETE", "/domains/{domain}/mailboxes/{local}", "delete_mailbox", handleMailbox(db), api...)
+	router.Handle("GET", "/domains/{domain}/aliases", "list_domain_aliases", handleAliases(db), api...)
+	router.Handle("POST", "/domains/{domain}/aliases", "create_alias", handleAliases(db), api...)
+	router.Handle("GET", "/domains/{domain}/aliases/{local}", "get_alias", handleAlias(db), api...)
+	router.Handle("PUT", "/domains/{domain}/aliases/{local}", "update_alias", handleAlias(db), api...)
+	router.Handle("GET", "/mailboxes", "list_mailboxes", handleAddresses(db, "mailboxes"), api...)
+	router.Handle("GET", "/aliases", "list_aliases", handleAddresses(db, "aliases"), api...)
+
+	router.Handle("POST", "/import", "import", handleImport(db), throttled...)
+	router.Handle("GET", "/export", "export", handleExport(db), api...)
+
+	activity = NewActivity(cfg.GetStreamBuffer())
+	router.Handle("GET", "/events", "stream_events", handleEvents(activity, time.Duration(cfg.GetStreamKeepalive())*time.Second), api...)
+
+	router.Handle("GET", "/webhooks", "list_webhooks", handleWebhooks(NewWebhookStore(db)), api...)
+	router.Handle("POST", "/webhooks", "create_webhook", handleWebhooks(NewWebhookStore(db)), api...)
+	router.Handle("GET", "/webhooks/{id}", "get_webhook", handleWebhooks(NewWebhookStore(db)), api...)
+	router.Handle("PUT", "/webhooks/{id}", "update_webhook", handleWebhooks(NewWebhookStore(db)), api...)
+	router.Handle("DELETE", "/webhooks/{id}", "delete_webhook", handleWebhooks(NewWebhookStore(db)), api...)
+	router.Handle("GET", "/webhooks/{id}/deliveries", "list_webhook_deliveries", handleWebhookDeliveries(NewWebhookStore(db)), api...)
+	router.Handle("POST", "/webhooks/{id}/replay", "replay_webhook", handleWebhookReplay(NewWebhookStore(db)), api...)
+
+	router.Handle("GET", "/openapi.json", "openapi", handleOpenAPI(sessions), api...)
+	router.Handle("GET", "/csrf", "csrf", handleCSRF, api...)
+	router.Handle("GET", "/tokens", "list_tokens", handleTokens(tokens), api...)
+	router.Handle("POST", "/tokens", "create_token", handleTokens(tokens), api...)
+	router.Handle("DELETE", "/tokens/{id}", "revoke_token", handleToken(tokens), api...)
+	router.Handle("GET", "/sessions", "list_sessions", handleSessions(sessions), api...)
+	router.Handle("DELETE", "/sessions", "kill_sessions", handleSessions(sessions), api...)
+	router.Handle("DELETE", "/sessions/{id}", "kill_session", handleSessions(sessions), api...)
+
+	if cfg.Server.TLS == nil {
+		err = http.ListenAndServe(cfg.Server.Listen, router)
+	} else {
+		if reloader, err = NewTLSReloader(cfg.Server.TLS); err != nil {
+			log.Critical(err.Error())
+		}
+
+		go reloadOnHangup(reloader)
+
+		server := &http.Server{
+			Addr:      cfg.Server.Listen,
+			Handler:   router,
+			TLSConfig: reloader.Config(),
+		}
+		err = server.ListenAndServeTLS("", "")
+	}
+
+	log.Critical(err.Error())
 }
 
-func handleRoot(w http.ResponseWriter, ctx *Context) {
-	ctx.s.Set("up", "tralala")
+// Reload TLS certificates on SIGHUP
+func reloadOnHangup(reloader *TLSReloader) {
+	var hup = make(chan os.Signal, 1)
+
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := reloader.Reload(); err != nil {
+			log.Error("Can't reload TLS certificates: %s", err.Error())
+		} else {
+			log.Notice("TLS certificates reloaded")
+		}
+	}
 }
 
-// Create database table
-func dbTablePrepare(db *sql.DB) error {
-	_, err := db.Exec(
-		"CREATE TABLE IF NOT EXISTS `msm_session`(" +
-			"`id` varchar(255), " +
-			"`started` int, " +
-			"`updated` int, " +
-			"`data` blob, " +
-			"PRIMARY KEY(`id`)" +
-			") Engine=MyISAM",
-	)
+func serveMetrics(listen string) {
+	var mux = http.NewServeMux()
+
+	mux.Handle("/metrics", metrics)
 
-	return err
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.Error("Metrics listener: %s", err.Error())
+	}
 }
 
 // Exit handler
@@ -95,6 +285,10 @@ func destruct(c chan os.Signal, args ...interface{}) {
 
 	for _, item := range args {
 		switch item.(type) {
+		case *Notifier:
+			item.(*Notifier).Close()
+		case *WebhookDispatcher:
+			item.(*WebhookDispatcher).Close()
 		case *Provider:
 			item.(*Provider).Flush()
 		case *Log:
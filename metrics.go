@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metrics = NewMetricRegistry()
+
+	metricSessionLoads = metrics.Counter("msm_session_loads_total",
+		"Sessions restored from the database.")
+	metricSessionSaves = metrics.Counter("msm_session_saves_total",
+		"Sessions saved to the database.")
+	metricSessionCreates = metrics.Counter("msm_session_creates_total",
+		"New sessions stored in the database.")
+	metricSessionGC = metrics.Counter("msm_session_gc_deleted_total",
+		"Expired sessions deleted from the database by garbage collector.")
+	metricDBQuery = metrics.Histogram("msm_db_query_duration_seconds",
+		"Database query latency.", DefBuckets, "query")
+	metricHTTPRequests = metrics.Counter("msm_http_requests_total",
+		"HTTP requests by route and status.", "route", "status")
+	metricHTTPDuration = metrics.Histogram("msm_http_request_duration_seconds",
+		"HTTP request latency by route and status.", DefBuckets, "route", "status")
+	metricNotifications = metrics.Counter("msm_notifications_total",
+		"Notification deliveries by template and status.", "template", "status")
+	metricWebhooks = metrics.Counter("msm_webhook_deliveries_total",
+		"Webhook deliveries by event and status.", "event", "status")
+)
+
+// Metric with the text exposition
+type Collector interface {
+	Write(w io.Writer)
+}
+
+// Set of metrics served in the Prometheus text format
+type MetricRegistry struct {
+	lock       sync.Mutex
+	collectors []Collector
+}
+
+func NewMetricRegistry() *MetricRegistry {
+	return &MetricRegistry{
+		collectors: make([]Collector, 0),
+	}
+}
+
+// Register counter with the label names
+func (this *MetricRegistry) Counter(name, help string, labels ...string) (c *CounterVec) {
+	c = &CounterVec{
+		desc:   desc{name, help, "counter", labels},
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+
+	this.Register(c)
+
+	return
+}
+
+// Register gauge read by the callback on scrape
+func (this *MetricRegistry) GaugeFunc(name, help string, fn func() float64) (g *GaugeFunc) {
+	g = &GaugeFunc{
+		desc: desc{name, help, "gauge", nil},
+		fn:   fn,
+	}
+
+	this.Register(g)
+
+	return
+}
+
+// Register histogram with the buckets upper bounds and label names
+func (this *MetricRegistry) Histogram(name, help string, buckets []float64, labels ...string) (h *HistogramVec) {
+	h = &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+		series:  make(map[string][]string),
+	}
+
+	this.Register(h)
+
+	return
+}
+
+func (this *MetricRegistry) Register(c Collector) {
+	this.lock.Lock()
+	this.collectors = append(this.collectors, c)
+	this.lock.Unlock()
+}
+
+func (this *MetricRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf = bytes.NewBuffer(nil)
+
+	this.lock.Lock()
+	for _, c := range this.collectors {
+		c.Write(buf)
+	}
+	this.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Metric description
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (this *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", this.name, this.help, this.name, this.kind)
+}
+
+// Label pairs for the values, extra pair is appended if given
+func (this *desc) pairs(values []string, extra ...string) string {
+	var items = make([]string, 0, len(values)+1)
+
+	for i, v := range values {
+		items = append(items, this.labels[i]+"="+escapeLabel(v))
+	}
+
+	if len(extra) == 2 {
+		items = append(items, extra[0]+"="+escapeLabel(extra[1]))
+	}
+
+	if len(items) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(items, ",") + "}"
+}
+
+// Series key by label values
+func (this *desc) key(values []string) string {
+	if len(values) != len(this.labels) {
+		panic(fmt.Sprintf("Metric %s expects %d label values, got %d", this.name, len(this.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// Monotonic counter
+type CounterVec struct {
+	desc
+
+	lock   sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func (this *CounterVec) Inc(labels ...string) {
+	this.Add(1, labels...)
+}
+
+func (this *CounterVec) Add(v float64, labels ...string) {
+	var key = this.key(labels)
+
+	this.lock.Lock()
+	if _, ok := this.series[key]; !ok {
+		this.series[key] = append([]string{}, labels...)
+	}
+	this.values[key] += v
+	this.lock.Unlock()
+}
+
+func (this *CounterVec) Write(w io.Writer) {
+	this.header(w)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.labels) == 0 && len(this.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", this.name)
+	}
+
+	for _, key := range sortedKeys(this.series) {
+		fmt.Fprintf(w, "%s%s %s\n", this.name, this.pairs(this.series[key]), formatFloat(this.values[key]))
+	}
+}
+
+// Gauge value from the callback
+type GaugeFunc struct {
+	desc
+
+	fn func() float64
+}
+
+func (this *GaugeFunc) Write(w io.Writer) {
+	this.header(w)
+	fmt.Fprintf(w, "%s %s\n", this.name, formatFloat(this.fn()))
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram with the cumulative buckets
+type HistogramVec struct {
+	desc
+
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+	series map[string][]string
+}
+
+func (this *HistogramVec) Observe(v float64, labels ...string) {
+	var key = this.key(labels)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	h, ok := this.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(this.buckets))}
+
+		this.values[key] = h
+		this.series[key] = append([]string{}, labels...)
+	}
+
+	for i, le := range this.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// Observe duration since the start point
+func (this *HistogramVec) Since(start time.Time, labels ...string) {
+	this.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (this *HistogramVec) Write(w io.Writer) {
+	this.header(w)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, key := range sortedKeys(this.series) {
+		var (
+			h      = this.values[key]
+			labels = this.series[key]
+		)
+
+		for i, le := range this.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, this.pairs(labels, "le", formatFloat(le)), h.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, this.pairs(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.name, this.pairs(labels), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.name, this.pairs(labels), h.count)
+	}
+}
+
+// Response writer keeping status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusWriter) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+	}
+
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *statusWriter) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+
+	return this.ResponseWriter.Write(b)
+}
+
+// Streamed response, e.g. server-sent events
+func (this *statusWriter) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Count requests and latency of the handler by route name and status
+func instrumentHandler(route string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			sw    = &statusWriter{ResponseWriter: w}
+		)
+
+		fn(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		status := strconv.Itoa(sw.status)
+		metricHTTPRequests.Inc(route, status)
+		metricHTTPDuration.Since(start, route, status)
+	}
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+
+	return `"` + v + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) (keys []string) {
+	keys = make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_MetricsTextExposition(t *testing.T) {
+	var (
+		reg     = NewMetricRegistry()
+		counter = reg.Counter("test_requests_total", "Requests.", "route", "status")
+		hist    = reg.Histogram("test_duration_seconds", "Duration.", []float64{.1, 1}, "query")
+		_       = reg.GaugeFunc("test_active", "Active.", func() float64 { return 3 })
+	)
+
+	counter.Inc("root", "200")
+	counter.Add(2, "root", "500")
+	counter.Inc("quo\"te", "200")
+	hist.Observe(.05, "select")
+	hist.Observe(.5, "select")
+	hist.Observe(5, "select")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	reg.ServeHTTP(w, r)
+
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="root",status="200"} 1`,
+		`test_requests_total{route="root",status="500"} 2`,
+		`test_requests_total{route="quo\"te",status="200"} 1`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{query="select",le="0.1"} 1`,
+		`test_duration_seconds_bucket{query="select",le="1"} 2`,
+		`test_duration_seconds_bucket{query="select",le="+Inf"} 3`,
+		`test_duration_seconds_sum{query="select"} 5.55`,
+		`test_duration_seconds_count{query="select"} 3`,
+		"test_active 3",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line `%s` in the output:\n%s", line, body)
+		}
+	}
+}
+
+func Test_InstrumentHandlerStatus(t *testing.T) {
+	var handler = instrumentHandler("test_route", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	handler(w, r)
+
+	out := httptest.NewRecorder()
+	metrics.ServeHTTP(out, r)
+
+	if !strings.Contains(out.Body.String(), `msm_http_requests_total{route="test_route",status="404"} 1`) {
+		t.Errorf("Expected request counter with status 404")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Database schema changes applied in order,
+// schema version is the number of applied items
+var migrations = []string{
+	"CREATE TABLE IF NOT EXISTS `msm_session`(" +
+		"`id` varchar(255), " +
+		"`started` int, " +
+		"`updated` int, " +
+		"`data` blob, " +
+		"PRIMARY KEY(`id`)" +
+		") Engine=MyISAM",
+	"CREATE TABLE IF NOT EXISTS `msm_token`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`name` varchar(255), " +
+		"`prefix` varchar(32), " +
+		"`hash` char(64), " +
+		"`role` varchar(32), " +
+		"`scopes` text, " +
+		"`created` int, " +
+		"`expires` int, " +
+		"`last_used` int, " +
+		"`revoked` tinyint, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`prefix`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_staff`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`login` varchar(255), " +
+		"`password` varchar(255), " +
+		"`role` varchar(32), " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`login`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_lockout`(" +
+		"`name` varchar(255), " +
+		"`until` int, " +
+		"PRIMARY KEY(`name`)" +
+		")",
+	"ALTER TABLE `msm_staff` " +
+		"ADD `totp_secret` varchar(64), " +
+		"ADD `totp_enabled` tinyint DEFAULT 0, " +
+		"ADD `totp_last` bigint DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS `msm_staff_recovery`(" +
+		"`staff_id` int, " +
+		"`hash` char(64), " +
+		"`used` tinyint, " +
+		"PRIMARY KEY(`staff_id`, `hash`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_mailbox`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`address` varchar(255), " +
+		"`password` varchar(255), " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"`updated` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`address`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_reset`(" +
+		"`hash` char(64), " +
+		"`mailbox_id` int, " +
+		"`created` int, " +
+		"`expires` int, " +
+		"`used` tinyint, " +
+		"PRIMARY KEY(`hash`), " +
+		"KEY(`mailbox_id`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_dkim`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`domain` varchar(255), " +
+		"`selector` varchar(63), " +
+		"`algorithm` varchar(16), " +
+		"`private` blob, " +
+		"`public` text, " +
+		"`state` varchar(16), " +
+		"`created` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`domain`, `selector`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_domain`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`name` varchar(255), " +
+		"`description` varchar(255), " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`name`)" +
+		")",
+	"ALTER TABLE `msm_mailbox` " +
+		"ADD `domain` varchar(255), " +
+		"ADD `name` varchar(255), " +
+		"ADD `quota` bigint DEFAULT 0, " +
+		"ADD KEY(`domain`)",
+	"CREATE TABLE IF NOT EXISTS `msm_alias`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`address` varchar(255), " +
+		"`domain` varchar(255), " +
+		"`goto` text, " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`address`), " +
+		"KEY(`domain`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_tenant`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`parent` int DEFAULT 0, " +
+		"`kind` varchar(16), " +
+		"`name` varchar(255), " +
+		"`max_domains` int DEFAULT 0, " +
+		"`max_mailboxes` int DEFAULT 0, " +
+		"`max_aliases` int DEFAULT 0, " +
+		"`max_quota` bigint DEFAULT 0, " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"PRIMARY KEY(`id`), " +
+		"UNIQUE KEY(`name`), " +
+		"KEY(`parent`)" +
+		")",
+	"ALTER TABLE `msm_domain` " +
+		"ADD `tenant_id` int DEFAULT 0, " +
+		"ADD KEY(`tenant_id`)",
+	"ALTER TABLE `msm_staff` ADD `tenant_id` int DEFAULT 0",
+	"ALTER TABLE `msm_token` ADD `tenant_id` int DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS `msm_webhook`(" +
+		"`id` int AUTO_INCREMENT, " +
+		"`url` varchar(2048), " +
+		"`secret` varchar(64), " +
+		"`events` text, " +
+		"`active` tinyint, " +
+		"`created` int, " +
+		"`tenant_id` int DEFAULT 0, " +
+		"PRIMARY KEY(`id`), " +
+		"KEY(`tenant_id`)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS `msm_webhook_outbox`(" +
+		"`id` bigint AUTO_INCREMENT, " +
+		"`webhook_id` int, " +
+		"`event` varchar(64), " +
+		"`payload` mediumtext, " +
+		"`created` int, " +
+		"`attempts` int DEFAULT 0, " +
+		"`next_attempt` int, " +
+		"`delivered` int DEFAULT 0, " +
+		"`last_error` varchar(255), " +
+		"PRIMARY KEY(`id`), " +
+		"KEY(`webhook_id`, `created`), " +
+		"KEY(`delivered`, `next_attempt`)" +
+		")",
+	"ALTER TABLE `msm_session` " +
+		"ADD `principal_kind` varchar(16) DEFAULT '', " +
+		"ADD `principal_id` int DEFAULT 0, " +
+		"ADD `principal` varchar(255) DEFAULT '', " +
+		"ADD `tenant_id` int DEFAULT 0, " +
+		"ADD `ip` varchar(64) DEFAULT '', " +
+		"ADD `user_agent` varchar(255) DEFAULT '', " +
+		"ADD KEY(`principal_kind`, `principal`)",
+	"ALTER TABLE `msm_session` ADD `agent_hash` char(64) DEFAULT ''",
+}
+
+// Apply pending migrations
+func migrate(db *sql.DB) (err error) {
+	var version int
+
+	_, err = db.Exec(
+		"CREATE TABLE IF NOT EXISTS `msm_schema`(" +
+			"`version` int, " +
+			"`applied` int, " +
+			"PRIMARY KEY(`version`)" +
+			")",
+	)
+	if err != nil {
+		return
+	}
+
+	if version, err = schemaVersion(db); err != nil {
+		return
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err = db.Exec(migrations[version]); err != nil {
+			return
+		}
+
+		_, err = db.Exec("INSERT INTO `msm_schema`(`version`, `applied`) VALUES(?, ?)", version+1, time.Now().Unix())
+		if err != nil {
+			return
+		}
+
+		log.Info("Database schema migrated to version %d", version+1)
+	}
+
+	return
+}
+
+// Last applied migration number
+func schemaVersion(db *sql.DB) (version int, err error) {
+	err = db.QueryRow("SELECT COALESCE(MAX(`version`), 0) FROM `msm_schema`").Scan(&version)
+
+	return
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const notifyQueueLen = 100
+
+var ErrQueueFull = errors.New("Notification queue is full")
+
+// Built-in templates: subject line, empty line and body
+var notifyTemplates = map[string]string{
+	"password_reset": "Subject: Password reset for {{.Address}}\n\n" +
+		"A password reset was requested for the mailbox {{.Address}}.\n\n" +
+		"Reset token: {{.Token}}\n\n" +
+		"The token can be used once and expires at {{.Expires}}.\n",
+	"quota_warning": "Subject: Mailbox {{.Address}} is {{.Percent}}% full\n\n" +
+		"The mailbox {{.Address}} uses {{.Used}} of {{.Quota}} bytes.\n" +
+		"Delete old messages to keep receiving mail.\n",
+	"lockout": "Subject: {{.Key}} is locked\n\n" +
+		"The key {{.Key}} is locked until {{.Until}} after {{.Failures}} failed attempts.\n",
+}
+
+// Mail message
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// RFC 5322 message with the quoted-printable body
+func (this *Message) Bytes() []byte {
+	var (
+		buf    bytes.Buffer
+		domain = "localhost"
+	)
+
+	if i := strings.LastIndex(this.From, "@"); i >= 0 {
+		domain = this.From[i+1:]
+	}
+
+	fmt.Fprintf(&buf, "From: %s\r\n", this.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(this.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", this.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", RandSecureId(24), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.Replace(this.Body, "\n", "\r\n", -1)))
+	qp.Close()
+
+	return buf.Bytes()
+}
+
+// Message delivery
+type Sender interface {
+	Send(msg *Message) error
+}
+
+// Sender constructors by the name
+var senders = map[string]func(cfg *Notify) (Sender, error){
+	"smtp":    NewSMTPSender,
+	"maildir": NewMaildirSender,
+	"log":     func(cfg *Notify) (Sender, error) { return &LogSender{}, nil },
+}
+
+func NewSender(cfg *Config) (Sender, error) {
+	var (
+		name   = cfg.GetNotifySender()
+		notify = cfg.Notify
+	)
+
+	if notify == nil {
+		notify = &Notify{}
+	}
+
+	if fn, ok := senders[name]; ok {
+		return fn(notify)
+	}
+
+	return nil, fmt.Errorf("Unknown notification sender `%s`", name)
+}
+
+// Send with the SMTP relay
+type SMTPSender struct {
+	addr string
+	host string
+	auth smtp.Auth
+	tls  bool
+}
+
+func NewSMTPSender(cfg *Notify) (Sender, error) {
+	var (
+		sender = &SMTPSender{}
+		err    error
+	)
+
+	if cfg.SMTP == nil || cfg.SMTP.Addr == "" {
+		return nil, errors.New("SMTP address is not configured")
+	}
+
+	sender.addr = cfg.SMTP.Addr
+	sender.tls = cfg.SMTP.TLS
+
+	if sender.host, _, err = net.SplitHostPort(sender.addr); err != nil {
+		return nil, err
+	}
+
+	if cfg.SMTP.Username != "" {
+		sender.auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, sender.host)
+	}
+
+	return sender, nil
+}
+
+func (this *SMTPSender) Send(msg *Message) (err error) {
+	var (
+		conn   net.Conn
+		client *smtp.Client
+	)
+
+	if !this.tls {
+		return smtp.SendMail(this.addr, this.auth, msg.From, msg.To, msg.Bytes())
+	}
+
+	if conn, err = tls.Dial("tcp", this.addr, &tls.Config{ServerName: this.host}); err != nil {
+		return
+	}
+
+	if client, err = smtp.NewClient(conn, this.host); err != nil {
+		conn.Close()
+		return
+	}
+
+	defer client.Close()
+
+	if this.auth != nil {
+		if err = client.Auth(this.auth); err != nil {
+			return
+		}
+	}
+
+	if err = client.Mail(msg.From); err != nil {
+		return
+	}
+
+	for _, rcpt := range msg.To {
+		if err = client.Rcpt(rcpt); err != nil {
+			return
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return
+	}
+
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	return client.Quit()
+}
+
+// Deliver to the maildir, for testing
+type MaildirSender struct {
+	dir string
+}
+
+func NewMaildirSender(cfg *Notify) (Sender, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("Maildir directory is not configured")
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MaildirSender{dir: cfg.Dir}, nil
+}
+
+// Write to tmp and move to new
+func (this *MaildirSender) Send(msg *Message) (err error) {
+	var (
+		host, _ = os.Hostname()
+		name    = fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), RandStringId(8), host)
+		tmp     = filepath.Join(this.dir, "tmp", name)
+	)
+
+	if err = ioutil.WriteFile(tmp, msg.Bytes(), 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, filepath.Join(this.dir, "new", name))
+}
+
+// Only log messages. Body is not logged, it may contain the reset
+// tokens
+type LogSender struct{}
+
+func (this *LogSender) Send(msg *Message) error {
+	log.With("to", strings.Join(msg.To, ", "), "subject", msg.Subject, "length", len(msg.Body)).Info("Notification")
+
+	return nil
+}
+
+type notifyTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Queued message
+type delivery struct {
+	name    string
+	msg     *Message
+	attempt int
+}
+
+// Render templates and deliver queued messages, failed ones
+// are retried with the exponential backoff
+type Notifier struct {
+	sender    Sender
+	from      string
+	retries   int
+	backoff   time.Duration
+	templates map[string]*notifyTemplate
+
+	lock    sync.Mutex
+	closed  bool
+	queue   chan *delivery
+	stopped chan bool
+}
+
+func NewNotifier(cfg *Config, sender Sender) (notifier *Notifier, err error) {
+	notifier = &Notifier{
+		sender:    sender,
+		from:      cfg.GetNotifyFrom(),
+		retries:   cfg.GetNotifyRetries(),
+		backoff:   time.Duration(cfg.GetNotifyBackoff()) * time.Second,
+		templates: make(map[string]*notifyTemplate),
+		queue:     make(chan *delivery, notifyQueueLen),
+		stopped:   make(chan bool),
+	}
+
+	for name, text := range notifyTemplates {
+		if err = notifier.Parse(name, text); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Notify != nil && cfg.Notify.Templates != "" {
+		if err = notifier.Load(cfg.Notify.Templates); err != nil {
+			return nil, err
+		}
+	}
+
+	go notifier.run()
+
+	return
+}
+
+// Add or replace template
+func (this *Notifier) Parse(name, text string) (err error) {
+	var (
+		t     = &notifyTemplate{}
+		parts = strings.SplitN(text, "\n\n", 2)
+	)
+
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject:") {
+		return fmt.Errorf("Template %s must start with the subject line", name)
+	}
+
+	if t.subject, err = template.New(name).Parse(strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject:"))); err != nil {
+		return
+	}
+
+	if t.body, err = template.New(name).Parse(parts[1]); err != nil {
+		return
+	}
+
+	this.templates[name] = t
+
+	return
+}
+
+// Read `<name>.tmpl` files from the directory
+func (this *Notifier) Load(dir string) (err error) {
+	var files []string
+
+	if files, err = filepath.Glob(filepath.Join(dir, "*.tmpl")); err != nil {
+		return
+	}
+
+	for _, file := range files {
+		var text []byte
+
+		if text, err = ioutil.ReadFile(file); err != nil {
+			return
+		}
+
+		if err = this.Parse(strings.TrimSuffix(filepath.Base(file), ".tmpl"), string(text)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Render template and queue the message
+func (this *Notifier) Notify(name string, to []string, data interface{}) (err error) {
+	var (
+		t       *notifyTemplate
+		ok      bool
+		subject bytes.Buffer
+		body    bytes.Buffer
+	)
+
+	if t, ok = this.templates[name]; !ok {
+		return fmt.Errorf("Unknown notification template %s", name)
+	}
+
+	// Recipients are written to the header as is
+	for _, addr := range to {
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("Invalid recipient %q", addr)
+		}
+	}
+
+	if err = t.subject.Execute(&subject, data); err != nil {
+		return
+	}
+
+	if err = t.body.Execute(&body, data); err != nil {
+		return
+	}
+
+	return this.enqueue(&delivery{
+		name: name,
+		msg: &Message{
+			From:    this.from,
+			To:      to,
+			Subject: subject.String(),
+			Body:    body.String(),
+		},
+	})
+}
+
+// Stop accepting messages and deliver queued ones,
+// pending retries are dropped
+func (this *Notifier) Close() {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.queue)
+	this.lock.Unlock()
+
+	<-this.stopped
+}
+
+func (this *Notifier) enqueue(d *delivery) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return errors.New("Notifier is closed")
+	}
+
+	select {
+	case this.queue <- d:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (this *Notifier) run() {
+	for d := range this.queue {
+		this.deliver(d)
+	}
+
+	close(this.stopped)
+}
+
+func (this *Notifier) deliver(d *delivery) {
+	var err = this.sender.Send(d.msg)
+
+	if err == nil {
+		metricNotifications.Inc(d.name, "sent")
+		return
+	}
+
+	if d.attempt++; d.attempt >= this.retries {
+		metricNotifications.Inc(d.name, "failed")
+		log.With("template", d.name, "to", strings.Join(d.msg.To, ", "), "error", err).
+			Error("Notification dropped", "attempts", d.attempt)
+		return
+	}
+
+	metricNotifications.Inc(d.name, "retry")
+
+	delay := this.backoff << uint(d.attempt-1)
+	log.With("template", d.name, "error", err).Warning("Notification failed", "retry", delay.String())
+
+	time.AfterFunc(delay, func() {
+		if err := this.enqueue(d); err != nil {
+			log.With("template", d.name, "error", err).Error("Notification dropped")
+		}
+	})
+}
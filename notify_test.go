@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sender failing the first calls
+type SenderMock struct {
+	fails int
+	calls int
+	sent  chan *Message
+}
+
+func (this *SenderMock) Send(msg *Message) error {
+	if this.calls++; this.calls <= this.fails {
+		return errors.New("Connection refused")
+	}
+
+	this.sent <- msg
+
+	return nil
+}
+
+func Test_NotifierRetry(t *testing.T) {
+	var (
+		sender      = &SenderMock{fails: 2, sent: make(chan *Message, 1)}
+		notifier, _ = NewNotifier(&Config{Notify: &Notify{From: "msm@example.com", Retries: 3}}, sender)
+	)
+
+	notifier.backoff = time.Millisecond
+	defer notifier.Close()
+
+	err := notifier.Notify("lockout", []string{"admin@example.com"}, LockInfo{Key: "staff:admin", Failures: 5, Until: time.Unix(1500000000, 0)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	select {
+	case msg := <-sender.sent:
+		if msg.Subject != "staff:admin is locked" || msg.From != "msm@example.com" || !strings.Contains(msg.Body, "after 5 failed attempts") {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message is not delivered")
+	}
+
+	if sender.calls != 3 {
+		t.Errorf("Expected 3 attempts, but got %d", sender.calls)
+	}
+
+	if err := notifier.Notify("unknown", nil, nil); err == nil {
+		t.Errorf("Expected error on unknown template")
+	}
+
+	if err := notifier.Notify("lockout", []string{"admin@example.com\r\nBcc: other@example.net"}, LockInfo{}); err == nil {
+		t.Errorf("Expected error on header in the recipient")
+	}
+}
+
+func Test_MaildirSenderAndTemplates(t *testing.T) {
+	var (
+		dir, _ = ioutil.TempDir("", "msm")
+		cfg    = &Config{Notify: &Notify{Sender: "maildir", Dir: filepath.Join(dir, "Maildir"), Templates: dir}}
+	)
+
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "password_reset.tmpl"), []byte("Subject: Ваш пароль {{.Address}}\n\nToken {{.Token}}\n"), 0600)
+
+	sender, err := NewSender(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	notifier, err := NewNotifier(cfg, sender)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	notifier.Notify("password_reset", []string{"owner@example.net"}, map[string]string{"Address": "user@example.com", "Token": "secret"})
+	notifier.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "Maildir", "new", "*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in maildir, but got %d", len(files))
+	}
+
+	data, _ := ioutil.ReadFile(files[0])
+	for _, expected := range []string{"To: owner@example.net\r\n", "Subject: =?utf-8?q?", "Token secret\r\n"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %q in message:\n%s", expected, data)
+		}
+	}
+
+	if _, err := NewSender(&Config{Notify: &Notify{Sender: "smtp"}}); err == nil {
+		t.Errorf("Expected error without SMTP address")
+	}
+}
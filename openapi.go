@@ -0,0 +1,885 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	OpenAPIVersion = "3.0.3"
+	apiSchemaRef   = "#/components/schemas/"
+	// Request body limit of the validated operations
+	apiMaxBody = 1 << 20
+	// Problem type of the rejected request body
+	ProblemValidation = "/openapi.json#/components/responses/ValidationFailed"
+)
+
+// Subset of the OpenAPI schema object checked by Validate
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+	MaxLength            int                `json:"maxLength,omitempty"`
+	MinItems             int                `json:"minItems,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	WriteOnly            bool               `json:"writeOnly,omitempty"`
+}
+
+// Check JSON value decoded with UseNumber, returns rejected fields
+func (this *Schema) Validate(value interface{}) []InvalidParam {
+	return this.validate(value, "", nil)
+}
+
+func (this *Schema) validate(value interface{}, name string, params []InvalidParam) []InvalidParam {
+	var schema = this
+
+	if this.Ref != "" {
+		schema = apiSchemas[strings.TrimPrefix(this.Ref, apiSchemaRef)]
+	}
+
+	if name == "" {
+		name = "body"
+	}
+
+	invalid := func(format string, args ...interface{}) []InvalidParam {
+		return append(params, InvalidParam{Name: name, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if value == nil {
+		return invalid("must not be null")
+	}
+
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("must be an object")
+		}
+
+		for _, field := range schema.Required {
+			if _, ok := obj[field]; !ok {
+				params = append(params, InvalidParam{Name: apiField(name, field), Reason: "is required"})
+			}
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if prop, ok := schema.Properties[key]; ok {
+				params = prop.validate(obj[key], apiField(name, key), params)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				params = append(params, InvalidParam{Name: apiField(name, key), Reason: "is not allowed"})
+			}
+		}
+
+		return params
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return invalid("must be an array")
+		}
+
+		if len(arr) < schema.MinItems {
+			return invalid("must have at least %d items", schema.MinItems)
+		}
+
+		for i, item := range arr {
+			params = schema.Items.validate(item, fmt.Sprintf("%s[%d]", name, i), params)
+		}
+
+		return params
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return invalid("must be a string")
+		}
+
+		switch n := len([]rune(str)); {
+		case n < schema.MinLength:
+			return invalid("must be at least %d characters", schema.MinLength)
+		case schema.MaxLength > 0 && n > schema.MaxLength:
+			return invalid("must be at most %d characters", schema.MaxLength)
+		case schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(str):
+			return invalid("must match %s", schema.Pattern)
+		}
+
+	case "integer":
+		num, ok := value.(json.Number)
+		if !ok {
+			return invalid("must be an integer")
+		}
+
+		i, err := num.Int64()
+		if err != nil {
+			return invalid("must be an integer")
+		}
+
+		if schema.Minimum != nil && i < *schema.Minimum {
+			return invalid("must be at least %d", *schema.Minimum)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid("must be a boolean")
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		var names []string
+
+		for _, v := range schema.Enum {
+			if v == value {
+				return params
+			}
+
+			names = append(names, fmt.Sprint(v))
+		}
+
+		return invalid("must be one of %s", strings.Join(names, ", "))
+	}
+
+	return params
+}
+
+func apiField(name, field string) string {
+	if name == "body" {
+		return field
+	}
+
+	return name + "." + field
+}
+
+func apiRef(name string) *Schema {
+	return &Schema{Ref: apiSchemaRef + name}
+}
+
+func apiString(max int) *Schema {
+	return &Schema{Type: "string", MaxLength: max}
+}
+
+// Integer with the minimum
+func apiInt(min int64) *Schema {
+	return &Schema{Type: "integer", Format: "int64", Minimum: &min}
+}
+
+func apiBool() *Schema {
+	return &Schema{Type: "boolean"}
+}
+
+func apiArray(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+// Object without the undocumented fields
+func apiObject(required []string, props map[string]*Schema) *Schema {
+	var closed = false
+
+	return &Schema{Type: "object", Required: required, Properties: props, AdditionalProperties: &closed}
+}
+
+func apiDescribe(schema *Schema, description string) *Schema {
+	schema.Description = description
+	return schema
+}
+
+func apiReadOnly(schema *Schema) *Schema {
+	schema.ReadOnly = true
+	return schema
+}
+
+// Response page of the list operation
+func apiPage(item string) *Schema {
+	return &Schema{Type: "object", Properties: map[string]*Schema{
+		"items": apiArray(apiRef(item)),
+		"next":  &Schema{Type: "string", Description: "Cursor of the next page, empty on the last page"},
+		"total": &Schema{Type: "integer", Format: "int64", Description: "Rows matching the filters, with count=1"},
+	}}
+}
+
+func domainSchema(required ...string) *Schema {
+	return apiObject(required, map[string]*Schema{
+		"id":          apiReadOnly(apiInt(1)),
+		"name":        &Schema{Type: "string", Pattern: `^[A-Za-z0-9.-]+$`, MinLength: 1, MaxLength: 255},
+		"description": apiString(255),
+		"active":      apiBool(),
+		"created":     apiReadOnly(apiInt(0)),
+		"tenant_id":   apiInt(0),
+	})
+}
+
+func mailboxSchema(required ...string) *Schema {
+	return apiObject(required, map[string]*Schema{
+		"id":            apiReadOnly(apiInt(1)),
+		"address":       &Schema{Type: "string", MinLength: 1, MaxLength: 255},
+		"domain":        apiString(255),
+		"name":          apiString(255),
+		"password":      &Schema{Type: "string", WriteOnly: true},
+		"password_hash": apiString(255),
+		"quota":         apiDescribe(apiInt(0), "Bytes, zero is unlimited"),
+		"active":        apiBool(),
+		"created":       apiReadOnly(apiInt(0)),
+	})
+}
+
+func aliasSchema(required ...string) *Schema {
+	return apiObject(required, map[string]*Schema{
+		"id":      apiReadOnly(apiInt(1)),
+		"address": &Schema{Type: "string", MinLength: 1, MaxLength: 255},
+		"domain":  apiString(255),
+		"goto":    apiArray(&Schema{Type: "string", MinLength: 1, MaxLength: 255}),
+		"active":  apiBool(),
+		"created": apiReadOnly(apiInt(0)),
+	})
+}
+
+func tenantSchema(required ...string) *Schema {
+	return apiObject(required, map[string]*Schema{
+		"id":            apiReadOnly(apiInt(1)),
+		"parent":        apiInt(0),
+		"kind":          &Schema{Type: "string", Enum: []interface{}{TenantReseller, TenantCustomer}},
+		"name":          &Schema{Type: "string", MinLength: 1, MaxLength: 255},
+		"max_domains":   apiInt(0),
+		"max_mailboxes": apiInt(0),
+		"max_aliases":   apiInt(0),
+		"max_quota":     apiInt(0),
+		"active":        apiBool(),
+		"created":       apiReadOnly(apiInt(0)),
+		"usage":         apiReadOnly(apiRef("TenantUsage")),
+	})
+}
+
+func webhookSchema(required ...string) *Schema {
+	var events = []interface{}{"*"}
+
+	for _, event := range webhookEvents {
+		events = append(events, event)
+	}
+
+	return apiObject(required, map[string]*Schema{
+		"id":        apiReadOnly(apiInt(1)),
+		"url":       &Schema{Type: "string", Format: "uri", MinLength: 1, MaxLength: 2048},
+		"secret":    apiDescribe(apiReadOnly(apiString(64)), "HMAC key of the signature, returned once on create"),
+		"events":    apiArray(&Schema{Type: "string", Enum: events}),
+		"active":    apiBool(),
+		"created":   apiReadOnly(apiInt(0)),
+		"tenant_id": apiReadOnly(apiInt(0)),
+	})
+}
+
+// Component schemas
+var apiSchemas = map[string]*Schema{
+	"Problem": {Type: "object", Properties: map[string]*Schema{
+		"type":           {Type: "string", Format: "uri-reference"},
+		"title":          {Type: "string"},
+		"status":         {Type: "integer"},
+		"detail":         {Type: "string"},
+		"invalid-params": apiArray(apiRef("InvalidParam")),
+	}},
+	"InvalidParam": {Type: "object", Properties: map[string]*Schema{
+		"name":   {Type: "string"},
+		"reason": {Type: "string"},
+	}},
+	"Login": apiObject([]string{"login", "password"}, map[string]*Schema{
+		"login":    {Type: "string", MinLength: 1, MaxLength: 255},
+		"password": {Type: "string", WriteOnly: true},
+	}),
+	"LoginCode": apiObject(nil, map[string]*Schema{
+		"code":          apiString(16),
+		"recovery_code": apiString(64),
+	}),
+	"Code": apiObject([]string{"code"}, map[string]*Schema{
+		"code": apiString(16),
+	}),
+	"Principal": {Type: "object", Properties: map[string]*Schema{
+		"Kind":   {Type: "string"},
+		"Id":     {Type: "integer", Format: "int64"},
+		"Name":   {Type: "string"},
+		"Role":   {Type: "string"},
+		"Scopes": apiArray(&Schema{Type: "string"}),
+		"Tenant": {Type: "integer", Format: "int64"},
+	}},
+	"LockInfo": {Type: "object", Properties: map[string]*Schema{
+		"key":      {Type: "string"},
+		"failures": {Type: "integer"},
+		"until":    {Type: "string", Format: "date-time"},
+	}},
+	"MailboxLogin": apiObject([]string{"address", "password"}, map[string]*Schema{
+		"address":  {Type: "string", MinLength: 1, MaxLength: 255},
+		"password": {Type: "string", WriteOnly: true},
+	}),
+	"MailboxPassword": apiObject([]string{"current", "password"}, map[string]*Schema{
+		"current":  {Type: "string", WriteOnly: true},
+		"password": {Type: "string", WriteOnly: true},
+	}),
+	"MailboxReset": apiObject([]string{"address"}, map[string]*Schema{
+		"address": {Type: "string", MinLength: 1, MaxLength: 255},
+		"notify":  {Type: "string", MaxLength: 255, Description: "Recipient of the reset token"},
+	}),
+	"QuotaWarning": apiObject([]string{"address", "used"}, map[string]*Schema{
+		"address": {Type: "string", MinLength: 1, MaxLength: 255},
+		"used":    {Type: "integer", Format: "int64", Description: "Used bytes"},
+	}),
+	"MailboxResetConfirm": apiObject([]string{"token", "password"}, map[string]*Schema{
+		"token":    {Type: "string", MinLength: 1},
+		"password": {Type: "string", WriteOnly: true},
+	}),
+	"DKIMKey": {Type: "object", Properties: map[string]*Schema{
+		"id":        {Type: "integer", Format: "int64"},
+		"domain":    {Type: "string"},
+		"selector":  {Type: "string"},
+		"algorithm": {Type: "string", Enum: []interface{}{DKIMRSA, DKIMEd25519}},
+		"state":     {Type: "string"},
+		"created":   {Type: "integer", Format: "int64"},
+	}},
+	"DKIMKeyRequest": apiObject([]string{"domain", "selector"}, map[string]*Schema{
+		"domain":    {Type: "string", MinLength: 1, MaxLength: 255},
+		"selector":  {Type: "string", MinLength: 1, MaxLength: 63},
+		"algorithm": {Type: "string", Enum: []interface{}{DKIMRSA, DKIMEd25519}},
+		"bits":      apiInt(0),
+	}),
+	"DKIMRotate": apiObject([]string{"selector"}, map[string]*Schema{
+		"selector": {Type: "string", MinLength: 1, MaxLength: 63},
+	}),
+	"DNSReport": {Type: "object", Properties: map[string]*Schema{
+		"domain": {Type: "string"},
+		"status": {Type: "string"},
+		"checks": apiArray(&Schema{Type: "object", Properties: map[string]*Schema{
+			"name":    {Type: "string"},
+			"status":  {Type: "string"},
+			"message": {Type: "string"},
+			"records": apiArray(&Schema{Type: "string"}),
+		}}),
+	}},
+	"Tenant":       tenantSchema("name", "kind"),
+	"TenantUpdate": tenantSchema(),
+	"TenantUsage": {Type: "object", Properties: map[string]*Schema{
+		"domains":   {Type: "integer", Format: "int64"},
+		"mailboxes": {Type: "integer", Format: "int64"},
+		"aliases":   {Type: "integer", Format: "int64"},
+		"quota":     {Type: "integer", Format: "int64"},
+	}},
+	"Domain":        domainSchema("name"),
+	"DomainUpdate":  domainSchema(),
+	"Mailbox":       mailboxSchema("address"),
+	"MailboxUpdate": mailboxSchema(),
+	"Alias":         aliasSchema("address", "goto"),
+	"AliasUpdate":   aliasSchema(),
+	"BulkReport": {Type: "object", Properties: map[string]*Schema{
+		"dry_run":   {Type: "boolean"},
+		"committed": {Type: "boolean"},
+		"domains":   {Type: "integer"},
+		"mailboxes": {Type: "integer"},
+		"aliases":   {Type: "integer"},
+		"errors": apiArray(&Schema{Type: "object", Properties: map[string]*Schema{
+			"row":   {Type: "integer"},
+			"type":  {Type: "string"},
+			"key":   {Type: "string"},
+			"error": {Type: "string"},
+		}}),
+	}},
+	"Token": {Type: "object", Properties: map[string]*Schema{
+		"id":        {Type: "integer", Format: "int64"},
+		"name":      {Type: "string"},
+		"prefix":    {Type: "string"},
+		"role":      {Type: "string"},
+		"scopes":    apiArray(&Schema{Type: "string"}),
+		"created":   {Type: "integer", Format: "int64"},
+		"expires":   {Type: "integer", Format: "int64"},
+		"last_used": {Type: "integer", Format: "int64"},
+		"revoked":   {Type: "boolean"},
+		"tenant_id": {Type: "integer", Format: "int64"},
+	}},
+	"Webhook":       webhookSchema("url", "events"),
+	"WebhookUpdate": webhookSchema(),
+	"WebhookDelivery": {Type: "object", Properties: map[string]*Schema{
+		"id":           {Type: "integer", Format: "int64"},
+		"webhook_id":   {Type: "integer", Format: "int64"},
+		"event":        {Type: "string"},
+		"created":      {Type: "integer", Format: "int64"},
+		"attempts":     {Type: "integer"},
+		"next_attempt": {Type: "integer", Format: "int64"},
+		"delivered":    {Type: "integer", Format: "int64"},
+		"last_error":   {Type: "string"},
+	}},
+	"WebhookReplay": apiObject(nil, map[string]*Schema{
+		"since": apiDescribe(apiInt(0), "Events created since the time"),
+		"all":   apiDescribe(apiBool(), "Delivered events too, not only the failed ones"),
+	}),
+	"Session": {Type: "object", Properties: map[string]*Schema{
+		"id":             apiDescribe(&Schema{Type: "string"}, "Hash of the session id"),
+		"principal_kind": {Type: "string"},
+		"principal_id":   {Type: "integer", Format: "int64"},
+		"principal":      {Type: "string"},
+		"tenant_id":      {Type: "integer", Format: "int64"},
+		"ip":             {Type: "string"},
+		"user_agent":     {Type: "string"},
+		"started":        {Type: "integer", Format: "int64"},
+		"updated":        {Type: "integer", Format: "int64"},
+		"cached":         {Type: "boolean"},
+	}},
+	"TokenRequest": apiObject([]string{"name", "role"}, map[string]*Schema{
+		"name":       {Type: "string", MinLength: 1, MaxLength: 255},
+		"role":       {Type: "string", MinLength: 1},
+		"scopes":     apiArray(&Schema{Type: "string", MinLength: 1}),
+		"expires_in": apiDescribe(apiInt(0), "Seconds, zero is no expiry"),
+	}),
+}
+
+// Query parameter
+type apiParam struct {
+	Name        string
+	Description string
+	Schema      *Schema
+}
+
+var sessionParams = []apiParam{
+	{"principal", "Staff login or mailbox address", &Schema{Type: "string"}},
+	{"kind", "Principal kind", &Schema{Type: "string", Enum: []interface{}{PrincipalStaff, PrincipalMailbox, PrincipalToken}}},
+}
+
+// Documented operation. Scope is the required principal scope,
+// empty for the public operations
+type apiOperation struct {
+	Method  string
+	Path    string
+	Name    string
+	Tag     string
+	Summary string
+	Scope   string
+	Query   []apiParam
+	// List parameters of the spec fields
+	List *ListSpec
+	// JSON body validated before the handler
+	Body *Schema
+	// Form body is accepted too and isn't validated
+	Form bool
+	// Raw body media types, not validated
+	Upload   []string
+	Status   int
+	Response *Schema
+	// Response media types other than JSON
+	Download []string
+}
+
+var apiOperations = []*apiOperation{
+	{Method: "GET", Path: "/healthz", Name: "healthz", Tag: "service", Summary: "Liveness probe", Status: http.StatusOK},
+	{Method: "GET", Path: "/readyz", Name: "readyz", Tag: "service", Summary: "Readiness probe", Status: http.StatusOK},
+	{Method: "GET", Path: "/openapi.json", Name: "openapi", Tag: "service", Summary: "This document", Status: http.StatusOK, Response: &Schema{Type: "object"}},
+	{Method: "GET", Path: "/csrf", Name: "csrf", Tag: "auth", Summary: "CSRF token of the session", Status: http.StatusOK,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"token": {Type: "string"}}}},
+
+	{Method: "POST", Path: "/login", Name: "login", Tag: "auth", Summary: "Staff login", Body: apiRef("Login"), Form: true,
+		Status: http.StatusOK, Response: apiRef("Principal")},
+	{Method: "POST", Path: "/login/totp", Name: "login_totp", Tag: "auth", Summary: "Second factor of the pending login", Body: apiRef("LoginCode"),
+		Status: http.StatusOK, Response: apiRef("Principal")},
+	{Method: "POST", Path: "/logout", Name: "logout", Tag: "auth", Summary: "Destroy the session", Status: http.StatusNoContent},
+	{Method: "POST", Path: "/totp/enroll", Name: "enroll_totp", Tag: "auth", Summary: "Start TOTP enrollment", Status: http.StatusOK,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"secret": {Type: "string"}, "uri": {Type: "string"}}}},
+	{Method: "POST", Path: "/totp/confirm", Name: "confirm_totp", Tag: "auth", Summary: "Enable TOTP with the code", Body: apiRef("Code"), Status: http.StatusOK,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"recovery_codes": apiArray(&Schema{Type: "string"})}}},
+	{Method: "DELETE", Path: "/totp", Name: "disable_totp", Tag: "auth", Summary: "Disable TOTP with the code", Body: apiRef("Code"), Status: http.StatusNoContent},
+	{Method: "GET", Path: "/lockouts", Name: "list_lockouts", Tag: "auth", Summary: "Locked login keys", Scope: "lockouts:admin",
+		Status: http.StatusOK, Response: apiArray(apiRef("LockInfo"))},
+	{Method: "DELETE", Path: "/lockouts", Name: "clear_lockouts", Tag: "auth", Summary: "Remove all locks", Scope: "lockouts:admin", Status: http.StatusNoContent},
+	{Method: "DELETE", Path: "/lockouts/{key}", Name: "clear_lockout", Tag: "auth", Summary: "Remove the lock", Scope: "lockouts:admin", Status: http.StatusNoContent},
+
+	{Method: "GET", Path: "/tokens", Name: "list_tokens", Tag: "tokens", Summary: "API tokens", Scope: "tokens:admin", List: tokenList,
+		Status: http.StatusOK, Response: apiPage("Token")},
+	{Method: "POST", Path: "/tokens", Name: "create_token", Tag: "tokens", Summary: "Issue API token, the secret is returned once", Scope: "tokens:admin",
+		Body: apiRef("TokenRequest"), Status: http.StatusCreated,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"token": {Type: "string"}, "detail": apiRef("Token")}}},
+	{Method: "DELETE", Path: "/tokens/{id}", Name: "revoke_token", Tag: "tokens", Summary: "Revoke API token", Scope: "tokens:admin", Status: http.StatusNoContent},
+	{Method: "GET", Path: "/sessions", Name: "list_sessions", Tag: "sessions", Summary: "Sessions of the scope, the last active first", Scope: "sessions:admin",
+		Query:  sessionParams,
+		Status: http.StatusOK, Response: apiArray(apiRef("Session"))},
+	{Method: "DELETE", Path: "/sessions", Name: "kill_sessions", Tag: "sessions", Summary: "Log out the principal or everyone", Scope: "sessions:admin",
+		Query:  append([]apiParam{{"all", "All sessions of the scope, required without principal", &Schema{Type: "boolean"}}}, sessionParams...),
+		Status: http.StatusOK, Response: &Schema{Type: "object", Properties: map[string]*Schema{"killed": {Type: "integer", Format: "int64"}}}},
+	{Method: "DELETE", Path: "/sessions/{id}", Name: "kill_session", Tag: "sessions", Summary: "Log out the session", Scope: "sessions:admin", Status: http.StatusNoContent},
+
+	{Method: "POST", Path: "/mailbox/login", Name: "mailbox_login", Tag: "mailbox", Summary: "Mailbox owner login", Body: apiRef("MailboxLogin"),
+		Status: http.StatusOK, Response: apiRef("Principal")},
+	{Method: "POST", Path: "/mailbox/password", Name: "mailbox_password", Tag: "mailbox", Summary: "Change own mailbox password", Scope: "self:password",
+		Body: apiRef("MailboxPassword"), Status: http.StatusNoContent},
+	{Method: "POST", Path: "/mailbox/reset", Name: "mailbox_reset", Tag: "mailbox", Summary: "Issue mailbox password reset token", Scope: "mailboxes:password",
+		Body: apiRef("MailboxReset"), Status: http.StatusCreated,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"token": {Type: "string"}, "expires": {Type: "integer", Format: "int64"}}}},
+	{Method: "POST", Path: "/mailbox/reset/confirm", Name: "mailbox_reset_confirm", Tag: "mailbox", Summary: "Set mailbox password with the reset token",
+		Body: apiRef("MailboxResetConfirm"), Status: http.StatusNoContent},
+	{Method: "POST", Path: "/mailbox/quota-warning", Name: "mailbox_quota_warning", Tag: "mailbox", Summary: "Mail the quota warning to the mailbox",
+		Scope: "mailboxes:write", Body: apiRef("QuotaWarning"), Status: http.StatusAccepted},
+
+	{Method: "GET", Path: "/dkim", Name: "list_dkim_keys", Tag: "dkim", Summary: "DKIM keys", Scope: "domains:read",
+		Query:  []apiParam{{"domain", "Keys of the domain", &Schema{Type: "string"}}},
+		Status: http.StatusOK, Response: apiArray(apiRef("DKIMKey"))},
+	{Method: "POST", Path: "/dkim", Name: "create_dkim_key", Tag: "dkim", Summary: "Generate DKIM key", Scope: "domains:dkim",
+		Body: apiRef("DKIMKeyRequest"), Status: http.StatusCreated, Response: apiRef("DKIMKey")},
+	{Method: "GET", Path: "/dkim/export", Name: "export_dkim_keys", Tag: "dkim", Summary: "Key and signing tables of the milter", Scope: "domains:read",
+		Query:  []apiParam{{"format", "Milter format", &Schema{Type: "string"}}},
+		Status: http.StatusOK, Download: []string{"text/plain"}},
+	{Method: "POST", Path: "/dkim/sync", Name: "sync_dkim_keys", Tag: "dkim", Summary: "Write the keys of the milter", Scope: "domains:dkim", Status: http.StatusNoContent},
+	{Method: "POST", Path: "/dkim/{id}/rotate", Name: "rotate_dkim_key", Tag: "dkim", Summary: "Replace the key with the new selector", Scope: "domains:dkim",
+		Body: apiRef("DKIMRotate"), Status: http.StatusCreated, Response: apiRef("DKIMKey")},
+	{Method: "DELETE", Path: "/dkim/{id}", Name: "retire_dkim_key", Tag: "dkim", Summary: "Retire DKIM key", Scope: "domains:dkim", Status: http.StatusNoContent},
+	{Method: "GET", Path: "/dns/{domain}", Name: "check_dns", Tag: "dns", Summary: "Check DNS records of the domain", Scope: "domains:read",
+		Status: http.StatusOK, Response: apiRef("DNSReport")},
+
+	{Method: "GET", Path: "/tenants", Name: "list_tenants", Tag: "tenants", Summary: "Tenants of the scope", Scope: "tenants:read", List: tenantList,
+		Status: http.StatusOK, Response: apiPage("Tenant")},
+	{Method: "POST", Path: "/tenants", Name: "create_tenant", Tag: "tenants", Summary: "Create tenant", Scope: "tenants:write",
+		Body: apiRef("Tenant"), Status: http.StatusCreated, Response: apiRef("Tenant")},
+	{Method: "GET", Path: "/tenants/{id}", Name: "get_tenant", Tag: "tenants", Summary: "Tenant with usage", Scope: "tenants:read",
+		Status: http.StatusOK, Response: apiRef("Tenant")},
+	{Method: "PUT", Path: "/tenants/{id}", Name: "update_tenant", Tag: "tenants", Summary: "Update tenant, omitted fields are kept", Scope: "tenants:write",
+		Body: apiRef("TenantUpdate"), Status: http.StatusOK, Response: apiRef("Tenant")},
+
+	{Method: "GET", Path: "/domains", Name: "list_domains", Tag: "domains", Summary: "Domains of the scope", Scope: "domains:read", List: domainList,
+		Status: http.StatusOK, Response: apiPage("Domain")},
+	{Method: "POST", Path: "/domains", Name: "create_domain", Tag: "domains", Summary: "Create domain", Scope: "domains:write",
+		Body: apiRef("Domain"), Status: http.StatusCreated, Response: apiRef("Domain")},
+	{Method: "GET", Path: "/domains/{domain}", Name: "get_domain", Tag: "domains", Summary: "Domain", Scope: "domains:read",
+		Status: http.StatusOK, Response: apiRef("Domain")},
+	{Method: "PUT", Path: "/domains/{domain}", Name: "update_domain", Tag: "domains", Summary: "Update domain, omitted fields are kept", Scope: "domains:write",
+		Body: apiRef("DomainUpdate"), Status: http.StatusOK, Response: apiRef("Domain")},
+	{Method: "DELETE", Path: "/domains/{domain}", Name: "delete_domain", Tag: "domains", Summary: "Delete domain without mailboxes and aliases", Scope: "domains:write",
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/domains/{domain}/mailboxes", Name: "list_domain_mailboxes", Tag: "domains", Summary: "Mailboxes of the domain", Scope: "mailboxes:read",
+		List: mailboxList, Status: http.StatusOK, Response: apiPage("Mailbox")},
+	{Method: "POST", Path: "/domains/{domain}/mailboxes", Name: "create_mailbox", Tag: "domains", Summary: "Create mailbox", Scope: "mailboxes:write",
+		Body: apiRef("Mailbox"), Status: http.StatusCreated, Response: apiRef("Mailbox")},
+	{Method: "GET", Path: "/domains/{domain}/mailboxes/{local}", Name: "get_mailbox", Tag: "domains", Summary: "Mailbox", Scope: "mailboxes:read",
+		Status: http.StatusOK, Response: apiRef("Mailbox")},
+	{Method: "PUT", Path: "/domains/{domain}/mailboxes/{local}", Name: "update_mailbox", Tag: "domains", Summary: "Update mailbox, omitted fields are kept", Scope: "mailboxes:write",
+		Body: apiRef("MailboxUpdate"), Status: http.StatusOK, Response: apiRef("Mailbox")},
+	{Method: "DELETE", Path: "/domains/{domain}/mailboxes/{local}", Name: "delete_mailbox", Tag: "domains", Summary: "Delete mailbox", Scope: "mailboxes:write",
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/domains/{domain}/aliases", Name: "list_domain_aliases", Tag: "domains", Summary: "Aliases of the domain", Scope: "aliases:read",
+		List: aliasList, Status: http.StatusOK, Response: apiPage("Alias")},
+	{Method: "POST", Path: "/domains/{domain}/aliases", Name: "create_alias", Tag: "domains", Summary: "Create alias", Scope: "aliases:write",
+		Body: apiRef("Alias"), Status: http.StatusCreated, Response: apiRef("Alias")},
+	{Method: "GET", Path: "/domains/{domain}/aliases/{local}", Name: "get_alias", Tag: "domains", Summary: "Alias", Scope: "aliases:read",
+		Status: http.StatusOK, Response: apiRef("Alias")},
+	{Method: "PUT", Path: "/domains/{domain}/aliases/{local}", Name: "update_alias", Tag: "domains", Summary: "Update alias, omitted fields are kept", Scope: "aliases:write",
+		Body: apiRef("AliasUpdate"), Status: http.StatusOK, Response: apiRef("Alias")},
+	{Method: "GET", Path: "/mailboxes", Name: "list_mailboxes", Tag: "domains", Summary: "Mailboxes of the scope", Scope: "mailboxes:read",
+		List: mailboxList, Status: http.StatusOK, Response: apiPage("Mailbox")},
+	{Method: "GET", Path: "/aliases", Name: "list_aliases", Tag: "domains", Summary: "Aliases of the scope", Scope: "aliases:read",
+		List: aliasList, Status: http.StatusOK, Response: apiPage("Alias")},
+
+	{Method: "POST", Path: "/import", Name: "import", Tag: "bulk", Summary: "Import domains, mailboxes and aliases in one transaction, crypt hashes are replaced by bcrypt on the first login", Scope: "domains:write",
+		Query: []apiParam{
+			{"format", "csv, json or yaml, by default from the content type", &Schema{Type: "string", Enum: []interface{}{"csv", "json", "yaml"}}},
+			{"type", "Record type of CSV without the type column", &Schema{Type: "string", Enum: []interface{}{"domain", "mailbox", "alias"}}},
+			{"source", "Panel of the CSV table export, requires type. Plesk passwords are exported in plain with mail_auth_view", &Schema{Type: "string", Enum: []interface{}{"postfixadmin", "iredmail", "plesk"}}},
+			{"dry_run", "Validate only", &Schema{Type: "boolean"}},
+		},
+		Upload: []string{"text/csv", "application/json", "application/x-yaml"}, Status: http.StatusOK, Response: apiRef("BulkReport")},
+	{Method: "GET", Path: "/export", Name: "export", Tag: "bulk", Summary: "Export domains, mailboxes and aliases, password hashes with the mailboxes:export scope", Scope: "domains:read",
+		Query:  []apiParam{{"format", "csv, json or yaml", &Schema{Type: "string", Enum: []interface{}{"csv", "json", "yaml"}}}},
+		Status: http.StatusOK, Download: []string{"text/csv", "application/json", "application/x-yaml"}},
+
+	{Method: "GET", Path: "/events", Name: "stream_events", Tag: "events", Summary: "Live changes and audit records of the scope as server-sent events", Scope: "events:read",
+		Query:  []apiParam{{"last_event_id", "Replay the buffered events after the id, like the Last-Event-ID header", &Schema{Type: "integer", Format: "int64"}}},
+		Status: http.StatusOK, Download: []string{"text/event-stream"}},
+
+	{Method: "GET", Path: "/webhooks", Name: "list_webhooks", Tag: "webhooks", Summary: "Webhooks of the scope", Scope: "webhooks:read", List: webhookList,
+		Status: http.StatusOK, Response: apiPage("Webhook")},
+	{Method: "POST", Path: "/webhooks", Name: "create_webhook", Tag: "webhooks", Summary: "Subscribe to events, the secret is returned once", Scope: "webhooks:write",
+		Body: apiRef("Webhook"), Status: http.StatusCreated, Response: apiRef("Webhook")},
+	{Method: "GET", Path: "/webhooks/{id}", Name: "get_webhook", Tag: "webhooks", Summary: "Webhook", Scope: "webhooks:read",
+		Status: http.StatusOK, Response: apiRef("Webhook")},
+	{Method: "PUT", Path: "/webhooks/{id}", Name: "update_webhook", Tag: "webhooks", Summary: "Update webhook, omitted fields are kept", Scope: "webhooks:write",
+		Body: apiRef("WebhookUpdate"), Status: http.StatusOK, Response: apiRef("Webhook")},
+	{Method: "DELETE", Path: "/webhooks/{id}", Name: "delete_webhook", Tag: "webhooks", Summary: "Delete webhook with its deliveries", Scope: "webhooks:write",
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/webhooks/{id}/deliveries", Name: "list_webhook_deliveries", Tag: "webhooks", Summary: "Deliveries of the webhook", Scope: "webhooks:read",
+		List: deliveryList, Status: http.StatusOK, Response: apiPage("WebhookDelivery")},
+	{Method: "POST", Path: "/webhooks/{id}/replay", Name: "replay_webhook", Tag: "webhooks", Summary: "Deliver the events again", Scope: "webhooks:write",
+		Body: apiRef("WebhookReplay"), Status: http.StatusAccepted,
+		Response: &Schema{Type: "object", Properties: map[string]*Schema{"replayed": {Type: "integer", Format: "int64"}}}},
+}
+
+// Operation of the route name, nil if undocumented
+func findOperation(name string) *apiOperation {
+	for _, op := range apiOperations {
+		if op.Name == name {
+			return op
+		}
+	}
+
+	return nil
+}
+
+// OpenAPI document of the operations, cookie is the session cookie name
+func OpenAPIDocument(cookie string) map[string]interface{} {
+	var paths = make(map[string]map[string]interface{})
+
+	for _, op := range apiOperations {
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]interface{})
+		}
+
+		paths[op.Path][strings.ToLower(op.Method)] = op.document()
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   NAME,
+			"version": VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"responses": map[string]interface{}{
+				"Problem":          apiProblem("Error"),
+				"ValidationFailed": apiProblem("Request body doesn't match the schema, invalid-params lists the fields"),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearer":  map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": cookie},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}
+}
+
+func apiProblem(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			ProblemContentType: map[string]interface{}{"schema": apiRef("Problem")},
+		},
+	}
+}
+
+// Operation object
+func (this *apiOperation) document() map[string]interface{} {
+	var (
+		params    []interface{}
+		response  = map[string]interface{}{"description": http.StatusText(this.Status)}
+		responses = map[string]interface{}{
+			"default": map[string]interface{}{"$ref": "#/components/responses/Problem"},
+		}
+		doc = map[string]interface{}{
+			"operationId": this.Name,
+			"summary":     this.Summary,
+			"tags":        []string{this.Tag},
+		}
+	)
+
+	for _, s := range strings.Split(this.Path, "/") {
+		if strings.HasPrefix(s, "{") {
+			params = append(params, map[string]interface{}{
+				"name": strings.Trim(s, "{}"), "in": "path", "required": true, "schema": &Schema{Type: "string"},
+			})
+		}
+	}
+
+	for _, p := range this.Query {
+		params = append(params, map[string]interface{}{
+			"name": p.Name, "in": "query", "description": p.Description, "schema": p.Schema,
+		})
+	}
+
+	if this.List != nil {
+		params = append(params, listParams(this.List)...)
+	}
+
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+
+	if this.Scope == "" {
+		doc["security"] = []interface{}{}
+	} else {
+		doc["description"] = "Requires the " + this.Scope + " scope"
+		doc["x-scope"] = this.Scope
+	}
+
+	switch {
+	case this.Body != nil:
+		content := map[string]interface{}{"application/json": map[string]interface{}{"schema": this.Body}}
+		if this.Form {
+			content["application/x-www-form-urlencoded"] = map[string]interface{}{"schema": this.Body}
+		}
+
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		responses["422"] = map[string]interface{}{"$ref": "#/components/responses/ValidationFailed"}
+
+	case len(this.Upload) > 0:
+		content := make(map[string]interface{})
+		for _, media := range this.Upload {
+			content[media] = map[string]interface{}{"schema": &Schema{Type: "string", Format: "binary"}}
+		}
+
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	switch {
+	case this.Response != nil:
+		response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": this.Response}}
+
+	case len(this.Download) > 0:
+		content := make(map[string]interface{})
+		for _, media := range this.Download {
+			content[media] = map[string]interface{}{"schema": &Schema{Type: "string", Format: "binary"}}
+		}
+
+		response["content"] = content
+	}
+
+	responses[fmt.Sprint(this.Status)] = response
+	doc["responses"] = responses
+
+	return doc
+}
+
+// Sort, limit, cursor, count and the filter of each field
+func listParams(spec *ListSpec) (params []interface{}) {
+	var (
+		names []string
+		kinds = map[int]string{FieldString: "string", FieldInt: "integer", FieldBool: "boolean"}
+	)
+
+	params = append(params,
+		map[string]interface{}{"name": listSortParam, "in": "query", "schema": &Schema{Type: "string"},
+			"description": "Comma separated fields, `-field` is descending, default " + spec.Default},
+		map[string]interface{}{"name": listLimitParam, "in": "query", "schema": &Schema{Type: "integer"},
+			"description": fmt.Sprintf("Page size from 1 to %d, default %d", listMaxLimit, listDefaultLimit)},
+		map[string]interface{}{"name": listCursorParam, "in": "query", "schema": &Schema{Type: "string"},
+			"description": "Next cursor of the previous page"},
+		map[string]interface{}{"name": listCountParam, "in": "query", "schema": &Schema{Type: "boolean"},
+			"description": "Return the total of the matching rows"},
+	)
+
+	for name := range spec.Fields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "query", "schema": &Schema{Type: kinds[spec.Fields[name].Kind]},
+			"description": "Filter `" + name + "=v1,v2`, also with != > >= < <= and ~ of the strings",
+		})
+	}
+
+	return
+}
+
+// Serve OpenAPI document: GET /openapi.json
+func handleOpenAPI(sessions *Provider) func(http.ResponseWriter, *Context) {
+	var doc = OpenAPIDocument(sessions.Name())
+
+	return func(w http.ResponseWriter, ctx *Context) {
+		if ctx.r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
+
+// Validate JSON body of the documented operation before the handler
+func ValidateBody(next ContextHandler) ContextHandler {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if validRequest(w, ctx) {
+			next(w, ctx)
+		}
+	}
+}
+
+// Check JSON body of the operation, the body is restored for the
+// handler. Writes problem response on failure
+func validRequest(w http.ResponseWriter, ctx *Context) bool {
+	var (
+		op    *apiOperation
+		media string
+		body  []byte
+		value interface{}
+		err   error
+	)
+
+	// Handler out of the router has no operation
+	if ctx.route != nil {
+		op = findOperation(ctx.route.Name)
+	}
+
+	if op == nil || op.Body == nil {
+		return true
+	}
+
+	if ct := ctx.r.Header.Get("Content-Type"); ct != "" {
+		if media, _, err = mime.ParseMediaType(ct); err != nil {
+			media = ct
+		}
+	}
+
+	switch {
+	case op.Form && (media == "application/x-www-form-urlencoded" || media == "multipart/form-data"):
+		return true
+	case media != "" && media != "application/json":
+		writeError(w, http.StatusUnsupportedMediaType, "Content type must be application/json")
+		return false
+	}
+
+	if ctx.r.Body != nil {
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(w, ctx.r.Body, apiMaxBody)); err != nil {
+			writeError(w, http.StatusBadRequest, "Can't read request body: "+err.Error())
+			return false
+		}
+	}
+
+	ctx.r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	if err = dec.Decode(&value); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return false
+	}
+
+	if params := op.Body.Validate(value); len(params) > 0 {
+		ctx.log.Debug("Request body rejected", "operation", op.Name, "invalid", len(params))
+		writeProblem(w, &Problem{
+			Type:          ProblemValidation,
+			Status:        http.StatusUnprocessableEntity,
+			Detail:        "Request body doesn't match the schema",
+			InvalidParams: params,
+		})
+
+		return false
+	}
+
+	return true
+}
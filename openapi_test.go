@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_SchemaValidate(t *testing.T) {
+	cases := []struct {
+		schema *Schema
+		body   string
+		params []InvalidParam
+	}{
+		{apiRef("Domain"), `{"name":"example.com","active":true}`, nil},
+		{apiRef("DomainUpdate"), `{"id":1,"created":0,"description":"Updated"}`, nil},
+		{apiRef("Domain"), `[]`, []InvalidParam{{"body", "must be an object"}}},
+		{apiRef("Domain"), `{"active":"yes","owner":1}`, []InvalidParam{
+			{"name", "is required"},
+			{"active", "must be a boolean"},
+			{"owner", "is not allowed"},
+		}},
+		{apiRef("Mailbox"), `{"address":"john","quota":-1}`, []InvalidParam{{"quota", "must be at least 0"}}},
+		{apiRef("Mailbox"), `{"address":"john","quota":1.5}`, []InvalidParam{{"quota", "must be an integer"}}},
+		{apiRef("Alias"), `{"address":"info","goto":["john@example.com",""]}`, []InvalidParam{{"goto[1]", "must be at least 1 characters"}}},
+		{apiRef("Tenant"), `{"name":"acme","kind":"owner"}`, []InvalidParam{{"kind", "must be one of reseller, customer"}}},
+		{apiRef("TenantUpdate"), `{"usage":null}`, []InvalidParam{{"usage", "must not be null"}}},
+		{apiRef("Domain"), `{"name":"bad name"}`, []InvalidParam{{"name", "must match ^[A-Za-z0-9.-]+$"}}},
+	}
+
+	for _, c := range cases {
+		var value interface{}
+
+		dec := json.NewDecoder(strings.NewReader(c.body))
+		dec.UseNumber()
+		dec.Decode(&value)
+
+		if params := c.schema.Validate(value); !reflect.DeepEqual(params, c.params) {
+			t.Errorf("Expected %v of %s, but got %v", c.params, c.body, params)
+		}
+	}
+}
+
+func Test_FindOperation(t *testing.T) {
+	for _, name := range []string{"list_domains", "update_mailbox", "rotate_dkim_key", "export_dkim_keys"} {
+		if op := findOperation(name); op == nil || op.Name != name {
+			t.Errorf("Unexpected operation of %s: %+v", name, op)
+		}
+	}
+
+	if op := findOperation("delete_alias"); op != nil {
+		t.Errorf("Unexpected operation %+v", op)
+	}
+}
+
+func Test_OpenAPIDocument(t *testing.T) {
+	var (
+		names = make(map[string]bool)
+		doc   = OpenAPIDocument("sid")
+		paths = doc["paths"].(map[string]map[string]interface{})
+	)
+
+	for _, op := range apiOperations {
+		if names[op.Name] {
+			t.Errorf("Duplicate operation %s", op.Name)
+		}
+
+		names[op.Name] = true
+
+		if _, ok := paths[op.Path][strings.ToLower(op.Method)]; !ok {
+			t.Errorf("Operation %s %s isn't documented", op.Method, op.Path)
+		}
+
+		for _, schema := range []*Schema{op.Body, op.Response} {
+			if schema != nil && schema.Ref != "" && apiSchemas[strings.TrimPrefix(schema.Ref, apiSchemaRef)] == nil {
+				t.Errorf("Unknown schema %s of %s", schema.Ref, op.Name)
+			}
+		}
+	}
+
+	if _, err := json.Marshal(doc); err != nil {
+		t.Errorf("Can't encode document: %s", err)
+	}
+}
+
+func Test_ValidRequest(t *testing.T) {
+	var (
+		db, _   = InitDBMock(t)
+		prov, _ = NewManager(db, 0)
+		router  = NewRouter(prov)
+		called  bool
+		session = NewSession(RandStringId(64))
+	)
+
+	defer db.Close()
+
+	// Operation is of the route name
+	router.Handle("POST", "/domains", "create_domain", func(w http.ResponseWriter, ctx *Context) {
+		called = true
+	}, Authenticate(prov, nil), CheckCSRF, ValidateBody)
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "admin", Role: RoleAdmin})
+	prov.append(session)
+
+	request := func(contentType, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/domains", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+		r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+		r.Header.Set("Content-Type", contentType)
+
+		called = false
+		router.ServeHTTP(w, r)
+
+		return w
+	}
+
+	w := request("application/json", `{"name":"example.com","active":"yes"}`)
+
+	var problem Problem
+
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || w.Code != http.StatusUnprocessableEntity || called {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != ProblemContentType || problem.Type != ProblemValidation ||
+		!reflect.DeepEqual(problem.InvalidParams, []InvalidParam{{"active", "must be a boolean"}}) {
+		t.Errorf("Unexpected problem %+v", problem)
+	}
+
+	if w = request("application/json", `{"name":`); w.Code != http.StatusBadRequest || called {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if w = request("text/plain", `{"name":"example.com"}`); w.Code != http.StatusUnsupportedMediaType || called {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+
+	if w = request("application/json; charset=utf-8", `{"name":"example.com"}`); !called {
+		t.Errorf("Expected valid body, but got %d: %s", w.Code, w.Body.String())
+	}
+}
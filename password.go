@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+var ErrPasswordBreached = errors.New("Password is found in the breached passwords list")
+
+// Mailbox password rules
+type PasswordPolicy struct {
+	minLength int
+	classes   int
+	// SHA1 hex of the breached passwords
+	breached map[string]bool
+}
+
+func NewPasswordPolicy(cfg *Config) (policy *PasswordPolicy, err error) {
+	policy = &PasswordPolicy{
+		minLength: cfg.GetPasswordMinLength(),
+		classes:   cfg.GetPasswordClasses(),
+		breached:  make(map[string]bool),
+	}
+
+	if file := cfg.GetPasswordBreached(); file != "" {
+		err = policy.Load(file)
+	}
+
+	return
+}
+
+// Read breached passwords file. Lines are plain passwords or SHA1
+// hashes, the `HASH:count` format of the public dumps is accepted
+func (this *PasswordPolicy) Load(file string) (err error) {
+	var (
+		f       *os.File
+		scanner *bufio.Scanner
+		list    = make(map[string]bool)
+	)
+
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		if hash := strings.SplitN(line, ":", 2)[0]; isSHA1(hash) {
+			list[strings.ToLower(hash)] = true
+		} else {
+			list[passwordSHA1(line)] = true
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	this.breached = list
+	log.Info("Loaded %d breached passwords from %s", len(list), file)
+
+	return
+}
+
+// Check password against the rules
+func (this *PasswordPolicy) Check(password string) error {
+	var (
+		length                     int
+		lower, upper, digit, other int
+	)
+
+	for _, r := range password {
+		length++
+
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	if length < this.minLength {
+		return fmt.Errorf("Password must be at least %d characters long", this.minLength)
+	}
+
+	if lower+upper+digit+other < this.classes {
+		return fmt.Errorf("Password must contain at least %d of lower case, upper case, digits and other characters", this.classes)
+	}
+
+	if this.breached[passwordSHA1(password)] {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
+
+func passwordSHA1(password string) string {
+	var sum = sha1.Sum([]byte(password))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func isSHA1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+
+	return err == nil
+}
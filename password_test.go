@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_PasswordPolicy(t *testing.T) {
+	var (
+		dir, _ = ioutil.TempDir("", "msm")
+		file   = filepath.Join(dir, "breached.txt")
+	)
+
+	defer os.RemoveAll(dir)
+
+	// Plain password and the SHA1 hash of "Password123!" in the dump format
+	ioutil.WriteFile(file, []byte("Summer2017!!\r\nB7E4A4DA2ACA6ABC6F53B4C7C1E9F2E2A4AA3AB5:12\n"+passwordSHA1("Password123!")+":3\n"), 0600)
+
+	policy, err := NewPasswordPolicy(&Config{Password: &Password{Breached: file}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"Sh0rt!", false},
+		{"onlylowercaseletters", false},
+		{"lowercase and digits 123", true},
+		{"Summer2017!!", false},
+		{"Password123!", false},
+		{"Correct Horse Battery", true},
+	}
+
+	for _, test := range tests {
+		if err := policy.Check(test.password); (err == nil) != test.valid {
+			t.Errorf("Password %q: expected valid %v, but got %v", test.password, test.valid, err)
+		}
+	}
+
+	if _, err := NewPasswordPolicy(&Config{Password: &Password{Breached: filepath.Join(dir, "missing")}}); err == nil {
+		t.Errorf("Expected error on missing breached file")
+	}
+}
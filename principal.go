@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/gob"
+	"strings"
+)
+
+// Session key for the authenticated principal
+const PrincipalKey = "principal"
+
+// Principal kinds
+const (
+	PrincipalStaff   = "staff"
+	PrincipalToken   = "token"
+	PrincipalCert    = "cert"
+	PrincipalMailbox = "mailbox"
+)
+
+// Staff roles
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleHelpdesk = "helpdesk"
+)
+
+// Scopes granted by the role. Scope is `resource:action`,
+// `*` matches any resource or action
+var roleScopes = map[string][]string{
+	RoleAdmin: {"*"},
+	RoleOperator: {
+		"domains:*", "mailboxes:*", "aliases:*", "tenants:*", "webhooks:*", "events:read",
+	},
+	RoleHelpdesk: {
+		"domains:read", "mailboxes:read", "mailboxes:password", "aliases:read", "tenants:read", "events:read",
+	},
+}
+
+// Scopes of the mailbox owner, the resource is the own mailbox
+var mailboxScopes = []string{"self:read", "self:password"}
+
+func init() {
+	gob.Register(Principal{})
+}
+
+// Authenticated caller: staff member or mailbox owner logged in
+// with session or machine client with API token or client certificate
+type Principal struct {
+	Kind string
+	Id   int64
+	Name string
+	Role string
+	// Machine client scopes restrict role scopes, empty for staff
+	Scopes []string
+	// Reseller or customer tenant the principal belongs to,
+	// zero for the global principal
+	Tenant int64
+}
+
+// Check access by RBAC role and machine client scopes
+func (this *Principal) Can(scope string) bool {
+	if this != nil && this.Kind == PrincipalMailbox {
+		return matchScopes(mailboxScopes, scope)
+	}
+
+	if this == nil || !matchScopes(roleScopes[this.Role], scope) {
+		return false
+	}
+
+	if this.Kind != PrincipalStaff {
+		return matchScopes(this.Scopes, scope)
+	}
+
+	return true
+}
+
+// Principal holds each scope of the role and each of the scopes,
+// so the token of them grants nothing beyond its issuer
+func (this *Principal) Grants(role string, scopes []string) bool {
+	for _, list := range [][]string{roleScopes[role], scopes} {
+		for _, scope := range list {
+			if !this.Can(scope) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Role is known
+func validRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// Any scope pattern matches the scope
+func matchScopes(patterns []string, scope string) bool {
+	for _, p := range patterns {
+		if matchScope(p, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchScope(pattern, scope string) bool {
+	if pattern == "*" || pattern == scope {
+		return true
+	}
+
+	if resource := strings.TrimSuffix(pattern, ":*"); resource != pattern {
+		return strings.HasPrefix(scope, resource+":")
+	}
+
+	return false
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page size
+const (
+	listDefaultLimit = 50
+	listMaxLimit     = 1000
+)
+
+// Query parameters with the special meaning, others are filters
+const (
+	listSortParam   = "sort"
+	listLimitParam  = "limit"
+	listCursorParam = "cursor"
+	listCountParam  = "count"
+)
+
+// Field kinds
+const (
+	FieldString = iota
+	FieldInt
+	FieldBool
+)
+
+// Filter operators, longer first so `>=` is not taken for `>`.
+// `~` is substring match of the string field
+var listOperators = []string{">=", "<=", "!=", "=", ">", "<", "~"}
+
+// Backtick quoted MySQL column
+func quoteColumn(ident string) string {
+	return "`" + strings.Replace(ident, "`", "``", -1) + "`"
+}
+
+// Field of the list item. Name is the JSON field of the item,
+// so the cursor is taken from the last item of the page
+type ListField struct {
+	Column string
+	Kind   int
+	Sort   bool
+}
+
+// Listed resource
+type ListSpec struct {
+	// Select list and FROM clause
+	Columns string
+	Table   string
+	Fields  map[string]ListField
+	// Unique sortable field, ends every sort so the order is stable
+	Key string
+	// Sort if none requested, e.g. `-created`
+	Default string
+}
+
+type ListFilter struct {
+	Field    string
+	Operator string
+	Values   []interface{}
+}
+
+type ListSort struct {
+	Field string
+	Desc  bool
+}
+
+// List request: filters, sort, page cursor and size
+type ListQuery struct {
+	spec    *ListSpec
+	Filters []ListFilter
+	Sort    []ListSort
+	Cursor  []interface{}
+	Limit   int
+	// Total count requested
+	Count bool
+}
+
+// Listed page. Next is the cursor of the following page, empty for
+// the last one. Total is set if requested
+type ListPage struct {
+	Items []interface{} `json:"items"`
+	Next  string        `json:"next,omitempty"`
+	Total *int64        `json:"total,omitempty"`
+}
+
+// Parse raw query string:
+//
+//	domain=example.com&active=1&quota>=1000&address~john&sort=-quota,address&limit=100&cursor=...&count=1
+//
+// Comma separated values of `=` match any of them
+func ParseListQuery(spec *ListSpec, raw string) (query *ListQuery, err error) {
+	var sort, cursor string
+
+	query = &ListQuery{
+		spec:  spec,
+		Limit: listDefaultLimit,
+	}
+
+	for _, term := range strings.Split(raw, "&") {
+		var name, op, value string
+
+		if term == "" {
+			continue
+		}
+
+		if term, err = url.QueryUnescape(term); err != nil {
+			return nil, errors.New("Invalid query string")
+		}
+
+		name, op, value = splitListTerm(term)
+
+		switch {
+		case name == listSortParam && op == "=":
+			sort = value
+		case name == listCursorParam && op == "=":
+			cursor = value
+		case name == listCountParam && op == "=":
+			query.Count = bulkBool(value)
+		case name == listLimitParam && op == "=":
+			if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 || query.Limit > listMaxLimit {
+				return nil, fmt.Errorf("Limit must be from 1 to %d", listMaxLimit)
+			}
+		default:
+			if err = query.addFilter(name, op, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if sort == "" {
+		sort = spec.Default
+	}
+
+	if err = query.setSort(sort); err != nil {
+		return nil, err
+	}
+
+	if cursor != "" {
+		if err = query.setCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// Field name is letters, digits and underscores, the operator follows
+func splitListTerm(term string) (name, op, value string) {
+	var i int
+
+	for i < len(term) && (term[i] == '_' || term[i] >= 'a' && term[i] <= 'z' || term[i] >= '0' && term[i] <= '9') {
+		i++
+	}
+
+	name, term = term[:i], term[i:]
+
+	for _, op := range listOperators {
+		if strings.HasPrefix(term, op) {
+			return name, op, term[len(op):]
+		}
+	}
+
+	return name, term, ""
+}
+
+func (this *ListQuery) addFilter(name, op, value string) error {
+	var (
+		field, ok = this.spec.Fields[name]
+		filter    = ListFilter{Field: name, Operator: op}
+		values    = []string{value}
+	)
+
+	switch {
+	case !ok:
+		return errors.New("Unknown filter field " + name)
+	case op == "" || (op == "~" && field.Kind != FieldString):
+		return errors.New("Invalid filter operator of " + name)
+	case op == "=" || op == "!=":
+		values = strings.Split(value, ",")
+	}
+
+	for _, v := range values {
+		typed, err := listValue(field, v)
+		if err != nil {
+			return fmt.Errorf("Invalid value of %s: %s", name, v)
+		}
+
+		filter.Values = append(filter.Values, typed)
+	}
+
+	this.Filters = append(this.Filters, filter)
+
+	return nil
+}
+
+// `-field` is descending
+func (this *ListQuery) setSort(sort string) error {
+	var seen = make(map[string]bool)
+
+	for _, name := range strings.Split(sort, ",") {
+		var item ListSort
+
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		if item.Field = strings.TrimPrefix(name, "-"); item.Field != name {
+			item.Desc = true
+		}
+
+		if field, ok := this.spec.Fields[item.Field]; !ok || !field.Sort || seen[item.Field] {
+			return errors.New("Invalid sort field " + item.Field)
+		}
+
+		seen[item.Field] = true
+		this.Sort = append(this.Sort, item)
+	}
+
+	if !seen[this.spec.Key] {
+		this.Sort = append(this.Sort, ListSort{Field: this.spec.Key})
+	}
+
+	return nil
+}
+
+// Cursor is the JSON list of the sort values of the last item
+func (this *ListQuery) setCursor(cursor string) (err error) {
+	var (
+		data   []byte
+		values []interface{}
+		dec    *json.Decoder
+	)
+
+	if data, err = base64.RawURLEncoding.DecodeString(cursor); err == nil {
+		dec = json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	}
+
+	if err != nil || len(values) != len(this.Sort) {
+		return errors.New("Invalid cursor")
+	}
+
+	for i, sort := range this.Sort {
+		v, err := listValue(this.spec.Fields[sort.Field], fmt.Sprint(values[i]))
+		if err != nil {
+			return errors.New("Invalid cursor")
+		}
+
+		this.Cursor = append(this.Cursor, v)
+	}
+
+	return
+}
+
+// Convert by the field kind
+func listValue(field ListField, value string) (interface{}, error) {
+	switch field.Kind {
+	case FieldInt:
+		return strconv.ParseInt(value, 10, 64)
+	case FieldBool:
+		return strconv.ParseBool(value)
+	}
+
+	return value, nil
+}
+
+// Filter conditions joined with AND
+func (this *ListQuery) where() (cond string, args []interface{}) {
+	var parts []string
+
+	for _, filter := range this.Filters {
+		var column = quoteColumn(this.spec.Fields[filter.Field].Column)
+
+		switch {
+		case filter.Operator == "~":
+			parts = append(parts, column+" LIKE ? ESCAPE '!'")
+			args = append(args, "%"+listEscape.Replace(filter.Values[0].(string))+"%")
+
+		case len(filter.Values) > 1:
+			op := "IN"
+			if filter.Operator == "!=" {
+				op = "NOT IN"
+			}
+
+			parts = append(parts, column+" "+op+" ("+strings.TrimSuffix(strings.Repeat("?, ", len(filter.Values)), ", ")+")")
+			args = append(args, filter.Values...)
+
+		default:
+			parts = append(parts, column+" "+filter.Operator+" ?")
+			args = append(args, filter.Values[0])
+		}
+	}
+
+	return strings.Join(parts, " AND "), args
+}
+
+// LIKE pattern escape
+var listEscape = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// Rows after the cursor in the sort order:
+// a > ? OR (a = ? AND b > ?) OR ...
+func (this *ListQuery) after() (cond string, args []interface{}) {
+	var parts []string
+
+	for i, sort := range this.Sort {
+		var (
+			terms []string
+			op    = ">"
+		)
+
+		for j := 0; j < i; j++ {
+			terms = append(terms, quoteColumn(this.spec.Fields[this.Sort[j].Field].Column)+" = ?")
+			args = append(args, this.Cursor[j])
+		}
+
+		if sort.Desc {
+			op = "<"
+		}
+
+		terms = append(terms, quoteColumn(this.spec.Fields[sort.Field].Column)+" "+op+" ?")
+		args = append(args, this.Cursor[i])
+
+		parts = append(parts, "("+strings.Join(terms, " AND ")+")")
+	}
+
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
+
+// Page and count queries. Base condition and its arguments limit
+// the rows, e.g. to the tenant scope
+func (this *ListQuery) SQL(base string, baseArgs ...interface{}) (page string, pageArgs []interface{}, count string, countArgs []interface{}) {
+	var (
+		conds = []string{"(" + base + ")"}
+		order []string
+	)
+
+	countArgs = append(countArgs, baseArgs...)
+
+	if cond, filterArgs := this.where(); cond != "" {
+		conds = append(conds, cond)
+		countArgs = append(countArgs, filterArgs...)
+	}
+
+	count = "SELECT COUNT(*) FROM " + this.spec.Table + " WHERE " + strings.Join(conds, " AND ")
+	pageArgs = countArgs
+
+	if len(this.Cursor) > 0 {
+		cond, cursorArgs := this.after()
+		conds = append(conds, cond)
+		pageArgs = append(pageArgs[:len(pageArgs):len(pageArgs)], cursorArgs...)
+	}
+
+	for _, sort := range this.Sort {
+		dir := " ASC"
+		if sort.Desc {
+			dir = " DESC"
+		}
+
+		order = append(order, quoteColumn(this.spec.Fields[sort.Field].Column)+dir)
+	}
+
+	// One more row tells if there is the next page
+	page = "SELECT " + this.spec.Columns + " FROM " + this.spec.Table +
+		" WHERE " + strings.Join(conds, " AND ") +
+		" ORDER BY " + strings.Join(order, ", ") +
+		" LIMIT " + strconv.Itoa(this.Limit+1)
+
+	return
+}
+
+// Run the queries, scan makes the item of the row
+func (this *ListQuery) Run(q querier, scan func(row rowScanner) (interface{}, error), base string, baseArgs ...interface{}) (page *ListPage, err error) {
+	var query, args, count, countArgs = this.SQL(base, baseArgs...)
+
+	page = &ListPage{Items: make([]interface{}, 0)}
+
+	if this.Count {
+		var total int64
+
+		if err = q.QueryRow(count, countArgs...).Scan(&total); err != nil {
+			return nil, err
+		}
+
+		page.Total = &total
+	}
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Items = append(page.Items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > this.Limit {
+		page.Items = page.Items[:this.Limit]
+
+		if page.Next, err = this.next(page.Items[this.Limit-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// Cursor after the item
+func (this *ListQuery) next(item interface{}) (cursor string, err error) {
+	var (
+		data   []byte
+		fields map[string]interface{}
+		values []interface{}
+		dec    *json.Decoder
+	)
+
+	if data, err = json.Marshal(item); err != nil {
+		return
+	}
+
+	dec = json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err = dec.Decode(&fields); err != nil {
+		return
+	}
+
+	for _, sort := range this.Sort {
+		value, ok := fields[sort.Field]
+
+		// Omitted empty value
+		if !ok {
+			switch this.spec.Fields[sort.Field].Kind {
+			case FieldInt:
+				value = 0
+			case FieldBool:
+				value = false
+			default:
+				value = ""
+			}
+		}
+
+		values = append(values, value)
+	}
+
+	if data, err = json.Marshal(values); err != nil {
+		return
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Parse list query of the request, write bad request on failure
+func (this *Context) ListQuery(w http.ResponseWriter, spec *ListSpec) (*ListQuery, bool) {
+	query, err := ParseListQuery(spec, this.r.URL.RawQuery)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	return query, true
+}
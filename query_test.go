@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"reflect"
+	"testing"
+)
+
+var testList = &ListSpec{
+	Columns: "`id`, `name`",
+	Table:   "`msm_test`",
+	Fields: map[string]ListField{
+		"id":     {"id", FieldInt, true},
+		"name":   {"name", FieldString, true},
+		"active": {"active", FieldBool, false},
+	},
+	Key:     "id",
+	Default: "name",
+}
+
+type testItem struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+func Test_ParseListQuery(t *testing.T) {
+	cases := []struct {
+		raw   string
+		page  string
+		args  []interface{}
+		count string
+	}{
+		{
+			"",
+			"SELECT `id`, `name` FROM `msm_test` WHERE (1 = 1) ORDER BY `name` ASC, `id` ASC LIMIT 51",
+			nil,
+			"SELECT COUNT(*) FROM `msm_test` WHERE (1 = 1)",
+		},
+		{
+			"active=true&id>=10&sort=-id&limit=5",
+			"SELECT `id`, `name` FROM `msm_test` WHERE (1 = 1) AND `active` = ? AND `id` >= ? ORDER BY `id` DESC LIMIT 6",
+			[]interface{}{true, int64(10)},
+			"SELECT COUNT(*) FROM `msm_test` WHERE (1 = 1) AND `active` = ? AND `id` >= ?",
+		},
+		{
+			"id!=1,2&name~50%25_off",
+			"SELECT `id`, `name` FROM `msm_test` WHERE (1 = 1) AND `id` NOT IN (?, ?) AND `name` LIKE ? ESCAPE '!' ORDER BY `name` ASC, `id` ASC LIMIT 51",
+			[]interface{}{int64(1), int64(2), "%50!%!_off%"},
+			"SELECT COUNT(*) FROM `msm_test` WHERE (1 = 1) AND `id` NOT IN (?, ?) AND `name` LIKE ? ESCAPE '!'",
+		},
+		{
+			"cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`["john",7]`)),
+			"SELECT `id`, `name` FROM `msm_test` WHERE (1 = 1) AND ((`name` > ?) OR (`name` = ? AND `id` > ?)) ORDER BY `name` ASC, `id` ASC LIMIT 51",
+			[]interface{}{"john", "john", int64(7)},
+			"SELECT COUNT(*) FROM `msm_test` WHERE (1 = 1)",
+		},
+	}
+
+	for _, c := range cases {
+		query, err := ParseListQuery(testList, c.raw)
+		if err != nil {
+			t.Errorf("Unexpected error of %q: %s", c.raw, err)
+			continue
+		}
+
+		page, args, count, _ := query.SQL("1 = 1")
+		if page != c.page || count != c.count || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("Unexpected SQL of %q:\n%s %v\n%s", c.raw, page, args, count)
+		}
+	}
+}
+
+func Test_ParseListQueryInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"unknown=1",
+		"id=abc",
+		"id~1",
+		"active",
+		"sort=active",
+		"sort=name,name",
+		"limit=0",
+		"limit=1001",
+		"cursor=invalid",
+		"cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`[1]`)),
+	} {
+		if _, err := ParseListQuery(testList, raw); err == nil {
+			t.Errorf("Expected error of %q", raw)
+		}
+	}
+}
+
+func Test_ListQueryRun(t *testing.T) {
+	db, mock := InitDBMock(t)
+	defer db.Close()
+
+	query, err := ParseListQuery(testList, "limit=2&count=1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM `msm_test`").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT `id`, `name` FROM `msm_test` WHERE \\(`tenant_id` = \\?\\) ORDER BY `name` ASC, `id` ASC LIMIT 3").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "").AddRow(2, "").AddRow(3, "john"))
+
+	page, err := query.Run(db, func(row rowScanner) (interface{}, error) {
+		var item = &testItem{}
+
+		return item, row.Scan(&item.Id, &item.Name)
+	}, "`tenant_id` = ?", 1)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(page.Items) != 2 || page.Total == nil || *page.Total != 3 {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	// Omitted empty name is in the cursor
+	if expected := base64.RawURLEncoding.EncodeToString([]byte(`["",2]`)); page.Next != expected {
+		t.Errorf("Expected cursor %s, but got %s", expected, page.Next)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
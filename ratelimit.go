@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Buckets kept before the full ones are dropped
+const rateMaxKeys = 10000
+
+var ErrRateLimited = errors.New("Too many requests, try later")
+
+// Token bucket of the client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Request rate limit by key. Each key has the bucket of burst tokens
+// refilled with the rate per second, the request takes one token
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewRateLimiter(cfg *Config) *RateLimiter {
+	return &RateLimiter{
+		rate:    cfg.GetRateLimit(),
+		burst:   float64(cfg.GetRateBurst()),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take the token of the key, returns time to wait if there is none
+func (this *RateLimiter) Allow(key string) (wait time.Duration, ok bool) {
+	var now = this.now()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.buckets) >= rateMaxKeys {
+		this.prune(now)
+	}
+
+	b := this.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: this.burst, last: now}
+		this.buckets[key] = b
+	}
+
+	b.tokens = this.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / this.rate * float64(time.Second)), false
+	}
+
+	b.tokens--
+
+	return 0, true
+}
+
+func (this *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	var tokens = b.tokens + now.Sub(b.last).Seconds()*this.rate
+
+	if tokens > this.burst {
+		return this.burst
+	}
+
+	return tokens
+}
+
+// Drop the buckets refilled to the burst
+func (this *RateLimiter) prune(now time.Time) {
+	for key, b := range this.buckets {
+		if this.refill(b, now) >= this.burst {
+			delete(this.buckets, key)
+		}
+	}
+}
+
+// Throttle requests of the client address
+func RateLimit(limiter *RateLimiter) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(w http.ResponseWriter, ctx *Context) {
+			if wait, ok := limiter.Allow(remoteIP(ctx.r)); !ok {
+				ctx.log.Notice("Request rate limited", "remote", ctx.r.RemoteAddr)
+				writeRetry(w, wait, ErrRateLimited)
+
+				return
+			}
+
+			next(w, ctx)
+		}
+	}
+}
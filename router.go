@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Handler with the request context
+type ContextHandler func(http.ResponseWriter, *Context)
+
+// Wraps the handler, e.g. to authenticate the request
+type Middleware func(ContextHandler) ContextHandler
+
+// Apply middleware to the handler, the first one runs first
+func Chain(fn ContextHandler, mw ...Middleware) ContextHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+
+	return fn
+}
+
+// Method and path pattern. Pattern segment `{name}` matches any
+// non-empty segment and is available as the context parameter.
+// Name is the metrics route label
+type Route struct {
+	Method   string
+	Pattern  string
+	Name     string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+// Route parameters of the path, nil if the path doesn't match
+func (this *Route) match(segments []string) map[string]string {
+	return pathParams(this.segments, segments)
+}
+
+// Request router. Unknown path is not found, known path with other
+// method is not allowed. Trailing slash is ignored
+type Router struct {
+	sessions *Provider
+	routes   []*Route
+}
+
+func NewRouter(sessions *Provider) *Router {
+	return &Router{
+		sessions: sessions,
+	}
+}
+
+// Add route with the middleware chain
+func (this *Router) Handle(method, pattern, name string, fn ContextHandler, mw ...Middleware) {
+	var route = &Route{
+		Method:   method,
+		Pattern:  pattern,
+		Name:     name,
+		segments: strings.Split(pattern, "/"),
+	}
+
+	route.handler = instrumentHandler(name, inContext(Chain(fn, mw...), this.sessions, route))
+	this.routes = append(this.routes, route)
+}
+
+// Registered routes
+func (this *Router) Routes() []*Route {
+	return this.routes
+}
+
+func (this *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		segments = strings.Split(routePath(r.URL.Path), "/")
+		allowed  []string
+		seen     = make(map[string]bool)
+	)
+
+	for _, route := range this.routes {
+		params := route.match(segments)
+		if params == nil {
+			continue
+		}
+
+		if route.Method == r.Method || (r.Method == "HEAD" && route.Method == "GET") {
+			r = r.WithContext(withRouteParams(r.Context(), params))
+			route.handler(w, r)
+
+			return
+		}
+
+		if !seen[route.Method] {
+			seen[route.Method] = true
+			allowed = append(allowed, route.Method)
+		}
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+
+		instrumentHandler("method_not_allowed", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "")
+		})(w, r)
+
+		return
+	}
+
+	instrumentHandler("not_found", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "")
+	})(w, r)
+}
+
+type routeParamsKey struct{}
+
+func withRouteParams(parent context.Context, params map[string]string) context.Context {
+	return context.WithValue(parent, routeParamsKey{}, params)
+}
+
+// Parameters of the pattern segments `{name}`, nil on mismatch
+func pathParams(pattern, segments []string) map[string]string {
+	var params = make(map[string]string)
+
+	if len(pattern) != len(segments) {
+		return nil
+	}
+
+	for i, s := range pattern {
+		switch {
+		case strings.HasPrefix(s, "{"):
+			if segments[i] == "" {
+				return nil
+			}
+
+			params[strings.Trim(s, "{}")] = segments[i]
+
+		case s != segments[i]:
+			return nil
+		}
+	}
+
+	return params
+}
+
+// Path without the trailing slash
+func routePath(path string) string {
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	return path
+}
+
+// Plain handler without the context
+func PlainHandler(fn http.HandlerFunc) ContextHandler {
+	return func(w http.ResponseWriter, ctx *Context) {
+		fn(w, ctx.r)
+	}
+}
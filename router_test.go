@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Router(t *testing.T) {
+	var (
+		db, _   = InitDBMock(t)
+		prov, _ = NewManager(db, 0)
+		router  = NewRouter(prov)
+		trace   []string
+	)
+
+	defer db.Close()
+
+	mark := func(name string) Middleware {
+		return func(next ContextHandler) ContextHandler {
+			return func(w http.ResponseWriter, ctx *Context) {
+				trace = append(trace, name)
+				next(w, ctx)
+			}
+		}
+	}
+
+	handler := func(w http.ResponseWriter, ctx *Context) {
+		trace = append(trace, ctx.route.Name+":"+ctx.Param("domain")+":"+ctx.Param("local"))
+	}
+
+	router.Handle("GET", "/domains", "list_domains", handler, mark("first"), mark("second"))
+	router.Handle("GET", "/domains/{domain}/mailboxes/{local}", "get_mailbox", handler)
+	router.Handle("PUT", "/domains/{domain}/mailboxes/{local}", "update_mailbox", handler)
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+		trace  string
+	}{
+		{"GET", "/domains", http.StatusOK, "first,second,list_domains::"},
+		{"GET", "/domains/", http.StatusOK, "first,second,list_domains::"},
+		{"HEAD", "/domains", http.StatusOK, "first,second,list_domains::"},
+		{"PUT", "/domains/example.com/mailboxes/john", http.StatusOK, "update_mailbox:example.com:john"},
+		{"DELETE", "/domains/example.com/mailboxes/john", http.StatusMethodNotAllowed, ""},
+		{"GET", "/domains//mailboxes/john", http.StatusNotFound, ""},
+		{"GET", "/", http.StatusNotFound, ""},
+	}
+
+	for _, c := range cases {
+		trace = nil
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(c.method, c.path, nil)
+
+		router.ServeHTTP(w, r)
+
+		if w.Code != c.code || strings.Join(trace, ",") != c.trace {
+			t.Errorf("Unexpected %s %s: %d, %v", c.method, c.path, w.Code, trace)
+		}
+
+		if c.code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, PUT" {
+			t.Errorf("Expected Allow header, but got %q", w.Header().Get("Allow"))
+		}
+	}
+}
+
+func Test_RateLimiter(t *testing.T) {
+	var (
+		now     = time.Unix(1000, 0)
+		limiter = &RateLimiter{rate: 2, burst: 2, now: func() time.Time { return now }, buckets: make(map[string]*bucket)}
+	)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := limiter.Allow("10.0.0.1"); !ok {
+			t.Fatalf("Expected request %d allowed", i)
+		}
+	}
+
+	if wait, ok := limiter.Allow("10.0.0.1"); ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected wait 500ms, but got %s", wait)
+	}
+
+	if _, ok := limiter.Allow("10.0.0.2"); !ok {
+		t.Errorf("Expected other key allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+
+	if _, ok := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("Expected refilled token")
+	}
+
+	now = now.Add(time.Minute)
+	limiter.prune(now)
+
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Expected full buckets dropped, but got %d", len(limiter.buckets))
+	}
+}
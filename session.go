@@ -11,8 +11,16 @@ type Session struct {
 	//	maxlifetime int64
 	sid    string
 	uptime time.Time
+	// Client of the first request
+	ip        string
+	agent     string
+	agentHash string
+	started   int64
 
 	values map[interface{}]interface{}
+
+	// New session is stored by the provider on the first value set
+	persist func(*Session) error
 }
 
 type SessionInterface interface {
@@ -24,8 +32,9 @@ type SessionInterface interface {
 
 func NewSession(sid string) (sess *Session) {
 	sess = &Session{
-		sid:    sid,
-		values: make(map[interface{}]interface{}),
+		sid:     sid,
+		values:  make(map[interface{}]interface{}),
+		started: time.Now().Unix(),
 	}
 
 	sess.up()
@@ -45,15 +54,24 @@ func (this *Session) Delete(key interface{}) error {
 	return nil
 }
 
-func (this *Session) Id() string {
-	return this.sid
+func (this *Session) Id() (sid string) {
+	this.Lock()
+	sid = this.sid
+	this.Unlock()
+
+	return
 }
 
 func (this *Session) Cb(fn func(s *Session, args ...interface{}) error, args ...interface{}) (err error) {
 	this.Lock()
 	err = fn(this, args...)
+	persist := this.commit()
 	this.Unlock()
 
+	if err == nil && persist != nil {
+		err = this.store(persist)
+	}
+
 	return
 }
 
@@ -72,11 +90,45 @@ func (this *Session) Set(key, value interface{}) error {
 
 	this.Lock()
 	this.set(key, value)
+	persist := this.commit()
 	this.Unlock()
 
+	if persist != nil {
+		return this.store(persist)
+	}
+
 	return nil
 }
 
+// Session is not stored yet
+func (this *Session) IsNew() (isnew bool) {
+	this.Lock()
+	isnew = this.persist != nil
+	this.Unlock()
+
+	return
+}
+
+// Take persist callback once the new session has values
+func (this *Session) commit() (persist func(*Session) error) {
+	if this.persist != nil && len(this.values) > 0 {
+		persist, this.persist = this.persist, nil
+	}
+
+	return
+}
+
+// Call persist callback, keep it to retry on failure
+func (this *Session) store(persist func(*Session) error) (err error) {
+	if err = persist(this); err != nil {
+		this.Lock()
+		this.persist = persist
+		this.Unlock()
+	}
+
+	return
+}
+
 func (this *Session) delete(key interface{}) {
 	if _, ok := this.values[key]; ok {
 		delete(this.values, key)
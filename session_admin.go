@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Stored user agent length
+const userAgentLen = 255
+
+// Session metadata. Id is the hash of the session id, the session
+// id itself is never shown
+type SessionInfo struct {
+	Id            string `json:"id"`
+	PrincipalKind string `json:"principal_kind,omitempty"`
+	PrincipalId   int64  `json:"principal_id,omitempty"`
+	Principal     string `json:"principal,omitempty"`
+	TenantId      int64  `json:"tenant_id,omitempty"`
+	IP            string `json:"ip"`
+	UserAgent     string `json:"user_agent"`
+	Started       int64  `json:"started"`
+	Updated       int64  `json:"updated"`
+	// Active session in the memory storage
+	Cached bool `json:"cached"`
+
+	sid string
+}
+
+func sessionHandle(sid string) string {
+	var sum = sha256.Sum256([]byte(sid))
+
+	return hex.EncodeToString(sum[:12])
+}
+
+func userAgent(r *http.Request) string {
+	var ua = r.UserAgent()
+
+	if len(ua) > userAgentLen {
+		ua = ua[:userAgentLen]
+	}
+
+	return ua
+}
+
+// Stored sessions with the cached ones, the last updated first.
+// Cached session has the current principal and update time
+func (this *Provider) Sessions() (list []*SessionInfo, err error) {
+	var (
+		rows *sql.Rows
+		byId = make(map[string]*SessionInfo)
+	)
+
+	rows, err = this.conn.Query("SELECT `id`, `principal_kind`, `principal_id`, `principal`, `tenant_id`, `ip`, `user_agent`, `started`, `updated` FROM `msm_session`")
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var info = &SessionInfo{}
+
+		err = rows.Scan(&info.sid, &info.PrincipalKind, &info.PrincipalId, &info.Principal, &info.TenantId,
+			&info.IP, &info.UserAgent, &info.Started, &info.Updated)
+		if err != nil {
+			rows.Close()
+			return
+		}
+
+		byId[info.sid] = info
+		list = append(list, info)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	this.lock.Lock()
+
+	for _, s := range this.store {
+		s.Lock()
+
+		info := byId[s.sid]
+		if info == nil {
+			info = &SessionInfo{sid: s.sid, IP: s.ip, UserAgent: s.agent, Started: s.started}
+			list = append(list, info)
+		}
+
+		p, _ := s.values[PrincipalKey].(Principal)
+		info.PrincipalKind, info.PrincipalId, info.Principal, info.TenantId = p.Kind, p.Id, p.Name, p.Tenant
+		info.Updated, info.Cached = s.uptime.Unix(), true
+
+		s.Unlock()
+	}
+
+	this.lock.Unlock()
+
+	for _, info := range list {
+		info.Id = sessionHandle(info.sid)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Updated > list[j].Updated
+	})
+
+	return
+}
+
+// Destroy the sessions, their clients are logged out
+func (this *Provider) Kill(list []*SessionInfo) (n int64, err error) {
+	var result sql.Result
+
+	this.lock.Lock()
+
+	for _, info := range list {
+		if i, _ := this.get(info.sid); i >= 0 {
+			this.delete(i)
+		}
+	}
+
+	this.lock.Unlock()
+
+	for _, info := range list {
+		if result, err = this.conn.Exec("DELETE FROM `msm_session` WHERE `id` = ?", info.sid); err != nil {
+			return
+		}
+
+		if rows, _ := result.RowsAffected(); rows > 0 || info.Cached {
+			n++
+		}
+	}
+
+	return
+}
+
+// Destroy the sessions of the principal except the kept one
+func (this *Provider) KillPrincipal(kind string, id int64, keep string) (n int64, err error) {
+	var list, found []*SessionInfo
+
+	if list, err = this.Sessions(); err != nil {
+		return
+	}
+
+	for _, info := range list {
+		if info.PrincipalKind == kind && info.PrincipalId == id && info.sid != keep {
+			found = append(found, info)
+		}
+	}
+
+	return this.Kill(found)
+}
+
+// Destroy all sessions
+func (this *Provider) Purge() (n int64, err error) {
+	var result sql.Result
+
+	this.lock.Lock()
+	this.store = make([]*Session, 0)
+	this.lock.Unlock()
+
+	if result, err = this.conn.Exec("DELETE FROM `msm_session`"); err != nil {
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// Sessions of the principal, kind is any if empty
+func filterSessions(list []*SessionInfo, kind, name string) (found []*SessionInfo) {
+	for _, info := range list {
+		if (kind == "" || info.PrincipalKind == kind) && strings.EqualFold(info.Principal, name) {
+			found = append(found, info)
+		}
+	}
+
+	return
+}
+
+// Sessions of the tenant scope
+func visibleSessions(q querier, scope int64, list []*SessionInfo) (found []*SessionInfo, err error) {
+	var visible = make(map[int64]bool)
+
+	if scope == 0 {
+		return list, nil
+	}
+
+	for _, info := range list {
+		ok, seen := visible[info.TenantId]
+		if !seen {
+			if ok, err = tenantVisible(q, scope, info.TenantId); err != nil {
+				return
+			}
+
+			visible[info.TenantId] = ok
+		}
+
+		if ok {
+			found = append(found, info)
+		}
+	}
+
+	return
+}
+
+// Active sessions of the tenant scope: GET /sessions, optionally of
+// the principal. Logout: DELETE /sessions/{id}, all sessions of the
+// principal: DELETE /sessions?principal=name, all: DELETE /sessions?all=true
+func handleSessions(sessions *Provider) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			query = ctx.r.URL.Query()
+			name  = query.Get("principal")
+			kind  = query.Get("kind")
+			id    = ctx.Param("id")
+			list  []*SessionInfo
+			n     int64
+			err   error
+		)
+
+		if !ctx.Require(w, "sessions:admin") {
+			return
+		}
+
+		if ctx.r.Method == "DELETE" && id == "" && name == "" && query.Get("all") != "true" {
+			writeError(w, http.StatusBadRequest, "Principal or all required")
+			return
+		}
+
+		if list, err = sessions.Sessions(); err == nil {
+			list, err = visibleSessions(ctx.db, ctx.Tenant(), list)
+		}
+
+		if writeStoreError(w, ctx, "Can't list sessions", err) {
+			return
+		}
+
+		if name != "" {
+			list = filterSessions(list, kind, name)
+		}
+
+		switch {
+		case ctx.r.Method == "GET":
+			if list == nil {
+				list = make([]*SessionInfo, 0)
+			}
+
+			writeJSON(w, http.StatusOK, list)
+
+		case id != "":
+			for _, info := range list {
+				if info.Id == id {
+					if _, err = sessions.Kill([]*SessionInfo{info}); !writeStoreError(w, ctx, "Can't kill session", err) {
+						ctx.log.Notice("Session killed", "session", id, "session_principal", info.Principal)
+						w.WriteHeader(http.StatusNoContent)
+					}
+
+					return
+				}
+			}
+
+			writeError(w, http.StatusNotFound, "")
+
+		default:
+			if name == "" && ctx.Tenant() == 0 {
+				n, err = sessions.Purge()
+			} else {
+				n, err = sessions.Kill(list)
+			}
+
+			if !writeStoreError(w, ctx, "Can't kill sessions", err) {
+				ctx.log.Notice("Sessions killed", "session_principal", name, "count", n)
+				writeJSON(w, http.StatusOK, map[string]int64{"killed": n})
+			}
+		}
+	}
+}
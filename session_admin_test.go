@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var sessionInfoColumns = []string{"id", "principal_kind", "principal_id", "principal", "tenant_id", "ip", "user_agent", "started", "updated"}
+
+// Cached session overrides the stored metadata
+func Test_ProviderSessions(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		cached   = NewSession("cached")
+	)
+
+	defer db.Close()
+
+	cached.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 2, Name: "jane"})
+	prov.append(cached)
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_session`").
+		WillReturnRows(sqlmock.NewRows(sessionInfoColumns).
+			AddRow("stored", PrincipalStaff, 1, "john", 0, "10.0.0.1", "curl", 100, 200).
+			AddRow("cached", "", 0, "", 0, "10.0.0.2", "Firefox", 100, 150))
+
+	list, err := prov.Sessions()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(list) != 2 || list[0].Principal != "jane" || !list[0].Cached || list[0].IP != "10.0.0.2" ||
+		list[1].Principal != "john" || list[1].Cached || list[1].Id != sessionHandle("stored") {
+		t.Errorf("Unexpected sessions %+v, %+v", list[0], list[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_KillSessions(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		handler  = HandleInContext(handleSessions(prov), prov, nil)
+		admin    = NewSession(RandStringId(64))
+		victim   = NewSession("victim")
+	)
+
+	defer db.Close()
+
+	csrfToken(admin)
+	admin.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "admin", Role: RoleAdmin})
+	victim.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 2, Name: "john", Role: RoleHelpdesk})
+	prov.append(admin)
+	prov.append(victim)
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, path, nil)
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: admin.Id()})
+		r.Header.Set(CSRFHeader, admin.Get(CSRFKey).(string))
+
+		handler(w, r)
+
+		return w
+	}
+
+	if w := request("DELETE", "/sessions"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without principal, but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_session`").
+		WillReturnRows(sqlmock.NewRows(sessionInfoColumns).AddRow("stored", PrincipalStaff, 2, "john", 0, "10.0.0.1", "curl", 100, 200))
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("victim").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("stored").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if w := request("DELETE", "/sessions?principal=John&kind=staff"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"killed":2`) {
+		t.Errorf("Expected two sessions killed, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, s := prov.get("victim"); s != nil || prov.Len() != 1 {
+		t.Errorf("Expected cached session removed")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Session deleted by the command is dropped from the cache
+func Test_DropDeletedSessions(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+	)
+
+	defer db.Close()
+
+	prov.append(NewSession("alive"))
+	prov.append(NewSession("killed"))
+
+	mock.ExpectQuery("SELECT `id` FROM `msm_session` WHERE `id` IN \\(\\?, \\?\\)").WithArgs("alive", "killed").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("alive"))
+
+	if err := prov.dropDeleted(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if _, s := prov.get("killed"); s != nil || prov.Len() != 1 {
+		t.Errorf("Expected deleted session dropped")
+	}
+
+	// Large cache is checked in the batches
+	for i := 0; i < sessionCheckBatch; i++ {
+		prov.append(NewSession(fmt.Sprintf("sid%d", i)))
+	}
+
+	mock.ExpectQuery("SELECT `id` FROM `msm_session` WHERE `id` IN \\(\\?" + strings.Repeat(", \\?", sessionCheckBatch-1) + "\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("alive"))
+	mock.ExpectQuery("SELECT `id` FROM `msm_session` WHERE `id` IN \\(\\?\\)").WithArgs(fmt.Sprintf("sid%d", sessionCheckBatch-1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(fmt.Sprintf("sid%d", sessionCheckBatch-1)))
+
+	if err := prov.dropDeleted(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if prov.Len() != 2 {
+		t.Errorf("Expected two sessions left, but got %d", prov.Len())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Session binding modes
+const (
+	BindIP     = "ip"
+	BindSubnet = "subnet"
+)
+
+// Client fingerprint the session is bound to. Session used by the
+// other client is destroyed, the client gets the new one
+type SessionBinding struct {
+	// Prefix lengths of the compared addresses, zero is not bound
+	ipv4  int
+	ipv6  int
+	agent bool
+}
+
+// Binding of the configuration, nil if the session isn't bound
+func NewSessionBinding(cfg *Config) (*SessionBinding, error) {
+	var binding = &SessionBinding{}
+
+	if cfg.Session != nil {
+		binding.agent = cfg.Session.Agent
+	}
+
+	switch cfg.GetSessionBind() {
+	case "":
+	case BindIP:
+		binding.ipv4, binding.ipv6 = 32, 128
+	case BindSubnet:
+		binding.ipv4, binding.ipv6 = cfg.GetSessionIPv4Prefix(), cfg.GetSessionIPv6Prefix()
+
+		if binding.ipv4 < 1 || binding.ipv4 > 32 || binding.ipv6 < 1 || binding.ipv6 > 128 {
+			return nil, errors.New("Invalid session subnet prefix")
+		}
+	default:
+		return nil, errors.New("Unknown session bind " + cfg.GetSessionBind() + ", expected ip or subnet")
+	}
+
+	if binding.ipv4 == 0 && !binding.agent {
+		return nil, nil
+	}
+
+	return binding, nil
+}
+
+// Mismatch reason, empty if the request is of the session client
+func (this *SessionBinding) Check(s *Session, r *http.Request) string {
+	s.Lock()
+	ip, agent := s.ip, s.agentHash
+	s.Unlock()
+
+	if this.ipv4 > 0 && !this.sameNetwork(ip, remoteIP(r)) {
+		return "address"
+	}
+
+	if this.agent && agent != agentHash(r) {
+		return "user agent"
+	}
+
+	return ""
+}
+
+// Addresses are in the same subnet of the prefix length
+func (this *SessionBinding) sameNetwork(a, b string) bool {
+	var (
+		ipa  = net.ParseIP(a)
+		ipb  = net.ParseIP(b)
+		mask net.IPMask
+	)
+
+	if ipa == nil || ipb == nil {
+		return false
+	}
+
+	if ipa.To4() != nil && ipb.To4() != nil {
+		mask = net.CIDRMask(this.ipv4, 32)
+		ipa, ipb = ipa.To4(), ipb.To4()
+	} else {
+		mask = net.CIDRMask(this.ipv6, 128)
+	}
+
+	return ipa.Mask(mask).Equal(ipb.Mask(mask))
+}
+
+// Hash of the whole user agent, the stored one is truncated
+func agentHash(r *http.Request) string {
+	var sum = sha256.Sum256([]byte(r.UserAgent()))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_SessionBindingCheck(t *testing.T) {
+	var session = NewSession("sid")
+
+	session.ip, session.agentHash = "10.0.0.1", agentHash(&http.Request{Header: http.Header{"User-Agent": {"curl"}}})
+
+	cases := []struct {
+		binding *SessionBinding
+		remote  string
+		agent   string
+		reason  string
+	}{
+		{&SessionBinding{ipv4: 32, ipv6: 128}, "10.0.0.1:1234", "Firefox", ""},
+		{&SessionBinding{ipv4: 32, ipv6: 128}, "10.0.0.2:1234", "curl", "address"},
+		{&SessionBinding{ipv4: 24, ipv6: 64}, "10.0.0.200:1234", "curl", ""},
+		{&SessionBinding{ipv4: 24, ipv6: 64}, "10.0.1.1:1234", "curl", "address"},
+		{&SessionBinding{ipv4: 24, ipv6: 64}, "[2001:db8::1]:1234", "curl", "address"},
+		{&SessionBinding{agent: true}, "10.0.1.1:1234", "curl", ""},
+		{&SessionBinding{agent: true}, "10.0.0.1:1234", "Firefox", "user agent"},
+	}
+
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set("User-Agent", c.agent)
+
+		if reason := c.binding.Check(session, r); reason != c.reason {
+			t.Errorf("Expected reason %q for %s %s, but got %q", c.reason, c.remote, c.agent, reason)
+		}
+	}
+
+	session.ip = "2001:db8::1"
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8::ffff]:1234"
+
+	if reason := (&SessionBinding{ipv4: 24, ipv6: 64}).Check(session, r); reason != "" {
+		t.Errorf("Expected same IPv6 subnet, but got %q", reason)
+	}
+}
+
+func Test_NewSessionBinding(t *testing.T) {
+	if binding, err := NewSessionBinding(&Config{}); binding != nil || err != nil {
+		t.Errorf("Expected unbound sessions, but got %v, %v", binding, err)
+	}
+
+	if _, err := NewSessionBinding(&Config{Session: &SessionConfig{Bind: "mac"}}); err == nil {
+		t.Errorf("Expected unknown bind error")
+	}
+
+	binding, err := NewSessionBinding(&Config{Session: &SessionConfig{Bind: BindSubnet, IPv4Prefix: 16}})
+	if err != nil || binding.ipv4 != 16 || binding.ipv6 != 64 {
+		t.Errorf("Unexpected binding %+v, %v", binding, err)
+	}
+
+	for _, cfg := range []SessionConfig{{Bind: BindSubnet, IPv4Prefix: -8}, {Bind: BindSubnet, IPv6Prefix: 129}} {
+		if _, err := NewSessionBinding(&Config{Session: &cfg}); err == nil {
+			t.Errorf("Expected invalid prefix error of %+v", cfg)
+		}
+	}
+}
+
+// Session used from the other network is destroyed
+func Test_StartSessionBindMismatch(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		stolen   = NewSession("stolen")
+	)
+
+	defer db.Close()
+
+	prov.SetBinding(&SessionBinding{ipv4: 24, ipv6: 64})
+
+	stolen.ip = "10.0.0.1"
+	stolen.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "john"})
+	prov.append(stolen)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.77:1234"
+	r.AddCookie(&http.Cookie{Name: prov.Name(), Value: "stolen"})
+
+	if session, err := prov.Start(httptest.NewRecorder(), r); err != nil || session != stolen {
+		t.Fatalf("Expected session of the same subnet, but got %v, %v", session, err)
+	}
+
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("stolen").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r.RemoteAddr = "10.0.1.5:1234"
+
+	session, err := prov.Start(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if session == stolen || !session.IsNew() || session.ip != "10.0.1.5" || prov.Len() != 0 {
+		t.Errorf("Expected new session, but got %s with %d cached", session.Id(), prov.Len())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_SessionCookieOnly(t *testing.T) {
+	var (
+		db, _   = InitDBMock(t)
+		prov, _ = NewManager(db, 0)
+		cached  = NewSession("cached")
+	)
+
+	defer db.Close()
+
+	prov.append(cached)
+
+	r, _ := http.NewRequest("GET", "/?"+prov.Name()+"=cached", nil)
+
+	if session, _ := prov.Start(httptest.NewRecorder(), r); session != cached {
+		t.Errorf("Expected session of the query")
+	}
+
+	prov.SetCookieOnly(true)
+	r, _ = http.NewRequest("GET", "/?"+prov.Name()+"=cached", nil)
+
+	if session, _ := prov.Start(httptest.NewRecorder(), r); session == cached {
+		t.Errorf("Expected query session id ignored")
+	}
+}
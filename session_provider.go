@@ -5,10 +5,14 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Session ids in one query of the cache check
+const sessionCheckBatch = 500
+
 type Provider struct {
 	// Seconds. Keep session data from DB in the memmory
 	cacheLifeTime time.Duration
@@ -19,6 +23,16 @@ type Provider struct {
 	gcInterval time.Duration
 	// Hours. Database garbage collector value
 	maxAge int
+	// Last successful garbage collection
+	gcTime time.Time
+	// Client binding, nil if not bound
+	binding *SessionBinding
+	// Session id of the form and query is ignored
+	cookieOnly bool
+	// Timeouts by the session policy, unlimited if missing
+	timeouts map[string]SessionTimeout
+	// Seconds. Session cookie max age, zero is the browser session
+	cookieAge int
 
 	lock sync.Mutex
 	// Memmory storage for the active sessions
@@ -74,6 +88,24 @@ func (this *Provider) GC(gc int64) {
 	this.watchGarbage()
 }
 
+// Time of the last successful garbage collection
+func (this *Provider) LastGC() (t time.Time) {
+	this.lock.Lock()
+	t = this.gcTime
+	this.lock.Unlock()
+
+	return
+}
+
+// Number of sessions in the memmory storage
+func (this *Provider) Len() (l int) {
+	this.lock.Lock()
+	l = len(this.store)
+	this.lock.Unlock()
+
+	return
+}
+
 // Cookie name
 func (this *Provider) Name() string {
 	return this.cookieName
@@ -86,10 +118,29 @@ func (this *Provider) SetCacheInterval(cache int64) {
 	}
 }
 
+// Bind sessions to the client, nil disables the check
+func (this *Provider) SetBinding(binding *SessionBinding) {
+	this.binding = binding
+}
+
+// Take session id from the cookie only
+func (this *Provider) SetCookieOnly(cookieOnly bool) {
+	this.cookieOnly = cookieOnly
+}
+
+// Session timeouts by the policy of the principal
+func (this *Provider) SetTimeouts(timeouts map[string]SessionTimeout) {
+	this.timeouts = timeouts
+	this.cookieAge = int(cookieAge(timeouts))
+}
+
+// Get session by request cookie or form value. Unknown session is not
+// stored and cookie is not sent until the first value is set, so the
+// handler must set values before writing the response body
 func (this *Provider) Start(w http.ResponseWriter, r *http.Request) (session *Session, err error) {
 	var (
-		cookie *http.Cookie
 		sid    string
+		cached bool
 	)
 
 	if sid, err = this.sid(r); err != nil {
@@ -100,35 +151,146 @@ func (this *Provider) Start(w http.ResponseWriter, r *http.Request) (session *Se
 		this.lock.Lock()
 		_, session = this.get(sid)
 		this.lock.Unlock()
-	} else {
-		sid = RandStringId(64)
+
+		if cached = session != nil; !cached {
+			if session, err = this.read(sid); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if session == nil {
-		if session, err = this.read(sid); err != nil {
-			return nil, err
+	// Expired session is destroyed at once, not by the garbage collector
+	if session != nil {
+		if reason := this.timeout(session).Check(session, time.Now()); reason != "" {
+			this.expire(session, reason)
+			session = nil
 		}
+	}
 
-		this.lock.Lock()
-		this.append(session)
-		this.lock.Unlock()
-	} else {
+	// Stolen session is destroyed
+	if session != nil && this.binding != nil {
+		if reason := this.binding.Check(session, r); reason != "" {
+			this.invalidate(session, r, reason)
+			session = nil
+		}
+	}
+
+	if session != nil {
+		session.Lock()
 		session.up()
+		session.Unlock()
+
+		if !cached {
+			this.lock.Lock()
+			this.append(session)
+			this.lock.Unlock()
+		}
 	}
 
-	cookie = &http.Cookie{
-		Name:     this.cookieName,
-		Value:    url.QueryEscape(sid),
-		MaxAge:   this.maxAge,
-		Path:     "/",
-		HttpOnly: true,
+	// Client id is never trusted for the new session
+	if session == nil {
+		session = NewSession(RandSecureId(64))
+		session.ip, session.agent, session.agentHash = remoteIP(r), userAgent(r), agentHash(r)
+		session.persist = func(s *Session) (err error) {
+			if err = this.create(s); err != nil {
+				return
+			}
+
+			this.lock.Lock()
+			this.append(s)
+			this.lock.Unlock()
+
+			this.setCookie(w, r, s.Id())
+
+			return
+		}
+
+		return
 	}
-	http.SetCookie(w, cookie)
-	r.AddCookie(cookie)
+
+	this.setCookie(w, r, session.sid)
 
 	return
 }
 
+// Change session id, keep values and rotate CSRF token.
+// Must be called on the privilege change, e.g. login
+func (this *Provider) Regenerate(w http.ResponseWriter, r *http.Request, s *Session) (err error) {
+	var (
+		sid   = RandSecureId(64)
+		isnew = s.IsNew()
+	)
+
+	// Lifetime is counted from the privilege change
+	started := time.Now().Unix()
+
+	if !isnew {
+		if _, err = this.conn.Exec("UPDATE `msm_session` SET `id` = ?, `started` = ? WHERE `id` = ?", sid, started, s.Id()); err != nil {
+			return
+		}
+	}
+
+	this.lock.Lock()
+	s.Lock()
+	s.sid, s.started = sid, started
+	s.Unlock()
+	this.lock.Unlock()
+
+	if !isnew {
+		this.setCookie(w, r, sid)
+	}
+
+	_, err = rotateCSRF(s)
+
+	return
+}
+
+// Timeouts of the session principal
+func (this *Provider) timeout(s *Session) SessionTimeout {
+	s.Lock()
+	p, _ := s.values[PrincipalKey].(Principal)
+	s.Unlock()
+
+	return this.timeouts[sessionPolicy(p)]
+}
+
+// Destroy the timed out session
+func (this *Provider) expire(s *Session, reason string) {
+	var sid = s.Id()
+
+	s.Lock()
+	p, _ := s.values[PrincipalKey].(Principal)
+	s.Unlock()
+
+	if _, err := this.Kill([]*SessionInfo{{sid: sid}}); err != nil {
+		log.With("session", sessionHandle(sid), "error", err).Error("Can't destroy expired session")
+		return
+	}
+
+	log.With("session", sessionHandle(sid), "session_principal", p.Name, "reason", reason).Info("Session expired")
+}
+
+// Destroy the session used by the other client
+func (this *Provider) invalidate(s *Session, r *http.Request, reason string) {
+	var (
+		sid   = s.Id()
+		entry = log.With("session", sessionHandle(sid), "remote", remoteIP(r), "reason", reason)
+	)
+
+	s.Lock()
+	p, _ := s.values[PrincipalKey].(Principal)
+	entry = entry.With("session_ip", s.ip, "session_principal", p.Name)
+	s.Unlock()
+
+	if _, err := this.Kill([]*SessionInfo{{sid: sid}}); err != nil {
+		entry.Error("Can't destroy session", "error", err)
+	}
+
+	entry.Hook(func(level int, msg string, fields Fields) {
+		publishAudit("sessions:admin", p.Tenant, msg, fields)
+	}).Warning("Session fingerprint mismatch")
+}
+
 // Add new session entry to the provider storage
 func (this *Provider) append(session *Session) {
 	this.store = append(this.store, session)
@@ -168,13 +330,56 @@ func (this *Provider) flush() {
 	this.each(fn)
 }
 
-// Clean session garbage from DB
+// Clean session garbage from DB: abandoned sessions and the ones
+// over the timeouts of the principal kind
 func (this *Provider) garbage() (err error) {
 	var (
-		now = time.Now().Unix()
+		now    = time.Now().Unix()
+		result sql.Result
+		rows   int64
+		kinds  = kindTimeouts(this.timeouts)
 	)
 
-	_, err = this.conn.Exec("DELETE FROM `msm_session` WHERE ? - `updated` > ?", now, this.maxAge)
+	// Cached sessions update the database when they leave the cache
+	this.Flush()
+
+	defer metricDBQuery.Since(time.Now(), "session_gc")
+
+	if result, err = this.conn.Exec("DELETE FROM `msm_session` WHERE ? - `updated` > ?", now, this.maxAge); err != nil {
+		return
+	}
+
+	if rows, err = result.RowsAffected(); err == nil {
+		metricSessionGC.Add(float64(rows))
+	}
+
+	for _, kind := range []string{"", PrincipalMailbox, PrincipalStaff} {
+		var (
+			t     = kinds[kind]
+			conds []string
+			args  = []interface{}{kind}
+		)
+
+		if t.Idle > 0 {
+			conds, args = append(conds, "? - `updated` > ?"), append(args, now, t.Idle)
+		}
+
+		if t.Lifetime > 0 {
+			conds, args = append(conds, "? - `started` > ?"), append(args, now, t.Lifetime)
+		}
+
+		if len(conds) == 0 {
+			continue
+		}
+
+		if result, err = this.conn.Exec("DELETE FROM `msm_session` WHERE `principal_kind` = ? AND ("+strings.Join(conds, " OR ")+")", args...); err != nil {
+			return
+		}
+
+		if rows, err = result.RowsAffected(); err == nil {
+			metricSessionGC.Add(float64(rows))
+		}
+	}
 
 	return
 }
@@ -235,34 +440,151 @@ func (this *Provider) keepAlive() {
 	this.store = store
 }
 
-// Restore session from DB or create new if not exists
-func (this *Provider) read(sid string) (session *Session, err error) {
+// Drop cached sessions deleted from the database by the other
+// process, e.g. the sessions command. Database is checked without
+// the lock in the batches of the session ids
+func (this *Provider) dropDeleted() (err error) {
 	var (
-		now         int64
-		row         *sql.Row
-		sessiondata []byte
+		sids    []string
+		missing = make(map[string]bool)
 	)
 
-	session = NewSession(sid)
+	this.lock.Lock()
+	for _, s := range this.store {
+		sids = append(sids, s.sid)
+	}
+	this.lock.Unlock()
 
-	row = this.conn.QueryRow("SELECT `data` FROM `msm_session` WHERE `id` = ?", sid)
-	err = row.Scan(&sessiondata)
+	for len(sids) > 0 {
+		batch := sids
+		if len(batch) > sessionCheckBatch {
+			batch = batch[:sessionCheckBatch]
+		}
+
+		sids = sids[len(batch):]
 
+		if err = this.findDeleted(batch, missing); err != nil {
+			return
+		}
+	}
+
+	if len(missing) == 0 {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	store := make([]*Session, 0, len(this.store))
+
+	for _, s := range this.store {
+		if !missing[s.sid] {
+			store = append(store, s)
+		}
+	}
+
+	this.store = store
+
+	return
+}
+
+// Add the session ids missing in the database
+func (this *Provider) findDeleted(sids []string, missing map[string]bool) (err error) {
+	var (
+		rows  *sql.Rows
+		found = make(map[string]bool)
+		args  = make([]interface{}, 0, len(sids))
+	)
+
+	for _, sid := range sids {
+		args = append(args, sid)
+	}
+
+	rows, err = this.conn.Query("SELECT `id` FROM `msm_session` WHERE `id` IN (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			return nil, err
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var sid string
+
+		if err = rows.Scan(&sid); err != nil {
+			return
 		}
 
-		now = time.Now().Unix()
+		found[sid] = true
+	}
 
-		_, err = this.conn.Exec("INSERT INTO `msm_session`(`id`,`data`,`started`, `updated`) VALUES(?, ?, ?, ?)",
-			sid, "", now, now)
+	if err = rows.Err(); err != nil {
+		return
+	}
 
-		if err != nil {
-			return nil, err
+	for _, sid := range sids {
+		if !found[sid] {
+			missing[sid] = true
 		}
 	}
 
+	return
+}
+
+// Store new session to the DB
+func (this *Provider) create(s *Session) (err error) {
+	var (
+		data []byte
+		sid  string
+		now  = time.Now().Unix()
+	)
+
+	s.Lock()
+	sid = s.sid
+	p, _ := s.values[PrincipalKey].(Principal)
+	data, err = EncodeGob(s.values)
+	s.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	defer metricDBQuery.Since(time.Now(), "session_insert")
+
+	_, err = this.conn.Exec("INSERT INTO `msm_session`(`id`, `data`, `started`, `updated`, `ip`, `user_agent`, `agent_hash`, `principal_kind`, `principal_id`, `principal`, `tenant_id`) "+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", sid, data, now, now, s.ip, s.agent, s.agentHash, p.Kind, p.Id, p.Name, p.Tenant)
+	if err == nil {
+		metricSessionCreates.Inc()
+	}
+
+	return
+}
+
+// Restore session from DB, nil if not exists
+func (this *Provider) read(sid string) (session *Session, err error) {
+	var (
+		row         *sql.Row
+		sessiondata []byte
+		start       time.Time
+		updated     int64
+	)
+
+	start = time.Now()
+	session = NewSession(sid)
+	row = this.conn.QueryRow("SELECT `data`, `ip`, `user_agent`, `agent_hash`, `started`, `updated` FROM `msm_session` WHERE `id` = ?", sid)
+	err = row.Scan(&sessiondata, &session.ip, &session.agent, &session.agentHash, &session.started, &updated)
+	metricDBQuery.Since(start, "session_select")
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	metricSessionLoads.Inc()
+
+	// Last request time, the idle timeout is checked by the caller
+	session.uptime = time.Unix(updated, 0)
+
 	if len(sessiondata) > 0 {
 		session.values, err = DecodeGob(sessiondata)
 
@@ -284,15 +606,41 @@ func (this *Provider) save(s *Session) (err error) {
 		return
 	}
 
-	_, err = this.conn.Exec("UPDATE `msm_session` SET `data` = ?, `updated` = ? WHERE `id` = ?", data, time.Now().Unix(), s.sid)
+	p, _ := s.values[PrincipalKey].(Principal)
+
+	defer metricDBQuery.Since(time.Now(), "session_update")
+
+	_, err = this.conn.Exec("UPDATE `msm_session` SET `data` = ?, `updated` = ?, `principal_kind` = ?, `principal_id` = ?, `principal` = ?, `tenant_id` = ? WHERE `id` = ?",
+		data, s.uptime.Unix(), p.Kind, p.Id, p.Name, p.Tenant, s.sid)
+	if err == nil {
+		metricSessionSaves.Inc()
+	}
 
 	return
 }
 
+// Send session cookie
+func (this *Provider) setCookie(w http.ResponseWriter, r *http.Request, sid string) {
+	var cookie = &http.Cookie{
+		Name:     this.cookieName,
+		Value:    url.QueryEscape(sid),
+		MaxAge:   this.cookieAge,
+		Path:     "/",
+		HttpOnly: true,
+	}
+
+	http.SetCookie(w, cookie)
+	r.AddCookie(cookie)
+}
+
 // Get session id from the http request by cookie name
 func (this *Provider) sid(r *http.Request) (string, error) {
 	cookie, err := r.Cookie(this.cookieName)
 
+	if (err != nil || cookie.Value == "") && this.cookieOnly {
+		return "", nil
+	}
+
 	if err != nil || cookie.Value == "" || cookie.MaxAge < 0 {
 		err := r.ParseForm()
 		if err != nil {
@@ -308,6 +656,10 @@ func (this *Provider) sid(r *http.Request) (string, error) {
 }
 
 func (this *Provider) watchCache() {
+	if err := this.dropDeleted(); err != nil {
+		log.Error("Session cache check: %s", err.Error())
+	}
+
 	this.lock.Lock()
 	this.keepAlive()
 	this.lock.Unlock()
@@ -316,6 +668,13 @@ func (this *Provider) watchCache() {
 }
 
 func (this *Provider) watchGarbage() {
-	this.garbage()
+	if err := this.garbage(); err != nil {
+		log.Error("Session garbage collection: %s", err.Error())
+	} else {
+		this.lock.Lock()
+		this.gcTime = time.Now()
+		this.lock.Unlock()
+	}
+
 	time.AfterFunc(this.gcInterval, func() { this.watchGarbage() })
 }
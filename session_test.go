@@ -16,6 +16,9 @@ type SomeSessMock struct {
 	Value int
 }
 
+// Columns of the session read
+var sessionColumns = []string{"data", "ip", "user_agent", "agent_hash", "started", "updated"}
+
 func InitDBMock(t *testing.T) (db *sql.DB, mock sqlmock.Sqlmock) {
 	var (
 		err error
@@ -90,7 +93,7 @@ func Test_ProviderReadExisting(t *testing.T) {
 
 		mock.ExpectQuery("SELECT").
 			WithArgs(v["key"]).
-			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(c))
+			WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(c, "127.0.0.1", "", "", 0, 0))
 	}
 
 	for _, v := range sessions {
@@ -107,35 +110,52 @@ func Test_ProviderReadExisting(t *testing.T) {
 
 func Test_CreateCookieSidIfCookieNotPasswedInRequest(t *testing.T) {
 	var (
-		err error
+		err  error
+		sess *Session
 
 		db, mock = InitDBMock(t)
 		prov, _  = NewManager(db, 0)
 	)
 
-	mock.ExpectQuery("SELECT").WithArgs(sqlmock.AnyArg()).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}))
-	mock.ExpectExec("INSERT INTO").WillReturnResult(sqlmock.NewResult(1, 1))
-
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "/", nil)
 
-	_, err = prov.Start(w, r)
+	sess, err = prov.Start(w, r)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 
+	if c := w.Header().Get("Set-Cookie"); c != "" || !sess.IsNew() || prov.Len() != 0 {
+		t.Errorf("Expected new session without cookie, but got %s", c)
+	}
+
+	mock.ExpectExec("INSERT INTO").WithArgs(sess.Id(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", "", agentHash(r), "", 0, "", 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = sess.Set("user", "anyuser"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
 	if ok, _ := regexp.MatchString("msm-server-sid=.", r.Header.Get("Cookie")); !ok {
 		t.Errorf("Expexted valid cookie in the response")
 	}
 
+	if sess.IsNew() || prov.Len() != 1 {
+		t.Errorf("Expected stored session")
+	}
+
+	// Stored once
+	if err = sess.Set("user", "otheruser"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
 	// we make sure that all expectations were met
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Fatalf("There were unfulfilled expections: %s", err.Error())
 	}
 }
 
-func Test_ProviderReadAndCreateNew(t *testing.T) {
+func Test_ProviderReadExistingAndMissing(t *testing.T) {
 	var (
 		err error
 
@@ -163,19 +183,22 @@ func Test_ProviderReadAndCreateNew(t *testing.T) {
 		if v["key"] == "exists" {
 			mock.ExpectQuery("SELECT").
 				WithArgs(v["key"]).
-				WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(c))
+				WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(c, "127.0.0.1", "", "", 0, 0))
 		} else {
 			mock.ExpectQuery("SELECT").
-				WithArgs(v["key"]).WillReturnRows(sqlmock.NewRows([]string{"data"}))
-
-			mock.ExpectExec("INSERT INTO").WillReturnResult(sqlmock.NewResult(1, 1))
+				WithArgs(v["key"]).WillReturnRows(sqlmock.NewRows(sessionColumns))
 		}
 	}
 
 	for _, v := range sessions {
-		if _, err = prov.read(v["key"].(string)); err != nil {
+		s, err := prov.read(v["key"].(string))
+		if err != nil {
 			t.Error(err)
 		}
+
+		if (s == nil) != (v["key"] == "notexists") {
+			t.Errorf("Unexpected session %v for key %s", s, v["key"])
+		}
 	}
 
 	// we make sure that all expectations were met
@@ -198,7 +221,7 @@ func Test_StartSessionWithExistingCookie(t *testing.T) {
 
 	c, _ := EncodeGob(map[interface{}]interface{}{"data": "somedata"})
 	mock.ExpectQuery("SELECT").WithArgs(sid).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(c))
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(c, "127.0.0.1", "", "", 0, 0))
 
 	w := httptest.NewRecorder()
 	http.SetCookie(w, &http.Cookie{Name: prov.cookieName, Value: sid})
@@ -221,6 +244,38 @@ func Test_StartSessionWithExistingCookie(t *testing.T) {
 	}
 }
 
+func Test_StartSessionWithUnknownCookie(t *testing.T) {
+	var (
+		err  error
+		sess *Session
+
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		sid      = RandStringId(64)
+	)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT").WithArgs(sid).
+		WillReturnRows(sqlmock.NewRows(sessionColumns))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: prov.cookieName, Value: sid})
+
+	if sess, err = prov.Start(w, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if !sess.IsNew() || sess.Id() == sid {
+		t.Errorf("Expected new session with generated id")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
 func Test_GarbageRecordsRemove(t *testing.T) {
 	var (
 		err error
@@ -465,7 +520,7 @@ func Test_StartSessionConcurrance(t *testing.T) {
 
 		c, _ := EncodeGob(map[interface{}]interface{}{"siddata": queue[i]})
 		mock.ExpectQuery("SELECT").WithArgs(queue[i]).
-			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(c))
+			WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(c, "127.0.0.1", "", "", 0, 0))
 
 		sess, err = handler(prov, queue[i])
 
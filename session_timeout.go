@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Staff session timeouts in seconds if not configured
+const (
+	staffSessionIdle     = 3600
+	staffSessionLifetime = 43200
+)
+
+// Session timeouts in seconds, zero is unlimited. Lifetime is
+// counted from the login, idle from the last request
+type SessionTimeout struct {
+	Idle     int64
+	Lifetime int64
+}
+
+// Timeouts by the session policy. Configured zero value is the
+// default one, negative is unlimited
+func NewSessionTimeouts(cfg *Config) (timeouts map[string]SessionTimeout, err error) {
+	var (
+		idle     = cfg.GetSessionIdle()
+		lifetime = cfg.GetSessionLifetime()
+		pick     = func(value, def int64) int64 {
+			switch {
+			case value < 0:
+				return 0
+			case value == 0:
+				return def
+			}
+
+			return value
+		}
+	)
+
+	timeouts = map[string]SessionTimeout{
+		"":               {Idle: pick(idle, 0), Lifetime: pick(lifetime, 0)},
+		PrincipalMailbox: {Idle: pick(idle, 0), Lifetime: pick(lifetime, 0)},
+	}
+
+	for role := range roleScopes {
+		timeouts[role] = SessionTimeout{Idle: pick(idle, staffSessionIdle), Lifetime: pick(lifetime, staffSessionLifetime)}
+	}
+
+	if cfg.Session == nil {
+		return
+	}
+
+	for key, t := range cfg.Session.Role {
+		def, ok := timeouts[key]
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Unknown session role %s, expected staff role or %s", key, PrincipalMailbox)
+		}
+
+		timeouts[key] = SessionTimeout{Idle: pick(t.Idle, def.Idle), Lifetime: pick(t.Lifetime, def.Lifetime)}
+	}
+
+	return
+}
+
+// Timeouts key of the principal: staff role, `mailbox` or empty
+// for the anonymous session
+func sessionPolicy(p Principal) string {
+	switch p.Kind {
+	case PrincipalStaff:
+		return p.Role
+	case PrincipalMailbox:
+		return PrincipalMailbox
+	}
+
+	return ""
+}
+
+// Longer of the timeouts, zero is unlimited
+func longerTimeout(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// Timeouts by the principal kind of the stored session. Role isn't
+// stored, so staff sessions get the longest timeouts of the roles
+func kindTimeouts(timeouts map[string]SessionTimeout) map[string]SessionTimeout {
+	var (
+		kinds = map[string]SessionTimeout{"": timeouts[""], PrincipalMailbox: timeouts[PrincipalMailbox]}
+		first = true
+	)
+
+	for role := range roleScopes {
+		t, staff := timeouts[role], kinds[PrincipalStaff]
+
+		if !first {
+			t = SessionTimeout{Idle: longerTimeout(t.Idle, staff.Idle), Lifetime: longerTimeout(t.Lifetime, staff.Lifetime)}
+		}
+
+		kinds[PrincipalStaff], first = t, false
+	}
+
+	return kinds
+}
+
+// Session cookie age in seconds: the longest lifetime, zero keeps
+// the cookie for the browser session if any lifetime is unlimited
+func cookieAge(timeouts map[string]SessionTimeout) (age int64) {
+	for _, t := range timeouts {
+		if t.Lifetime == 0 {
+			return 0
+		}
+
+		if t.Lifetime > age {
+			age = t.Lifetime
+		}
+	}
+
+	return
+}
+
+// Expiration reason, empty if the session is alive
+func (this SessionTimeout) Check(s *Session, now time.Time) string {
+	s.Lock()
+	started, uptime := s.started, s.uptime
+	s.Unlock()
+
+	switch {
+	case this.Lifetime > 0 && now.Unix()-started > this.Lifetime:
+		return "lifetime"
+	case this.Idle > 0 && now.Sub(uptime) > time.Duration(this.Idle)*time.Second:
+		return "idle"
+	}
+
+	return ""
+}
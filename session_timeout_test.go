@@ -0,0 +1,212 @@
+package main
+
+import (
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_NewSessionTimeouts(t *testing.T) {
+	timeouts, err := NewSessionTimeouts(&Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if timeouts[RoleAdmin] != (SessionTimeout{staffSessionIdle, staffSessionLifetime}) || timeouts[PrincipalMailbox] != (SessionTimeout{}) {
+		t.Errorf("Unexpected default timeouts %v", timeouts)
+	}
+
+	timeouts, err = NewSessionTimeouts(&Config{Session: &SessionConfig{
+		Idle: 600,
+		Role: map[string]SessionTimeout{
+			RoleAdmin:        {Idle: 300},
+			PrincipalMailbox: {Idle: -1, Lifetime: 86400},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if timeouts[RoleAdmin] != (SessionTimeout{300, staffSessionLifetime}) ||
+		timeouts[RoleHelpdesk] != (SessionTimeout{600, staffSessionLifetime}) ||
+		timeouts[PrincipalMailbox] != (SessionTimeout{0, 86400}) ||
+		timeouts[""] != (SessionTimeout{600, 0}) {
+		t.Errorf("Unexpected timeouts %v", timeouts)
+	}
+
+	if _, err = NewSessionTimeouts(&Config{Session: &SessionConfig{Role: map[string]SessionTimeout{"root": {}}}}); err == nil {
+		t.Errorf("Expected unknown role error")
+	}
+}
+
+func Test_SessionTimeoutCheck(t *testing.T) {
+	var (
+		now     = time.Now()
+		session = NewSession("sid")
+		timeout = SessionTimeout{Idle: 60, Lifetime: 3600}
+	)
+
+	cases := []struct {
+		started time.Time
+		uptime  time.Time
+		reason  string
+	}{
+		{now.Add(-time.Minute), now.Add(-time.Second), ""},
+		{now.Add(-time.Minute), now.Add(-2 * time.Minute), "idle"},
+		{now.Add(-2 * time.Hour), now.Add(-time.Second), "lifetime"},
+	}
+
+	for _, c := range cases {
+		session.started, session.uptime = c.started.Unix(), c.uptime
+
+		if reason := timeout.Check(session, now); reason != c.reason {
+			t.Errorf("Expected reason %q, but got %q", c.reason, reason)
+		}
+	}
+
+	if reason := (SessionTimeout{}).Check(session, now); reason != "" {
+		t.Errorf("Expected unlimited session, but got %q", reason)
+	}
+}
+
+// Idle session of the database is deleted, the client gets the new one
+func Test_StartSessionExpired(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		now      = time.Now().Unix()
+		staff    = NewSession("staff")
+	)
+
+	defer db.Close()
+
+	prov.SetTimeouts(map[string]SessionTimeout{RoleAdmin: {Idle: 60, Lifetime: 3600}})
+
+	staff.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "john", Role: RoleAdmin})
+	data, _ := EncodeGob(staff.values)
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_session`").WithArgs("idle").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(data, "127.0.0.1", "", "", now-600, now-120))
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("idle").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_session`").WithArgs("alive").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(data, "127.0.0.1", "", "", now-600, now-30))
+
+	for _, sid := range []string{"idle", "alive"} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: sid})
+
+		session, err := prov.Start(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if expired := session.IsNew(); expired != (sid == "idle") {
+			t.Errorf("Unexpected session %s of %s", session.Id(), sid)
+		}
+	}
+
+	if prov.Len() != 1 {
+		t.Errorf("Expected alive session cached, but got %d", prov.Len())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Cached session over the lifetime is destroyed at once
+func Test_StartSessionLifetime(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		staff    = NewSession("staff")
+	)
+
+	defer db.Close()
+
+	prov.SetTimeouts(map[string]SessionTimeout{RoleHelpdesk: {Lifetime: 3600}})
+
+	staff.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 2, Name: "jane", Role: RoleHelpdesk})
+	staff.started = time.Now().Add(-2 * time.Hour).Unix()
+	prov.append(staff)
+
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `id` = \\?").WithArgs("staff").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: prov.Name(), Value: "staff"})
+
+	session, err := prov.Start(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if session == staff || session.Get(PrincipalKey) != nil || prov.Len() != 0 {
+		t.Errorf("Expected new anonymous session, but got %s with %d cached", session.Id(), prov.Len())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_KindTimeouts(t *testing.T) {
+	timeouts, _ := NewSessionTimeouts(&Config{Session: &SessionConfig{
+		Role: map[string]SessionTimeout{
+			RoleAdmin:        {Idle: 300, Lifetime: 3600},
+			PrincipalMailbox: {Lifetime: 86400},
+		},
+	}})
+
+	kinds := kindTimeouts(timeouts)
+
+	if kinds[PrincipalStaff] != (SessionTimeout{staffSessionIdle, staffSessionLifetime}) ||
+		kinds[PrincipalMailbox] != (SessionTimeout{0, 86400}) || kinds[""] != (SessionTimeout{}) {
+		t.Errorf("Unexpected kind timeouts %v", kinds)
+	}
+
+	if age := cookieAge(timeouts); age != 0 {
+		t.Errorf("Expected browser session cookie, but got %d", age)
+	}
+
+	timeouts[""] = SessionTimeout{Lifetime: 600}
+
+	if age := cookieAge(timeouts); age != 86400 {
+		t.Errorf("Expected the longest lifetime, but got %d", age)
+	}
+}
+
+// Stored sessions over the timeouts of the kind are deleted
+func Test_GarbageTimeouts(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+	)
+
+	defer db.Close()
+
+	prov.SetTimeouts(map[string]SessionTimeout{
+		PrincipalMailbox: {Lifetime: 86400},
+		RoleAdmin:        {Idle: 60, Lifetime: 3600},
+		RoleOperator:     {Idle: 300, Lifetime: 7200},
+		RoleHelpdesk:     {Idle: 600, Lifetime: 1800},
+	})
+
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE \\? - `updated` > \\?").WithArgs(sqlmock.AnyArg(), 86400*180).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `principal_kind` = \\? AND \\(\\? - `started` > \\?\\)").
+		WithArgs(PrincipalMailbox, sqlmock.AnyArg(), 86400).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// Staff sessions get the longest timeouts of the roles
+	mock.ExpectExec("DELETE FROM `msm_session` WHERE `principal_kind` = \\? AND \\(\\? - `updated` > \\? OR \\? - `started` > \\?\\)").
+		WithArgs(PrincipalStaff, sqlmock.AnyArg(), 600, sqlmock.AnyArg(), 7200).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := prov.garbage(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBadCredentials = errors.New("Invalid login or password")
+
+// Hash to compare with when login is unknown, keeps response time equal
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Staff accounts
+type StaffStore struct {
+	conn *sql.DB
+}
+
+func NewStaffStore(db *sql.DB) *StaffStore {
+	return &StaffStore{
+		conn: db,
+	}
+}
+
+// Check login and password of the active account
+func (this *StaffStore) Authenticate(login, password string) (principal *Principal, err error) {
+	var (
+		hash  string
+		start = time.Now()
+	)
+
+	principal = &Principal{
+		Kind: PrincipalStaff,
+		Name: login,
+	}
+
+	err = this.conn.QueryRow("SELECT `id`, `password`, `role`, `tenant_id` FROM `msm_staff` WHERE `login` = ? AND `active` = 1", login).
+		Scan(&principal.Id, &hash, &principal.Role, &principal.Tenant)
+	metricDBQuery.Since(start, "staff_auth")
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrBadCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+
+	return
+}
+
+// Login request
+type loginRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// Staff login: POST /login with JSON or form login and password.
+// Failures are throttled by login and client address. Accounts with
+// the second factor are kept pending until POST /login/totp
+func handleLogin(sessions *Provider, staff *StaffStore, limiter *Limiter, mfa *TOTPAuth) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			req       loginRequest
+			principal *Principal
+			err       error
+		)
+
+		if ctx.r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		if strings.HasPrefix(ctx.r.Header.Get("Content-Type"), "application/json") {
+			if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+		} else {
+			req.Login = ctx.r.PostFormValue("login")
+			req.Password = ctx.r.PostFormValue("password")
+		}
+
+		if req.Login == "" || req.Password == "" {
+			writeError(w, http.StatusBadRequest, "Login and password required")
+			return
+		}
+
+		keys := []string{"staff:" + req.Login, "ip:" + remoteIP(ctx.r)}
+
+		if wait, err := limiter.Check(keys...); err != nil {
+			ctx.log.Notice("Login throttled", "login", req.Login, "error", err)
+			writeRetry(w, wait, err)
+			return
+		}
+
+		if principal, err = staff.Authenticate(req.Login, req.Password); err == ErrBadCredentials {
+			delay := limiter.Fail(keys...)
+
+			ctx.log.Notice("Login failed", "login", req.Login, "delay", delay.String())
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't check staff login", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		// Address failures are kept
+		limiter.Success(keys[0])
+
+		if required, err := mfa.Required(ctx.s, principal); err == nil && required {
+			if err = sessions.Regenerate(w, ctx.r, ctx.s); err != nil {
+				ctx.log.Error("Can't regenerate session", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+
+			ctx.log.Info("Password accepted, second factor required", "login", principal.Name)
+
+			w.Header().Set(CSRFHeader, ctx.s.Get(CSRFKey).(string))
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"mfa_required": true})
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't check second factor", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		completeLogin(w, ctx, sessions, principal)
+	}
+}
+
+// Store authenticated principal in the new session
+func completeLogin(w http.ResponseWriter, ctx *Context, sessions *Provider, principal *Principal) {
+	var err error
+
+	if err = sessions.Regenerate(w, ctx.r, ctx.s); err == nil {
+		err = ctx.s.Set(PrincipalKey, *principal)
+	}
+
+	if err != nil {
+		ctx.log.Error("Can't store login session", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	ctx.log.Info("Login", "login", principal.Name, "role", principal.Role)
+
+	w.Header().Set(CSRFHeader, ctx.s.Get(CSRFKey).(string))
+	writeJSON(w, http.StatusOK, principal)
+}
+
+// Drop session principal of staff or mailbox owner: POST /logout
+func handleLogout(sessions *Provider) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if ctx.r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		// Token and certificate clients have no session to end
+		if _, ok := ctx.s.Get(PrincipalKey).(Principal); !ok {
+			writeError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		ctx.s.Delete(PrincipalKey)
+
+		if err := sessions.Regenerate(w, ctx.r, ctx.s); err != nil {
+			ctx.log.Error("Can't regenerate session", "error", err)
+		}
+
+		ctx.log.Info("Logout")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// List locks: GET /lockouts, remove all: DELETE /lockouts,
+// remove one: DELETE /lockouts/{key}. Keys are server wide, so
+// tenant principals are refused
+func handleLockouts(limiter *Limiter) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "lockouts:admin") {
+			return
+		}
+
+		if ctx.Tenant() != 0 {
+			writeError(w, http.StatusForbidden, "Global principal required")
+			return
+		}
+
+		key := ctx.Param("key")
+
+		switch ctx.r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, limiter.Locks())
+
+		case "DELETE":
+			if err := limiter.Clear(key); err != nil {
+				ctx.log.Error("Can't clear lockouts", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+
+			ctx.log.Notice("Lockouts cleared", "key", key)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	}
+}
+
+// Too many requests response with the delay in seconds
+func writeRetry(w http.ResponseWriter, wait time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, err.Error())
+}
+
+// Client address without port
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
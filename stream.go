@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Events kept for the reconnected clients by default
+	activityBuffer = 1000
+	// Events queued for the slow client before it is dropped
+	activityQueue = 64
+	// Stream event of the log record
+	EventAudit = "audit"
+	// Scope of the audit records of the public routes
+	auditScope = "audit:read"
+)
+
+// Live event. Principal sees it with the scope if the tenant is
+// in its tenant scope
+type StreamEvent struct {
+	Id     int64
+	Type   string
+	Scope  string
+	Tenant int64
+	Data   interface{}
+}
+
+// Broadcast of the events to the stream clients. Last events are
+// kept in the ring buffer and replayed to the reconnected client.
+// Ids start with 1 on each server start
+type Activity struct {
+	lock   sync.Mutex
+	events []*StreamEvent
+	last   int64
+	subs   map[chan *StreamEvent]bool
+}
+
+// Log records of the request handlers are streamed too
+var activity = NewActivity(activityBuffer)
+
+func NewActivity(size int) *Activity {
+	return &Activity{
+		events: make([]*StreamEvent, size),
+		subs:   make(map[chan *StreamEvent]bool),
+	}
+}
+
+// Add the event and send it to the clients. Client with the full
+// queue is dropped, it reconnects and gets the buffered events
+func (this *Activity) Publish(typ, scope string, tenant int64, data interface{}) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.last++
+
+	ev := &StreamEvent{Id: this.last, Type: typ, Scope: scope, Tenant: tenant, Data: data}
+	this.events[(ev.Id-1)%int64(len(this.events))] = ev
+
+	for ch := range this.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(this.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Buffered events after the id. Zero id of the new client replays
+// nothing, the id above the last one, e.g. of the previous server
+// start, replays all of them
+func (this *Activity) since(id int64) (events []*StreamEvent) {
+	var first = this.last - int64(len(this.events)) + 1
+
+	if id == 0 {
+		return
+	}
+
+	if id > this.last {
+		id = 0
+	}
+
+	if first < id+1 {
+		first = id + 1
+	}
+
+	if first < 1 {
+		first = 1
+	}
+
+	for i := first; i <= this.last; i++ {
+		events = append(events, this.events[(i-1)%int64(len(this.events))])
+	}
+
+	return
+}
+
+// Buffered events after the id and the channel of the new ones.
+// Channel is closed by cancel or if the client is dropped
+func (this *Activity) Subscribe(after int64) (replay []*StreamEvent, ch chan *StreamEvent, cancel func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ch = make(chan *StreamEvent, activityQueue)
+	this.subs[ch] = true
+
+	return this.since(after), ch, func() {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+
+		if this.subs[ch] {
+			delete(this.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Log hook of the request context. Notice and more severe records
+// are streamed with the scope of the route
+func (this *Context) audit(level int, msg string, fields Fields) {
+	var scope = auditScope
+
+	if level > LevelNotice || this.route == nil {
+		return
+	}
+
+	for _, op := range apiOperations {
+		if op.Name == this.route.Name && op.Scope != "" {
+			scope = op.Scope
+		}
+	}
+
+	publishAudit(scope, this.Tenant(), msg, fields)
+}
+
+// Stream the log record as the audit event
+func publishAudit(scope string, tenant int64, msg string, fields Fields) {
+	activity.Publish(EventAudit, scope, tenant, map[string]interface{}{
+		"time":    time.Now().Unix(),
+		"message": msg,
+		"fields":  fields,
+	})
+}
+
+// Live activity: GET /events. Server-sent events of the changes and
+// audit records the principal may read. Reconnected client gets the
+// buffered events after Last-Event-ID, the new client only the new
+// events
+func handleEvents(hub *Activity, keepalive time.Duration) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			visible = make(map[int64]bool)
+			after   int64
+			ticker  = time.NewTicker(keepalive)
+		)
+
+		defer ticker.Stop()
+
+		if !ctx.Require(w, "events:read") {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "Streaming unsupported")
+			return
+		}
+
+		// EventSource can't set the header of the first request
+		id := ctx.r.Header.Get("Last-Event-ID")
+		if id == "" {
+			id = ctx.r.URL.Query().Get("last_event_id")
+		}
+
+		if id != "" {
+			after, _ = strconv.ParseInt(id, 10, 64)
+		}
+
+		allowed := func(ev *StreamEvent) bool {
+			if !ctx.principal.Can(ev.Scope) {
+				return false
+			}
+
+			ok, seen := visible[ev.Tenant]
+			if !seen {
+				var err error
+
+				if ok, err = tenantVisible(ctx.db, ctx.Tenant(), ev.Tenant); err != nil {
+					ctx.log.Error("Can't check event tenant", "error", err)
+					return false
+				}
+
+				visible[ev.Tenant] = ok
+			}
+
+			return ok
+		}
+
+		replay, events, cancel := hub.Subscribe(after)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		for _, ev := range replay {
+			if allowed(ev) && writeEvent(w, ev) != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+
+		for {
+			select {
+			case <-ctx.r.Context().Done():
+				return
+
+			case ev, ok := <-events:
+				if !ok {
+					ctx.log.Warning("Slow event stream client dropped")
+					return
+				}
+
+				if !allowed(ev) {
+					continue
+				}
+
+				if writeEvent(w, ev) != nil {
+					return
+				}
+
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev *StreamEvent) error {
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Id, ev.Type, data)
+
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_ActivityReplay(t *testing.T) {
+	var hub = NewActivity(3)
+
+	ids := func(events []*StreamEvent) (ids []int64) {
+		for _, ev := range events {
+			ids = append(ids, ev.Id)
+		}
+
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		hub.Publish(EventDomainCreated, "domains:read", 0, i)
+	}
+
+	cases := map[int64]string{
+		0:  "[]",
+		1:  "[3 4 5]",
+		4:  "[5]",
+		5:  "[]",
+		99: "[3 4 5]",
+	}
+
+	for after, expected := range cases {
+		if got := fmt.Sprint(ids(hub.since(after))); got != expected {
+			t.Errorf("Expected %s after %d, but got %s", expected, after, got)
+		}
+	}
+
+	replay, events, cancel := hub.Subscribe(5)
+	defer cancel()
+
+	if len(replay) != 0 {
+		t.Errorf("Expected nothing to replay, but got %d", len(replay))
+	}
+
+	hub.Publish(EventDomainDeleted, "domains:read", 0, nil)
+
+	if ev := <-events; ev.Id != 6 || ev.Type != EventDomainDeleted {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+
+	// Slow client is dropped
+	for i := 0; i <= activityQueue; i++ {
+		hub.Publish(EventDomainCreated, "domains:read", 0, i)
+	}
+
+	for range events {
+	}
+
+	if len(hub.subs) != 0 {
+		t.Errorf("Expected slow client dropped")
+	}
+}
+
+// Replayed events are filtered by the scope and tenant of the principal
+func Test_EventStream(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		hub      = NewActivity(10)
+		handler  = HandleInContext(handleEvents(hub, time.Minute), prov, nil)
+		session  = NewSession(RandStringId(64))
+	)
+
+	defer db.Close()
+
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "helpdesk", Role: RoleHelpdesk, Tenant: 1})
+	prov.append(session)
+
+	hub.Publish(EventDomainCreated, "domains:read", 1, map[string]string{"name": "old.com"})
+	hub.Publish(EventDomainCreated, "domains:read", 1, map[string]string{"name": "example.com"})
+	hub.Publish(EventMailboxCreated, "mailboxes:read", 2, map[string]string{"address": "john@example.org"})
+	hub.Publish(EventDomainDeleted, "domains:read", 3, map[string]string{"name": "other.net"})
+	hub.Publish(EventAudit, "tokens:admin", 1, map[string]string{"message": "API token created"})
+	hub.Publish(EventMailboxDeleted, "mailboxes:read", 2, map[string]string{"address": "jane@example.org"})
+
+	mock.ExpectQuery("SELECT `parent` FROM `msm_tenant`").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"parent"}).AddRow(1))
+	mock.ExpectQuery("SELECT `parent` FROM `msm_tenant`").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"parent"}).AddRow(5))
+
+	// Stream ends at once, only the replay is written
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/events", nil)
+	r = r.WithContext(ctx)
+	r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+	r.Header.Set("Last-Event-ID", "1")
+
+	handler(w, r)
+
+	expected := "id: 2\nevent: domain.created\ndata: {\"name\":\"example.com\"}\n\n" +
+		"id: 3\nevent: mailbox.created\ndata: {\"address\":\"john@example.org\"}\n\n" +
+		"id: 6\nevent: mailbox.deleted\ndata: {\"address\":\"jane@example.org\"}\n\n"
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" || w.Body.String() != expected {
+		t.Errorf("Unexpected stream %d: %q", w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
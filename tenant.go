@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tenant kinds. Reseller manages its customers, customer owns domains.
+// Hierarchy is two levels deep
+const (
+	TenantReseller = "reseller"
+	TenantCustomer = "customer"
+)
+
+const tenantColumns = "`id`, `parent`, `kind`, `name`, `max_domains`, `max_mailboxes`, `max_aliases`, `max_quota`, `active`, `created`"
+
+// Create or update rejected by the data rules: unknown domain,
+// exceeded tenant limit. Not a database failure
+type ConstraintError struct {
+	msg string
+	// Tenant limit reached, e.g. `domains` of max
+	Tenant int64
+	Limit  string
+	Max    int64
+}
+
+func (this *ConstraintError) Error() string {
+	return this.msg
+}
+
+func constraintError(format string, args ...interface{}) error {
+	return &ConstraintError{msg: fmt.Sprintf(format, args...)}
+}
+
+func limitError(t *Tenant, limit string, max int64, format string) error {
+	return &ConstraintError{msg: fmt.Sprintf(format, t.Name, max), Tenant: t.Id, Limit: limit, Max: max}
+}
+
+// Reseller or customer. Limits count the tenant resources together
+// with its customers, zero is unlimited
+type Tenant struct {
+	Id           int64  `json:"id"`
+	Parent       int64  `json:"parent,omitempty"`
+	Kind         string `json:"kind"`
+	Name         string `json:"name"`
+	MaxDomains   int64  `json:"max_domains"`
+	MaxMailboxes int64  `json:"max_mailboxes"`
+	MaxAliases   int64  `json:"max_aliases"`
+	// Bytes, sum of the mailbox quotas
+	MaxQuota int64        `json:"max_quota"`
+	Active   bool         `json:"active"`
+	Created  int64        `json:"created"`
+	Usage    *TenantUsage `json:"usage,omitempty"`
+}
+
+// Resources of the tenant with its customers
+type TenantUsage struct {
+	Domains   int64 `json:"domains"`
+	Mailboxes int64 `json:"mailboxes"`
+	Aliases   int64 `json:"aliases"`
+	Quota     int64 `json:"quota"`
+}
+
+func (this *Tenant) Validate() error {
+	this.Name = strings.TrimSpace(this.Name)
+
+	switch {
+	case this.Name == "":
+		return errors.New("Tenant name required")
+	case this.Kind != TenantReseller && this.Kind != TenantCustomer:
+		return errors.New("Tenant kind must be reseller or customer")
+	case this.Kind == TenantReseller && this.Parent != 0:
+		return errors.New("Reseller can't have a parent")
+	case this.MaxDomains < 0 || this.MaxMailboxes < 0 || this.MaxAliases < 0 || this.MaxQuota < 0:
+		return errors.New("Limits must not be negative")
+	}
+
+	return nil
+}
+
+type TenantStore struct {
+	conn *sql.DB
+}
+
+func NewTenantStore(db *sql.DB) *TenantStore {
+	return &TenantStore{
+		conn: db,
+	}
+}
+
+// Create tenant, parent of the customer must be a reseller
+func (this *TenantStore) Create(tenant *Tenant) (err error) {
+	var result sql.Result
+
+	defer metricDBQuery.Since(time.Now(), "tenant_insert")
+
+	if tenant.Parent != 0 {
+		parent, err := getTenant(this.conn, tenant.Parent, false)
+		if err == sql.ErrNoRows || (err == nil && parent.Kind != TenantReseller) {
+			return constraintError("Parent tenant must be a reseller")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	tenant.Created = time.Now().Unix()
+
+	result, err = this.conn.Exec("INSERT INTO `msm_tenant`(`parent`, `kind`, `name`, `max_domains`, `max_mailboxes`, `max_aliases`, `max_quota`, `active`, `created`) "+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		tenant.Parent, tenant.Kind, tenant.Name, tenant.MaxDomains, tenant.MaxMailboxes, tenant.MaxAliases, tenant.MaxQuota, tenant.Active, tenant.Created)
+	if err != nil {
+		return
+	}
+
+	tenant.Id, err = result.LastInsertId()
+
+	return
+}
+
+// Tenant with its usage
+func (this *TenantStore) Get(id int64) (tenant *Tenant, err error) {
+	defer metricDBQuery.Since(time.Now(), "tenant_select")
+
+	if tenant, err = getTenant(this.conn, id, false); err != nil {
+		return
+	}
+
+	tenant.Usage, err = tenantUsage(this.conn, id)
+
+	return
+}
+
+// List fields, named as in JSON
+var tenantList = &ListSpec{
+	Columns: tenantColumns,
+	Table:   "`msm_tenant`",
+	Fields: map[string]ListField{
+		"id":      {"id", FieldInt, true},
+		"parent":  {"parent", FieldInt, true},
+		"kind":    {"kind", FieldString, true},
+		"name":    {"name", FieldString, true},
+		"active":  {"active", FieldBool, true},
+		"created": {"created", FieldInt, true},
+	},
+	Key:     "id",
+	Default: "id",
+}
+
+// Tenants in the scope: the tenant and its customers, all for the
+// global scope
+func (this *TenantStore) List(scope int64, query *ListQuery) (*ListPage, error) {
+	var (
+		cond = "1 = 1"
+		args []interface{}
+	)
+
+	defer metricDBQuery.Since(time.Now(), "tenant_list")
+
+	if scope != 0 {
+		cond, args = "`id` = ? OR `parent` = ?", []interface{}{scope, scope}
+	}
+
+	return query.Run(this.conn, func(row rowScanner) (interface{}, error) {
+		return scanTenant(row)
+	}, cond, args...)
+}
+
+// Update name, limits and active flag. Lowered limit does not touch
+// existing resources, it only blocks new ones
+func (this *TenantStore) Update(tenant *Tenant) (err error) {
+	defer metricDBQuery.Since(time.Now(), "tenant_update")
+
+	_, err = this.conn.Exec("UPDATE `msm_tenant` SET `name` = ?, `max_domains` = ?, `max_mailboxes` = ?, `max_aliases` = ?, `max_quota` = ?, `active` = ? WHERE `id` = ?",
+		tenant.Name, tenant.MaxDomains, tenant.MaxMailboxes, tenant.MaxAliases, tenant.MaxQuota, tenant.Active, tenant.Id)
+
+	return
+}
+
+func scanTenant(row rowScanner) (tenant *Tenant, err error) {
+	tenant = &Tenant{}
+
+	err = row.Scan(&tenant.Id, &tenant.Parent, &tenant.Kind, &tenant.Name,
+		&tenant.MaxDomains, &tenant.MaxMailboxes, &tenant.MaxAliases, &tenant.MaxQuota, &tenant.Active, &tenant.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Locked row holds concurrent limit checks of the tenant
+// until the transaction ends
+func getTenant(q querier, id int64, lock bool) (*Tenant, error) {
+	var query = "SELECT " + tenantColumns + " FROM `msm_tenant` WHERE `id` = ?"
+
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	return scanTenant(q.QueryRow(query, id))
+}
+
+func tenantUsage(q querier, id int64) (usage *TenantUsage, err error) {
+	var scope, args = tenantScope(id, "`tenant_id`")
+
+	usage = &TenantUsage{}
+
+	if err = q.QueryRow("SELECT COUNT(*) FROM `msm_domain` WHERE "+scope, args...).Scan(&usage.Domains); err != nil {
+		return
+	}
+
+	err = q.QueryRow("SELECT COUNT(*), COALESCE(SUM(`quota`), 0) FROM `msm_mailbox` "+
+		"WHERE `domain` IN (SELECT `name` FROM `msm_domain` WHERE "+scope+")", args...).Scan(&usage.Mailboxes, &usage.Quota)
+	if err != nil {
+		return
+	}
+
+	err = q.QueryRow("SELECT COUNT(*) FROM `msm_alias` "+
+		"WHERE `domain` IN (SELECT `name` FROM `msm_domain` WHERE "+scope+")", args...).Scan(&usage.Aliases)
+
+	return
+}
+
+// Condition on the tenant id column to match the scope tenant and its
+// customers. Global scope matches all
+func tenantScope(scope int64, column string) (string, []interface{}) {
+	if scope == 0 {
+		return "1 = 1", nil
+	}
+
+	return column + " IN (SELECT `id` FROM `msm_tenant` WHERE `id` = ? OR `parent` = ?)", []interface{}{scope, scope}
+}
+
+// Tenant is the scope tenant or its customer
+func tenantVisible(q querier, scope, tenant int64) (ok bool, err error) {
+	var parent int64
+
+	switch {
+	case scope == 0 || scope == tenant:
+		return true, nil
+	case tenant == 0:
+		return false, nil
+	}
+
+	if err = q.QueryRow("SELECT `parent` FROM `msm_tenant` WHERE `id` = ?", tenant).Scan(&parent); err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return parent == scope, err
+}
+
+// Check the tenant and its reseller can take the added resources.
+// Tenants of the `from` chain hold them already, e.g. domain moved
+// between the customers of one reseller. Tenant rows are locked
+// so the check is safe within the transaction
+func checkTenantLimits(q querier, tenant, from int64, add TenantUsage) (err error) {
+	var (
+		held  = make(map[int64]bool)
+		t     *Tenant
+		usage *TenantUsage
+	)
+
+	for id := from; id != 0; id = t.Parent {
+		if t, err = getTenant(q, id, false); err != nil {
+			return
+		}
+
+		held[id] = true
+	}
+
+	for id := tenant; id != 0; id = t.Parent {
+		if t, err = getTenant(q, id, true); err == sql.ErrNoRows {
+			return constraintError("Unknown tenant %d", id)
+		} else if err != nil {
+			return
+		}
+
+		if held[id] {
+			continue
+		}
+
+		if !t.Active {
+			return constraintError("Tenant %s is suspended", t.Name)
+		}
+
+		if usage, err = tenantUsage(q, id); err != nil {
+			return
+		}
+
+		switch {
+		case add.Domains > 0 && t.MaxDomains > 0 && usage.Domains+add.Domains > t.MaxDomains:
+			return limitError(t, "domains", t.MaxDomains, "Tenant %s limit of %d domains reached")
+		case add.Mailboxes > 0 && t.MaxMailboxes > 0 && usage.Mailboxes+add.Mailboxes > t.MaxMailboxes:
+			return limitError(t, "mailboxes", t.MaxMailboxes, "Tenant %s limit of %d mailboxes reached")
+		case add.Aliases > 0 && t.MaxAliases > 0 && usage.Aliases+add.Aliases > t.MaxAliases:
+			return limitError(t, "aliases", t.MaxAliases, "Tenant %s limit of %d aliases reached")
+		case add.Quota > 0 && t.MaxQuota > 0 && usage.Quota+add.Quota > t.MaxQuota:
+			return limitError(t, "quota", t.MaxQuota, "Tenant %s quota limit of %d bytes exceeded")
+		}
+	}
+
+	return
+}
+
+// Mailbox without quota is unlimited, not allowed if the tenant
+// or its reseller limits the total quota
+func checkTenantQuota(q querier, tenant int64) (err error) {
+	var t *Tenant
+
+	for id := tenant; id != 0; id = t.Parent {
+		if t, err = getTenant(q, id, false); err != nil {
+			return
+		}
+
+		if t.MaxQuota > 0 {
+			return constraintError("Tenant %s requires mailbox quota", t.Name)
+		}
+	}
+
+	return
+}
+
+// List and create tenants: GET, POST /tenants, get with usage and
+// update: GET, PUT /tenants/{id}. Tenant principal sees itself and its
+// customers and can't change own limits
+func handleTenants(tenants *TenantStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			path  = ctx.Param("id")
+			scope = "tenants:read"
+		)
+
+		if !safeMethod(ctx.r.Method) {
+			scope = "tenants:write"
+		}
+
+		if !ctx.Require(w, scope) {
+			return
+		}
+
+		if path == "" {
+			switch ctx.r.Method {
+			case "GET":
+				query, ok := ctx.ListQuery(w, tenantList)
+				if !ok {
+					return
+				}
+
+				page, err := tenants.List(ctx.Tenant(), query)
+				if err != nil {
+					ctx.log.Error("Can't list tenants", "error", err)
+					writeError(w, http.StatusInternalServerError, "")
+					return
+				}
+
+				writeJSON(w, http.StatusOK, page)
+
+			case "POST":
+				var tenant = &Tenant{Active: true}
+
+				if err := json.NewDecoder(ctx.r.Body).Decode(tenant); err != nil {
+					writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+					return
+				}
+
+				// Reseller creates own customers only
+				if ctx.Tenant() != 0 {
+					tenant.Parent = ctx.Tenant()
+				}
+
+				if err := tenant.Validate(); err != nil {
+					writeError(w, http.StatusUnprocessableEntity, err.Error())
+					return
+				}
+
+				if !writeStoreError(w, ctx, "Can't create tenant", tenants.Create(tenant)) {
+					ctx.log.Notice("Tenant created", "tenant_id", tenant.Id, "tenant_name", tenant.Name)
+					writeJSON(w, http.StatusCreated, tenant)
+				}
+
+			default:
+				writeError(w, http.StatusMethodNotAllowed, "")
+			}
+
+			return
+		}
+
+		id, err := strconv.ParseInt(path, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		if ok, err := tenantVisible(ctx.db, ctx.Tenant(), id); err != nil {
+			ctx.log.Error("Can't check tenant", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		} else if !ok {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		tenant, err := tenants.Get(id)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't get tenant", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		switch ctx.r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, tenant)
+
+		case "PUT":
+			var kind, parent = tenant.Kind, tenant.Parent
+
+			if id == ctx.Tenant() {
+				ctx.log.Notice("Access denied", "scope", scope, "tenant_id", id)
+				writeError(w, http.StatusForbidden, "Tenant can't change own limits")
+				return
+			}
+
+			if err := json.NewDecoder(ctx.r.Body).Decode(tenant); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+
+			tenant.Id, tenant.Kind, tenant.Parent, tenant.Usage = id, kind, parent, nil
+
+			if err := tenant.Validate(); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+
+			if !writeStoreError(w, ctx, "Can't update tenant", tenants.Update(tenant)) {
+				ctx.log.Notice("Tenant updated", "tenant_id", tenant.Id)
+				writeJSON(w, http.StatusOK, tenant)
+			}
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	}
+}
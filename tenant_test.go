@@ -0,0 +1,139 @@
+package main
+
+import (
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var tenantRowColumns = []string{"id", "parent", "kind", "name", "max_domains", "max_mailboxes", "max_aliases", "max_quota", "active", "created"}
+
+// Expect usage queries of the tenant scope
+func expectTenantUsage(mock sqlmock.Sqlmock, id int64, usage TenantUsage) {
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM `msm_domain`").WithArgs(id, id).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(usage.Domains))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\), COALESCE\\(SUM\\(`quota`\\), 0\\) FROM `msm_mailbox`").WithArgs(id, id).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "quota"}).AddRow(usage.Mailboxes, usage.Quota))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM `msm_alias`").WithArgs(id, id).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(usage.Aliases))
+}
+
+func Test_TenantLimits(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		reseller = sqlmock.NewRows(tenantRowColumns).AddRow(1, 0, TenantReseller, "hoster", 0, 5, 0, 0, true, 0)
+		customer = sqlmock.NewRows(tenantRowColumns).AddRow(2, 1, TenantCustomer, "acme", 0, 10, 0, 0, true, 0)
+	)
+
+	defer db.Close()
+
+	// Customer is below its limit, reseller counts all customers
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\? FOR UPDATE").WithArgs(2).WillReturnRows(customer)
+	expectTenantUsage(mock, 2, TenantUsage{Domains: 1, Mailboxes: 3})
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\? FOR UPDATE").WithArgs(1).WillReturnRows(reseller)
+	expectTenantUsage(mock, 1, TenantUsage{Domains: 2, Mailboxes: 5})
+
+	err := checkTenantLimits(db, 2, 0, TenantUsage{Mailboxes: 1})
+	if _, ok := err.(*ConstraintError); !ok || err.Error() != "Tenant hoster limit of 5 mailboxes reached" {
+		t.Errorf("Expected reseller limit error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Domain moved between customers of one reseller is counted once
+func Test_TenantLimitsMove(t *testing.T) {
+	var db, mock = InitDBMock(t)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\?$").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(tenantRowColumns).AddRow(2, 1, TenantCustomer, "acme", 0, 0, 0, 0, true, 0))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\?$").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(tenantRowColumns).AddRow(1, 0, TenantReseller, "hoster", 1, 0, 0, 0, true, 0))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\? FOR UPDATE").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(tenantRowColumns).AddRow(3, 1, TenantCustomer, "initech", 0, 0, 0, 100, true, 0))
+	expectTenantUsage(mock, 3, TenantUsage{Quota: 60})
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\? FOR UPDATE").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(tenantRowColumns).AddRow(1, 0, TenantReseller, "hoster", 1, 0, 0, 0, true, 0))
+
+	if err := checkTenantLimits(db, 3, 2, TenantUsage{Domains: 1, Quota: 40}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_HandleDomainsTenantScope(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		router   = NewRouter(prov)
+		api      = []Middleware{Authenticate(prov, nil), CheckCSRF, ValidateBody}
+		session  = NewSession(RandStringId(64))
+		columns  = []string{"id", "name", "description", "active", "created", "tenant_id"}
+	)
+
+	defer db.Close()
+
+	router.Handle("GET", "/domains", "list_domains", handleDomains(db), api...)
+	router.Handle("GET", "/domains/{domain}/mailboxes", "list_domain_mailboxes", handleMailboxes(db), api...)
+	router.Handle("POST", "/domains/{domain}/mailboxes", "create_mailbox", handleMailboxes(db), api...)
+
+	csrfToken(session)
+	session.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "reseller", Role: RoleOperator, Tenant: 1})
+	prov.append(session)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: session.Id()})
+		r.Header.Set(CSRFHeader, session.Get(CSRFKey).(string))
+
+		router.ServeHTTP(w, r)
+
+		return w
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_domain` WHERE \\(`tenant_id` IN (.+) LIMIT 51").WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "example.com", "", true, 0, 2))
+
+	if w := request("GET", "/domains", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tenant_id":2`) {
+		t.Errorf("Expected scoped domain list, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Domain of the other tenant is not found
+	mock.ExpectQuery("SELECT (.+) FROM `msm_domain` WHERE `name` = \\? AND `tenant_id` IN").WithArgs("other.org", 1, 1).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	if w := request("GET", "/domains/other.org/mailboxes/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Limit of the customer is reached
+	mock.ExpectQuery("SELECT (.+) FROM `msm_domain` WHERE `name` = \\? AND `tenant_id` IN").WithArgs("example.com", 1, 1).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "example.com", "", true, 0, 2))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(2))
+	mock.ExpectQuery("SELECT (.+) FROM `msm_tenant` WHERE `id` = \\? FOR UPDATE").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(tenantRowColumns).AddRow(2, 1, TenantCustomer, "acme", 0, 0, 0, 1000, true, 0))
+	expectTenantUsage(mock, 2, TenantUsage{Domains: 1, Mailboxes: 1, Quota: 800})
+	mock.ExpectRollback()
+	expectWebhooks(mock, 2)
+
+	w := request("POST", "/domains/example.com/mailboxes", `{"address":"john","password":"secret","quota":500}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "quota limit") {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
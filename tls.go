@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Listener TLS configuration with the certificates reloaded
+// from files on demand
+type TLSReloader struct {
+	cfg *TLSConfig
+
+	lock   sync.RWMutex
+	config *tls.Config
+}
+
+func NewTLSReloader(cfg *TLSConfig) (reloader *TLSReloader, err error) {
+	if cfg == nil || cfg.Cert == "" || cfg.Key == "" {
+		return nil, errors.New("TLS certificate and key files required")
+	}
+
+	reloader = &TLSReloader{
+		cfg: cfg,
+	}
+
+	if err = reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Listener configuration, each handshake gets the current one
+func (this *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			this.lock.RLock()
+			defer this.lock.RUnlock()
+
+			return this.config, nil
+		},
+	}
+}
+
+// Read certificate, key and client CA files
+func (this *TLSReloader) Reload() (err error) {
+	var (
+		config = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+		cert tls.Certificate
+		pem  []byte
+	)
+
+	if cert, err = tls.LoadX509KeyPair(this.cfg.Cert, this.cfg.Key); err != nil {
+		return
+	}
+
+	config.Certificates = []tls.Certificate{cert}
+
+	if this.cfg.MinVersion != "" {
+		if v, ok := tlsVersions[this.cfg.MinVersion]; !ok {
+			return fmt.Errorf("Unknown TLS version `%s`", this.cfg.MinVersion)
+		} else {
+			config.MinVersion = v
+		}
+	}
+
+	if config.CipherSuites, err = cipherSuites(this.cfg.Ciphers); err != nil {
+		return
+	}
+
+	if this.cfg.ClientCA != "" {
+		if pem, err = ioutil.ReadFile(this.cfg.ClientCA); err != nil {
+			return
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", this.cfg.ClientCA)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if this.cfg.ClientRequire {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	this.lock.Lock()
+	this.config = config
+	this.lock.Unlock()
+
+	return
+}
+
+// Cipher suite ids by names, nil for the defaults
+func cipherSuites(names []string) (ids []uint16, err error) {
+	var known = make(map[string]uint16)
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	for _, name := range names {
+		if id, ok := known[strings.ToUpper(name)]; ok {
+			ids = append(ids, id)
+		} else {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite `%s`", name)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write self-signed certificate and key to the directory
+func writeTestCert(t *testing.T, dir, cn string) (cert *x509.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"msm"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	cert, _ = x509.ParseCertificate(der)
+	certFile = filepath.Join(dir, cn+".crt")
+	keyFile = filepath.Join(dir, cn+".key")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return
+}
+
+func Test_TLSReloaderConfig(t *testing.T) {
+	var (
+		dir, _               = ioutil.TempDir("", "msm-tls")
+		_, certFile, keyFile = writeTestCert(t, dir, "server")
+		_, caFile, _         = writeTestCert(t, dir, "client-ca")
+	)
+
+	defer os.RemoveAll(dir)
+
+	reloader, err := NewTLSReloader(&TLSConfig{
+		Cert:          certFile,
+		Key:           keyFile,
+		MinVersion:    "1.3",
+		Ciphers:       []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ClientCA:      caFile,
+		ClientRequire: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	config, _ := reloader.Config().GetConfigForClient(nil)
+
+	if config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 1 {
+		t.Errorf("Unexpected TLS policy: version %x, ciphers %v", config.MinVersion, config.CipherSuites)
+	}
+
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("Expected client certificate verification")
+	}
+
+	// Replace certificate and reload
+	writeTestCert(t, dir, "server")
+
+	if err = reloader.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if next, _ := reloader.Config().GetConfigForClient(nil); next == config {
+		t.Errorf("Expected new configuration after reload")
+	}
+
+	for _, cfg := range []*TLSConfig{
+		{Cert: certFile, Key: keyFile, MinVersion: "2.0"},
+		{Cert: certFile, Key: keyFile, Ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{Cert: certFile, Key: filepath.Join(dir, "missing.key")},
+	} {
+		if _, err = NewTLSReloader(cfg); err == nil {
+			t.Errorf("Expected error for the configuration %v", cfg)
+		}
+	}
+}
+
+func Test_AuthClientCertificatePrincipal(t *testing.T) {
+	var (
+		dir, _        = ioutil.TempDir("", "msm-tls")
+		mx1, _, _     = writeTestCert(t, dir, "mx1.example.com")
+		mx2, _, _     = writeTestCert(t, dir, "mx2.example.com")
+		unknown, _, _ = writeTestCert(t, dir, "unknown.example.com")
+		auth          = NewAuth(nil, &TLSConfig{
+			Clients: []TLSClient{
+				{Subject: "mx1.example.com", Role: RoleHelpdesk, Scopes: []string{"mailboxes:password"}},
+				{Subject: "CN=mx2.example.com,O=msm", Name: "mx2", Role: RoleHelpdesk, Scopes: []string{"mailboxes:read"}},
+			},
+		})
+		tests = []struct {
+			cert *x509.Certificate
+			name string
+		}{
+			{mx1, "mx1.example.com"},
+			{mx2, "mx2"},
+			{unknown, ""},
+			{nil, ""},
+		}
+	)
+
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+
+		if test.cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.cert}}}
+		}
+
+		p, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		if test.name == "" && p != nil {
+			t.Errorf("Test %d: unexpected principal %v", i, p)
+		}
+
+		if test.name != "" && (p == nil || p.Name != test.name || p.Kind != PrincipalCert) {
+			t.Errorf("Test %d: expected principal %s, but got %v", i, test.name, p)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Token string: msm_<prefix>_<secret>
+	tokenMark      = "msm"
+	tokenPrefixLen = 12
+	tokenSecretLen = 40
+	// Seconds. Do not update last used time more often
+	tokenUseInterval = 60
+)
+
+var ErrTokenInvalid = errors.New("Invalid API token")
+
+// API token for the machine clients. Only the hash of the
+// token string is stored, the prefix is used for the lookup
+type Token struct {
+	Id       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Prefix   string   `json:"prefix"`
+	Role     string   `json:"role"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	Expires  int64    `json:"expires,omitempty"`
+	LastUsed int64    `json:"last_used,omitempty"`
+	Revoked  bool     `json:"revoked"`
+	// Tenant of the issuer, zero is global
+	Tenant int64 `json:"tenant_id,omitempty"`
+}
+
+// Principal with the token role and scopes
+func (this *Token) Principal() *Principal {
+	return &Principal{
+		Kind:   PrincipalToken,
+		Id:     this.Id,
+		Name:   this.Name,
+		Role:   this.Role,
+		Scopes: this.Scopes,
+		Tenant: this.Tenant,
+	}
+}
+
+type TokenStore struct {
+	conn *sql.DB
+}
+
+func NewTokenStore(db *sql.DB) *TokenStore {
+	return &TokenStore{
+		conn: db,
+	}
+}
+
+// Issue new token, ttl in seconds, zero for the token without expiry.
+// Token string is returned once and can't be restored
+func (this *TokenStore) Create(name, role string, scopes []string, ttl int64, tenant int64) (token *Token, secret string, err error) {
+	var (
+		result sql.Result
+		now    = time.Now().Unix()
+	)
+
+	defer metricDBQuery.Since(time.Now(), "token_insert")
+
+	if !validRole(role) {
+		return nil, "", errors.New("Unknown role " + role)
+	}
+
+	token = &Token{
+		Name:    name,
+		Prefix:  RandSecureId(tokenPrefixLen),
+		Role:    role,
+		Scopes:  scopes,
+		Created: now,
+		Tenant:  tenant,
+	}
+
+	if ttl > 0 {
+		token.Expires = now + ttl
+	}
+
+	secret = tokenMark + "_" + token.Prefix + "_" + RandSecureId(tokenSecretLen)
+
+	result, err = this.conn.Exec("INSERT INTO `msm_token`(`name`, `prefix`, `hash`, `role`, `scopes`, `created`, `expires`, `last_used`, `revoked`, `tenant_id`) "+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, 0, 0, ?)",
+		token.Name, token.Prefix, tokenHash(secret), token.Role, strings.Join(token.Scopes, " "), token.Created, token.Expires, token.Tenant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if token.Id, err = result.LastInsertId(); err != nil {
+		return nil, "", err
+	}
+
+	return
+}
+
+// Check token string and return its principal
+func (this *TokenStore) Authenticate(secret string) (principal *Principal, err error) {
+	var (
+		token  *Token
+		hash   string
+		now    = time.Now().Unix()
+		prefix = tokenPrefix(secret)
+	)
+
+	defer metricDBQuery.Since(time.Now(), "token_auth")
+
+	if prefix == "" {
+		return nil, ErrTokenInvalid
+	}
+
+	if token, hash, err = this.get(prefix); err == sql.ErrNoRows {
+		return nil, ErrTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(tokenHash(secret))) != 1 {
+		return nil, ErrTokenInvalid
+	}
+
+	if token.Revoked || (token.Expires > 0 && token.Expires < now) {
+		return nil, ErrTokenInvalid
+	}
+
+	if now-token.LastUsed > tokenUseInterval {
+		if _, err = this.conn.Exec("UPDATE `msm_token` SET `last_used` = ? WHERE `id` = ?", now, token.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return token.Principal(), nil
+}
+
+// List fields, named as in JSON
+var tokenList = &ListSpec{
+	Columns: "`id`, `name`, `prefix`, `role`, `scopes`, `created`, `expires`, `last_used`, `revoked`, `tenant_id`",
+	Table:   "`msm_token`",
+	Fields: map[string]ListField{
+		"id":        {"id", FieldInt, true},
+		"name":      {"name", FieldString, true},
+		"prefix":    {"prefix", FieldString, false},
+		"role":      {"role", FieldString, true},
+		"created":   {"created", FieldInt, true},
+		"expires":   {"expires", FieldInt, true},
+		"last_used": {"last_used", FieldInt, true},
+		"revoked":   {"revoked", FieldBool, true},
+		"tenant_id": {"tenant_id", FieldInt, true},
+	},
+	Key:     "id",
+	Default: "id",
+}
+
+// Tokens of the tenant scope
+func (this *TokenStore) List(scope int64, query *ListQuery) (*ListPage, error) {
+	var cond, args = tenantScope(scope, "`tenant_id`")
+
+	defer metricDBQuery.Since(time.Now(), "token_list")
+
+	return query.Run(this.conn, func(row rowScanner) (interface{}, error) {
+		var (
+			token  = &Token{}
+			scopes string
+		)
+
+		err := row.Scan(&token.Id, &token.Name, &token.Prefix, &token.Role, &scopes,
+			&token.Created, &token.Expires, &token.LastUsed, &token.Revoked, &token.Tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		token.Scopes = strings.Fields(scopes)
+
+		return token, nil
+	}, cond, args...)
+}
+
+// Revoke token of the tenant scope
+func (this *TokenStore) Revoke(id int64, scope int64) (err error) {
+	var (
+		result     sql.Result
+		rows       int64
+		cond, args = tenantScope(scope, "`tenant_id`")
+	)
+
+	defer metricDBQuery.Since(time.Now(), "token_revoke")
+
+	if result, err = this.conn.Exec("UPDATE `msm_token` SET `revoked` = 1 WHERE `id` = ? AND "+cond, append([]interface{}{id}, args...)...); err != nil {
+		return
+	}
+
+	if rows, err = result.RowsAffected(); err == nil && rows == 0 {
+		err = sql.ErrNoRows
+	}
+
+	return
+}
+
+// Get token and its hash by prefix
+func (this *TokenStore) get(prefix string) (token *Token, hash string, err error) {
+	var scopes string
+
+	token = &Token{}
+
+	err = this.conn.QueryRow("SELECT `id`, `name`, `prefix`, `hash`, `role`, `scopes`, `created`, `expires`, `last_used`, `revoked`, `tenant_id` "+
+		"FROM `msm_token` WHERE `prefix` = ?", prefix).
+		Scan(&token.Id, &token.Name, &token.Prefix, &hash, &token.Role, &scopes,
+			&token.Created, &token.Expires, &token.LastUsed, &token.Revoked, &token.Tenant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token.Scopes = strings.Fields(scopes)
+
+	return
+}
+
+// Token request
+type tokenRequest struct {
+	Name      string   `json:"name"`
+	Role      string   `json:"role"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+// List and issue tokens
+func handleTokens(tokens *TokenStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "tokens:admin") {
+			return
+		}
+
+		switch ctx.r.Method {
+		case "GET":
+			query, ok := ctx.ListQuery(w, tokenList)
+			if !ok {
+				return
+			}
+
+			page, err := tokens.List(ctx.Tenant(), query)
+			if err != nil {
+				ctx.log.Error("Can't list tokens", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+
+			writeJSON(w, http.StatusOK, page)
+
+		case "POST":
+			var req tokenRequest
+
+			if err := json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+
+			if req.Name == "" || !validRole(req.Role) || len(req.Scopes) == 0 {
+				writeError(w, http.StatusBadRequest, "Name, valid role and scopes required")
+				return
+			}
+
+			if !ctx.principal.Grants(req.Role, req.Scopes) {
+				ctx.log.Warning("Token escalation refused", "token_role", req.Role, "token_scopes", req.Scopes)
+				writeError(w, http.StatusForbidden, "Role or scopes exceed the issuer rights")
+				return
+			}
+
+			// Token acts within the issuer tenant
+			token, secret, err := tokens.Create(req.Name, req.Role, req.Scopes, req.ExpiresIn, ctx.Tenant())
+			if err != nil {
+				ctx.log.Error("Can't create token", "error", err)
+				writeError(w, http.StatusInternalServerError, "")
+				return
+			}
+
+			ctx.log.Notice("API token created", "token_id", token.Id, "token_name", token.Name)
+
+			writeJSON(w, http.StatusCreated, map[string]interface{}{
+				"token":  secret,
+				"detail": token,
+			})
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	}
+}
+
+// Revoke token: DELETE /tokens/{id}
+func handleToken(tokens *TokenStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "tokens:admin") {
+			return
+		}
+
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+
+		if err = tokens.Revoke(id, ctx.Tenant()); err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			ctx.log.Error("Can't revoke token", "error", err)
+			writeError(w, http.StatusInternalServerError, "")
+			return
+		}
+
+		ctx.log.Notice("API token revoked", "token_id", id)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Token from Authorization bearer or X-API-Key header
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return r.Header.Get("X-API-Key")
+}
+
+// Lookup prefix of the well formed token string
+func tokenPrefix(secret string) string {
+	var parts = strings.Split(secret, "_")
+
+	if len(parts) != 3 || parts[0] != tokenMark || len(parts[1]) != tokenPrefixLen || len(parts[2]) != tokenSecretLen {
+		return ""
+	}
+
+	return parts[1]
+}
+
+func tokenHash(secret string) string {
+	var sum = sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
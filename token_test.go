@@ -0,0 +1,184 @@
+package main
+
+import (
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tokenColumns = []string{"id", "name", "prefix", "hash", "role", "scopes", "created", "expires", "last_used", "revoked", "tenant_id"}
+
+func Test_PrincipalCan(t *testing.T) {
+	var tests = []struct {
+		principal *Principal
+		scope     string
+		can       bool
+	}{
+		{nil, "domains:read", false},
+		{&Principal{Kind: PrincipalStaff, Role: RoleAdmin}, "tokens:admin", true},
+		{&Principal{Kind: PrincipalStaff, Role: RoleOperator}, "mailboxes:write", true},
+		{&Principal{Kind: PrincipalStaff, Role: RoleOperator}, "tokens:admin", false},
+		{&Principal{Kind: PrincipalStaff, Role: RoleHelpdesk}, "mailboxes:write", false},
+		{&Principal{Kind: PrincipalStaff, Role: "unknown"}, "domains:read", false},
+		{&Principal{Kind: PrincipalToken, Role: RoleAdmin, Scopes: []string{"domains:read"}}, "domains:read", true},
+		{&Principal{Kind: PrincipalToken, Role: RoleAdmin, Scopes: []string{"domains:read"}}, "domains:write", false},
+		{&Principal{Kind: PrincipalToken, Role: RoleHelpdesk, Scopes: []string{"mailboxes:*"}}, "mailboxes:write", false},
+		{&Principal{Kind: PrincipalToken, Role: RoleOperator, Scopes: []string{"mailboxes:*"}}, "mailboxes:write", true},
+	}
+
+	for i, test := range tests {
+		if can := test.principal.Can(test.scope); can != test.can {
+			t.Errorf("Test %d: expected %v for scope %s, but got %v", i, test.can, test.scope, can)
+		}
+	}
+}
+
+func Test_TokenAuthenticate(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		tokens   = NewTokenStore(db)
+		prefix   = RandSecureId(tokenPrefixLen)
+		secret   = tokenMark + "_" + prefix + "_" + RandSecureId(tokenSecretLen)
+		now      = time.Now().Unix()
+		tests    = []struct {
+			secret  string
+			hash    string
+			expires int64
+			revoked bool
+			valid   bool
+		}{
+			{secret, tokenHash(secret), 0, false, true},
+			{secret, tokenHash(secret), now + 60, false, true},
+			{secret, tokenHash(secret), now - 60, false, false},
+			{secret, tokenHash(secret), 0, true, false},
+			{secret, tokenHash("other"), 0, false, false},
+			{"malformed", "", 0, false, false},
+		}
+	)
+
+	defer db.Close()
+
+	for i, test := range tests {
+		if test.secret == secret {
+			mock.ExpectQuery("SELECT (.+) FROM `msm_token`").WithArgs(prefix).
+				WillReturnRows(sqlmock.NewRows(tokenColumns).
+					AddRow(1, "billing", prefix, test.hash, RoleOperator, "domains:read", now, test.expires, 0, test.revoked, 0))
+		}
+
+		if test.valid {
+			mock.ExpectExec("UPDATE `msm_token` SET `last_used`").WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		p, err := tokens.Authenticate(test.secret)
+
+		if test.valid && (err != nil || p.Kind != PrincipalToken || p.Name != "billing" || !p.Can("domains:read")) {
+			t.Errorf("Test %d: expected valid principal, but got %v, %v", i, p, err)
+		}
+
+		if !test.valid && err != ErrTokenInvalid {
+			t.Errorf("Test %d: expected error %v, but got %v", i, ErrTokenInvalid, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_HandleInContextBearerToken(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		tokens   = NewTokenStore(db)
+		prefix   = RandSecureId(tokenPrefixLen)
+		secret   = tokenMark + "_" + prefix + "_" + RandSecureId(tokenSecretLen)
+		called   bool
+	)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_token`").WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows(tokenColumns).
+			AddRow(7, "provisioning", prefix, tokenHash(secret), RoleOperator, "mailboxes:*", 0, 0, time.Now().Unix(), false, 0))
+
+	handler := HandleInContext(func(w http.ResponseWriter, ctx *Context) {
+		called = true
+
+		if !ctx.Require(w, "mailboxes:write") {
+			t.Errorf("Expected access to the mailboxes")
+		}
+
+		// Token session is never stored
+		ctx.s.Set("key", "value")
+	}, prov, NewAuth(tokens, nil))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+
+	handler(w, r)
+
+	if !called || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Expected handler call without session cookie")
+	}
+
+	// Rejected token
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer wrong")
+	called = false
+
+	handler(w, r)
+
+	if called || w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Token admin can't issue the token with more rights than its own
+func Test_TokenEscalation(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		prov, _  = NewManager(db, 0)
+		tokens   = NewTokenStore(db)
+		prefix   = RandSecureId(tokenPrefixLen)
+		secret   = tokenMark + "_" + prefix + "_" + RandSecureId(tokenSecretLen)
+		handler  = HandleInContext(handleTokens(tokens), prov, NewAuth(tokens, nil))
+	)
+
+	defer db.Close()
+
+	for _, body := range []string{
+		`{"name": "root", "role": "admin", "scopes": ["*"]}`,
+		`{"name": "root", "role": "admin", "scopes": ["tokens:admin"]}`,
+		`{"name": "ops", "role": "operator", "scopes": ["domains:write"]}`,
+	} {
+		mock.ExpectQuery("SELECT (.+) FROM `msm_token`").WithArgs(prefix).
+			WillReturnRows(sqlmock.NewRows(tokenColumns).
+				AddRow(7, "tenant-admin", prefix, tokenHash(secret), RoleAdmin, "tokens:admin", 0, 0, time.Now().Unix(), false, 3))
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/tokens", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+secret)
+
+		handler(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusForbidden, body, w.Code)
+		}
+	}
+
+	if !(&Principal{Kind: PrincipalStaff, Role: RoleAdmin}).Grants(RoleOperator, []string{"domains:*"}) {
+		t.Errorf("Expected admin grants operator token")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
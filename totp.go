@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Session key for the login waiting the second factor
+	MFAPendingKey = "mfa_pending"
+	// Session key for the secret waiting confirmation
+	TOTPEnrollKey = "totp_enroll"
+
+	totpDigits    = 6
+	totpPeriod    = 30
+	totpSecretLen = 20
+	recoveryCodes = 10
+	// Seconds to enter the second factor
+	mfaPendingTTL = 300
+)
+
+var (
+	ErrBadCode = errors.New("Invalid authentication code")
+
+	base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func init() {
+	gob.Register(MFAPending{})
+}
+
+// Staff login after the password check
+type MFAPending struct {
+	Principal Principal
+	Started   int64
+}
+
+// RFC 6238 time-based one-time passwords
+type TOTP struct {
+	// Accepted periods before and after the current one
+	Skew int
+	now  func() time.Time
+}
+
+func NewTOTP(skew int) *TOTP {
+	return &TOTP{
+		Skew: skew,
+		now:  time.Now,
+	}
+}
+
+// Random base32 secret
+func (this *TOTP) Secret() string {
+	var b = make([]byte, totpSecretLen)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base32NoPad.EncodeToString(b)
+}
+
+// Code for the period counter
+func (this *TOTP) Code(secret string, counter int64) (string, error) {
+	var (
+		key []byte
+		msg = make([]byte, 8)
+		err error
+	)
+
+	if key, err = base32NoPad.DecodeString(strings.ToUpper(strings.TrimRight(secret, "="))); err != nil {
+		return "", err
+	}
+
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// Check code in the skew window, returns matched counter
+// which must be greater than the last used one
+func (this *TOTP) Verify(secret, code string, last int64) (counter int64, err error) {
+	var current = this.now().Unix() / totpPeriod
+
+	code = strings.Replace(code, " ", "", -1)
+
+	for counter = current - int64(this.Skew); counter <= current+int64(this.Skew); counter++ {
+		if counter <= last {
+			continue
+		}
+
+		expected, err := this.Code(secret, counter)
+		if err != nil {
+			return 0, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, nil
+		}
+	}
+
+	return 0, ErrBadCode
+}
+
+// Enrollment URI for the authenticator applications
+func (this *TOTP) URI(issuer, account, secret string) string {
+	var query = url.Values{}
+
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// Random recovery codes and their hashes
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodes; i++ {
+		code := strings.ToLower(RandSecureId(5) + "-" + RandSecureId(5))
+
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryHash(code))
+	}
+
+	return
+}
+
+func recoveryHash(code string) string {
+	var sum = sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Second factor: account secret state
+func (this *StaffStore) TOTP(id int64) (secret string, enabled bool, last int64, err error) {
+	var nullSecret sql.NullString
+
+	defer metricDBQuery.Since(time.Now(), "staff_totp")
+
+	err = this.conn.QueryRow("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff` WHERE `id` = ?", id).
+		Scan(&nullSecret, &enabled, &last)
+
+	return nullSecret.String, enabled, last, err
+}
+
+// Enable second factor with new recovery codes
+func (this *StaffStore) EnableTOTP(id int64, secret string, counter int64, hashes []string) (err error) {
+	var tx *sql.Tx
+
+	defer metricDBQuery.Since(time.Now(), "staff_totp_enable")
+
+	if tx, err = this.conn.Begin(); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("UPDATE `msm_staff` SET `totp_secret` = ?, `totp_enabled` = 1, `totp_last` = ? WHERE `id` = ?", secret, counter, id); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM `msm_staff_recovery` WHERE `staff_id` = ?", id); err != nil {
+		return
+	}
+
+	for _, hash := range hashes {
+		if _, err = tx.Exec("INSERT INTO `msm_staff_recovery`(`staff_id`, `hash`, `used`) VALUES(?, ?, 0)", id, hash); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (this *StaffStore) DisableTOTP(id int64) (err error) {
+	defer metricDBQuery.Since(time.Now(), "staff_totp_disable")
+
+	if _, err = this.conn.Exec("UPDATE `msm_staff` SET `totp_secret` = NULL, `totp_enabled` = 0, `totp_last` = 0 WHERE `id` = ?", id); err != nil {
+		return
+	}
+
+	_, err = this.conn.Exec("DELETE FROM `msm_staff_recovery` WHERE `staff_id` = ?", id)
+
+	return
+}
+
+// Store used counter, false if it was used already
+func (this *StaffStore) UseTOTP(id, counter int64) (ok bool, err error) {
+	defer metricDBQuery.Since(time.Now(), "staff_totp_use")
+
+	return this.affected("UPDATE `msm_staff` SET `totp_last` = ? WHERE `id` = ? AND `totp_last` < ?", counter, id, counter)
+}
+
+// Mark recovery code used, false if not found or used
+func (this *StaffStore) UseRecoveryCode(id int64, code string) (ok bool, err error) {
+	defer metricDBQuery.Since(time.Now(), "staff_recovery_use")
+
+	return this.affected("UPDATE `msm_staff_recovery` SET `used` = 1 WHERE `staff_id` = ? AND `hash` = ? AND `used` = 0", id, recoveryHash(code))
+}
+
+func (this *StaffStore) affected(query string, args ...interface{}) (ok bool, err error) {
+	var (
+		result sql.Result
+		rows   int64
+	)
+
+	if result, err = this.conn.Exec(query, args...); err != nil {
+		return
+	}
+
+	rows, err = result.RowsAffected()
+
+	return rows == 1, err
+}
+
+// Second factor handlers
+type TOTPAuth struct {
+	issuer   string
+	sessions *Provider
+	staff    *StaffStore
+	limiter  *Limiter
+	totp     *TOTP
+}
+
+func NewTOTPAuth(cfg *Config, sessions *Provider, staff *StaffStore, limiter *Limiter) *TOTPAuth {
+	return &TOTPAuth{
+		issuer:   cfg.GetTOTPIssuer(),
+		sessions: sessions,
+		staff:    staff,
+		limiter:  limiter,
+		totp:     NewTOTP(cfg.GetTOTPSkew()),
+	}
+}
+
+// Keep principal in the half-authenticated state if the second
+// factor is enabled
+func (this *TOTPAuth) Required(s *Session, principal *Principal) (required bool, err error) {
+	if this == nil {
+		return
+	}
+
+	if _, required, _, err = this.staff.TOTP(principal.Id); err != nil || !required {
+		return
+	}
+
+	err = s.Set(MFAPendingKey, MFAPending{
+		Principal: *principal,
+		Started:   this.totp.now().Unix(),
+	})
+
+	return
+}
+
+// Second login step: POST /login/totp with code or recovery code
+func (this *TOTPAuth) handleLogin(w http.ResponseWriter, ctx *Context) {
+	var (
+		req struct {
+			Code     string `json:"code"`
+			Recovery string `json:"recovery_code"`
+		}
+		pending, ok = ctx.s.Get(MFAPendingKey).(MFAPending)
+		principal   = &pending.Principal
+		accepted    bool
+		err         error
+	)
+
+	if ctx.r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	if !ok || this.totp.now().Unix()-pending.Started > mfaPendingTTL {
+		ctx.s.Delete(MFAPendingKey)
+		writeError(w, http.StatusUnauthorized, "Login required")
+		return
+	}
+
+	if err = json.NewDecoder(ctx.r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	keys := []string{"totp:" + principal.Name, "ip:" + remoteIP(ctx.r)}
+
+	if wait, err := this.limiter.Check(keys...); err != nil {
+		writeRetry(w, wait, err)
+		return
+	}
+
+	if req.Recovery != "" {
+		accepted, err = this.staff.UseRecoveryCode(principal.Id, req.Recovery)
+	} else {
+		accepted, err = this.check(principal.Id, req.Code)
+	}
+
+	if err != nil {
+		ctx.log.Error("Can't check second factor", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !accepted {
+		this.limiter.Fail(keys...)
+		ctx.log.Notice("Second factor failed", "login", principal.Name)
+		writeError(w, http.StatusUnauthorized, ErrBadCode.Error())
+		return
+	}
+
+	this.limiter.Success(keys[0])
+	ctx.s.Delete(MFAPendingKey)
+
+	if req.Recovery != "" {
+		ctx.log.Warning("Recovery code used", "login", principal.Name)
+	}
+
+	completeLogin(w, ctx, this.sessions, principal)
+}
+
+// Enrollment: POST /totp/enroll returns new secret confirmed with
+// POST /totp/confirm. Enabled second factor is replaced only after
+// it is disabled
+func (this *TOTPAuth) handleEnroll(w http.ResponseWriter, ctx *Context) {
+	if !staffPrincipal(w, ctx) || this.enabled(w, ctx) {
+		return
+	}
+
+	secret := this.totp.Secret()
+
+	if err := ctx.s.Set(TOTPEnrollKey, secret); err != nil {
+		ctx.log.Error("Can't store TOTP secret", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    this.totp.URI(this.issuer, ctx.principal.Name, secret),
+	})
+}
+
+// Enable the enrolled secret: POST /totp/confirm
+func (this *TOTPAuth) handleConfirm(w http.ResponseWriter, ctx *Context) {
+	var (
+		req struct {
+			Code string `json:"code"`
+		}
+		secret string
+	)
+
+	if !staffPrincipal(w, ctx) {
+		return
+	}
+
+	if secret, _ = ctx.s.Get(TOTPEnrollKey).(string); secret == "" {
+		writeError(w, http.StatusConflict, "Enrollment not started")
+		return
+	}
+
+	if this.enabled(w, ctx) {
+		return
+	}
+
+	json.NewDecoder(ctx.r.Body).Decode(&req)
+
+	counter, err := this.totp.Verify(secret, req.Code, 0)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, ErrBadCode.Error())
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+
+	if err = this.staff.EnableTOTP(ctx.principal.Id, secret, counter, hashes); err != nil {
+		ctx.log.Error("Can't enable TOTP", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	ctx.s.Delete(TOTPEnrollKey)
+	ctx.log.Notice("Second factor enabled")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// Disable with the code: DELETE /totp
+func (this *TOTPAuth) handleDisable(w http.ResponseWriter, ctx *Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if !staffPrincipal(w, ctx) {
+		return
+	}
+
+	keys := []string{"totp:" + ctx.principal.Name, "ip:" + remoteIP(ctx.r)}
+
+	json.NewDecoder(ctx.r.Body).Decode(&req)
+
+	if wait, err := this.limiter.Check(keys...); err != nil {
+		writeRetry(w, wait, err)
+		return
+	}
+
+	ok, err := this.check(ctx.principal.Id, req.Code)
+	if err != nil {
+		ctx.log.Error("Can't check second factor", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !ok {
+		this.limiter.Fail(keys...)
+		writeError(w, http.StatusUnprocessableEntity, ErrBadCode.Error())
+		return
+	}
+
+	this.limiter.Success(keys[0])
+
+	if err := this.staff.DisableTOTP(ctx.principal.Id); err != nil {
+		ctx.log.Error("Can't disable TOTP", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	ctx.log.Notice("Second factor disabled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Second factor is of the staff session
+func staffPrincipal(w http.ResponseWriter, ctx *Context) bool {
+	if ctx.principal == nil || ctx.principal.Kind != PrincipalStaff {
+		writeError(w, http.StatusUnauthorized, "Staff login required")
+		return false
+	}
+
+	return true
+}
+
+// Answer conflict if the second factor of the principal is enabled
+func (this *TOTPAuth) enabled(w http.ResponseWriter, ctx *Context) bool {
+	_, enabled, _, err := this.staff.TOTP(ctx.principal.Id)
+	if err != nil {
+		ctx.log.Error("Can't read TOTP state", "error", err)
+		writeError(w, http.StatusInternalServerError, "")
+		return true
+	}
+
+	if enabled {
+		writeError(w, http.StatusConflict, "Second factor enabled, disable it first")
+	}
+
+	return enabled
+}
+
+// Verify account code and store used counter
+func (this *TOTPAuth) check(id int64, code string) (ok bool, err error) {
+	var (
+		secret  string
+		enabled bool
+		last    int64
+		counter int64
+	)
+
+	if secret, enabled, last, err = this.staff.TOTP(id); err != nil || !enabled {
+		return
+	}
+
+	if counter, err = this.totp.Verify(secret, code, last); err == ErrBadCode {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+
+	return this.staff.UseTOTP(id, counter)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 SHA1 secret "12345678901234567890"
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func Test_TOTPVectors(t *testing.T) {
+	var (
+		totp  = NewTOTP(0)
+		tests = []struct {
+			time int64
+			code string
+		}{
+			{59, "287082"},
+			{1111111109, "081804"},
+			{1111111111, "050471"},
+			{1234567890, "005924"},
+			{2000000000, "279037"},
+		}
+	)
+
+	for _, test := range tests {
+		totp.now = func() time.Time { return time.Unix(test.time, 0) }
+
+		if code, err := totp.Code(testTOTPSecret, test.time/totpPeriod); err != nil || code != test.code {
+			t.Errorf("Time %d: expected code %s, but got %s (%v)", test.time, test.code, code, err)
+		}
+
+		if _, err := totp.Verify(testTOTPSecret, test.code, 0); err != nil {
+			t.Errorf("Time %d: unexpected error %v", test.time, err)
+		}
+	}
+}
+
+func Test_TOTPSkewAndReplay(t *testing.T) {
+	var (
+		totp    = NewTOTP(1)
+		now     = time.Unix(1234567890, 0)
+		counter = now.Unix() / totpPeriod
+	)
+
+	totp.now = func() time.Time { return now }
+
+	previous, _ := totp.Code(testTOTPSecret, counter-1)
+	stale, _ := totp.Code(testTOTPSecret, counter-2)
+
+	if c, err := totp.Verify(testTOTPSecret, previous, 0); err != nil || c != counter-1 {
+		t.Errorf("Expected previous period accepted, but got %d, %v", c, err)
+	}
+
+	if _, err := totp.Verify(testTOTPSecret, stale, 0); err != ErrBadCode {
+		t.Errorf("Expected code out of skew rejected, but got %v", err)
+	}
+
+	if _, err := totp.Verify(testTOTPSecret, previous, counter-1); err != ErrBadCode {
+		t.Errorf("Expected used code rejected, but got %v", err)
+	}
+
+	uri := totp.URI("msm", "admin", testTOTPSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/msm:admin?") || !strings.Contains(uri, "secret="+testTOTPSecret) {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+}
+
+func Test_HandleLoginTOTP(t *testing.T) {
+	var (
+		db, mock       = InitDBMock(t)
+		prov, _        = NewManager(db, 0)
+		limiter, clock = testLimiter()
+		staff          = NewStaffStore(db)
+		mfa            = NewTOTPAuth(&Config{}, prov, staff, limiter)
+		now            = time.Unix(1234567890, 0)
+		hash, _        = bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		login          = HandleInContext(handleLogin(prov, staff, limiter, mfa), prov, nil)
+		second         = HandleInContext(mfa.handleLogin, prov, nil)
+		totpColumns    = []string{"totp_secret", "totp_enabled", "totp_last"}
+	)
+
+	defer db.Close()
+
+	mfa.totp.now = func() time.Time { return now }
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_staff`").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password", "role", "tenant_id"}).AddRow(1, hash, RoleAdmin, 0))
+	mock.ExpectQuery("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff`").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(totpColumns).AddRow(testTOTPSecret, true, 0))
+	mock.ExpectExec("INSERT INTO `msm_session`").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_session` SET `id`").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"login":"admin","password":"secret"}`))
+	r.Header.Set("Content-Type", "application/json")
+
+	login(w, r)
+
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), "mfa_required") {
+		t.Fatalf("Expected second factor request, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	var (
+		cookies = w.Header()["Set-Cookie"]
+		cookie  = cookies[len(cookies)-1]
+		csrf    = w.Header().Get(CSRFHeader)
+		s       = prov.store[len(prov.store)-1]
+	)
+
+	if s.Get(PrincipalKey) != nil {
+		t.Fatalf("Unexpected principal in the half-authenticated session")
+	}
+
+	step := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/login/totp", strings.NewReader(body))
+		r.Header.Set("Cookie", cookie)
+		r.Header.Set(CSRFHeader, csrf)
+
+		second(w, r)
+
+		return w
+	}
+
+	// Session saves are not checked here
+	mock.MatchExpectationsInOrder(false)
+
+	mock.ExpectQuery("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff`").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(totpColumns).AddRow(testTOTPSecret, true, 0))
+
+	if w := step(`{"code":"000000"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	now = now.Add(time.Second)
+	*clock = clock.Add(time.Second)
+	code, _ := mfa.totp.Code(testTOTPSecret, now.Unix()/totpPeriod)
+
+	mock.ExpectQuery("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff`").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(totpColumns).AddRow(testTOTPSecret, true, 0))
+	mock.ExpectExec("UPDATE `msm_staff` SET `totp_last`").WithArgs(now.Unix()/totpPeriod, 1, now.Unix()/totpPeriod).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_session` SET `id`").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if w := step(`{"code":"` + code + `"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected login, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	if p, ok := s.Get(PrincipalKey).(Principal); !ok || p.Name != "admin" || s.Get(MFAPendingKey) != nil {
+		t.Errorf("Expected authenticated session, but got %v", s.Get(PrincipalKey))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+func Test_RecoveryCodes(t *testing.T) {
+	var (
+		db, mock      = InitDBMock(t)
+		staff         = NewStaffStore(db)
+		codes, hashes = newRecoveryCodes()
+	)
+
+	defer db.Close()
+
+	if len(codes) != recoveryCodes || recoveryHash(strings.ToUpper(codes[0])) != hashes[0] {
+		t.Fatalf("Unexpected recovery codes %v", codes)
+	}
+
+	mock.ExpectExec("UPDATE `msm_staff_recovery` SET `used` = 1").WithArgs(1, hashes[0]).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_staff_recovery` SET `used` = 1").WithArgs(1, hashes[0]).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if ok, err := staff.UseRecoveryCode(1, codes[0]); !ok || err != nil {
+		t.Errorf("Expected recovery code accepted, but got %v", err)
+	}
+
+	if ok, _ := staff.UseRecoveryCode(1, codes[0]); ok {
+		t.Errorf("Expected used recovery code rejected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
+
+// Enabled second factor isn't replaced, disable attempts are throttled
+func Test_TOTPEnrollEnabled(t *testing.T) {
+	var (
+		db, mock    = InitDBMock(t)
+		prov, _     = NewManager(db, 0)
+		limiter, _  = testLimiter()
+		mfa         = NewTOTPAuth(&Config{}, prov, NewStaffStore(db), limiter)
+		router      = NewRouter(prov)
+		s           = NewSession(RandSecureId(64))
+		totpColumns = []string{"totp_secret", "totp_enabled", "totp_last"}
+	)
+
+	defer db.Close()
+
+	router.Handle("POST", "/totp/enroll", "enroll_totp", mfa.handleEnroll, Authenticate(prov, nil), CheckCSRF)
+	router.Handle("POST", "/totp/confirm", "confirm_totp", mfa.handleConfirm, Authenticate(prov, nil), CheckCSRF)
+	router.Handle("DELETE", "/totp", "disable_totp", mfa.handleDisable, Authenticate(prov, nil), CheckCSRF)
+
+	csrfToken(s)
+	s.Set(PrincipalKey, Principal{Kind: PrincipalStaff, Id: 1, Name: "admin", Role: RoleAdmin})
+	s.Set(TOTPEnrollKey, testTOTPSecret)
+	prov.append(s)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: prov.Name(), Value: s.Id()})
+		r.Header.Set(CSRFHeader, s.Get(CSRFKey).(string))
+
+		router.ServeHTTP(w, r)
+
+		return w
+	}
+
+	for _, path := range []string{"/totp/enroll/", "/totp/confirm"} {
+		mock.ExpectQuery("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff`").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(totpColumns).AddRow(testTOTPSecret, true, 0))
+
+		if w := request("POST", path, `{"code":"000000"}`); w.Code != http.StatusConflict {
+			t.Errorf("Expected status %d of %s, but got %d", http.StatusConflict, path, w.Code)
+		}
+	}
+
+	mock.ExpectQuery("SELECT `totp_secret`, `totp_enabled`, `totp_last` FROM `msm_staff`").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(totpColumns).AddRow(testTOTPSecret, true, 0))
+
+	if w := request("DELETE", "/totp", `{"code":"000000"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+
+	if w := request("DELETE", "/totp", `{"code":"000000"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, but got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("There were unfulfilled expections: %s", err.Error())
+	}
+}
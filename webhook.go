@@ -0,0 +1,884 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Events of the mail objects
+const (
+	EventDomainCreated    = "domain.created"
+	EventDomainSuspended  = "domain.suspended"
+	EventDomainActivated  = "domain.activated"
+	EventDomainDeleted    = "domain.deleted"
+	EventMailboxCreated   = "mailbox.created"
+	EventMailboxSuspended = "mailbox.suspended"
+	EventMailboxActivated = "mailbox.activated"
+	EventMailboxDeleted   = "mailbox.deleted"
+	// Mail server reports the mailbox usage over the warning level
+	// or the whole quota
+	EventQuotaWarning  = "quota.warning"
+	EventQuotaExceeded = "quota.exceeded"
+	// Tenant limit rejected the change
+	EventTenantLimitExceeded = "tenant.limit_exceeded"
+)
+
+var webhookEvents = []string{
+	EventDomainCreated, EventDomainSuspended, EventDomainActivated, EventDomainDeleted,
+	EventMailboxCreated, EventMailboxSuspended, EventMailboxActivated, EventMailboxDeleted,
+	EventQuotaWarning, EventQuotaExceeded, EventTenantLimitExceeded,
+}
+
+// Scope required to see the event in the activity stream
+var eventScopes = map[string]string{
+	EventDomainCreated:       "domains:read",
+	EventDomainSuspended:     "domains:read",
+	EventDomainActivated:     "domains:read",
+	EventDomainDeleted:       "domains:read",
+	EventMailboxCreated:      "mailboxes:read",
+	EventMailboxSuspended:    "mailboxes:read",
+	EventMailboxActivated:    "mailboxes:read",
+	EventMailboxDeleted:      "mailboxes:read",
+	EventQuotaWarning:        "mailboxes:read",
+	EventQuotaExceeded:       "mailboxes:read",
+	EventTenantLimitExceeded: "tenants:read",
+}
+
+// Delivery request headers. Signature is `sha256=<hex>` HMAC of
+// `<timestamp>.<body>` with the webhook secret
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	webhookColumns = "`id`, `url`, `secret`, `events`, `active`, `created`, `tenant_id`"
+	// Due deliveries taken at once
+	webhookBatch = 100
+	// Taken delivery isn't due for other dispatchers until the lease ends
+	webhookLease = time.Minute
+	// Retry delay limit
+	webhookMaxDelay = 6 * time.Hour
+	// Delivery error kept in the outbox
+	webhookErrorLen = 255
+)
+
+var (
+	// Loopback, private, link-local, multicast and reserved networks
+	// are not webhook targets
+	webhookDenied = parseNets(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	)
+	// Resolve the webhook host, replaced in tests
+	webhookLookup = net.LookupIP
+)
+
+func parseNets(cidrs ...string) (nets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return
+}
+
+// Address may be the webhook target
+func webhookAllowed(ip net.IP) bool {
+	for _, n := range webhookDenied {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Host must resolve to the public addresses only
+func checkWebhookHost(host string) error {
+	var ips = []net.IP{net.ParseIP(host)}
+
+	if ips[0] == nil {
+		var err error
+
+		if ips, err = webhookLookup(host); err != nil || len(ips) == 0 {
+			return errors.New("Webhook host " + host + " cannot be resolved")
+		}
+	}
+
+	for _, ip := range ips {
+		if !webhookAllowed(ip) {
+			return errors.New("Webhook URL must not target internal address " + ip.String())
+		}
+	}
+
+	return nil
+}
+
+// Address is checked again when dialed, the host may resolve
+// differently since the webhook was saved
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !webhookAllowed(ip) {
+		return errors.New("Webhook target " + host + " is not allowed")
+	}
+
+	return nil
+}
+
+// Delivery client. Redirects aren't followed and there is no proxy,
+// so only the checked address is reached
+func newWebhookClient(timeout time.Duration) *http.Client {
+	var dialer = &net.Dialer{Timeout: timeout, Control: webhookDialControl}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Subscription to the events of the tenant scope, `*` is any event.
+// Secret is returned once on create
+type Webhook struct {
+	Id       int64    `json:"id"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	Events   []string `json:"events"`
+	Active   bool     `json:"active"`
+	Created  int64    `json:"created"`
+	TenantId int64    `json:"tenant_id,omitempty"`
+}
+
+func (this *Webhook) Validate() error {
+	var known = make(map[string]bool)
+
+	for _, event := range webhookEvents {
+		known[event] = true
+	}
+
+	u, err := url.Parse(this.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("Webhook URL must be absolute http or https URL")
+	}
+
+	if err = checkWebhookHost(u.Hostname()); err != nil {
+		return err
+	}
+
+	if len(this.Events) == 0 {
+		return errors.New("Webhook events required")
+	}
+
+	for _, event := range this.Events {
+		if event != "*" && !known[event] {
+			return errors.New("Unknown webhook event " + event)
+		}
+	}
+
+	return nil
+}
+
+// Subscribed to the event
+func (this *Webhook) Wants(event string) bool {
+	for _, e := range this.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Payload of the delivery. Id is the same for all subscribers
+type WebhookEvent struct {
+	Id       string      `json:"id"`
+	Event    string      `json:"event"`
+	Created  int64       `json:"created"`
+	TenantId int64       `json:"tenant_id,omitempty"`
+	Data     interface{} `json:"data"`
+}
+
+// Outbox row, delivered is zero until the receiver accepts it
+type WebhookDelivery struct {
+	Id          int64  `json:"id"`
+	WebhookId   int64  `json:"webhook_id"`
+	Event       string `json:"event"`
+	Created     int64  `json:"created"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	Delivered   int64  `json:"delivered,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// Write the event to the outbox of each subscribed webhook. Called
+// in the transaction of the change, so the event is stored with it
+// and streamed once committed. Webhooks of the tenant, its reseller
+// and the global ones get it
+func emitEvent(q querier, event string, tenant int64, data interface{}) (err error) {
+	var (
+		rows    *sql.Rows
+		targets []int64
+		payload []byte
+		now     = time.Now().Unix()
+	)
+
+	payload, err = json.Marshal(&WebhookEvent{
+		Id:       RandStringId(32),
+		Event:    event,
+		Created:  now,
+		TenantId: tenant,
+		Data:     data,
+	})
+	if err != nil {
+		return
+	}
+
+	afterCommit(q, func() {
+		activity.Publish(event, eventScopes[event], tenant, json.RawMessage(payload))
+	})
+
+	rows, err = q.Query("SELECT `id`, `events` FROM `msm_webhook` WHERE `active` = 1 AND "+
+		"(`tenant_id` = 0 OR `tenant_id` = ? OR `tenant_id` = (SELECT `parent` FROM `msm_tenant` WHERE `id` = ?))", tenant, tenant)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var (
+			hook   Webhook
+			events string
+		)
+
+		if err = rows.Scan(&hook.Id, &events); err != nil {
+			rows.Close()
+			return
+		}
+
+		if hook.Events = strings.Fields(events); hook.Wants(event) {
+			targets = append(targets, hook.Id)
+		}
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, id := range targets {
+		_, err = q.Exec("INSERT INTO `msm_webhook_outbox`(`webhook_id`, `event`, `payload`, `created`, `attempts`, `next_attempt`, `delivered`, `last_error`) "+
+			"VALUES(?, ?, ?, ?, 0, ?, 0, '')", id, event, string(payload), now, now)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Tenant limit rejection as the event, the change itself is rolled back
+func emitLimitEvent(db *sql.DB, err *ConstraintError) error {
+	if err.Tenant == 0 {
+		return nil
+	}
+
+	return emitEvent(db, EventTenantLimitExceeded, err.Tenant, map[string]interface{}{
+		"tenant_id": err.Tenant,
+		"limit":     err.Limit,
+		"max":       err.Max,
+		"message":   err.Error(),
+	})
+}
+
+// HMAC signature header value
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	var mac = hmac.New(sha256.New, []byte(secret))
+
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookStore struct {
+	conn *sql.DB
+}
+
+func NewWebhookStore(db *sql.DB) *WebhookStore {
+	return &WebhookStore{
+		conn: db,
+	}
+}
+
+// Create webhook with the new secret
+func (this *WebhookStore) Create(hook *Webhook) (err error) {
+	var result sql.Result
+
+	defer metricDBQuery.Since(time.Now(), "webhook_insert")
+
+	hook.Secret = RandSecureId(32)
+	hook.Created = time.Now().Unix()
+
+	result, err = this.conn.Exec("INSERT INTO `msm_webhook`(`url`, `secret`, `events`, `active`, `created`, `tenant_id`) VALUES(?, ?, ?, ?, ?, ?)",
+		hook.URL, hook.Secret, strings.Join(hook.Events, " "), hook.Active, hook.Created, hook.TenantId)
+	if err != nil {
+		return
+	}
+
+	hook.Id, err = result.LastInsertId()
+
+	return
+}
+
+// Webhook of the tenant scope, the secret is omitted
+func (this *WebhookStore) Get(id, scope int64) (hook *Webhook, err error) {
+	var cond, args = tenantScope(scope, "`tenant_id`")
+
+	defer metricDBQuery.Since(time.Now(), "webhook_select")
+
+	if hook, err = scanWebhook(this.conn.QueryRow("SELECT "+webhookColumns+" FROM `msm_webhook` WHERE `id` = ? AND "+cond,
+		append([]interface{}{id}, args...)...)); err == nil {
+		hook.Secret = ""
+	}
+
+	return
+}
+
+// Update URL, events and active flag
+func (this *WebhookStore) Update(hook *Webhook) (err error) {
+	defer metricDBQuery.Since(time.Now(), "webhook_update")
+
+	_, err = this.conn.Exec("UPDATE `msm_webhook` SET `url` = ?, `events` = ?, `active` = ? WHERE `id` = ?",
+		hook.URL, strings.Join(hook.Events, " "), hook.Active, hook.Id)
+
+	return
+}
+
+// Delete webhook with its deliveries
+func (this *WebhookStore) Delete(id int64) error {
+	defer metricDBQuery.Since(time.Now(), "webhook_delete")
+
+	return inTx(this.conn, func(tx *sql.Tx) (err error) {
+		if _, err = tx.Exec("DELETE FROM `msm_webhook_outbox` WHERE `webhook_id` = ?", id); err == nil {
+			_, err = tx.Exec("DELETE FROM `msm_webhook` WHERE `id` = ?", id)
+		}
+
+		return
+	})
+}
+
+// List fields, named as in JSON
+var (
+	webhookList = &ListSpec{
+		Columns: webhookColumns,
+		Table:   "`msm_webhook`",
+		Fields: map[string]ListField{
+			"id":        {"id", FieldInt, true},
+			"url":       {"url", FieldString, true},
+			"active":    {"active", FieldBool, true},
+			"created":   {"created", FieldInt, true},
+			"tenant_id": {"tenant_id", FieldInt, true},
+		},
+		Key:     "id",
+		Default: "id",
+	}
+	deliveryList = &ListSpec{
+		Columns: "`id`, `webhook_id`, `event`, `created`, `attempts`, `next_attempt`, `delivered`, `last_error`",
+		Table:   "`msm_webhook_outbox`",
+		Fields: map[string]ListField{
+			"id":           {"id", FieldInt, true},
+			"event":        {"event", FieldString, true},
+			"created":      {"created", FieldInt, true},
+			"attempts":     {"attempts", FieldInt, true},
+			"next_attempt": {"next_attempt", FieldInt, true},
+			"delivered":    {"delivered", FieldInt, true},
+		},
+		Key:     "id",
+		Default: "-id",
+	}
+)
+
+// Webhooks of the tenant scope
+func (this *WebhookStore) List(scope int64, query *ListQuery) (*ListPage, error) {
+	var cond, args = tenantScope(scope, "`tenant_id`")
+
+	defer metricDBQuery.Since(time.Now(), "webhook_list")
+
+	return query.Run(this.conn, func(row rowScanner) (interface{}, error) {
+		hook, err := scanWebhook(row)
+		if err == nil {
+			hook.Secret = ""
+		}
+
+		return hook, err
+	}, cond, args...)
+}
+
+// Outbox rows of the webhook
+func (this *WebhookStore) Deliveries(id int64, query *ListQuery) (*ListPage, error) {
+	defer metricDBQuery.Since(time.Now(), "webhook_deliveries")
+
+	return query.Run(this.conn, func(row rowScanner) (interface{}, error) {
+		var item = &WebhookDelivery{}
+
+		err := row.Scan(&item.Id, &item.WebhookId, &item.Event, &item.Created, &item.Attempts,
+			&item.NextAttempt, &item.Delivered, &item.LastError)
+
+		return item, err
+	}, "`webhook_id` = ?", id)
+}
+
+// Deliver again the events created since the time, only the failed
+// ones unless all is set. Returns the number of the queued deliveries
+func (this *WebhookStore) Replay(id, since int64, all bool) (n int64, err error) {
+	var (
+		result sql.Result
+		query  = "UPDATE `msm_webhook_outbox` SET `attempts` = 0, `next_attempt` = ?, `delivered` = 0, `last_error` = '' " +
+			"WHERE `webhook_id` = ? AND `created` >= ?"
+	)
+
+	defer metricDBQuery.Since(time.Now(), "webhook_replay")
+
+	if !all {
+		query += " AND `delivered` = 0"
+	}
+
+	if result, err = this.conn.Exec(query, time.Now().Unix(), id, since); err != nil {
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+func scanWebhook(row rowScanner) (hook *Webhook, err error) {
+	var events string
+
+	hook = &Webhook{}
+
+	if err = row.Scan(&hook.Id, &hook.URL, &hook.Secret, &events, &hook.Active, &hook.Created, &hook.TenantId); err != nil {
+		return nil, err
+	}
+
+	hook.Events = strings.Fields(events)
+
+	return
+}
+
+// Due delivery with the webhook
+type outboxItem struct {
+	id       int64
+	event    string
+	payload  string
+	attempts int
+	next     int64
+	url      string
+	secret   string
+}
+
+// Deliver the outbox. Failed deliveries are retried with the
+// exponential backoff until the attempts are used up, then they
+// wait for the replay. Several servers may share the outbox
+type WebhookDispatcher struct {
+	conn     *sql.DB
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	interval time.Duration
+	now      func() time.Time
+
+	once    sync.Once
+	stop    chan bool
+	stopped chan bool
+}
+
+func NewWebhookDispatcher(cfg *Config, db *sql.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		conn:     db,
+		client:   newWebhookClient(time.Duration(cfg.GetWebhookTimeout()) * time.Second),
+		retries:  cfg.GetWebhookRetries(),
+		backoff:  time.Duration(cfg.GetWebhookBackoff()) * time.Second,
+		interval: time.Duration(cfg.GetWebhookInterval()) * time.Second,
+		now:      time.Now,
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+}
+
+// Poll the outbox in background
+func (this *WebhookDispatcher) Start() {
+	go func() {
+		var ticker = time.NewTicker(this.interval)
+
+		defer close(this.stopped)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-this.stop:
+				return
+			case <-ticker.C:
+				if _, err := this.Dispatch(); err != nil {
+					log.Error("Can't dispatch webhooks: %s", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// Stop polling, running delivery is finished
+func (this *WebhookDispatcher) Close() {
+	this.once.Do(func() {
+		close(this.stop)
+		<-this.stopped
+	})
+}
+
+// Deliver due outbox rows once, returns the number of the delivered
+func (this *WebhookDispatcher) Dispatch() (sent int, err error) {
+	var (
+		items []*outboxItem
+		rows  *sql.Rows
+		now   = this.now().Unix()
+	)
+
+	rows, err = this.conn.Query("SELECT o.`id`, o.`event`, o.`payload`, o.`attempts`, o.`next_attempt`, w.`url`, w.`secret` "+
+		"FROM `msm_webhook_outbox` o JOIN `msm_webhook` w ON w.`id` = o.`webhook_id` "+
+		"WHERE o.`delivered` = 0 AND o.`attempts` < ? AND o.`next_attempt` <= ? AND w.`active` = 1 "+
+		"ORDER BY o.`id` LIMIT "+strconv.Itoa(webhookBatch), this.retries, now)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var item = &outboxItem{}
+
+		if err = rows.Scan(&item.id, &item.event, &item.payload, &item.attempts, &item.next, &item.url, &item.secret); err != nil {
+			rows.Close()
+			return
+		}
+
+		items = append(items, item)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, item := range items {
+		var result sql.Result
+
+		// Other dispatcher may have taken it
+		result, err = this.conn.Exec("UPDATE `msm_webhook_outbox` SET `next_attempt` = ? WHERE `id` = ? AND `next_attempt` = ?",
+			now+int64(webhookLease/time.Second), item.id, item.next)
+		if err != nil {
+			return
+		}
+
+		if n, _ := result.RowsAffected(); n != 1 {
+			continue
+		}
+
+		if err = this.deliver(item); err != nil {
+			return
+		}
+
+		if item.next == 0 {
+			sent++
+		}
+	}
+
+	return
+}
+
+// Post the payload and store the result, next is zeroed on success
+func (this *WebhookDispatcher) deliver(item *outboxItem) (err error) {
+	var (
+		now     = this.now()
+		failure = this.post(item, now.Unix())
+		entry   = log.With("delivery_id", item.id, "event", item.event, "error", failure)
+	)
+
+	item.attempts++
+
+	if failure == nil {
+		metricWebhooks.Inc(item.event, "sent")
+		item.next = 0
+
+		_, err = this.conn.Exec("UPDATE `msm_webhook_outbox` SET `attempts` = ?, `delivered` = ?, `last_error` = '' WHERE `id` = ?",
+			item.attempts, now.Unix(), item.id)
+
+		return
+	}
+
+	delay := webhookMaxDelay
+	if shift := uint(item.attempts - 1); shift < 32 && this.backoff<<shift < webhookMaxDelay {
+		delay = this.backoff << shift
+	}
+
+	item.next = now.Add(delay).Unix()
+
+	if item.attempts >= this.retries {
+		metricWebhooks.Inc(item.event, "failed")
+		entry.Error("Webhook delivery failed", "attempts", item.attempts)
+	} else {
+		metricWebhooks.Inc(item.event, "retry")
+		entry.Warning("Webhook delivery failed", "retry", delay.String())
+	}
+
+	msg := failure.Error()
+	if len(msg) > webhookErrorLen {
+		msg = msg[:webhookErrorLen]
+	}
+
+	_, err = this.conn.Exec("UPDATE `msm_webhook_outbox` SET `attempts` = ?, `next_attempt` = ?, `last_error` = ? WHERE `id` = ?",
+		item.attempts, item.next, msg, item.id)
+
+	return
+}
+
+// Signed POST, any 2xx status is accepted
+func (this *WebhookDispatcher) post(item *outboxItem, timestamp int64) error {
+	var body = []byte(item.payload)
+
+	req, err := http.NewRequest("POST", item.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", NAME+"/"+VERSION)
+	req.Header.Set(WebhookEventHeader, item.event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(item.id, 10))
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(item.secret, timestamp, body))
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	// Response body isn't kept, the receiver may be anything
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// List and create webhooks: GET, POST /webhooks, get, update and
+// delete: GET, PUT, DELETE /webhooks/{id}
+func handleWebhooks(hooks *WebhookStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var (
+			scope = "webhooks:read"
+			hook  *Webhook
+			id    int64
+			err   error
+		)
+
+		if !safeMethod(ctx.r.Method) {
+			scope = "webhooks:write"
+		}
+
+		if !ctx.Require(w, scope) {
+			return
+		}
+
+		if ctx.Param("id") == "" {
+			switch ctx.r.Method {
+			case "GET":
+				query, ok := ctx.ListQuery(w, webhookList)
+				if !ok {
+					return
+				}
+
+				page, err := hooks.List(ctx.Tenant(), query)
+				if writeStoreError(w, ctx, "Can't list webhooks", err) {
+					return
+				}
+
+				writeJSON(w, http.StatusOK, page)
+
+			case "POST":
+				hook = &Webhook{Active: true}
+
+				if err = json.NewDecoder(ctx.r.Body).Decode(hook); err != nil {
+					writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+					return
+				}
+
+				if err = hook.Validate(); err != nil {
+					writeError(w, http.StatusUnprocessableEntity, err.Error())
+					return
+				}
+
+				hook.TenantId = ctx.Tenant()
+
+				if !writeStoreError(w, ctx, "Can't create webhook", hooks.Create(hook)) {
+					ctx.log.Notice("Webhook created", "webhook_id", hook.Id, "url", hook.URL)
+					writeJSON(w, http.StatusCreated, hook)
+				}
+
+			default:
+				writeError(w, http.StatusMethodNotAllowed, "")
+			}
+
+			return
+		}
+
+		if hook, id = pathWebhook(w, ctx, hooks); hook == nil {
+			return
+		}
+
+		switch {
+		case ctx.r.Method == "GET":
+			writeJSON(w, http.StatusOK, hook)
+
+		// Given fields are changed
+		case ctx.r.Method == "PUT":
+			type plain Webhook
+
+			var current = *hook
+
+			if err = json.NewDecoder(ctx.r.Body).Decode((*plain)(hook)); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+				return
+			}
+
+			hook.Id, hook.Secret, hook.Created, hook.TenantId = current.Id, "", current.Created, current.TenantId
+
+			if err = hook.Validate(); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+
+			if !writeStoreError(w, ctx, "Can't update webhook", hooks.Update(hook)) {
+				ctx.log.Notice("Webhook updated", "webhook_id", id)
+				writeJSON(w, http.StatusOK, hook)
+			}
+
+		case ctx.r.Method == "DELETE":
+			if !writeStoreError(w, ctx, "Can't delete webhook", hooks.Delete(id)) {
+				ctx.log.Notice("Webhook deleted", "webhook_id", id)
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	}
+}
+
+// Outbox of the webhook: GET /webhooks/{id}/deliveries
+func handleWebhookDeliveries(hooks *WebhookStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		if !ctx.Require(w, "webhooks:read") {
+			return
+		}
+
+		hook, id := pathWebhook(w, ctx, hooks)
+		if hook == nil {
+			return
+		}
+
+		query, ok := ctx.ListQuery(w, deliveryList)
+		if !ok {
+			return
+		}
+
+		page, err := hooks.Deliveries(id, query)
+		if writeStoreError(w, ctx, "Can't list webhook deliveries", err) {
+			return
+		}
+
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// Deliver again: POST /webhooks/{id}/replay
+func handleWebhookReplay(hooks *WebhookStore) func(http.ResponseWriter, *Context) {
+	return func(w http.ResponseWriter, ctx *Context) {
+		var req struct {
+			Since int64 `json:"since"`
+			All   bool  `json:"all"`
+		}
+
+		if !ctx.Require(w, "webhooks:write") {
+			return
+		}
+
+		hook, id := pathWebhook(w, ctx, hooks)
+		if hook == nil {
+			return
+		}
+
+		if err := json.NewDecoder(ctx.r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		n, err := hooks.Replay(id, req.Since, req.All)
+		if writeStoreError(w, ctx, "Can't replay webhook deliveries", err) {
+			return
+		}
+
+		ctx.log.Notice("Webhook deliveries replayed", "webhook_id", id, "count", n)
+		writeJSON(w, http.StatusAccepted, map[string]int64{"replayed": n})
+	}
+}
+
+// Webhook of the path in the principal tenant scope, nil if the
+// error is written
+func pathWebhook(w http.ResponseWriter, ctx *Context, hooks *WebhookStore) (hook *Webhook, id int64) {
+	var err error
+
+	if id, err = strconv.ParseInt(ctx.Param("id"), 10, 64); err != nil {
+		writeError(w, http.StatusNotFound, "")
+		return nil, 0
+	}
+
+	if hook, err = hooks.Get(id, ctx.Tenant()); writeStoreError(w, ctx, "Can't get webhook", err) {
+		return nil, 0
+	}
+
+	return
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// No webhooks subscribed to the events of the tenant
+func expectWebhooks(mock sqlmock.Sqlmock, tenant int64) {
+	mock.ExpectQuery("SELECT `id`, `events` FROM `msm_webhook`").WithArgs(tenant, tenant).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "events"}))
+}
+
+func Test_WebhookValidate(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { webhookLookup = lookup }(webhookLookup)
+
+	webhookLookup = func(host string) ([]net.IP, error) {
+		switch host {
+		case "example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "internal.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.1.2.3")}, nil
+		}
+
+		return nil, errors.New("No such host")
+	}
+
+	cases := []struct {
+		hook Webhook
+		ok   bool
+	}{
+		{Webhook{URL: "https://example.com/hook", Events: []string{EventDomainCreated}}, true},
+		{Webhook{URL: "http://example.com/hook", Events: []string{"*"}}, true},
+		{Webhook{URL: "ftp://example.com/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "https://example.com/hook"}, false},
+		{Webhook{URL: "https://example.com/hook", Events: []string{"domain.renamed"}}, false},
+		{Webhook{URL: "https://internal.example.com/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "https://unknown.example.com/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://127.0.0.1:8080/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://169.254.169.254/latest", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://192.168.1.1/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://[::1]/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://[::ffff:127.0.0.1]/hook", Events: []string{"*"}}, false},
+		{Webhook{URL: "http://93.184.216.34/hook", Events: []string{"*"}}, true},
+	}
+
+	for _, c := range cases {
+		if err := c.hook.Validate(); (err == nil) != c.ok {
+			t.Errorf("Unexpected result of %+v: %v", c.hook, err)
+		}
+	}
+}
+
+// Delivery client refuses the internal address and the redirect
+func Test_WebhookClient(t *testing.T) {
+	var redirected bool
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer redirect.Close()
+
+	dispatcher := &WebhookDispatcher{client: newWebhookClient(time.Second)}
+	item := &outboxItem{id: 1, event: EventDomainCreated, payload: "{}", url: redirect.URL, secret: "secret"}
+
+	if err := dispatcher.post(item, 1500000000); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("Expected loopback refused, but got %v", err)
+	}
+
+	// Loopback is dialed by the test transport, the redirect still isn't followed
+	dispatcher.client.Transport = redirect.Client().Transport
+
+	if err := dispatcher.post(item, 1500000000); err == nil || err.Error() != "Status 302" || redirected {
+		t.Errorf("Expected redirect not followed, but got %v", err)
+	}
+}
+
+// Event is written to the outbox of the subscribed webhooks
+func Test_EmitEvent(t *testing.T) {
+	var db, mock = InitDBMock(t)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT `id`, `events` FROM `msm_webhook`").WithArgs(2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "events"}).
+			AddRow(1, "domain.created domain.deleted").
+			AddRow(2, "mailbox.created").
+			AddRow(3, "*"))
+	mock.ExpectExec("INSERT INTO `msm_webhook_outbox`").
+		WithArgs(1, EventDomainCreated, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO `msm_webhook_outbox`").
+		WithArgs(3, EventDomainCreated, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	if err := emitEvent(db, EventDomainCreated, 2, &Domain{Name: "example.com", TenantId: 2}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Delivered event is marked, failed one is scheduled with the backoff
+func Test_WebhookDispatch(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		now      = time.Unix(1500000000, 0)
+		payload  = `{"id":"abc","event":"domain.created","created":1500000000,"data":{"name":"example.com"}}`
+		received *http.Request
+		body     []byte
+	)
+
+	defer db.Close()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	dispatcher := &WebhookDispatcher{
+		conn:    db,
+		client:  receiver.Client(),
+		retries: 8,
+		backoff: 30 * time.Second,
+		now:     func() time.Time { return now },
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM `msm_webhook_outbox` o JOIN `msm_webhook` w").WithArgs(8, now.Unix()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event", "payload", "attempts", "next_attempt", "url", "secret"}).
+			AddRow(10, EventDomainCreated, payload, 0, now.Unix(), receiver.URL, "secret").
+			AddRow(11, EventDomainCreated, payload, 2, now.Unix()-10, failing.URL, "secret").
+			AddRow(12, EventDomainCreated, payload, 0, now.Unix(), receiver.URL, "secret"))
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET `next_attempt` = \\? WHERE `id` = \\? AND `next_attempt` = \\?").
+		WithArgs(now.Unix()+60, 10, now.Unix()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET `attempts` = \\?, `delivered` = \\?").
+		WithArgs(1, now.Unix(), 10).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET `next_attempt` = \\? WHERE `id` = \\? AND `next_attempt` = \\?").
+		WithArgs(now.Unix()+60, 11, now.Unix()-10).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET `attempts` = \\?, `next_attempt` = \\?, `last_error` = \\?").
+		WithArgs(3, now.Unix()+120, "Status 503", 11).WillReturnResult(sqlmock.NewResult(0, 1))
+	// Taken by the other dispatcher
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET `next_attempt` = \\? WHERE `id` = \\? AND `next_attempt` = \\?").
+		WithArgs(now.Unix()+60, 12, now.Unix()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	sent, err := dispatcher.Dispatch()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if sent != 1 || received == nil {
+		t.Fatalf("Expected one delivery, but got %d", sent)
+	}
+
+	timestamp, _ := strconv.ParseInt(received.Header.Get(WebhookTimestampHeader), 10, 64)
+
+	if received.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", timestamp, body) || string(body) != payload {
+		t.Errorf("Invalid signature %s of %s", received.Header.Get(WebhookSignatureHeader), body)
+	}
+
+	if received.Header.Get(WebhookEventHeader) != EventDomainCreated || received.Header.Get(WebhookDeliveryHeader) != "10" {
+		t.Errorf("Unexpected headers %v", received.Header)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+func Test_WebhookReplay(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		hooks    = NewWebhookStore(db)
+	)
+
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET (.+) WHERE `webhook_id` = \\? AND `created` >= \\? AND `delivered` = 0").
+		WithArgs(sqlmock.AnyArg(), 3, 1500000000).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("UPDATE `msm_webhook_outbox` SET (.+) WHERE `webhook_id` = \\? AND `created` >= \\?$").
+		WithArgs(sqlmock.AnyArg(), 3, 0).WillReturnResult(sqlmock.NewResult(0, 9))
+
+	if n, err := hooks.Replay(3, 1500000000, false); err != nil || n != 4 {
+		t.Errorf("Expected 4 failed deliveries replayed, but got %d: %v", n, err)
+	}
+
+	if n, err := hooks.Replay(3, 0, true); err != nil || n != 9 {
+		t.Errorf("Expected 9 deliveries replayed, but got %d: %v", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}
+
+// Domain with mailboxes is kept, empty one is deleted with the event
+func Test_DomainDelete(t *testing.T) {
+	var (
+		db, mock = InitDBMock(t)
+		domain   = &Domain{Name: "example.com"}
+	)
+
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(2))
+	mock.ExpectQuery("SELECT \\(SELECT COUNT").WithArgs("example.com", "example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	if _, ok := domain.Delete(db).(*ConstraintError); !ok {
+		t.Errorf("Expected constraint error")
+	}
+
+	mock.ExpectQuery("SELECT `tenant_id` FROM `msm_domain`").WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(2))
+	mock.ExpectQuery("SELECT \\(SELECT COUNT").WithArgs("example.com", "example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("UPDATE `msm_dkim` SET `state`").WithArgs(DKIMRetired, "example.com", DKIMRetired).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM `msm_domain`").WithArgs("example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT `id`, `events` FROM `msm_webhook`").WithArgs(2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "events"}).AddRow(1, "domain.deleted"))
+	mock.ExpectExec("INSERT INTO `msm_webhook_outbox`").
+		WithArgs(1, EventDomainDeleted, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := domain.Delete(db); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expections: %s", err)
+	}
+}